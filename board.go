@@ -86,7 +86,7 @@ func CanBearOff(board []int, player int, local bool) bool {
 		homeStart, homeEnd = HomeRange(player)
 		homeStart, homeEnd = minInt(homeStart, homeEnd), maxInt(homeStart, homeEnd)
 	}
-	for i := 1; i < 24; i++ {
+	for i := 1; i <= 24; i++ {
 		if (i < homeStart || i > homeEnd) && PlayerCheckers(board[i], player) > 0 {
 			return false
 		}
@@ -94,7 +94,26 @@ func CanBearOff(board []int, player int, local bool) bool {
 	return true
 }
 
+// PipCount returns the pip count of the provided player. The board must be
+// oriented from the perspective of player 1, as it is on the server.
+func PipCount(board []int, player int) int {
+	var pips int
+	pips += PlayerCheckers(board[SpaceBarPlayer], player) * 25
+	pips += PlayerCheckers(board[SpaceBarOpponent], player) * 25
+	for space := 1; space <= 24; space++ {
+		spaceValue := space
+		if player == 2 {
+			spaceValue = 25 - space
+		}
+		pips += PlayerCheckers(board[space], player) * spaceValue
+	}
+	return pips
+}
+
+// ParseSpace parses a space. A trailing asterisk, which marks a space where an
+// opponent's checker was hit, is ignored. Returns -1 when the space is invalid.
 func ParseSpace(space string) int {
+	space = strings.TrimSuffix(space, "*")
 	i, err := strconv.Atoi(space)
 	if err != nil {
 		switch strings.ToLower(space) {
@@ -0,0 +1,28 @@
+package bgammon
+
+import "testing"
+
+func TestParseSpace(t *testing.T) {
+	for _, test := range []struct {
+		space    string
+		expected int
+	}{
+		{"1", 1},
+		{"24", 24},
+		{"8*", 8},
+		{"bar", SpaceBarPlayer},
+		{"BAR", SpaceBarPlayer},
+		{"b", SpaceBarPlayer},
+		{"off", SpaceHomePlayer},
+		{"o", SpaceHomePlayer},
+		{"home", SpaceHomePlayer},
+		{"h", SpaceHomePlayer},
+		{"", -1},
+		{"*", -1},
+		{"barr", -1},
+	} {
+		if space := ParseSpace(test.space); space != test.expected {
+			t.Errorf("parsed %q as %d, expected %d", test.space, space, test.expected)
+		}
+	}
+}
@@ -1,6 +1,14 @@
 package main
 
+import "code.rocket9labs.com/tslocum/bgammon"
+
 type account struct {
 	id       int
+	email    string
 	username string
+	password string // Password hash.
+	created  int64
+	rating   int
+	admin    bool // Whether the account may use moderator commands.
+	settings bgammon.Settings
 }
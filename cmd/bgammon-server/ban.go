@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"time"
+)
+
+// ban prevents a user from connecting to the server. Bans apply to the
+// username of the banned user, and to the address they were connected from
+// when they were banned.
+type ban struct {
+	username  string // Lowercase.
+	address   string
+	expires   int64 // Permanent when zero.
+	moderator string
+}
+
+func (b *ban) expired(now int64) bool {
+	return b.expires != 0 && b.expires <= now
+}
+
+// remoteHost returns the host of the provided network address.
+func remoteHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// loadBans loads the bans stored in the database.
+func (s *server) loadBans() {
+	bans, err := activeBans()
+	if err != nil {
+		errorf("failed to load bans: %s", err)
+		return
+	}
+
+	s.bansLock.Lock()
+	s.bans = bans
+	s.bansLock.Unlock()
+}
+
+// banned returns whether the provided username or address is banned. Either
+// may be left empty.
+func (s *server) banned(username []byte, address string) bool {
+	lower := string(bytes.ToLower(username))
+	now := time.Now().Unix()
+
+	s.bansLock.Lock()
+	defer s.bansLock.Unlock()
+
+	for _, b := range s.bans {
+		if b.expired(now) {
+			continue
+		}
+		if (lower != "" && b.username == lower) || (address != "" && b.address == address) {
+			return true
+		}
+	}
+	return false
+}
+
+// addBan bans a user. The ban is stored in the database when accounts are
+// enabled.
+func (s *server) addBan(b *ban) {
+	if db != nil {
+		err := storeBan(b)
+		if err != nil {
+			errorf("failed to store ban of %s: %s", b.username, err)
+		}
+	}
+
+	s.bansLock.Lock()
+	s.bans = append(s.bans, b)
+	s.bansLock.Unlock()
+}
+
+// removeBans removes all bans of a username and returns whether any bans
+// were removed.
+func (s *server) removeBans(username string) bool {
+	lower := strings.ToLower(username)
+	if db != nil {
+		err := deleteBans(lower)
+		if err != nil {
+			errorf("failed to delete bans of %s: %s", lower, err)
+		}
+	}
+
+	s.bansLock.Lock()
+	defer s.bansLock.Unlock()
+
+	var removed bool
+	i := 0
+	for _, b := range s.bans {
+		if b.username == lower {
+			removed = true
+			continue
+		}
+		s.bans[i] = b
+		i++
+	}
+	s.bans = s.bans[:i]
+	return removed
+}
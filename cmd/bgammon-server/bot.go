@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// botMaxSequences and botMaxSearchTime limit the number of move sequences
+// evaluated when searching for the best sequence of moves, as the number of
+// possible sequences is large when doubles are rolled.
+const (
+	botMaxSequences  = 10000
+	botMaxSearchTime = 250 * time.Millisecond
+)
+
+// botCommand returns the command the bot sends in response to the provided
+// game state, or an empty string when the bot has nothing to do.
+func botCommand(gs *bgammon.GameState) string {
+	player := gs.PlayerNumber
+	if player == 0 || gs.Winner != 0 || gs.Player1.Name == "" || gs.Player2.Name == "" {
+		return ""
+	}
+	g := botGame(gs)
+
+	switch {
+	case g.Turn == 0:
+		roll := g.Roll1
+		if player == 2 {
+			roll = g.Roll2
+		}
+		if roll == 0 {
+			return bgammon.CommandRoll
+		}
+	case g.Turn != player:
+		if g.DoubleOffered {
+			if botAcceptDouble(g, player) {
+				return bgammon.CommandAccept
+			}
+			return bgammon.CommandReject
+		}
+	case g.DoubleOffered:
+		// Wait for the opponent to respond to the double offer.
+	case g.Roll1 == 0:
+		return bgammon.CommandRoll
+	default:
+		moves := botMoves(g)
+		if len(moves) == 0 {
+			if len(g.DiceRolls()) != 0 {
+				// The server ends the turn when the remaining dice may not
+				// be used.
+				return ""
+			}
+			return bgammon.CommandOk
+		}
+		// Moves are sent one at a time, as each move changes which moves
+		// are legal. The remaining moves are chosen when the board is
+		// received.
+		return fmt.Sprintf("%s %s", bgammon.CommandMove, bgammon.FormatAndFlipMoves(moves[:1], player))
+	}
+	return ""
+}
+
+// botGame returns a copy of the game sent to the bot, with the board
+// oriented from the perspective of player 1 as it is on the server.
+func botGame(gs *bgammon.GameState) *bgammon.Game {
+	g := gs.Game.Copy()
+	if gs.PlayerNumber != 2 {
+		return g
+	}
+
+	for space := 1; space <= 24; space++ {
+		g.Board[space] = gs.Board[bgammon.FlipSpace(space, 2)]
+	}
+	g.Board[bgammon.SpaceHomePlayer], g.Board[bgammon.SpaceHomeOpponent] = gs.Board[bgammon.SpaceHomeOpponent], gs.Board[bgammon.SpaceHomePlayer]
+	g.Board[bgammon.SpaceBarPlayer], g.Board[bgammon.SpaceBarOpponent] = gs.Board[bgammon.SpaceBarOpponent], gs.Board[bgammon.SpaceBarPlayer]
+	g.Moves = bgammon.FlipMoves(gs.Moves, 2)
+	return g
+}
+
+// botMoves returns the sequence of legal moves which results in the best
+// position for the current player. When the search is cut short, the best
+// sequence found so far is returned.
+func botMoves(g *bgammon.Game) [][]int {
+	var bestMoves [][]int
+	bestScore := math.MinInt
+	seen := make(map[string]bool)
+	deadline := time.Now().Add(botMaxSearchTime)
+	var sequences int
+
+	var search func(g *bgammon.Game, moves [][]int)
+	search = func(g *bgammon.Game, moves [][]int) {
+		if bestMoves != nil && (sequences >= botMaxSequences || time.Now().After(deadline)) {
+			return
+		}
+
+		legalMoves := g.LegalMoves(false)
+		if len(legalMoves) == 0 {
+			if len(moves) == 0 {
+				return
+			}
+			sequences++
+			score := botEvaluate(g.Board, g.Turn)
+			if score > bestScore {
+				bestScore = score
+				bestMoves = moves
+			}
+			return
+		}
+
+		for _, move := range legalMoves {
+			gc := g.Copy()
+			gc.AddLocalMove(move)
+
+			// Skip positions which were already reached in a different order.
+			key := fmt.Sprint(len(moves), gc.Board)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			search(gc, append(moves[:len(moves):len(moves)], move))
+		}
+	}
+	search(g, nil)
+	return bestMoves
+}
+
+// botEvaluate returns a score for the provided board from the perspective of
+// the provided player. Hitting, making points, escaping checkers from the
+// opponent's home board and leaving as few blots as possible within reach of
+// the opponent are preferred.
+func botEvaluate(board []int, player int) int {
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+
+	var score int
+	score += 10 * (bgammon.OpponentCheckers(board[bgammon.SpaceBarPlayer], player) + bgammon.OpponentCheckers(board[bgammon.SpaceBarOpponent], player))
+	score += 5 * (bgammon.PlayerCheckers(board[bgammon.SpaceHomePlayer], player) + bgammon.PlayerCheckers(board[bgammon.SpaceHomeOpponent], player))
+
+	homeStart, homeEnd := bgammon.HomeRange(player)
+	if homeStart > homeEnd {
+		homeStart, homeEnd = homeEnd, homeStart
+	}
+	opponentHomeStart, opponentHomeEnd := bgammon.HomeRange(opponent)
+	if opponentHomeStart > opponentHomeEnd {
+		opponentHomeStart, opponentHomeEnd = opponentHomeEnd, opponentHomeStart
+	}
+	for space := 1; space <= 24; space++ {
+		checkers := bgammon.PlayerCheckers(board[space], player)
+		if space >= opponentHomeStart && space <= opponentHomeEnd {
+			score -= 2 * checkers
+		}
+		switch {
+		case checkers >= 2:
+			score += 3
+			if space >= homeStart && space <= homeEnd {
+				score += 2
+			}
+		case checkers == 1:
+			if botExposed(board, space, opponent) {
+				score -= 5
+			} else {
+				score--
+			}
+		}
+	}
+	return score
+}
+
+// botExposed returns whether a checker on the provided space may be hit by
+// one of the opponent's checkers with a single roll.
+func botExposed(board []int, space int, opponent int) bool {
+	// Player 1 moves from space 24 to space 1, player 2 moves from space 1
+	// to space 24. Checkers on the bar enter from just outside the board.
+	direction, bar := -1, 25
+	if opponent == 2 {
+		direction, bar = 1, 0
+	}
+	if bgammon.PlayerCheckers(board[bgammon.SpaceBarPlayer], opponent) > 0 || bgammon.PlayerCheckers(board[bgammon.SpaceBarOpponent], opponent) > 0 {
+		distance := (space - bar) * direction
+		if distance >= 1 && distance <= 12 {
+			return true
+		}
+	}
+	for distance := 1; distance <= 12; distance++ {
+		from := space - distance*direction
+		if from < 1 || from > 24 {
+			break
+		}
+		if bgammon.PlayerCheckers(board[from], opponent) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// botAcceptDouble returns whether the bot accepts a double offered by its
+// opponent. Doubles are accepted unless the bot trails in the race by more
+// than one eighth of the opponent's pip count.
+func botAcceptDouble(g *bgammon.Game, player int) bool {
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+	pips, opponentPips := bgammon.PipCount(g.Board, player), bgammon.PipCount(g.Board, opponent)
+	return pips <= opponentPips+opponentPips/8
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"code.rocket9labs.com/tslocum/bgammon"
@@ -16,31 +18,101 @@ type serverClient struct {
 	json         bool
 	name         []byte
 	account      int
+	admin        bool
+	address      string // Host of the remote address of the client.
+	application  string // Name and version of the client application, when provided.
+	transport    string // Transport the client is connected with: tcp, ws or bot.
+	lang         string // Language of messages sent to the client. See languages.
+	rating       int
 	connected    int64
-	lastActive   int64
+	lastActive   atomic.Int64 // Unix time of the last command received. Accessed atomically, as clients are pinged from another goroutine.
 	lastPing     int64
+	pinged       time.Time     // When the last unanswered ping was sent.
+	latency      time.Duration // Round-trip time of the last answered ping.
+	lastChat     time.Time
+	chatOff      bool              // Whether global chat messages are not delivered to the client.
+	whisperOff   bool              // Whether private messages are not delivered to the client.
+	muted        map[string]bool   // Lowercase usernames of muted players.
+	friends      map[string]string // Usernames of friends, keyed by lowercase username.
+	settings     bgammon.Settings
 	commands     chan []byte
 	playerNumber int
 	terminating  bool
+	timedOut     bool         // Whether the client was disconnected for not responding to pings.
+	requestID    atomic.Int64 // ID of the command being handled, or zero when no ID was provided. Accessed atomically, as events are also sent from other goroutines.
+	lobby        atomic.Bool  // Whether the client is sent lobby updates.
+	flipped      bool         // Whether the client is shown the board from the perspective of the other player.
 	bgammon.Client
 }
 
+// perspective returns the player whose perspective the board and moves are
+// shown to the client from. Players see the board from their own perspective,
+// and spectators from the perspective of player 1, unless they flipped the
+// board.
+func (c *serverClient) perspective() int {
+	if !c.flipped {
+		return c.playerNumber
+	} else if c.playerNumber == 2 {
+		return 1
+	}
+	return 2
+}
+
 func (c *serverClient) sendEvent(e interface{}) {
+	c.sendReply(e, int(c.requestID.Load()))
+}
+
+// sendReply sends the provided event in reply to the command with the provided
+// request ID. Events sent after the command was handled, such as the results
+// of database queries, are sent using the request ID of the command.
+func (c *serverClient) sendReply(e interface{}, requestID int) {
+	// Translate the reasons commands failed.
+	switch ev := e.(type) {
+	case *bgammon.EventFailedCreate:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	case *bgammon.EventFailedJoin:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	case *bgammon.EventFailedLeave:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	case *bgammon.EventFailedRoll:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	case *bgammon.EventFailedMove:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	case *bgammon.EventFailedOk:
+		ev.Reason = c.localizeReason(ev.Code, ev.Reason)
+	}
+
 	// JSON formatted messages.
 	if c.json {
 		switch ev := e.(type) {
 		case *bgammon.EventWelcome:
 			ev.Type = bgammon.EventTypeWelcome
+		case *bgammon.EventSession:
+			ev.Type = bgammon.EventTypeSession
 		case *bgammon.EventHelp:
 			ev.Type = bgammon.EventTypeHelp
 		case *bgammon.EventPing:
 			ev.Type = bgammon.EventTypePing
 		case *bgammon.EventNotice:
 			ev.Type = bgammon.EventTypeNotice
+		case *bgammon.EventServerMessage:
+			ev.Type = bgammon.EventTypeServerMessage
 		case *bgammon.EventSay:
 			ev.Type = bgammon.EventTypeSay
+		case *bgammon.EventChat:
+			ev.Type = bgammon.EventTypeChat
+		case *bgammon.EventWhisper:
+			ev.Type = bgammon.EventTypeWhisper
+		case *bgammon.EventInvite:
+			ev.Type = bgammon.EventTypeInvite
+		case *bgammon.EventFriendOnline:
+			ev.Type = bgammon.EventTypeFriendOnline
 		case *bgammon.EventList:
 			ev.Type = bgammon.EventTypeList
+		case *bgammon.EventLobbyUpdate:
+			ev.Type = bgammon.EventTypeLobbyUpdate
+		case *bgammon.EventFailedCreate:
+			ev.Type = bgammon.EventTypeFailedCreate
 		case *bgammon.EventJoined:
 			ev.Type = bgammon.EventTypeJoined
 		case *bgammon.EventFailedJoin:
@@ -51,6 +123,8 @@ func (c *serverClient) sendEvent(e interface{}) {
 			ev.Type = bgammon.EventTypeFailedLeave
 		case *bgammon.EventBoard:
 			ev.Type = bgammon.EventTypeBoard
+		case *bgammon.EventDesync:
+			ev.Type = bgammon.EventTypeDesync
 		case *bgammon.EventRolled:
 			ev.Type = bgammon.EventTypeRolled
 		case *bgammon.EventFailedRoll:
@@ -61,12 +135,56 @@ func (c *serverClient) sendEvent(e interface{}) {
 			ev.Type = bgammon.EventTypeFailedMove
 		case *bgammon.EventFailedOk:
 			ev.Type = bgammon.EventTypeFailedOk
+		case *bgammon.EventDoubleOffered:
+			ev.Type = bgammon.EventTypeDoubleOffered
+		case *bgammon.EventDoubleAccepted:
+			ev.Type = bgammon.EventTypeDoubleAccepted
+		case *bgammon.EventDoubleRejected:
+			ev.Type = bgammon.EventTypeDoubleRejected
+		case *bgammon.EventAutoDouble:
+			ev.Type = bgammon.EventTypeAutoDouble
+		case *bgammon.EventBeaver:
+			ev.Type = bgammon.EventTypeBeaver
+		case *bgammon.EventRaccoon:
+			ev.Type = bgammon.EventTypeRaccoon
+		case *bgammon.EventTimeWarning:
+			ev.Type = bgammon.EventTypeTimeWarning
 		case *bgammon.EventWin:
 			ev.Type = bgammon.EventTypeWin
+		case *bgammon.EventPipCount:
+			ev.Type = bgammon.EventTypePipCount
+		case *bgammon.EventLeaderboard:
+			ev.Type = bgammon.EventTypeLeaderboard
+		case *bgammon.EventHistory:
+			ev.Type = bgammon.EventTypeHistory
+		case *bgammon.EventStats:
+			ev.Type = bgammon.EventTypeStats
+		case *bgammon.EventProfile:
+			ev.Type = bgammon.EventTypeProfile
+		case *bgammon.EventWho:
+			ev.Type = bgammon.EventTypeWho
+		case *bgammon.EventPosition:
+			ev.Type = bgammon.EventTypePosition
+		case *bgammon.EventHint:
+			ev.Type = bgammon.EventTypeHint
+		case *bgammon.EventLegalMoves:
+			ev.Type = bgammon.EventTypeLegalMoves
+		case *bgammon.EventSettings:
+			ev.Type = bgammon.EventTypeSettings
+		case *bgammon.EventVersion:
+			ev.Type = bgammon.EventTypeVersion
+		case *bgammon.EventStatus:
+			ev.Type = bgammon.EventTypeStatus
+		case *bgammon.EventTranscript:
+			ev.Type = bgammon.EventTypeTranscript
 		default:
 			log.Panicf("unknown event type %+v", ev)
 		}
 
+		if ev, ok := e.(interface{ SetRequestID(id int) }); ok {
+			ev.SetRequestID(requestID)
+		}
+
 		buf, err := json.Marshal(e)
 		if err != nil {
 			panic(err)
@@ -75,61 +193,231 @@ func (c *serverClient) sendEvent(e interface{}) {
 		return
 	}
 
-	// Human-readable messages.
+	// Human-readable messages. Replies to commands which were sent with a
+	// request ID are prefixed with the ID.
+	write := c.Write
+	if requestID != 0 {
+		prefix := strconv.Itoa(requestID) + " "
+		write = func(message []byte) {
+			c.Write(append([]byte(prefix), message...))
+		}
+	}
 	switch ev := e.(type) {
 	case *bgammon.EventWelcome:
-		c.Write([]byte(fmt.Sprintf("welcome %s there are %d clients playing %d matches.", ev.PlayerName, ev.Clients, ev.Games)))
+		write([]byte(fmt.Sprintf("welcome %s there are %d clients playing %d matches.", ev.PlayerName, ev.Clients, ev.Games)))
+	case *bgammon.EventSession:
+		registered := 0
+		if ev.Registered {
+			registered = 1
+		}
+		write([]byte(fmt.Sprintf("session %d %d %d %d", ev.ClientID, registered, ev.Time, ev.Protocol)))
 	case *bgammon.EventHelp:
-		c.Write([]byte("helpstart Help text:"))
-		c.Write([]byte(fmt.Sprintf("help %s", ev.Message)))
-		c.Write([]byte("helpend End of help text."))
+		write([]byte("helpstart Help text:"))
+		for _, line := range strings.Split(ev.Message, "\n") {
+			write([]byte(fmt.Sprintf("help %s", line)))
+		}
+		write([]byte("helpend End of help text."))
 	case *bgammon.EventPing:
-		c.Write([]byte(fmt.Sprintf("ping %s", ev.Message)))
+		write([]byte(fmt.Sprintf("ping %s", ev.Message)))
 	case *bgammon.EventNotice:
-		c.Write([]byte(fmt.Sprintf("notice %s", ev.Message)))
+		write([]byte(fmt.Sprintf("notice %s", ev.Message)))
+	case *bgammon.EventServerMessage:
+		write([]byte(fmt.Sprintf("servermessage %s", ev.Message)))
 	case *bgammon.EventSay:
-		c.Write([]byte(fmt.Sprintf("say %s %s", ev.Player, ev.Message)))
+		write([]byte(fmt.Sprintf("say %s %s", ev.Player, ev.Message)))
+	case *bgammon.EventChat:
+		write([]byte(fmt.Sprintf("chat %s %s", ev.Player, ev.Message)))
+	case *bgammon.EventWhisper:
+		write([]byte(fmt.Sprintf("whisper %s %s", ev.Player, ev.Message)))
+	case *bgammon.EventInvite:
+		write([]byte(fmt.Sprintf("invite %d %s %d %d", ev.ID, ev.Player, ev.Points, ev.Expires)))
+	case *bgammon.EventFriendOnline:
+		write([]byte(fmt.Sprintf("friendonline %s", ev.Player)))
 	case *bgammon.EventList:
-		c.Write([]byte("liststart Matches list:"))
+		write([]byte("liststart Matches list:"))
 		for _, g := range ev.Games {
-			password := 0
-			if g.Password {
-				password = 1
-			}
-			name := "(No name)"
-			if g.Name != "" {
-				name = g.Name
-			}
-			c.Write([]byte(fmt.Sprintf("game %d %d %d %d %s", g.ID, password, g.Points, g.Players, name)))
+			write(formatListing(g))
 		}
-		c.Write([]byte("listend End of matches list."))
+		write([]byte("listend End of matches list."))
+	case *bgammon.EventLobbyUpdate:
+		write([]byte("lobbystart Lobby update:"))
+		for _, g := range ev.Games {
+			write(formatListing(g))
+		}
+		write([]byte("lobbyend End of lobby update."))
+	case *bgammon.EventFailedCreate:
+		write([]byte(fmt.Sprintf("failedcreate %s", ev.Reason)))
 	case *bgammon.EventJoined:
-		c.Write([]byte(fmt.Sprintf("joined %d %d %s", ev.GameID, ev.PlayerNumber, ev.Player)))
+		write([]byte(fmt.Sprintf("joined %d %d %s", ev.GameID, ev.PlayerNumber, ev.Player)))
 	case *bgammon.EventFailedJoin:
-		c.Write([]byte(fmt.Sprintf("failedjoin %s", ev.Reason)))
+		write([]byte(fmt.Sprintf("failedjoin %s", ev.Reason)))
 	case *bgammon.EventLeft:
-		c.Write([]byte(fmt.Sprintf("left %s", ev.Player)))
+		write([]byte(fmt.Sprintf("left %s %s", ev.Player, ev.Reason)))
 	case *bgammon.EventRolled:
-		c.Write([]byte(fmt.Sprintf("rolled %s %d %d", ev.Player, ev.Roll1, ev.Roll2)))
+		tie := 0
+		if ev.Tie {
+			tie = 1
+		}
+		write([]byte(fmt.Sprintf("rolled %s %d %d %d", ev.Player, ev.Roll1, ev.Roll2, tie)))
 	case *bgammon.EventFailedRoll:
-		c.Write([]byte(fmt.Sprintf("failedroll %s", ev.Reason)))
+		write([]byte(fmt.Sprintf("failedroll %s", ev.Reason)))
 	case *bgammon.EventMoved:
-		c.Write([]byte(fmt.Sprintf("moved %s %s", ev.Player, bgammon.FormatAndFlipMoves(ev.Moves, c.playerNumber))))
+		moves := bgammon.FormatAndFlipMoves(ev.Moves, c.perspective())
+		if c.settings.Combined {
+			moves = bgammon.FormatCombinedMoves(bgammon.FlipMoves(ev.Moves, c.perspective()))
+		}
+		write([]byte(fmt.Sprintf("moved %s %s", ev.Player, moves)))
 	case *bgammon.EventFailedMove:
-		c.Write([]byte(fmt.Sprintf("failedmove %d/%d %s", ev.From, ev.To, ev.Reason)))
+		write([]byte(fmt.Sprintf("failedmove %d/%d %s", ev.From, ev.To, ev.Reason)))
 	case *bgammon.EventFailedOk:
-		c.Write([]byte(fmt.Sprintf("failedok %s", ev.Reason)))
+		write([]byte(fmt.Sprintf("failedok %s", ev.Reason)))
+	case *bgammon.EventDoubleOffered:
+		write([]byte(fmt.Sprintf("doubleoffered %s %d", ev.Player, ev.Points)))
+	case *bgammon.EventDoubleAccepted:
+		write([]byte(fmt.Sprintf("doubleaccepted %s %d", ev.Player, ev.Points)))
+	case *bgammon.EventDoubleRejected:
+		write([]byte(fmt.Sprintf("doublerejected %s %d", ev.Player, ev.Points)))
+	case *bgammon.EventAutoDouble:
+		write([]byte(fmt.Sprintf("autodouble %d", ev.Points)))
+	case *bgammon.EventBeaver:
+		write([]byte(fmt.Sprintf("beaver %s %d", ev.Player, ev.Points)))
+	case *bgammon.EventRaccoon:
+		write([]byte(fmt.Sprintf("raccoon %s %d", ev.Player, ev.Points)))
+	case *bgammon.EventTimeWarning:
+		write([]byte(fmt.Sprintf("timewarning %s %d", ev.Player, ev.Seconds)))
 	case *bgammon.EventWin:
-		if ev.Points != 0 {
-			c.Write([]byte(fmt.Sprintf("win %s wins %d points!", ev.Player, ev.Points)))
+		if ev.Forfeit {
+			write([]byte(fmt.Sprintf("win %s wins! Opponent did not reconnect.", ev.Player)))
+		} else if ev.Resigned && ev.Points != 0 {
+			write([]byte(fmt.Sprintf("win %s wins %d points! Opponent resigned.", ev.Player, ev.Points)))
+		} else if ev.Resigned {
+			write([]byte(fmt.Sprintf("win %s wins! Opponent resigned.", ev.Player)))
+		} else if ev.Timeout {
+			write([]byte(fmt.Sprintf("win %s wins %d points! Opponent ran out of time.", ev.Player, ev.Points)))
+		} else if ev.Idle {
+			write([]byte(fmt.Sprintf("win %s wins %d points! Opponent was inactive.", ev.Player, ev.Points)))
+		} else if ev.Points != 0 {
+			write([]byte(fmt.Sprintf("win %s wins %d points!", ev.Player, ev.Points)))
 		} else {
-			c.Write([]byte(fmt.Sprintf("win %s wins!", ev.Player)))
+			write([]byte(fmt.Sprintf("win %s wins!", ev.Player)))
+		}
+		if ev.Match {
+			write([]byte(fmt.Sprintf("matchover %s %d %d", ev.Player, ev.Score1, ev.Score2)))
+		}
+	case *bgammon.EventDesync:
+		write([]byte(fmt.Sprintf("desync %s", ev.Checksum)))
+	case *bgammon.EventPipCount:
+		write([]byte(fmt.Sprintf("pipcount %d %d", ev.Player1, ev.Player2)))
+	case *bgammon.EventLeaderboard:
+		write([]byte("leaderboardstart Leaderboard:"))
+		for i, p := range ev.Players {
+			write([]byte(fmt.Sprintf("leader %d %s %d %d %d", i+1, p.Name, p.Rating, p.Wins, p.Losses)))
+		}
+		write([]byte("leaderboardend End of leaderboard."))
+	case *bgammon.EventHistory:
+		write([]byte("historystart Match history:"))
+		for _, m := range ev.Matches {
+			winner := m.Player1
+			if m.Winner == 2 {
+				winner = m.Player2
+			}
+			noGammons := 0
+			if m.NoGammons {
+				noGammons = 1
+			}
+			write([]byte(fmt.Sprintf("historymatch %d %d %s %d %s %d %s %d %d %d", m.ID, m.Ended, m.Player1, m.Score1, m.Player2, m.Score2, winner, m.WinType, m.Seed, noGammons)))
+		}
+		write([]byte("historyend End of match history."))
+	case *bgammon.EventStats:
+		line := fmt.Sprintf("stats %s %d %d %d %d %d %d %d", ev.Name, ev.Rating, ev.Matches, ev.Wins, ev.Losses, ev.GammonsWon, ev.GammonsLost, ev.OpponentRating)
+		if len(ev.Dice) != 0 {
+			dice := make([]string, len(ev.Dice))
+			for i, count := range ev.Dice {
+				dice[i] = strconv.Itoa(count)
+			}
+			line += " " + strings.Join(dice, ",")
+		}
+		write([]byte(line))
+	case *bgammon.EventProfile:
+		var registered, private int
+		if ev.Registered {
+			registered = 1
+		}
+		if ev.Private {
+			private = 1
+		}
+		status := "offline"
+		if ev.InMatch {
+			status = "playing"
+		} else if ev.Online {
+			status = "online"
+		}
+		write([]byte(fmt.Sprintf("profile %s %d %d %d %d %d %d %d %d %s", ev.Name, registered, private, ev.Joined, ev.Rating, ev.Rank, ev.Matches, ev.Wins, ev.Losses, status)))
+	case *bgammon.EventWho:
+		write([]byte("whostart Online players:"))
+		for _, p := range ev.Players {
+			inMatch := 0
+			if p.InMatch {
+				inMatch = 1
+			}
+			line := fmt.Sprintf("who %s %d %d %d %s %d", p.Name, inMatch, p.Rating, p.Idle, p.Transport, p.Latency)
+			if p.Address != "" {
+				line += " " + p.Address
+			}
+			write([]byte(line))
+		}
+		write([]byte("whoend End of players list."))
+	case *bgammon.EventPosition:
+		write([]byte(fmt.Sprintf("position %s %s", ev.ID, ev.MatchID)))
+	case *bgammon.EventHint:
+		write([]byte(fmt.Sprintf("hint %s", bgammon.FormatMoves(ev.Moves))))
+	case *bgammon.EventLegalMoves:
+		write([]byte(fmt.Sprintf("legalmoves %s", bgammon.FormatMoves(ev.Moves))))
+	case *bgammon.EventSettings:
+		var jsonEnabled, highlight, autoRoll, private, autoOk, combined int
+		if ev.JSON {
+			jsonEnabled = 1
+		}
+		if ev.Highlight {
+			highlight = 1
+		}
+		if ev.AutoRoll {
+			autoRoll = 1
+		}
+		if ev.Private {
+			private = 1
 		}
+		if ev.AutoOk {
+			autoOk = 1
+		}
+		if ev.Combined {
+			combined = 1
+		}
+		write([]byte(fmt.Sprintf("settings %d %d %d %d %d %d", jsonEnabled, highlight, autoRoll, private, autoOk, combined)))
+	case *bgammon.EventVersion:
+		write([]byte(fmt.Sprintf("version %s %d %s", ev.Server, ev.Protocol, strings.Join(ev.Features, ","))))
+	case *bgammon.EventStatus:
+		line := fmt.Sprintf("status %d %d %d", ev.Uptime, ev.Clients, ev.Games)
+		if ev.GoroutineCount != 0 {
+			line += fmt.Sprintf(" %d %d", ev.GoroutineCount, ev.MemoryMB)
+		}
+		write([]byte(line))
+	case *bgammon.EventTranscript:
+		write([]byte("transcriptstart Match transcript:"))
+		for _, line := range strings.Split(strings.TrimRight(ev.Transcript, "\n"), "\n") {
+			write([]byte(fmt.Sprintf("transcript %s", line)))
+		}
+		write([]byte("transcriptend End of match transcript."))
 	default:
 		log.Panicf("unknown event type %+v", ev)
 	}
 }
 
+// mutes returns whether the client has muted the provided player.
+func (c *serverClient) mutes(name []byte) bool {
+	return c.muted[strings.ToLower(string(name))]
+}
+
 func (c *serverClient) sendNotice(message string) {
 	c.sendEvent(&bgammon.EventNotice{
 		Message: message,
@@ -164,36 +452,53 @@ func (c *serverClient) Terminate(reason string) {
 func logClientRead(msg []byte) {
 	msgLower := bytes.ToLower(msg)
 	loginJSON := bytes.HasPrefix(msgLower, []byte("loginjson ")) || bytes.HasPrefix(msgLower, []byte("lj "))
-	if bytes.HasPrefix(msgLower, []byte("login ")) || bytes.HasPrefix(msgLower, []byte("l ")) || loginJSON {
+	registerJSON := bytes.HasPrefix(msgLower, []byte("registerjson ")) || bytes.HasPrefix(msgLower, []byte("rj "))
+	register := bytes.HasPrefix(msgLower, []byte("register ")) || registerJSON
+	if bytes.HasPrefix(msgLower, []byte("login ")) || bytes.HasPrefix(msgLower, []byte("l ")) || loginJSON || register {
 		split := bytes.Split(msg, []byte(" "))
+		params := split[1:]
 		var clientName []byte
+		var email []byte
 		var username []byte
 		var password []byte
-		l := len(split)
-		if l > 1 {
-			if loginJSON {
-				clientName = split[1]
-			} else {
-				username = split[1]
+		if loginJSON || registerJSON {
+			if len(params) > 0 {
+				clientName = params[0]
+				params = params[1:]
 			}
-			if l > 2 {
-				if loginJSON {
-					username = split[2]
-				} else {
-					password = []byte("*******")
-				}
-				if l > 3 {
-					if loginJSON {
-						password = []byte("*******")
-					}
-				}
+		}
+		if register && len(params) > 0 {
+			email = []byte("*******")
+			params = params[1:]
+		}
+		if len(params) > 0 {
+			username = params[0]
+			if len(params) > 1 {
+				password = []byte("*******")
 			}
 		}
 		if len(clientName) == 0 {
 			clientName = []byte("unspecified")
 		}
-		log.Printf("<- %s %s %s %s", split[0], clientName, username, password)
+		if register {
+			debugf("<- %s %s %s %s %s", split[0], clientName, email, username, password)
+			return
+		}
+		debugf("<- %s %s %s %s", split[0], clientName, username, password)
 	} else if !bytes.HasPrefix(msgLower, []byte("list")) && !bytes.HasPrefix(msgLower, []byte("ls")) && !bytes.HasPrefix(msgLower, []byte("pong")) {
-		log.Printf("<- %s", msg)
+		debugf("<- %s", msg)
+	}
+}
+
+// formatListing formats a match listed in human-readable form.
+func formatListing(g bgammon.GameListing) []byte {
+	password := 0
+	if g.Password {
+		password = 1
+	}
+	name := "(No name)"
+	if g.Name != "" {
+		name = g.Name
 	}
+	return []byte(fmt.Sprintf("game %d %d %d %d %s", g.ID, password, g.Points, g.Players, name))
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// botDelay is how long the bot waits before acting, so that its opponent is
+// able to follow along.
+const botDelay = 750 * time.Millisecond
+
+var _ bgammon.Client = &botClient{}
+
+// botClient is a computer controlled player. It receives the same JSON
+// formatted events as other clients and responds by sending commands.
+type botClient struct {
+	name       string
+	commands   chan<- []byte
+	state      *bgammon.GameState // Last received game state.
+	events     [][]byte
+	eventsLock sync.Mutex
+	notify     chan struct{}
+	done       chan struct{}
+	terminated atomic.Bool // Accessed atomically, as the bot is terminated from other goroutines.
+}
+
+func newBotClient(name string, commands chan<- []byte) *botClient {
+	return &botClient{
+		name:     name,
+		commands: commands,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *botClient) HandleReadWrite() {
+	if c.terminated.Load() {
+		return
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.notify:
+		}
+
+		c.eventsLock.Lock()
+		events := c.events
+		c.events = nil
+		c.eventsLock.Unlock()
+
+		for _, event := range events {
+			c.handleEvent(event)
+		}
+	}
+}
+
+// Write queues an event to be handled by the bot. Events are queued rather
+// than handled immediately because Write is called while commands are being
+// processed, and the bot responds to events by sending more commands.
+func (c *botClient) Write(message []byte) {
+	if c.terminated.Load() {
+		return
+	}
+
+	c.eventsLock.Lock()
+	c.events = append(c.events, message)
+	c.eventsLock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *botClient) send(command string) {
+	select {
+	case <-c.done:
+	case c.commands <- []byte(command):
+	}
+}
+
+func (c *botClient) handleEvent(message []byte) {
+	e, err := bgammon.DecodeEvent(message)
+	if err != nil {
+		warnf("bot %s failed to decode event %s: %s", c.name, message, err)
+		return
+	}
+
+	switch ev := e.(type) {
+	case *bgammon.EventPing:
+		c.send(bgammon.CommandPong + " " + ev.Message)
+	case *bgammon.EventLeft:
+		// Leave the server when the opponent leaves the match. The bot waits
+		// for opponents who lost their connection during a game to reconnect.
+		reconnecting := ev.Reason != bgammon.LeftReasonLeave && c.state != nil && c.state.Winner == 0
+		if ev.Player != c.name && !reconnecting {
+			c.send(bgammon.CommandDisconnect)
+		}
+	case *bgammon.EventRolled:
+		// Roll for the first turn. The board is not sent to JSON clients
+		// until both players have rolled, so the bot must roll here after
+		// its opponent rolls first. The board is sent after a tie.
+		if c.state == nil || c.state.Turn != 0 {
+			return
+		}
+		if ev.Player != c.name && (ev.Roll1 == 0 || ev.Roll2 == 0) {
+			time.Sleep(botDelay)
+			c.send(bgammon.CommandRoll)
+		}
+	case *bgammon.EventBoard:
+		c.state = &ev.GameState
+		command := botCommand(&ev.GameState)
+		if command != "" {
+			time.Sleep(botDelay)
+			c.send(command)
+		}
+	case *bgammon.EventWin:
+		if ev.Forfeit {
+			c.send(bgammon.CommandDisconnect)
+		} else if ev.Match {
+			c.send(bgammon.CommandRematch)
+		}
+	}
+}
+
+func (c *botClient) Terminate(reason string) {
+	if c.terminated.Swap(true) {
+		return
+	}
+	close(c.done)
+}
+
+func (c *botClient) Terminated() bool {
+	return c.terminated.Load()
+}
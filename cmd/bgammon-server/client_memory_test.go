@@ -0,0 +1,342 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// testTimeout is how long tests wait for an event before failing.
+const testTimeout = 5 * time.Second
+
+var _ bgammon.Client = &memoryClient{}
+
+// memoryClient is a client connected in-process rather than over the network.
+// It allows the server to be tested end-to-end without opening a socket:
+// commands are sent by calling send, and the events sent to the client are
+// read by calling receive.
+type memoryClient struct {
+	client     *serverClient
+	commands   chan<- []byte
+	events     [][]byte
+	eventsLock sync.Mutex
+	notify     chan struct{}
+	done       chan struct{}
+	terminated atomic.Bool // Accessed atomically, as the client is used from other goroutines while testing.
+
+	// sendLock is held while a command is sent. The commands channel is
+	// closed after HandleReadWrite returns, which waits for commands being
+	// sent to be sent or discarded.
+	sendLock sync.RWMutex
+}
+
+func newMemoryClient(commands chan<- []byte) *memoryClient {
+	return &memoryClient{
+		commands: commands,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// connectMemoryClient connects a new in-process client to the server. The
+// client is greeted like a client connecting over the network, and must log
+// in before sending other commands. As newServer does not listen for
+// connections, a server with only memory clients connected is isolated from
+// the network.
+func (s *server) connectMemoryClient() *memoryClient {
+	const bufferSize = 8
+	commands := make(chan []byte, bufferSize)
+
+	now := time.Now().Unix()
+
+	mc := newMemoryClient(commands)
+	c := &serverClient{
+		id:        <-s.newClientIDs,
+		account:   -1,
+		transport: "memory",
+		connected: now,
+		commands:  commands,
+		Client:    mc,
+	}
+	c.lastActive.Store(now)
+	mc.client = c
+	s.sendHello(c)
+	go s.handleClient(c)
+	return mc
+}
+
+func (c *memoryClient) HandleReadWrite() {
+	if !c.terminated.Load() {
+		<-c.done
+	}
+
+	// Wait for commands being sent to be sent or discarded.
+	c.sendLock.Lock()
+	c.sendLock.Unlock()
+}
+
+// Write queues an event to be received by the client. Events are queued
+// rather than sent over a channel so that commands are never blocked by a
+// client which is not receiving events.
+func (c *memoryClient) Write(message []byte) {
+	if c.terminated.Load() {
+		return
+	}
+
+	c.eventsLock.Lock()
+	c.events = append(c.events, message)
+	c.eventsLock.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// send sends a command to the server as if it was received over the network.
+// Commands sent after the client is terminated are discarded.
+func (c *memoryClient) send(command string) {
+	c.sendLock.RLock()
+	defer c.sendLock.RUnlock()
+
+	if c.terminated.Load() {
+		return
+	}
+	select {
+	case <-c.done:
+	case c.commands <- []byte(command):
+	}
+}
+
+// receive returns the next event sent to the client, in the order events were
+// sent. False is returned when no event is sent within the provided duration.
+func (c *memoryClient) receive(timeout time.Duration) ([]byte, bool) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		c.eventsLock.Lock()
+		if len(c.events) != 0 {
+			event := c.events[0]
+			c.events[0] = nil // Allow memory to be deallocated.
+			c.events = c.events[1:]
+			c.eventsLock.Unlock()
+			return event, true
+		}
+		c.eventsLock.Unlock()
+
+		select {
+		case <-c.notify:
+		case <-t.C:
+			return nil, false
+		}
+	}
+}
+
+// receiveEvent returns the next JSON formatted event sent to the client which
+// the provided function returns true for. Other events are discarded. False is
+// returned when no such event is sent within the provided duration. The client
+// must have enabled JSON formatted events.
+func (c *memoryClient) receiveEvent(timeout time.Duration, f func(ev interface{}) bool) (interface{}, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		message, ok := c.receive(time.Until(deadline))
+		if !ok {
+			return nil, false
+		}
+		ev, err := bgammon.DecodeEvent(message)
+		if err == nil && f(ev) {
+			return ev, true
+		}
+	}
+}
+
+func (c *memoryClient) Terminate(reason string) {
+	if c.terminated.Swap(true) {
+		return
+	}
+	close(c.done)
+}
+
+func (c *memoryClient) Terminated() bool {
+	return c.terminated.Load()
+}
+
+// expectEvent returns the next event of type T sent to the client. Events of
+// other types are discarded. The test fails when no such event is sent.
+func expectEvent[T any](t *testing.T, c *memoryClient) T {
+	t.Helper()
+	return expectEventFunc(t, c, func(ev T) bool { return true })
+}
+
+// expectEventFunc returns the next event of type T sent to the client which
+// the provided function returns true for. Other events are discarded. The test
+// fails when no such event is sent.
+func expectEventFunc[T any](t *testing.T, c *memoryClient, f func(ev T) bool) T {
+	t.Helper()
+	ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+		e, ok := ev.(T)
+		return ok && f(e)
+	})
+	if !ok {
+		var zero T
+		t.Fatalf("client %s did not receive %T", c.name(), zero)
+	}
+	return ev.(T)
+}
+
+// expectNotice returns the next notice sent to the client containing the
+// provided message.
+func expectNotice(t *testing.T, c *memoryClient, message string) *bgammon.EventNotice {
+	t.Helper()
+	return expectEventFunc(t, c, func(ev *bgammon.EventNotice) bool {
+		return ev.Message == message
+	})
+}
+
+// disconnect disconnects the client and waits until it is removed from the
+// server. Clients are removed shortly after disconnecting.
+func disconnect(t *testing.T, s *server, c *memoryClient) {
+	t.Helper()
+	c.send(bgammon.CommandDisconnect)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var connected bool
+		s.clientsLock.Lock()
+		for _, sc := range s.clients {
+			if sc == c.client {
+				connected = true
+			}
+		}
+		s.clientsLock.Unlock()
+		if !connected {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("client %s did not disconnect", c.name())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestServer returns a server for testing. Debug commands are allowed, so
+// that tests may set up positions and dice. The server is stopped after the
+// test.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	return startTestServer(t, true)
+}
+
+// startTestServer returns a server for testing which allows debug commands
+// when debugCommands is true. The server is stopped after the test.
+func startTestServer(t *testing.T, debugCommands bool) *server {
+	t.Helper()
+	s := newServer(debugCommands)
+	t.Cleanup(s.stop)
+	return s
+}
+
+// newTestDatabase connects to a new database, which is closed after the test.
+func newTestDatabase(t *testing.T) {
+	t.Helper()
+	err := connectDB(filepath.Join(t.TempDir(), "bgammon.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		db = nil
+	})
+}
+
+// loginClient connects a client which logs in as a guest with the provided
+// username and enables JSON formatted events. The client is disconnected after
+// the test.
+func loginClient(t *testing.T, s *server, username string) *memoryClient {
+	t.Helper()
+	c := s.connectMemoryClient()
+	t.Cleanup(func() {
+		c.send(bgammon.CommandDisconnect)
+	})
+	c.send("loginjson test " + username)
+	expectEventFunc(t, c, func(ev *bgammon.EventWelcome) bool {
+		return ev.PlayerName == username
+	})
+	return c
+}
+
+// registerClient connects a client which registers an account with the
+// provided username and enables JSON formatted events. The client is
+// disconnected after the test.
+func registerClient(t *testing.T, s *server, username string) *memoryClient {
+	t.Helper()
+	c := s.connectMemoryClient()
+	t.Cleanup(func() {
+		c.send(bgammon.CommandDisconnect)
+	})
+	c.send("registerjson test " + username + "@example.com " + username + " secret")
+	expectEventFunc(t, c, func(ev *bgammon.EventSession) bool {
+		return ev.Registered
+	})
+	return c
+}
+
+// startMatch logs in two players and returns them, ordered by player number,
+// after the first player creates a public match with the provided points and
+// options and the second player joins it. For example: startMatch(t, s, "3 jacoby")
+func startMatch(t *testing.T, s *server, options string) (*memoryClient, *memoryClient, *serverGame) {
+	t.Helper()
+	return playMatch(t, s, loginClient(t, s, "alice"), loginClient(t, s, "bob"), options)
+}
+
+// playMatch returns the provided players, ordered by player number, after the
+// first player creates a public match with the provided points and options and
+// the second player joins it.
+func playMatch(t *testing.T, s *server, c1 *memoryClient, c2 *memoryClient, options string) (*memoryClient, *memoryClient, *serverGame) {
+	t.Helper()
+	c1.send("create public " + options)
+	created := expectEvent[*bgammon.EventJoined](t, c1)
+	c2.send("join " + strconv.Itoa(created.GameID))
+	expectEventFunc(t, c2, func(ev *bgammon.EventJoined) bool {
+		return ev.Player == c2.name()
+	})
+	expectEvent[*bgammon.EventBoard](t, c2)
+	g := s.gameByClient(c1.client)
+	if created.PlayerNumber == 2 {
+		c1, c2 = c2, c1
+	}
+	return c1, c2, g
+}
+
+// name returns the username of the client.
+func (c *memoryClient) name() string {
+	return string(c.client.name)
+}
+
+// setState sets the player whose turn it is and the dice they rolled, and
+// waits for the board to be sent to the player. The dice are not rolled when
+// empty.
+func setState(t *testing.T, c *memoryClient, turn int, dice string) *bgammon.EventBoard {
+	t.Helper()
+	command := "setstate " + strconv.Itoa(turn)
+	if dice != "" {
+		command += " " + dice
+	}
+	c.send(command)
+	expectNotice(t, c, c.name()+" set the state of the match.")
+	return expectEvent[*bgammon.EventBoard](t, c)
+}
+
+// setBoard sets up the provided board, from the perspective of player 1, and
+// waits for the board to be sent to the player. It must not be player 2's turn,
+// as the Position ID is read from the perspective of the player on roll.
+func setBoard(t *testing.T, c *memoryClient, board []int) *bgammon.EventBoard {
+	t.Helper()
+	id := bgammon.PositionID(board, 1)
+	c.send("setboard " + id)
+	expectNotice(t, c, c.name()+" set up position "+id+".")
+	return expectEvent[*bgammon.EventBoard](t, c)
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"log"
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -62,6 +62,8 @@ func (c *socketClient) readCommands() {
 
 	setTimeout()
 	var scanner = bufio.NewScanner(c.conn)
+	scanner.Buffer(nil, maxCommandLength+len("\r\n"))
+	var tooLong bool
 	for scanner.Scan() {
 		if c.terminated {
 			return
@@ -70,6 +72,11 @@ func (c *socketClient) readCommands() {
 		if scanner.Err() != nil {
 			c.Terminate(scanner.Err().Error())
 			return
+		} else if len(scanner.Bytes()) > maxCommandLength {
+			// The buffer has room for a line ending of two bytes, so a
+			// command ending with a single byte may still be too long.
+			tooLong = true
+			break
 		}
 
 		buf := make([]byte, len(scanner.Bytes()))
@@ -80,6 +87,10 @@ func (c *socketClient) readCommands() {
 
 		setTimeout()
 	}
+	if tooLong || errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		debugf("Client %s sent a command longer than %d bytes", c.conn.RemoteAddr(), maxCommandLength)
+		c.Terminate(errCommandTooLong.Error())
+	}
 }
 
 func (c *socketClient) writeEvents(closeWrite chan struct{}) {
@@ -121,7 +132,7 @@ func (c *socketClient) writeEvents(closeWrite chan struct{}) {
 		}
 
 		if !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
-			log.Printf("-> %s", event)
+			debugf("-> %s", event)
 		}
 		c.wgEvents.Done()
 	}
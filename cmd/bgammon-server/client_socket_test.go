@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketCommandTooLong(t *testing.T) {
+	long := "say " + strings.Repeat("a", maxCommandLength-len("say "))
+	for _, test := range []struct {
+		name    string
+		command string
+	}{
+		{"one byte", long + "a"},
+		{"longer than the buffer", long + long},
+	} {
+		server, client := net.Pipe()
+		commands := make(chan []byte, 2)
+		c := newSocketClient(server, commands, nil)
+
+		done := make(chan struct{})
+		go func() {
+			c.readCommands()
+			close(done)
+		}()
+
+		// Commands of the maximum length are accepted, including line endings.
+		go client.Write([]byte("say hello\n" + long + "\r\n" + test.command + "\nsay goodbye\n"))
+		for _, expected := range []string{"say hello", long} {
+			select {
+			case command := <-commands:
+				if string(command) != expected {
+					t.Errorf("%s: received command of %d bytes, expected %d bytes", test.name, len(command), len(expected))
+				}
+			case <-time.After(testTimeout):
+				t.Fatalf("%s: command was not received", test.name)
+			}
+		}
+
+		// The client is disconnected without handling the longer command or
+		// any command sent after it.
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatalf("%s: client was not disconnected after sending a command which is too long", test.name)
+		}
+		if !c.Terminated() {
+			t.Errorf("%s: client was not terminated", test.name)
+		}
+		select {
+		case command := <-commands:
+			t.Errorf("%s: received command of %d bytes after a command which is too long", test.name, len(command))
+		default:
+		}
+		client.Close()
+	}
+}
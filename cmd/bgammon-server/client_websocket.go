@@ -2,37 +2,220 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"compress/flate"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"code.rocket9labs.com/tslocum/bgammon"
 	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
 	"github.com/gobwas/ws/wsutil"
 )
 
+// webSocketCompression controls whether permessage-deflate compression is
+// negotiated with WebSocket clients which support it.
+var webSocketCompression = true
+
+// webSocketPingInterval is how often WebSocket ping frames are sent to clients
+// to keep idle connections open through proxies. Ping frames are handled by
+// the WebSocket implementation of the client, and are independent of the ping
+// events sent to inactive clients. Clients which answer ping frames are not
+// considered active. Ping frames are not sent when the interval is zero.
+var webSocketPingInterval = 30 * time.Second
+
+// trustedProxies are the networks of reverse proxies which are trusted to
+// provide the address of WebSocket clients in the X-Forwarded-For header. The
+// header is ignored when no proxies are trusted.
+var trustedProxies []*net.IPNet
+
+// webSocketOrigins are the origins of web pages which may connect to the
+// server using WebSocket, such as https://bgammon.org. Web pages from all
+// origins may connect when the list contains an asterisk. When the list is
+// empty, only web pages from the host the WebSocket connection is made to may
+// connect. Connections without an Origin header are not made by web browsers,
+// and are always accepted.
+var webSocketOrigins []string
+
+// webSocketCompressionThreshold is the minimum size of an event which is
+// compressed. Smaller events are sent uncompressed, as compressing them
+// saves little or no bandwidth.
+const webSocketCompressionThreshold = 256
+
+// deflateTail is removed from the end of each compressed message, as required
+// by the permessage-deflate extension. deflateFinal is appended to compressed
+// messages received from clients so that they may be decompressed.
+var (
+	deflateTail  = []byte{0x00, 0x00, 0xff, 0xff}
+	deflateFinal = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// deflateWriters is a pool of compressors shared by all WebSocket clients.
+var deflateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// parseTrustedProxies parses a comma separated list of IP addresses and CIDR
+// networks.
+func parseTrustedProxies(proxies string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range strings.Split(proxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parseWebSocketOrigins parses a comma separated list of origins, each of
+// which is a scheme and host, or an asterisk to allow all origins.
+func parseWebSocketOrigins(origins string) ([]string, error) {
+	var allowed []string
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		} else if origin == "*" {
+			allowed = append(allowed, origin)
+			continue
+		}
+
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid origin: %s", origin)
+		}
+		allowed = append(allowed, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return allowed, nil
+}
+
+// allowedOrigin returns whether a WebSocket connection may be made by the web
+// page which made the provided request. This prevents web pages on other
+// sites from connecting on behalf of their visitors.
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	} else if len(webSocketOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range webSocketOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedProxy returns whether the provided host is a trusted proxy.
+func trustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// webSocketAddress returns the host of the remote address of a WebSocket
+// client. When the client is connected through trusted proxies, the
+// X-Forwarded-For header is read from right to left and the first address
+// which is not a trusted proxy is returned. Addresses provided before it may
+// have been set by the client and are ignored.
+func webSocketAddress(r *http.Request) string {
+	host := remoteHost(r.RemoteAddr)
+	if !trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		} else if !trustedProxy(address) {
+			return address
+		}
+		host = address
+	}
+	return host
+}
+
 var _ bgammon.Client = &webSocketClient{}
 
 type webSocketClient struct {
 	conn       net.Conn
 	events     chan []byte
 	commands   chan<- []byte
+	compress   bool // Whether permessage-deflate compression was negotiated.
 	terminated bool
 	wgEvents   sync.WaitGroup
 }
 
 func newWebSocketClient(r *http.Request, w http.ResponseWriter, commands chan<- []byte, events chan []byte) *webSocketClient {
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if !allowedOrigin(r) {
+		debugf("Rejected WebSocket connection from %s: origin %s is not allowed", webSocketAddress(r), r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil
+	}
+
+	extension := &wsflate.Extension{
+		Parameters: wsflate.DefaultParameters,
+	}
+	upgrader := ws.HTTPUpgrader{}
+	if webSocketCompression {
+		upgrader.Negotiate = extension.Negotiate
+	}
+
+	conn, _, _, err := upgrader.Upgrade(r, w)
 	if err != nil {
 		return nil
 	}
 
+	_, compress := extension.Accepted()
 	return &webSocketClient{
 		conn:     conn,
 		events:   events,
 		commands: commands,
+		compress: compress,
 	}
 }
 
@@ -73,7 +256,7 @@ func (c *webSocketClient) readCommands() {
 		}
 
 		setTimeout()
-		msg, op, err := wsutil.ReadClientData(c.conn)
+		msg, op, err := c.readMessage()
 		if err != nil {
 			c.Terminate(err.Error())
 			return
@@ -89,6 +272,114 @@ func (c *webSocketClient) readCommands() {
 	}
 }
 
+// readMessage reads the next data message sent by the client. Control messages
+// are handled while reading. Compressed messages are decompressed. Messages
+// longer than maxCommandLength are not read.
+func (c *webSocketClient) readMessage() ([]byte, ws.OpCode, error) {
+	state := ws.StateServerSide
+	message := &wsflate.MessageState{}
+	var extensions []wsutil.RecvExtension
+	if c.compress {
+		state |= ws.StateExtended
+		extensions = append(extensions, message)
+	}
+	controlHandler := wsutil.ControlFrameHandler(c.conn, state)
+	rd := &wsutil.Reader{
+		Source:         c.conn,
+		State:          state,
+		Extensions:     extensions,
+		OnIntermediate: controlHandler,
+	}
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, 0, err
+		} else if hdr.OpCode.IsControl() {
+			err = controlHandler(hdr, rd)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		} else if hdr.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			err = rd.Discard()
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		msg, err := readCommand(rd)
+		if err != nil {
+			return nil, 0, err
+		} else if message.IsCompressed() {
+			msg, err = decompressMessage(msg)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return msg, hdr.OpCode, nil
+	}
+}
+
+// writeMessage sends an event to the client. Events are compressed when
+// compression was negotiated and the event is large enough.
+func (c *webSocketClient) writeMessage(event []byte) error {
+	if !c.compress || len(event) < webSocketCompressionThreshold {
+		return wsutil.WriteServerMessage(c.conn, ws.OpText, event)
+	}
+
+	payload, err := compressMessage(event)
+	if err != nil {
+		return err
+	}
+	frame := ws.NewTextFrame(payload)
+	frame.Header, err = wsflate.SetBit(frame.Header)
+	if err != nil {
+		return err
+	}
+	return ws.WriteFrame(c.conn, frame)
+}
+
+// compressMessage compresses a message using the permessage-deflate extension.
+// Context takeover is not used, so each message is compressed independently.
+func compressMessage(message []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := deflateWriters.Get().(*flate.Writer)
+	defer deflateWriters.Put(w)
+	w.Reset(buf)
+
+	_, err := w.Write(message)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail), nil
+}
+
+// decompressMessage decompresses a message compressed using the
+// permessage-deflate extension.
+func decompressMessage(message []byte) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(message), bytes.NewReader(deflateFinal)))
+	defer r.Close()
+	return readCommand(r)
+}
+
+// readCommand reads a command from the provided reader. An error is returned
+// without reading the rest of the command when it is longer than
+// maxCommandLength.
+func readCommand(r io.Reader) ([]byte, error) {
+	buf, err := io.ReadAll(io.LimitReader(r, int64(maxCommandLength)+1))
+	if err != nil {
+		return nil, err
+	} else if len(buf) > maxCommandLength {
+		return nil, errCommandTooLong
+	}
+	return buf, nil
+}
+
 func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 	setTimeout := func() {
 		err := c.conn.SetWriteDeadline(time.Now().Add(clientTimeout))
@@ -98,10 +389,27 @@ func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 		}
 	}
 
+	var keepAlive <-chan time.Time
+	if webSocketPingInterval > 0 {
+		t := time.NewTicker(webSocketPingInterval)
+		defer t.Stop()
+		keepAlive = t.C
+	}
+
 	setTimeout()
 	var event []byte
 	for {
 		select {
+		case <-keepAlive:
+			if c.terminated {
+				continue
+			}
+			setTimeout()
+			err := ws.WriteFrame(c.conn, ws.NewPingFrame(nil))
+			if err != nil {
+				c.Terminate(err.Error())
+			}
+			continue
 		case <-closeWrite:
 			for {
 				select {
@@ -120,7 +428,7 @@ func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 		}
 
 		setTimeout()
-		err := wsutil.WriteServerMessage(c.conn, ws.OpText, event)
+		err := c.writeMessage(event)
 		if err != nil {
 			c.Terminate(err.Error())
 			c.wgEvents.Done()
@@ -128,7 +436,7 @@ func (c *webSocketClient) writeEvents(closeWrite chan struct{}) {
 		}
 
 		if !bytes.HasPrefix(event, []byte(`{"Type":"ping"`)) && !bytes.HasPrefix(event, []byte(`{"Type":"list"`)) {
-			log.Printf("-> %s", event)
+			debugf("-> %s", event)
 		}
 		c.wgEvents.Done()
 	}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+)
+
+func TestParseWebSocketOrigins(t *testing.T) {
+	origins, err := parseWebSocketOrigins(" https://bgammon.org, HTTP://Localhost:8080/ ,*,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"https://bgammon.org", "http://localhost:8080", "*"}
+	if !reflect.DeepEqual(origins, expected) {
+		t.Errorf("parsed %v, expected %v", origins, expected)
+	}
+
+	for _, origin := range []string{"bgammon.org", "https://", "https://bgammon.org/play", "://bgammon.org"} {
+		if _, err := parseWebSocketOrigins(origin); err == nil {
+			t.Errorf("parsed invalid origin %s", origin)
+		}
+	}
+}
+
+func TestAllowedOrigin(t *testing.T) {
+	defer func(origins []string) {
+		webSocketOrigins = origins
+	}(webSocketOrigins)
+
+	for _, test := range []struct {
+		name    string
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{"allowed", []string{"https://bgammon.org"}, "https://bgammon.org", true},
+		{"allowed case insensitive", []string{"https://bgammon.org"}, "https://BGammon.org", true},
+		{"disallowed", []string{"https://bgammon.org"}, "https://example.com", false},
+		{"disallowed scheme", []string{"https://bgammon.org"}, "http://bgammon.org", false},
+		{"missing", []string{"https://bgammon.org"}, "", true},
+		{"malformed", []string{"https://bgammon.org"}, "null", false},
+		{"wildcard", []string{"*"}, "https://example.com", true},
+		{"same host", nil, "https://ws.bgammon.org", true},
+		{"other host", nil, "https://example.com", false},
+	} {
+		webSocketOrigins = test.origins
+
+		r := httptest.NewRequest(http.MethodGet, "https://ws.bgammon.org/", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if allowed := allowedOrigin(r); allowed != test.allowed {
+			t.Errorf("%s: origin %q allowed: %t, expected %t", test.name, test.origin, allowed, test.allowed)
+		}
+	}
+}
+
+func TestWebSocketOriginRejected(t *testing.T) {
+	defer func(origins []string) {
+		webSocketOrigins = origins
+	}(webSocketOrigins)
+	webSocketOrigins = []string{"https://bgammon.org"}
+
+	r := httptest.NewRequest(http.MethodGet, "https://ws.bgammon.org/", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w := httptest.NewRecorder()
+
+	if c := newWebSocketClient(r, w, nil, nil); c != nil {
+		t.Fatal("connection was upgraded")
+	} else if w.Code != http.StatusForbidden {
+		t.Errorf("responded with status %d, expected %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	long := strings.Repeat("a", maxCommandLength)
+	if command, err := readCommand(strings.NewReader(long)); err != nil || string(command) != long {
+		t.Errorf("read %d bytes with error %v, expected %d bytes", len(command), err, len(long))
+	}
+	if _, err := readCommand(strings.NewReader(long + "a")); !errors.Is(err, errCommandTooLong) {
+		t.Errorf("read command which is too long with error %v, expected %v", err, errCommandTooLong)
+	}
+
+	// Compressed commands are limited by their decompressed length.
+	for _, test := range []struct {
+		command string
+		err     error
+	}{
+		{long, nil},
+		{long + "a", errCommandTooLong},
+	} {
+		compressed, err := compressMessage([]byte(test.command))
+		if err != nil {
+			t.Fatal(err)
+		}
+		command, err := decompressMessage(compressed)
+		if !errors.Is(err, test.err) {
+			t.Errorf("decompressed %d bytes with error %v, expected error %v", len(test.command), err, test.err)
+		} else if err == nil && string(command) != test.command {
+			t.Errorf("decompressed %d bytes, expected %d bytes", len(command), len(test.command))
+		}
+	}
+}
+
+func TestWebSocketCommandTooLong(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		server, client := net.Pipe()
+		commands := make(chan []byte, 1)
+		c := &webSocketClient{
+			conn:     server,
+			commands: commands,
+			compress: compress,
+		}
+
+		done := make(chan struct{})
+		go func() {
+			c.readCommands()
+			close(done)
+		}()
+
+		// send sends a command as a masked text frame, as sent by browsers.
+		// Commands are compressed when compression was negotiated.
+		send := func(command string) error {
+			payload := []byte(command)
+			var err error
+			if compress {
+				payload, err = compressMessage(payload)
+				if err != nil {
+					return err
+				}
+			}
+			frame := ws.NewTextFrame(payload)
+			if compress {
+				frame.Header, err = wsflate.SetBit(frame.Header)
+				if err != nil {
+					return err
+				}
+			}
+			return ws.WriteFrame(client, ws.MaskFrameInPlace(frame))
+		}
+
+		long := "say " + strings.Repeat("a", maxCommandLength-len("say "))
+		go send(long)
+		select {
+		case command := <-commands:
+			if string(command) != long {
+				t.Errorf("compress %t: received command of %d bytes, expected %d bytes", compress, len(command), len(long))
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("compress %t: command was not received", compress)
+		}
+
+		go send(long + "a")
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatalf("compress %t: client was not disconnected after sending a command which is too long", compress)
+		}
+		if !c.Terminated() {
+			t.Errorf("compress %t: client was not terminated", compress)
+		}
+		select {
+		case command := <-commands:
+			t.Errorf("compress %t: received command of %d bytes which is too long", compress, len(command))
+		default:
+		}
+		client.Close()
+	}
+}
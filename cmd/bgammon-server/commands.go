@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// commandHandler handles a command sent by a client. The keyword is the
+// command or alias which was sent, and the game is the match the client is in,
+// or nil.
+type commandHandler func(s *server, cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte)
+
+// registeredCommand is a command which may be sent by clients.
+type registeredCommand struct {
+	keyword     string
+	aliases     []string
+	usage       string // Parameters of the command, or empty when it has none.
+	summary     string
+	details     string // Additional information, or empty.
+	beforeLogin bool   // Whether the command may be sent before logging in.
+	moderator   bool   // Whether the command is only available to moderators.
+	debug       bool   // Whether the command is only available when debug commands are enabled.
+	inMatch     bool   // Whether the client must be in a match.
+	player      bool   // Whether the client must be a player in the match, rather than a spectator.
+	hidden      bool   // Whether the command is omitted from help.
+	concurrent  bool   // Whether the command only affects the match the client is in, and may be handled concurrently with commands sent in other matches.
+	handle      commandHandler
+}
+
+// loginCommand is the login and register commands, which are handled separately
+// from the registered commands as they share aliases with other commands.
+var loginCommand = &registeredCommand{
+	keyword:     bgammon.CommandLogin,
+	beforeLogin: true,
+	handle:      (*server).handleLogin,
+}
+
+// registeredCommands are the commands handled by the server. The commands are
+// listed in help in this order. Commands are registered during initialization,
+// as the help handler refers to the registry.
+var registeredCommands []*registeredCommand
+
+func init() {
+	registeredCommands = []*registeredCommand{
+		{keyword: bgammon.CommandHelp, aliases: []string{"h"}, usage: "[command]", summary: "Print a list of commands, or help for a specific command.", handle: (*server).handleHelp},
+		{keyword: bgammon.CommandVersion, usage: "[client name]", summary: "Print the server version, protocol version and supported features.", beforeLogin: true, handle: (*server).handleVersion},
+		{keyword: bgammon.CommandJSON, usage: "<on/off>", summary: "Turn JSON formatted messages on or off.", handle: (*server).handleJSON},
+		{keyword: bgammon.CommandSay, aliases: []string{"s"}, usage: "<message>", summary: "Send a chat message to the players and spectators in your match.", concurrent: true, handle: (*server).handleSay},
+		{keyword: bgammon.CommandChat, aliases: []string{"broadcast"}, usage: "<message>", summary: "Send a chat message to all players on the server.", details: "Send 'chat off' to stop receiving chat messages, and 'chat on' to receive them again.", handle: (*server).handleChat},
+		{keyword: bgammon.CommandWhisper, aliases: []string{"w", "tell"}, usage: "<username> <message>", summary: "Send a private message to another player.", details: "Send 'whisper off' to stop receiving private messages, and 'whisper on' to receive them again.", handle: (*server).handleWhisper},
+		{keyword: bgammon.CommandMute, usage: "<username>", summary: "Stop receiving chat messages, private messages and invitations from a player.", handle: (*server).handleMute},
+		{keyword: bgammon.CommandUnmute, usage: "<username>", summary: "Resume receiving chat messages, private messages and invitations from a player.", handle: (*server).handleMute},
+		{keyword: bgammon.CommandMuted, summary: "List muted players.", handle: (*server).handleMuted},
+		{keyword: bgammon.CommandFriend, usage: "<add/remove/list> [username]", summary: "Add, remove or list your friends.", details: "You are notified when your friends log in. Only registered players may have friends.", handle: (*server).handleFriend},
+		{keyword: bgammon.CommandSettings, usage: "[get]/[set <name> <value>]", summary: "Print or change your settings.", details: "Settings are json, highlight, autoroll, private, autook and combined. Values are on or off.", handle: (*server).handleSettings},
+		{keyword: bgammon.CommandAutoRoll, usage: "<on/off>", summary: "Enable or disable rolling automatically at the start of each turn.", handle: (*server).handleAutoRoll},
+		{keyword: bgammon.CommandAutoOk, usage: "<on/off>", summary: "Enable or disable ending your turn automatically when no other play was possible.", details: "When another play was possible, send 'ok' to end your turn.", handle: (*server).handleAutoOk},
+		{keyword: bgammon.CommandKick, usage: "<username>", summary: "Disconnect a player.", moderator: true, handle: (*server).handleKick},
+		{keyword: bgammon.CommandBan, usage: "<username> [minutes]", summary: "Disconnect a player and prevent them from connecting again.", details: "Players are banned permanently when no duration is specified.", moderator: true, handle: (*server).handleKick},
+		{keyword: bgammon.CommandUnban, usage: "<username>", summary: "Remove all bans of a player.", moderator: true, handle: (*server).handleKick},
+		{keyword: bgammon.CommandList, aliases: []string{"ls"}, usage: "[open] [offset] [limit]", summary: "List matches.", details: "When 'open' is specified, only matches which may be joined are listed.", handle: (*server).handleList},
+		{keyword: bgammon.CommandLobby, usage: "<on/off>", summary: "Receive updates of the list of matches while you are not in a match.", details: "Updates stop when you join or watch a match.", handle: (*server).handleLobby},
+		{keyword: bgammon.CommandCreate, aliases: []string{"c"}, usage: "<public>/<private [password]>/<bot> <points> [time] [jacoby] [nogammon] [beaver] [autodouble[=limit]] [balanced] [hidespectators] [puzzle=position:dice] [name]", summary: "Create a match.", details: "Options may be specified in any order, followed by the name of the match. Time control is enabled by specifying the number of seconds on each player's clock, optionally followed by a plus sign and the number of seconds added after each turn. For example: create public 5 300+5 My Match", handle: (*server).handleCreate},
+		{keyword: bgammon.CommandJoin, aliases: []string{"j"}, usage: "<id>/<username> [password]", summary: "Join a match by its ID or by a player in the match.", handle: (*server).handleJoin},
+		{keyword: bgammon.CommandWatch, usage: "<id>/<username> [password]", summary: "Watch a match as a spectator.", handle: (*server).handleWatch},
+		{keyword: bgammon.CommandLeave, aliases: []string{"l"}, summary: "Leave the match you are playing or watching.", handle: (*server).handleLeave},
+		{keyword: bgammon.CommandCancel, summary: "Cancel a match you created before another player joins it.", inMatch: true, handle: (*server).handleCancel},
+		{keyword: bgammon.CommandInvite, usage: "<username> [points]", summary: "Invite an online player to play a match.", handle: (*server).handleInvite},
+		{keyword: bgammon.CommandAccept, usage: "[id]", summary: "Accept a double offer, or the invitation with the specified ID.", handle: (*server).handleAccept},
+		{keyword: bgammon.CommandDecline, usage: "<id>", summary: "Decline the invitation with the specified ID.", handle: (*server).handleDecline},
+		{keyword: bgammon.CommandResume, usage: "<username>", summary: "Resume a match against a player which was interrupted when the server restarted.", details: "The match is resumed once both players have sent this command.", handle: (*server).handleResume},
+		{keyword: bgammon.CommandDouble, aliases: []string{"d"}, summary: "Offer a double to your opponent.", inMatch: true, player: true, concurrent: true, handle: (*server).handleDouble},
+		{keyword: bgammon.CommandReject, summary: "Decline a double offer and resign the game.", inMatch: true, player: true, concurrent: true, handle: (*server).handleReject},
+		{keyword: bgammon.CommandBeaver, summary: "Accept a double offer and immediately redouble, keeping the doubling cube.", details: "Only available in matches with beavers enabled.", inMatch: true, player: true, concurrent: true, handle: (*server).handleBeaver},
+		{keyword: bgammon.CommandRaccoon, summary: "Immediately redouble after your double offer is beavered.", details: "Only available in matches with beavers enabled.", inMatch: true, player: true, concurrent: true, handle: (*server).handleBeaver},
+		{keyword: bgammon.CommandResign, usage: "[game/match]", summary: "Resign the current game, or the entire match.", inMatch: true, player: true, concurrent: true, handle: (*server).handleResign},
+		{keyword: bgammon.CommandRoll, aliases: []string{"r"}, summary: "Roll the dice.", concurrent: true, handle: (*server).handleRoll},
+		{keyword: bgammon.CommandMove, aliases: []string{"m", "mv"}, usage: "<from-to> [from-to]...", summary: "Move checkers.", details: "Specify one or more moves in the form FROM/TO. For example: 8/4 6/4 or 13/7", concurrent: true, handle: (*server).handleMove},
+		{keyword: bgammon.CommandReset, summary: "Undo all pending moves.", inMatch: true, player: true, concurrent: true, handle: (*server).handleReset},
+		{keyword: bgammon.CommandUndo, aliases: []string{"u"}, summary: "Undo the last pending move.", inMatch: true, player: true, concurrent: true, handle: (*server).handleUndo},
+		{keyword: bgammon.CommandOk, aliases: []string{"k"}, summary: "Confirm your moves and end your turn.", inMatch: true, player: true, concurrent: true, handle: (*server).handleOk},
+		{keyword: bgammon.CommandRematch, aliases: []string{"rm"}, usage: "[new/continue]", summary: "Offer or accept a rematch after the match has ended.", details: "A new match is played to the same number of points. A continued match keeps the current score and is played to that many more points.", inMatch: true, player: true, handle: (*server).handleRematch},
+		{keyword: bgammon.CommandBoard, aliases: []string{"b"}, summary: "Print the current state of the board.", inMatch: true, concurrent: true, handle: (*server).handleBoard},
+		{keyword: bgammon.CommandFlip, summary: "Show the board from the perspective of the other player.", details: "Moves are sent and must be specified from the perspective the board is shown from. Send the command again to restore the usual perspective.", inMatch: true, concurrent: true, handle: (*server).handleFlip},
+		{keyword: bgammon.CommandVerify, usage: "<checksum>", summary: "Confirm your board is in sync with the server.", details: "The checksum is provided in the board event. When it does not match, the board is sent again.", inMatch: true, concurrent: true, handle: (*server).handleVerify},
+		{keyword: bgammon.CommandPipCount, aliases: []string{"pc"}, summary: "Print the pip count of each player.", inMatch: true, concurrent: true, handle: (*server).handlePipCount},
+		{keyword: bgammon.CommandHint, summary: "Print suggested moves for the current roll.", inMatch: true, player: true, concurrent: true, handle: (*server).handleHint},
+		{keyword: bgammon.CommandLegalMoves, summary: "Print every legal move of a single checker for the current roll.", inMatch: true, player: true, concurrent: true, handle: (*server).handleLegalMoves},
+		{keyword: bgammon.CommandPosition, summary: "Print the GNU Backgammon Position ID and Match ID of the current position.", inMatch: true, concurrent: true, handle: (*server).handlePosition},
+		{keyword: bgammon.CommandTranscript, summary: "Print the record of the games played in the current match.", inMatch: true, concurrent: true, handle: (*server).handleTranscript},
+		{keyword: bgammon.CommandSetBoard, usage: "<positionid>", summary: "Set up a position from a GNU Backgammon Position ID.", details: "Both players must agree to set up the position, after which the match is no longer rated. Only registered players may propose a position.", concurrent: true, handle: (*server).handleSetBoard},
+		{keyword: bgammon.CommandSetState, usage: "<1/2> [dice]", summary: "Set the player whose turn it is and the dice they rolled.", debug: true, inMatch: true, player: true, concurrent: true, handle: (*server).handleSetState},
+		{keyword: bgammon.CommandLeaderboard, aliases: []string{"lb"}, usage: "[count]", summary: "List the highest rated players.", handle: (*server).handleLeaderboard},
+		{keyword: bgammon.CommandHistory, usage: "[offset]", summary: "List your recently completed matches.", handle: (*server).handleHistory},
+		{keyword: bgammon.CommandStats, usage: "[username]", summary: "Print the statistics of a registered player.", handle: (*server).handleStats},
+		{keyword: bgammon.CommandProfile, usage: "[username]", summary: "Print the public profile of a player.", details: "Your own profile is printed when no username is specified.", handle: (*server).handleProfile},
+		{keyword: bgammon.CommandWho, aliases: []string{"players"}, usage: "[name]", summary: "List online players.", handle: (*server).handleWho},
+		{keyword: bgammon.CommandStatus, summary: "Print the uptime and load of the server.", handle: (*server).handleStatus},
+		{keyword: bgammon.CommandPong, usage: "<message>", summary: "Respond to a ping sent by the server.", handle: (*server).handlePong},
+		{keyword: bgammon.CommandDisconnect, summary: "Disconnect from the server.", handle: (*server).handleDisconnect},
+		{keyword: bgammon.CommandTimeout, summary: "Check whether a player has run out of time.", hidden: true, concurrent: true, handle: (*server).handleTimeout},
+	}
+}
+
+// available returns whether the command is listed in help for the provided
+// client.
+func (c *registeredCommand) available(s *server, client *serverClient) bool {
+	return !c.hidden && (!c.moderator || client.admin) && (!c.debug || s.debugCommands)
+}
+
+// syntax returns the keyword of the command followed by its parameters.
+func (c *registeredCommand) syntax() string {
+	if c.usage == "" {
+		return c.keyword
+	}
+	return c.keyword + " " + c.usage
+}
+
+// run handles the command after checking whether the client may use it. The
+// match the client is in is locked while the command is handled. Only events
+// sent while handling the command include its request ID.
+func (c *registeredCommand) run(s *server, cmd serverCommand, keyword string, params [][]byte) {
+	cmd.client.requestID.Store(int64(cmd.id))
+	defer cmd.client.requestID.Store(0)
+
+	if c.moderator && !cmd.client.admin {
+		cmd.client.sendNotice("You are not a moderator.")
+		return
+	} else if c.debug && !s.debugCommands {
+		cmd.client.sendNotice("You are not allowed to use that command.")
+		return
+	}
+
+	clientGame := s.gameByClient(cmd.client)
+	if clientGame != nil {
+		clientGame.lock.Lock()
+		defer clientGame.lock.Unlock()
+	}
+	if c.inMatch && clientGame == nil {
+		cmd.client.sendNotice("You are not currently in a match.")
+		return
+	} else if c.player && cmd.client.playerNumber == 0 {
+		cmd.client.sendNotice("You are spectating this match.")
+		return
+	}
+
+	c.handle(s, cmd, clientGame, keyword, params)
+}
+
+// lookupCommand returns the command with the provided keyword or alias, or
+// nil when no such command exists.
+func lookupCommand(keyword string) *registeredCommand {
+	keyword = strings.ToLower(keyword)
+	for _, c := range registeredCommands {
+		if c.keyword == keyword {
+			return c
+		}
+		for _, alias := range c.aliases {
+			if alias == keyword {
+				return c
+			}
+		}
+	}
+	return nil
+}
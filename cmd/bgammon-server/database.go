@@ -0,0 +1,661 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+	"golang.org/x/crypto/bcrypt"
+	_ "modernc.org/sqlite"
+)
+
+const databaseSchema = `
+CREATE TABLE IF NOT EXISTS account (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	email    TEXT    NOT NULL,
+	username TEXT    NOT NULL UNIQUE COLLATE NOCASE,
+	password TEXT    NOT NULL,
+	created  INTEGER NOT NULL
+);
+`
+
+// databaseUpgrades are applied in order to upgrade the database schema. The
+// number of upgrades applied is stored as the database user version.
+var databaseUpgrades = []string{
+	"ALTER TABLE account ADD COLUMN rating INTEGER NOT NULL DEFAULT 1500",
+	"ALTER TABLE account ADD COLUMN wins INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN losses INTEGER NOT NULL DEFAULT 0",
+	"CREATE INDEX account_rating ON account (rating DESC)",
+	`CREATE TABLE matches (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	started  INTEGER NOT NULL,
+	ended    INTEGER NOT NULL,
+	account1 INTEGER NOT NULL,
+	account2 INTEGER NOT NULL,
+	player1  TEXT    NOT NULL,
+	player2  TEXT    NOT NULL,
+	points   INTEGER NOT NULL,
+	score1   INTEGER NOT NULL,
+	score2   INTEGER NOT NULL,
+	winner   INTEGER NOT NULL,
+	wintype  INTEGER NOT NULL
+)`,
+	"CREATE INDEX matches_account1 ON matches (account1, ended DESC)",
+	"CREATE INDEX matches_account2 ON matches (account2, ended DESC)",
+	`CREATE TABLE mute (
+	account  INTEGER NOT NULL,
+	username TEXT    NOT NULL COLLATE NOCASE,
+	PRIMARY KEY (account, username)
+)`,
+	"ALTER TABLE account ADD COLUMN admin INTEGER NOT NULL DEFAULT 0",
+	`CREATE TABLE ban (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	username  TEXT    NOT NULL COLLATE NOCASE,
+	address   TEXT    NOT NULL,
+	expires   INTEGER NOT NULL,
+	moderator TEXT    NOT NULL,
+	created   INTEGER NOT NULL
+)`,
+	"ALTER TABLE account ADD COLUMN settings TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE matches ADD COLUMN seed INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice1 INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice2 INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice3 INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice4 INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice5 INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE account ADD COLUMN dice6 INTEGER NOT NULL DEFAULT 0",
+	`CREATE TABLE resumable (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	account1 INTEGER NOT NULL,
+	account2 INTEGER NOT NULL,
+	player1  TEXT    NOT NULL,
+	player2  TEXT    NOT NULL,
+	state    TEXT    NOT NULL,
+	saved    INTEGER NOT NULL
+)`,
+	"CREATE INDEX resumable_account1 ON resumable (account1)",
+	"CREATE INDEX resumable_account2 ON resumable (account2)",
+	"ALTER TABLE matches ADD COLUMN nogammon INTEGER NOT NULL DEFAULT 0",
+	`CREATE TABLE friend (
+	account  INTEGER NOT NULL,
+	username TEXT    NOT NULL COLLATE NOCASE,
+	PRIMARY KEY (account, username)
+)`,
+}
+
+// historyPageSize is the number of matches returned by each history query.
+const historyPageSize = 10
+
+var db *sql.DB
+
+var (
+	errAccountsDisabled = errors.New("accounts are not enabled on this server")
+	errUsernameInUse    = errors.New("that username is already in use")
+	errInvalidLogin     = errors.New("invalid username or password")
+	errUnknownAccount   = errors.New("no account exists with that username")
+	errPrivateStats     = errors.New("that player's statistics are private")
+)
+
+// connectDB opens the SQLite database at the provided path and creates any
+// missing tables.
+func connectDB(path string) error {
+	var err error
+	db, err = sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(databaseSchema)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database schema: %s", err)
+	}
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(databaseUpgrades); version++ {
+		_, err = db.Exec(databaseUpgrades[version])
+		if err != nil {
+			return fmt.Errorf("failed to upgrade database schema to version %d: %s", version+1, err)
+		}
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registerAccount creates a new account. The password of the provided account
+// must already be hashed using hashPassword.
+func registerAccount(a *account) error {
+	if db == nil {
+		return errAccountsDisabled
+	} else if len(strings.TrimSpace(a.email)) == 0 || !strings.ContainsRune(a.email, '@') {
+		return errors.New("invalid email address")
+	} else if len(a.password) == 0 {
+		return errors.New("a password must be provided")
+	}
+
+	exists, err := accountExists([]byte(a.username))
+	if err != nil {
+		return err
+	} else if exists {
+		return errUsernameInUse
+	}
+
+	a.created = time.Now().Unix()
+
+	result, err := db.Exec("INSERT INTO account (email, username, password, created) VALUES (?, ?, ?, ?)", a.email, a.username, a.password, a.created)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	a.id = int(id)
+	a.rating = defaultRating
+	return nil
+}
+
+// hashPassword returns the hash of the provided password, which is stored
+// instead of the password.
+func hashPassword(password []byte) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// accountExists returns whether an account exists with the provided username.
+// False is returned when accounts are not enabled.
+func accountExists(username []byte) (bool, error) {
+	if db == nil {
+		return false, nil
+	}
+
+	var exists int
+	err := db.QueryRow("SELECT COUNT(*) FROM account WHERE username = ?", string(username)).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists != 0, nil
+}
+
+// loginAccount returns the account with the provided username when the
+// provided password matches the stored password hash.
+func loginAccount(username []byte, password []byte) (*account, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	a := &account{}
+	var settings string
+	err := db.QueryRow("SELECT id, email, username, password, created, rating, admin, settings FROM account WHERE username = ?", string(username)).Scan(&a.id, &a.email, &a.username, &a.password, &a.created, &a.rating, &a.admin, &settings)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidLogin
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(a.password), password)
+	if err != nil {
+		return nil, errInvalidLogin
+	}
+
+	a.settings, err = parseSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseSettings parses the stored preferences of an account. Accounts which
+// have never changed their settings have no stored preferences.
+func parseSettings(buf string) (bgammon.Settings, error) {
+	var settings bgammon.Settings
+	if buf == "" {
+		return settings, nil
+	}
+	err := json.Unmarshal([]byte(buf), &settings)
+	if err != nil {
+		return settings, fmt.Errorf("failed to parse settings: %s", err)
+	}
+	return settings, nil
+}
+
+// saveSettings stores the preferences of an account.
+func saveSettings(account int, settings bgammon.Settings) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	buf, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE account SET settings = ? WHERE id = ?", string(buf), account)
+	return err
+}
+
+// updateRatings updates the ratings of the winner and loser of a match. The
+// rating change of the winner is returned. The rating of the loser changes by
+// the same amount in the opposite direction.
+func updateRatings(winner int, loser int) (int, error) {
+	if db == nil {
+		return 0, errAccountsDisabled
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var winnerRating, loserRating int
+	err = tx.QueryRow("SELECT rating FROM account WHERE id = ?", winner).Scan(&winnerRating)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow("SELECT rating FROM account WHERE id = ?", loser).Scan(&loserRating)
+	if err != nil {
+		return 0, err
+	}
+
+	delta := ratingChange(winnerRating, loserRating)
+	_, err = tx.Exec("UPDATE account SET rating = rating + ?, wins = wins + 1 WHERE id = ?", delta, winner)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("UPDATE account SET rating = rating - ?, losses = losses + 1 WHERE id = ?", delta, loser)
+	if err != nil {
+		return 0, err
+	}
+	return delta, tx.Commit()
+}
+
+// leaderboard returns the highest rated accounts which have completed at least
+// one rated match.
+func leaderboard(count int) ([]bgammon.LeaderboardEntry, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT username, rating, wins, losses FROM account WHERE wins + losses > 0 ORDER BY rating DESC LIMIT ?", count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []bgammon.LeaderboardEntry
+	for rows.Next() {
+		e := bgammon.LeaderboardEntry{}
+		err = rows.Scan(&e.Name, &e.Rating, &e.Wins, &e.Losses)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// recordMatch stores the result of a completed match and the seed of the dice
+// rolled in the match. Guest players are recorded with an account ID of 0.
+func recordMatch(g *bgammon.Game, account1 int, account2 int, seed int64) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("INSERT INTO matches (started, ended, account1, account2, player1, player2, points, score1, score2, winner, wintype, nogammon, seed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", g.Started.Unix(), g.Ended.Unix(), account1, account2, g.Player1.Name, g.Player2.Name, g.Points, g.Player1.Points, g.Player2.Points, g.Winner, g.WinType, g.NoGammons, seed)
+	return err
+}
+
+// matchHistory returns the most recently completed matches of an account,
+// skipping the provided number of matches.
+func matchHistory(account int, offset int) ([]bgammon.HistoryMatch, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT id, started, ended, player1, player2, points, score1, score2, winner, wintype, nogammon, seed FROM matches WHERE account1 = ? OR account2 = ? ORDER BY ended DESC, id DESC LIMIT ? OFFSET ?", account, account, historyPageSize, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []bgammon.HistoryMatch
+	for rows.Next() {
+		m := bgammon.HistoryMatch{}
+		err = rows.Scan(&m.ID, &m.Started, &m.Ended, &m.Player1, &m.Player2, &m.Points, &m.Score1, &m.Score2, &m.Winner, &m.WinType, &m.NoGammons, &m.Seed)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// recordDice adds dice rolled by a player to the histogram of the values
+// rolled by their account.
+func recordDice(account int, rolls ...int) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	var counts [6]int
+	for _, roll := range rolls {
+		counts[roll-1]++
+	}
+	_, err := db.Exec("UPDATE account SET dice1 = dice1 + ?, dice2 = dice2 + ?, dice3 = dice3 + ?, dice4 = dice4 + ?, dice5 = dice5 + ?, dice6 = dice6 + ? WHERE id = ?", counts[0], counts[1], counts[2], counts[3], counts[4], counts[5], account)
+	return err
+}
+
+// playerStats returns the statistics of the account with the provided
+// username. The histogram of dice rolled is only included when private is
+// true, and statistics the player has hidden from other players are only
+// returned when private is true. Statistics are computed from the account and
+// the indexed matches of the account.
+func playerStats(username string, private bool) (*bgammon.EventStats, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	var id int
+	var dice [6]int
+	var buf string
+	ev := &bgammon.EventStats{}
+	err := db.QueryRow("SELECT id, username, rating, wins, losses, dice1, dice2, dice3, dice4, dice5, dice6, settings FROM account WHERE username = ?", username).Scan(&id, &ev.Name, &ev.Rating, &ev.Wins, &ev.Losses, &dice[0], &dice[1], &dice[2], &dice[3], &dice[4], &dice[5], &buf)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownAccount
+	} else if err != nil {
+		return nil, err
+	}
+	if private {
+		ev.Dice = dice[:]
+	} else {
+		settings, err := parseSettings(buf)
+		if err != nil {
+			return nil, err
+		} else if settings.Private {
+			return nil, errPrivateStats
+		}
+	}
+
+	var opponentRating float64
+	err = db.QueryRow(`SELECT
+	COUNT(*),
+	COALESCE(SUM(CASE WHEN ((account1 = ? AND winner = 1) OR (account2 = ? AND winner = 2)) AND wintype > 1 THEN 1 ELSE 0 END), 0),
+	COALESCE(SUM(CASE WHEN ((account1 = ? AND winner = 2) OR (account2 = ? AND winner = 1)) AND wintype > 1 THEN 1 ELSE 0 END), 0),
+	COALESCE(AVG(opponent.rating), 0)
+FROM matches LEFT JOIN account opponent ON opponent.id = CASE WHEN account1 = ? THEN account2 ELSE account1 END
+WHERE account1 = ? OR account2 = ?`, id, id, id, id, id, id, id).Scan(&ev.Matches, &ev.GammonsWon, &ev.GammonsLost, &opponentRating)
+	if err != nil {
+		return nil, err
+	}
+	ev.OpponentRating = int(opponentRating + 0.5)
+	return ev, nil
+}
+
+// playerProfile returns the public profile of the account with the provided
+// username. The rank and match statistics of players who have hidden their
+// statistics are only returned when self is true. The status of the player is
+// not included, as it is not stored.
+func playerProfile(username string, self bool) (*bgammon.EventProfile, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	var id int
+	var buf string
+	ev := &bgammon.EventProfile{
+		Registered: true,
+	}
+	err := db.QueryRow("SELECT id, username, created, rating, wins, losses, settings FROM account WHERE username = ?", username).Scan(&id, &ev.Name, &ev.Joined, &ev.Rating, &ev.Wins, &ev.Losses, &buf)
+	if err == sql.ErrNoRows {
+		return nil, errUnknownAccount
+	} else if err != nil {
+		return nil, err
+	}
+	settings, err := parseSettings(buf)
+	if err != nil {
+		return nil, err
+	}
+	ev.Private = settings.Private
+	if ev.Private && !self {
+		ev.Wins, ev.Losses = 0, 0
+		return ev, nil
+	}
+
+	if ev.Wins+ev.Losses > 0 {
+		err = db.QueryRow("SELECT COUNT(*) + 1 FROM account WHERE wins + losses > 0 AND rating > ?", ev.Rating).Scan(&ev.Rank)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = db.QueryRow("SELECT COUNT(*) FROM matches WHERE account1 = ? OR account2 = ?", id, id).Scan(&ev.Matches)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// mutedPlayers returns the usernames of the players muted by an account.
+func mutedPlayers(account int) ([]string, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT username FROM mute WHERE account = ? ORDER BY username", account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// mutePlayer adds a player to the muted players of an account.
+func mutePlayer(account int, username string) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("INSERT OR IGNORE INTO mute (account, username) VALUES (?, ?)", account, username)
+	return err
+}
+
+// unmutePlayer removes a player from the muted players of an account.
+func unmutePlayer(account int, username string) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("DELETE FROM mute WHERE account = ? AND username = ?", account, username)
+	return err
+}
+
+// friends returns the usernames of the friends of an account.
+func friends(account int) ([]string, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT username FROM friend WHERE account = ? ORDER BY username", account)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// addFriend adds a registered player to the friends of an account. The
+// username of the player is returned as it was registered.
+func addFriend(account int, username string) (string, error) {
+	if db == nil {
+		return "", errAccountsDisabled
+	}
+
+	var registered string
+	err := db.QueryRow("SELECT username FROM account WHERE username = ?", username).Scan(&registered)
+	if err == sql.ErrNoRows {
+		return "", errUnknownAccount
+	} else if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec("INSERT OR IGNORE INTO friend (account, username) VALUES (?, ?)", account, registered)
+	return registered, err
+}
+
+// removeFriend removes a player from the friends of an account.
+func removeFriend(account int, username string) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("DELETE FROM friend WHERE account = ? AND username = ?", account, username)
+	return err
+}
+
+// activeBans returns all bans which have not expired.
+func activeBans() ([]*ban, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT username, address, expires, moderator FROM ban WHERE expires = 0 OR expires > ?", time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bans []*ban
+	for rows.Next() {
+		b := &ban{}
+		err = rows.Scan(&b.username, &b.address, &b.expires, &b.moderator)
+		if err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// storeBan stores a ban.
+func storeBan(b *ban) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("INSERT INTO ban (username, address, expires, moderator, created) VALUES (?, ?, ?, ?, ?)", b.username, b.address, b.expires, b.moderator, time.Now().Unix())
+	return err
+}
+
+// deleteBans deletes all bans of a username.
+func deleteBans(username string) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("DELETE FROM ban WHERE username = ?", username)
+	return err
+}
+
+// storeResumableMatch stores the state of a match which was interrupted by the
+// server shutting down.
+func storeResumableMatch(m *resumableMatch, state []byte) error {
+	if db == nil {
+		return errAccountsDisabled
+	}
+
+	_, err := db.Exec("INSERT INTO resumable (account1, account2, player1, player2, state, saved) VALUES (?, ?, ?, ?, ?, ?)", m.account1, m.account2, m.player1, m.player2, string(state), m.saved)
+	return err
+}
+
+// resumableMatches returns the interrupted matches of an account which have
+// not expired. The state of the matches is not returned.
+func resumableMatches(account int) ([]*resumableMatch, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	rows, err := db.Query("SELECT id, account1, account2, player1, player2, saved FROM resumable WHERE (account1 = ? OR account2 = ?) AND saved > ? ORDER BY saved DESC, id DESC", account, account, time.Now().Add(-resumeTTL).Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []*resumableMatch
+	for rows.Next() {
+		m := &resumableMatch{}
+		err = rows.Scan(&m.id, &m.account1, &m.account2, &m.player1, &m.player2, &m.saved)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// takeResumableMatch deletes the interrupted match with the provided ID and
+// returns its state, so that the match may only be resumed once.
+func takeResumableMatch(id int) ([]byte, error) {
+	if db == nil {
+		return nil, errAccountsDisabled
+	}
+
+	var state string
+	err := db.QueryRow("SELECT state FROM resumable WHERE id = ?", id).Scan(&state)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("DELETE FROM resumable WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(state), nil
+}
+
+// purgeResumableMatches deletes interrupted matches which have expired and
+// returns the number of interrupted matches which may still be resumed.
+func purgeResumableMatches() (int, error) {
+	if db == nil {
+		return 0, errAccountsDisabled
+	}
+
+	_, err := db.Exec("DELETE FROM resumable WHERE saved <= ?", time.Now().Add(-resumeTTL).Unix())
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM resumable").Scan(&count)
+	return count, err
+}
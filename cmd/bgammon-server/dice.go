@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// chiSquaredCritical is the chi-squared value above which a distribution of
+// six faces (five degrees of freedom) is considered not uniform at a
+// significance level of 5%.
+const chiSquaredCritical = 11.07
+
+// diceAuditInterval is how often the distribution of all dice rolled by the
+// server is logged. The distribution is not logged when zero.
+var diceAuditInterval = 24 * time.Hour
+
+// diceAudit is the distribution of all dice rolled by the server since it
+// started, which is logged periodically as evidence that dice are rolled
+// uniformly. The counters may be updated from any goroutine.
+type diceAudit struct {
+	faces   [6]atomic.Int64 // Number of times each value from 1 to 6 was rolled.
+	rolls   atomic.Int64    // Number of rolls of two dice.
+	doubles atomic.Int64    // Number of rolls of two dice which were doubles.
+}
+
+var audit = &diceAudit{}
+
+// record adds dice rolled in a match to the distribution. Single dice rolled
+// for the first turn are only counted as faces.
+func (a *diceAudit) record(rolls ...int) {
+	for _, roll := range rolls {
+		a.faces[roll-1].Add(1)
+	}
+	if len(rolls) == 2 {
+		a.rolls.Add(1)
+		if rolls[0] == rolls[1] {
+			a.doubles.Add(1)
+		}
+	}
+}
+
+// distribution returns the number of times each value was rolled and the
+// total number of dice rolled.
+func (a *diceAudit) distribution() ([6]int, int) {
+	var faces [6]int
+	var total int
+	for i := range a.faces {
+		faces[i] = int(a.faces[i].Load())
+		total += faces[i]
+	}
+	return faces, total
+}
+
+// summary returns a summary of the distribution, which is compared with a
+// uniform distribution using Pearson's chi-squared test.
+func (a *diceAudit) summary() string {
+	faces, total := a.distribution()
+	if total == 0 {
+		return "Dice audit: no dice rolled"
+	}
+	rolls, doubles := a.rolls.Load(), a.doubles.Load()
+	var doublesPercent float64
+	if rolls > 0 {
+		doublesPercent = float64(doubles) / float64(rolls) * 100
+	}
+	x := chiSquared(faces, total)
+	uniform := "uniform"
+	if x > chiSquaredCritical {
+		uniform = "not uniform"
+	}
+	return fmt.Sprintf("Dice audit: %d dice rolled, faces: %v, doubles: %d of %d rolls (%.1f%%, expected 16.7%%), chi-squared: %.2f (%s)", total, faces, doubles, rolls, doublesPercent, x, uniform)
+}
+
+// handleDiceAudit periodically logs the distribution of all dice rolled.
+func (s *server) handleDiceAudit() {
+	if diceAuditInterval == 0 {
+		return
+	}
+	t := time.NewTicker(diceAuditInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		infof("%s", audit.summary())
+	}
+}
+
+// chiSquared returns the chi-squared statistic of the distribution of the
+// provided number of dice compared with a uniform distribution.
+func chiSquared(faces [6]int, dice int) float64 {
+	expected := float64(dice) / 6
+	var x float64
+	for _, count := range faces {
+		diff := float64(count) - expected
+		x += diff * diff / expected
+	}
+	return x
+}
+
+// diceSource generates dice rolls from a seed. Rolls are derived from the
+// seed using HMAC-SHA256, so they may not be predicted without knowing the
+// seed, while a match may be replayed using the same seed.
+//
+// Each die is rolled from its own byte of the HMAC output, so the two dice of
+// a roll are independent and uniformly distributed. Nothing about previous
+// rolls, such as a streak of doubles, affects the next roll.
+//
+// When balanced, rolls are instead drawn without replacement from a shuffled
+// deck of all 36 combinations of two dice. Every combination is rolled once
+// before the deck is shuffled again, which evens out the distribution of
+// rolls within a game at the cost of rolls no longer being independent.
+type diceSource struct {
+	seed     int64
+	key      []byte
+	counter  uint64
+	buf      []byte
+	balanced bool
+	deck     [][2]int // Remaining combinations when balanced.
+}
+
+func newDiceSource(seed int64) *diceSource {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seed))
+	return &diceSource{
+		seed: seed,
+		key:  key,
+	}
+}
+
+// diceState is the state of a dice source, which is stored when a match is
+// interrupted so that the same dice are rolled after it is resumed.
+type diceState struct {
+	Seed     int64
+	Counter  uint64
+	Buf      []byte
+	Balanced bool
+	Deck     [][2]int
+}
+
+// state returns the state of the dice source.
+func (d *diceSource) state() diceState {
+	return diceState{
+		Seed:     d.seed,
+		Counter:  d.counter,
+		Buf:      d.buf,
+		Balanced: d.balanced,
+		Deck:     d.deck,
+	}
+}
+
+// restoreDiceSource returns a dice source which continues rolling from the
+// provided state.
+func restoreDiceSource(state diceState) *diceSource {
+	d := newDiceSource(state.Seed)
+	d.counter = state.Counter
+	d.buf = state.Buf
+	d.balanced = state.Balanced
+	d.deck = state.Deck
+	return d
+}
+
+// randomSeed returns a seed generated using cryptographic randomness.
+func randomSeed() int64 {
+	i, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		panic(err)
+	}
+	return i.Int64()
+}
+
+// roll returns a dice roll between 1 and 6.
+func (d *diceSource) roll() int {
+	return d.intn(6) + 1
+}
+
+// rollPair returns a roll of two dice.
+func (d *diceSource) rollPair() (int, int) {
+	if !d.balanced {
+		return d.roll(), d.roll()
+	}
+
+	if len(d.deck) == 0 {
+		d.deck = make([][2]int, 0, 36)
+		for roll1 := 1; roll1 <= 6; roll1++ {
+			for roll2 := 1; roll2 <= 6; roll2++ {
+				d.deck = append(d.deck, [2]int{roll1, roll2})
+			}
+		}
+		// Fisher-Yates shuffle.
+		for i := len(d.deck) - 1; i > 0; i-- {
+			j := d.intn(i + 1)
+			d.deck[i], d.deck[j] = d.deck[j], d.deck[i]
+		}
+	}
+
+	pair := d.deck[len(d.deck)-1]
+	d.deck = d.deck[:len(d.deck)-1]
+	return pair[0], pair[1]
+}
+
+// intn returns a number between 0 and n-1. n must be between 1 and 256.
+func (d *diceSource) intn(n int) int {
+	// Values which would bias the result are discarded.
+	limit := 256 - 256%n
+	for {
+		if len(d.buf) == 0 {
+			counter := make([]byte, 8)
+			binary.BigEndian.PutUint64(counter, d.counter)
+			d.counter++
+
+			mac := hmac.New(sha256.New, d.key)
+			mac.Write(counter)
+			d.buf = mac.Sum(nil)
+		}
+
+		b := int(d.buf[0])
+		d.buf = d.buf[1:]
+		if b < limit {
+			return b % n
+		}
+	}
+}
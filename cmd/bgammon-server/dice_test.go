@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pairsChiSquaredCritical is the chi-squared value above which a distribution
+// of the 36 combinations of two dice (35 degrees of freedom) is considered not
+// uniform at a significance level of 5%.
+const pairsChiSquaredCritical = 49.80
+
+func TestChiSquared(t *testing.T) {
+	for _, test := range []struct {
+		faces    [6]int
+		expected float64
+	}{
+		{[6]int{10, 10, 10, 10, 10, 10}, 0},
+		{[6]int{6, 0, 0, 0, 0, 0}, 30},
+		{[6]int{2, 0, 1, 1, 1, 1}, 2},
+	} {
+		var dice int
+		for _, count := range test.faces {
+			dice += count
+		}
+		if x := chiSquared(test.faces, dice); x != test.expected {
+			t.Errorf("chi-squared of %v is %f, expected %f", test.faces, x, test.expected)
+		}
+	}
+}
+
+func TestDiceUniform(t *testing.T) {
+	const rolls = 36000
+	for _, balanced := range []bool{false, true} {
+		for seed := int64(1); seed <= 5; seed++ {
+			d := newDiceSource(seed)
+			d.balanced = balanced
+
+			var faces [6]int
+			var pairs [36]int
+			for i := 0; i < rolls; i++ {
+				roll1, roll2 := d.rollPair()
+				if roll1 < 1 || roll1 > 6 || roll2 < 1 || roll2 > 6 {
+					t.Fatalf("balanced %t, seed %d: rolled %d-%d", balanced, seed, roll1, roll2)
+				}
+				faces[roll1-1]++
+				faces[roll2-1]++
+				pairs[(roll1-1)*6+roll2-1]++
+			}
+
+			if x := chiSquared(faces, rolls*2); x > chiSquaredCritical {
+				t.Errorf("balanced %t, seed %d: faces %v are not uniform (chi-squared %.2f)", balanced, seed, faces, x)
+			}
+
+			// Each combination of two dice is equally likely, so the second
+			// die does not depend on the first.
+			expected := float64(rolls) / 36
+			var x float64
+			for _, count := range pairs {
+				diff := float64(count) - expected
+				x += diff * diff / expected
+			}
+			if x > pairsChiSquaredCritical {
+				t.Errorf("balanced %t, seed %d: combinations %v are not uniform (chi-squared %.2f)", balanced, seed, pairs, x)
+			}
+		}
+	}
+}
+
+func TestDiceBalanced(t *testing.T) {
+	d := newDiceSource(1)
+	d.balanced = true
+	for deck := 0; deck < 10; deck++ {
+		var pairs [36]int
+		for i := 0; i < 36; i++ {
+			roll1, roll2 := d.rollPair()
+			pairs[(roll1-1)*6+roll2-1]++
+		}
+		for i, count := range pairs {
+			if count != 1 {
+				t.Fatalf("deck %d: rolled %d-%d %d times, expected once", deck, i/6+1, i%6+1, count)
+			}
+		}
+	}
+}
+
+func TestDiceSeed(t *testing.T) {
+	for _, balanced := range []bool{false, true} {
+		roll := func(d *diceSource, n int) [][2]int {
+			var rolls [][2]int
+			for i := 0; i < n; i++ {
+				roll1, roll2 := d.rollPair()
+				rolls = append(rolls, [2]int{roll1, roll2})
+			}
+			return rolls
+		}
+
+		d1, d2 := newDiceSource(42), newDiceSource(42)
+		d1.balanced, d2.balanced = balanced, balanced
+		rolls := roll(d1, 50)
+		if other := roll(d2, 50); !reflect.DeepEqual(rolls, other) {
+			t.Fatalf("balanced %t: rolled %v and %v with the same seed", balanced, rolls, other)
+		}
+
+		// A restored source continues rolling where it left off.
+		restored := restoreDiceSource(d1.state())
+		if next, other := roll(d1, 50), roll(restored, 50); !reflect.DeepEqual(next, other) {
+			t.Errorf("balanced %t: rolled %v after restoring, expected %v", balanced, other, next)
+		}
+	}
+}
+
+func TestDiceAudit(t *testing.T) {
+	a := &diceAudit{}
+	if summary := a.summary(); summary != "Dice audit: no dice rolled" {
+		t.Errorf("summary %q without dice rolled", summary)
+	}
+
+	// Dice are recorded from many matches at once.
+	const (
+		workers = 8
+		rolls   = 720 // Every combination is recorded the same number of times.
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rolls; j++ {
+				roll1, roll2 := j%6+1, (j/6)%6+1
+				a.record(roll1, roll2)
+				a.record(roll1) // Rolled for the first turn.
+			}
+		}()
+	}
+	wg.Wait()
+
+	faces, total := a.distribution()
+	var sum int
+	for i, count := range faces {
+		sum += count
+		if count != workers*rolls*3/6 {
+			t.Errorf("rolled %d %d times, expected %d", i+1, count, workers*rolls*3/6)
+		}
+	}
+	if sum != total || total != workers*rolls*3 {
+		t.Errorf("faces sum to %d of %d dice, expected %d", sum, total, workers*rolls*3)
+	}
+	if n := a.rolls.Load(); n != workers*rolls {
+		t.Errorf("%d rolls of two dice, expected %d", n, workers*rolls)
+	}
+	if n := a.doubles.Load(); n != workers*rolls/6 {
+		t.Errorf("%d doubles, expected %d", n, workers*rolls/6)
+	}
+	if summary := a.summary(); !strings.Contains(summary, "17280 dice rolled") || !strings.Contains(summary, "doubles: 960 of 5760 rolls") || !strings.Contains(summary, "(uniform)") {
+		t.Errorf("unexpected summary %q", summary)
+	}
+}
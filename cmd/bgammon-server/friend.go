@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// notifyFriends notifies the connected players who added the provided client
+// as a friend that the client logged in. Friends are followed one way, so the
+// client is not notified in return.
+func (s *server) notifyFriends(c *serverClient) {
+	if c.account <= 0 {
+		return
+	}
+	lower := strings.ToLower(string(c.name))
+
+	s.clientsLock.Lock()
+	var notify []*serverClient
+	for _, sc := range s.clients {
+		if sc != c && sc.friends[lower] != "" {
+			notify = append(notify, sc)
+		}
+	}
+	s.clientsLock.Unlock()
+
+	for _, sc := range notify {
+		ev := &bgammon.EventFriendOnline{}
+		ev.Player = string(c.name)
+		sc.sendEvent(ev)
+	}
+}
+
+func (s *server) handleFriend(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	sendUsage := func() {
+		cmd.client.sendNotice("To add a friend, send 'friend add <username>'. To remove a friend, send 'friend remove <username>'. To list your friends, send 'friend list'.")
+	}
+	if len(params) == 0 {
+		sendUsage()
+		return
+	} else if cmd.client.account <= 0 {
+		cmd.client.sendNotice("Only registered players may have friends.")
+		return
+	}
+
+	switch strings.ToLower(string(params[0])) {
+	case "add":
+		if len(params) != 2 {
+			sendUsage()
+			return
+		} else if bytes.EqualFold(params[1], cmd.client.name) {
+			cmd.client.sendNotice("You may not add yourself as a friend.")
+			return
+		}
+		username, err := addFriend(cmd.client.account, string(params[1]))
+		if err == errUnknownAccount {
+			cmd.client.sendNotice(fmt.Sprintf("Failed to add friend: %s.", err))
+			return
+		} else if err != nil {
+			errorf("failed to add friend of %s: %s", cmd.client.name, err)
+			cmd.client.sendNotice("Failed to add friend. Please try again later.")
+			return
+		}
+		if cmd.client.friends == nil {
+			cmd.client.friends = make(map[string]string)
+		}
+		cmd.client.friends[strings.ToLower(username)] = username
+		cmd.client.sendNotice(fmt.Sprintf("Added %s as a friend. You will be notified when %s logs in.", username, username))
+	case "remove":
+		if len(params) != 2 {
+			sendUsage()
+			return
+		}
+		lower := strings.ToLower(string(params[1]))
+		username := cmd.client.friends[lower]
+		if username == "" {
+			cmd.client.sendNotice(fmt.Sprintf("%s is not your friend.", params[1]))
+			return
+		}
+		delete(cmd.client.friends, lower)
+		err := removeFriend(cmd.client.account, username)
+		if err != nil {
+			errorf("failed to remove friend of %s: %s", cmd.client.name, err)
+		}
+		cmd.client.sendNotice(fmt.Sprintf("Removed %s from your friends.", username))
+	case "list":
+		if len(cmd.client.friends) == 0 {
+			cmd.client.sendNotice("You have not added any friends.")
+			return
+		}
+		friends := make([]string, 0, len(cmd.client.friends))
+		s.clientsLock.Lock()
+		for _, username := range cmd.client.friends {
+			if sc := s.clientByUsername([]byte(username)); sc != nil && sc.account > 0 {
+				username += " (online)"
+			}
+			friends = append(friends, username)
+		}
+		s.clientsLock.Unlock()
+		sort.Slice(friends, func(i, j int) bool {
+			return strings.ToLower(friends[i]) < strings.ToLower(friends[j])
+		})
+		cmd.client.sendNotice(fmt.Sprintf("Friends: %s", strings.Join(friends, ", ")))
+	default:
+		sendUsage()
+	}
+}
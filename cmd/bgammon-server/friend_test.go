@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// expectNoFriendOnline sends the friend list command and fails the test when
+// the client is notified that a friend logged in before the list is received.
+func expectNoFriendOnline(t *testing.T, c *memoryClient, list string) {
+	t.Helper()
+	c.send("friend list")
+	ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+		switch ev := ev.(type) {
+		case *bgammon.EventFriendOnline:
+			return true
+		case *bgammon.EventNotice:
+			return ev.Message == list
+		}
+		return false
+	})
+	if !ok {
+		t.Fatalf("client %s did not receive %q", c.name(), list)
+	} else if online, ok := ev.(*bgammon.EventFriendOnline); ok {
+		t.Fatalf("client %s was notified that %s logged in", c.name(), online.Player)
+	}
+}
+
+func TestFriends(t *testing.T) {
+	newTestDatabase(t)
+	s := newTestServer(t)
+
+	guest := loginClient(t, s, "carol")
+	guest.send("friend add alice")
+	expectNotice(t, guest, "Only registered players may have friends.")
+
+	alice, bob := registerClient(t, s, "alice"), registerClient(t, s, "bob")
+	for _, test := range []struct {
+		command string
+		notice  string
+	}{
+		{"friend list", "You have not added any friends."},
+		{"friend add ALICE", "You may not add yourself as a friend."},
+		{"friend add carol", "Failed to add friend: " + errUnknownAccount.Error() + "."},
+		{"friend remove bob", "bob is not your friend."},
+		{"friend add BOB", "Added bob as a friend. You will be notified when bob logs in."},
+		{"friend list", "Friends: bob (online)"},
+	} {
+		alice.send(test.command)
+		expectNotice(t, alice, test.notice)
+	}
+
+	login := func(username string) *memoryClient {
+		t.Helper()
+		c := s.connectMemoryClient()
+		t.Cleanup(func() {
+			c.send(bgammon.CommandDisconnect)
+		})
+		c.send("loginjson test " + username + " secret")
+		expectEvent[*bgammon.EventWelcome](t, c)
+		return c
+	}
+
+	// Friends are followed one way, and are kept after logging out.
+	disconnect(t, s, bob)
+	expectNoFriendOnline(t, alice, "Friends: bob")
+	disconnect(t, s, alice)
+	alice = login("alice")
+	expectNoFriendOnline(t, alice, "Friends: bob")
+	bob = login("bob")
+	if ev := expectEvent[*bgammon.EventFriendOnline](t, alice); ev.Player != "bob" {
+		t.Errorf("notified that %s logged in, expected bob", ev.Player)
+	}
+	expectNoFriendOnline(t, bob, "You have not added any friends.")
+
+	// Removed friends are no longer followed.
+	alice.send("friend remove Bob")
+	expectNotice(t, alice, "Removed bob from your friends.")
+	disconnect(t, s, bob)
+	bob = login("bob")
+	expectNoFriendOnline(t, bob, "You have not added any friends.")
+	expectNoFriendOnline(t, alice, "You have not added any friends.")
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"code.rocket9labs.com/tslocum/bgammon"
@@ -16,24 +20,144 @@ type serverGame struct {
 	password   []byte
 	client1    *serverClient
 	client2    *serverClient
+	spectators []*serverClient
 	allowed1   []byte
 	allowed2   []byte
 	rematch    int
 	rejoin1    bool
 	rejoin2    bool
+
+	disconnected1 *disconnectedClient // Player 1 while they are reconnecting.
+	disconnected2 *disconnectedClient // Player 2 while they are reconnecting.
+
+	crawfordPlayed bool // Whether the Crawford game has been played.
+
+	rematchContinue bool // Whether the rematch offered continues the match, rather than starting a new match.
+
+	// hideSpectators is whether spectators are hidden from the players.
+	// Spectators are not counted when the match is listed, and their chat
+	// messages are sent as anonymousSpectator.
+	hideSpectators bool
+
+	// length is the number of points the match was originally played to, or
+	// zero when the match has not been continued. A continued match is
+	// played to this many more points than the match it continues.
+	length int
+
+	// AutoDouble is the highest value the doubling cube is turned to
+	// automatically when the players tie while rolling for the first turn,
+	// or zero when automatic doubles are disabled. Like the Jacoby rule,
+	// automatic doubles only apply to single games.
+	AutoDouble int
+
+	clockPlayer  int       // Player whose clock was running when the clocks were last updated.
+	clockUpdated time.Time // When the clocks were last updated.
+	clockWarned  int       // Lowest number of seconds remaining the player whose clock is running was warned of, or zero.
+
+	idlePlayer int       // Player whose inactivity timer is running.
+	idleSince  time.Time // When the inactivity timer started running.
+	idleWarned bool      // Whether the players were warned the inactivity timer is about to expire.
+
+	dice *diceSource // Source of all dice rolled in the match.
+
+	transcript *bgammon.Transcript // Record of the games played in the match.
+
+	chat []*bgammon.EventSay // Recent chat messages, oldest first.
+
+	left time.Time // When a player last left the match while it was in progress.
+
+	// lock is held while a command sent by a player or spectator is handled,
+	// and while a client is added to or removed from the match. The list of
+	// matches is also locked while clients are added or removed, as the match
+	// a client is in is looked up while only the list is locked.
+	lock sync.Mutex
+
+	creator   []byte // Username of the player who created the match, or nil for rematches.
+	cancelled bool   // Whether the creator cancelled the match before another player joined.
+
+	puzzle       string // GNU Backgammon Position ID the first game begins from, or empty when the match is not a puzzle.
+	puzzleRoll   [2]int // Dice rolled for the first turn of the puzzle.
+	puzzleJoiner bool   // Whether the player who joins the puzzle is on roll, rather than the player who created it.
+
+	setUp       bool   // Whether a position was set up during the match, after which the match is not rated.
+	setUpPlayer int    // Player who asked to set up a position, or zero.
+	setUpID     string // GNU Backgammon Position ID the player asked to set up.
+
+	// legalKey identifies the state of the game the legal moves and
+	// playable rolls were found in. See legal.
+	legalKey      string
+	legalMoves    [][]int
+	playableRolls []int
+
 	*bgammon.Game
 }
 
+// anonymousSpectator is the name chat messages sent by spectators are sent as
+// when spectators are hidden. Players may not register this username.
+const anonymousSpectator = "Spectator"
+
+// chatHistorySize is the number of recent chat messages in each match which
+// are sent to spectators and players when they join the match. Chat history
+// is not kept when zero.
+var chatHistorySize = 20
+
+// maxAutoDouble is the highest value the doubling cube may be turned to by
+// automatic doubles.
+const maxAutoDouble = 64
+
+// reconnectGracePeriod is how long the seat of a player who lost their
+// connection during a match is reserved for them.
+const reconnectGracePeriod = 2 * time.Minute
+
+// pauseGracePeriod is how long a match in progress is kept after both players
+// have left, so that either player may rejoin it.
+const pauseGracePeriod = 2 * time.Minute
+
+// disconnectedClient is a player who lost their connection during a match.
+type disconnectedClient struct {
+	client *serverClient
+	time   time.Time
+}
+
 func newServerGame(id int) *serverGame {
+	metrics.gamesCreated.Add(1)
+
 	now := time.Now().Unix()
 	return &serverGame{
 		id:         id,
 		created:    now,
 		lastActive: now,
+		dice:       newDiceSource(randomSeed()),
 		Game:       bgammon.NewGame(),
 	}
 }
 
+// turnPhase is the phase of the turn of the player whose turn it is. Players
+// may only double before rolling, and may only move after rolling.
+type turnPhase int
+
+const (
+	phaseOpening turnPhase = iota // The players are rolling for the first turn.
+	phasePreRoll                  // The player may double or roll.
+	phaseDoubled                  // The player offered a double, which their opponent has not answered.
+	phaseMoving                   // The player rolled and is moving their checkers.
+)
+
+// phase returns the phase of the current turn. The phase is derived from the
+// state of the game, so that it is never out of sync with the board.
+func (g *serverGame) phase() turnPhase {
+	switch {
+	case g.Turn == 0:
+		return phaseOpening
+	case g.DoubleOffered:
+		return phaseDoubled
+	case g.Roll1 == 0 && g.Roll2 == 0:
+		return phasePreRoll
+	default:
+		return phaseMoving
+	}
+}
+
 func (g *serverGame) roll(player int) bool {
 	if g.client1 == nil || g.client2 == nil || g.Winner != 0 {
 		return false
@@ -44,12 +168,14 @@ func (g *serverGame) roll(player int) bool {
 			if g.Roll1 != 0 {
 				return false
 			}
-			g.Roll1 = randInt(6) + 1
+			g.Roll1 = g.dice.roll()
+			g.recordDice(player, g.Roll1)
 		} else {
 			if g.Roll2 != 0 {
 				return false
 			}
-			g.Roll2 = randInt(6) + 1
+			g.Roll2 = g.dice.roll()
+			g.recordDice(player, g.Roll2)
 		}
 
 		if g.Started.IsZero() {
@@ -61,52 +187,136 @@ func (g *serverGame) roll(player int) bool {
 			g.allowed1, g.allowed2 = g.client1.name, g.client2.name
 		}
 		return true
-	} else if player != g.Turn || g.Roll1 != 0 || g.Roll2 != 0 {
+	} else if player != g.Turn || g.phase() != phasePreRoll {
 		return false
 	}
 
-	g.Roll1 = randInt(6) + 1
-	g.Roll2 = randInt(6) + 1
+	g.Roll1, g.Roll2 = g.dice.rollPair()
+	g.recordDice(player, g.Roll1, g.Roll2)
+	g.Beavered = false
 	return true
 }
 
-func (g *serverGame) sendBoard(client *serverClient) {
-	if client.json {
-		ev := &bgammon.EventBoard{
-			GameState: bgammon.GameState{
-				Game:         g.Game,
-				PlayerNumber: client.playerNumber,
-				Available:    g.LegalMoves(false),
-			},
+// recordDice adds the dice rolled by a player to the dice audit and to the
+// histogram of the values rolled by their account. The histogram is updated
+// without blocking other commands.
+func (g *serverGame) recordDice(player int, rolls ...int) {
+	audit.record(rolls...)
+
+	client := g.playerClient(player)
+	if db == nil || client == nil || client.account <= 0 {
+		return
+	}
+	go func(account int) {
+		err := recordDice(account, rolls...)
+		if err != nil {
+			errorf("failed to record dice rolled by account %d: %s", account, err)
+		}
+	}(client.account)
+}
+
+// openingTie prompts both players to roll again after they rolled the same
+// number for the first turn. When automatic doubles are enabled, the doubling
+// cube is turned each time the opening roll is tied, until it reaches the limit.
+func (g *serverGame) openingTie(ev *bgammon.EventRolled) {
+	var autoDouble *bgammon.EventAutoDouble
+	message := fmt.Sprintf("Both players rolled %d. Roll again to determine who goes first.", ev.Roll1)
+	if g.AutoDouble != 0 && g.Points == 1 && g.DoubleValue*2 <= g.AutoDouble {
+		g.DoubleValue *= 2
+		autoDouble = &bgammon.EventAutoDouble{
+			Points: g.DoubleValue,
+		}
+		message = fmt.Sprintf("Both players rolled %d. The doubling cube has been turned automatically to %d. Roll again to determine who goes first.", ev.Roll1, g.DoubleValue)
+	}
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		if autoDouble != nil {
+			client.sendEvent(autoDouble)
 		}
+		client.sendNotice(message)
+		g.sendBoard(client)
+	})
+}
 
-		// Reverse spaces for white.
-		if client.playerNumber == 2 {
-			ev.GameState.Game = ev.GameState.Copy()
+// legal returns the legal moves and the playable dice rolls of the player
+// whose turn it is. They are only found once each time the state of the game
+// changes, rather than each time the board is sent to a client. The returned
+// slices must not be modified.
+func (g *serverGame) legal() ([][]int, []int) {
+	key := fmt.Sprintf("%s,%d,%d,%v", g.Checksum(), g.Winner, len(g.Moves), g.DiceRolls())
+	if key != g.legalKey {
+		g.legalKey = key
+		g.legalMoves = g.LegalMoves(false)
+		g.playableRolls = g.PlayableRolls()
+	}
+	return g.legalMoves, g.playableRolls
+}
 
-			// Flip board.
-			for space := 1; space <= 24; space++ {
-				ev.Board[space] = g.Game.Board[bgammon.FlipSpace(space, client.playerNumber)]
-			}
-			ev.Board[bgammon.SpaceHomePlayer], ev.Board[bgammon.SpaceHomeOpponent] = ev.Board[bgammon.SpaceHomeOpponent], ev.Board[bgammon.SpaceHomePlayer]
-			ev.Board[bgammon.SpaceBarPlayer], ev.Board[bgammon.SpaceBarOpponent] = ev.Board[bgammon.SpaceBarOpponent], ev.Board[bgammon.SpaceBarPlayer]
+// gameState returns the state of the game from the perspective of the
+// provided client.
+func (g *serverGame) gameState(client *serverClient) *bgammon.GameState {
+	legalMoves, playableRolls := g.legal()
+	var available [][]int
+	for _, move := range legalMoves {
+		available = append(available, []int{move[0], move[1]})
+	}
 
-			ev.Moves = bgammon.FlipMoves(g.Game.Moves, client.playerNumber)
+	gs := &bgammon.GameState{
+		Game:         g.Game,
+		PlayerNumber: client.playerNumber,
+		Available:    available,
+		Remaining:    append([]int(nil), playableRolls...),
+		Race:         g.IsRace(),
+	}
 
-			legalMoves := g.LegalMoves(false)
-			for i := range ev.GameState.Available {
-				ev.GameState.Available[i][0], ev.GameState.Available[i][1] = bgammon.FlipSpace(legalMoves[i][0], client.playerNumber), bgammon.FlipSpace(legalMoves[i][1], client.playerNumber)
-			}
+	// Reverse spaces for white.
+	perspective := client.perspective()
+	if perspective == 2 {
+		gs.Game = gs.Copy()
+
+		// Flip board.
+		for space := 1; space <= 24; space++ {
+			gs.Board[space] = g.Game.Board[bgammon.FlipSpace(space, perspective)]
 		}
+		gs.Board[bgammon.SpaceHomePlayer], gs.Board[bgammon.SpaceHomeOpponent] = gs.Board[bgammon.SpaceHomeOpponent], gs.Board[bgammon.SpaceHomePlayer]
+		gs.Board[bgammon.SpaceBarPlayer], gs.Board[bgammon.SpaceBarOpponent] = gs.Board[bgammon.SpaceBarOpponent], gs.Board[bgammon.SpaceBarPlayer]
 
-		// Sort available moves.
-		bgammon.SortMoves(ev.Available)
+		gs.Moves = bgammon.FlipMoves(g.Game.Moves, perspective)
+		for _, move := range gs.Available {
+			move[0], move[1] = bgammon.FlipSpace(move[0], perspective), bgammon.FlipSpace(move[1], perspective)
+		}
+	}
 
-		client.sendEvent(ev)
+	// Sort available moves.
+	bgammon.SortMoves(gs.Available)
+
+	// The checkers of the player whose perspective the board is shown
+	// from are counted as the player's checkers.
+	player, opponent := 1, 2
+	if perspective == 2 {
+		player, opponent = 2, 1
+	}
+	gs.PlayerBar = bgammon.PlayerCheckers(gs.Board[bgammon.SpaceBarPlayer], player)
+	gs.PlayerOff = bgammon.PlayerCheckers(gs.Board[bgammon.SpaceHomePlayer], player)
+	gs.OpponentBar = bgammon.PlayerCheckers(gs.Board[bgammon.SpaceBarOpponent], opponent)
+	gs.OpponentOff = bgammon.PlayerCheckers(gs.Board[bgammon.SpaceHomeOpponent], opponent)
+
+	gs.Checksum = gs.Game.Checksum()
+	return gs
+}
+
+func (g *serverGame) sendBoard(client *serverClient) {
+	g.updateClocks()
+	g.updateIdle()
+
+	if client.json {
+		client.sendEvent(&bgammon.EventBoard{
+			GameState: *g.gameState(client),
+		})
 		return
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(g.BoardState(client.playerNumber, false)))
+	scanner := bufio.NewScanner(bytes.NewReader(g.BoardState(client.perspective(), false)))
 	for scanner.Scan() {
 		client.sendNotice(string(scanner.Bytes()))
 	}
@@ -130,11 +340,79 @@ func (g *serverGame) eachClient(f func(client *serverClient)) {
 	if g.client2 != nil {
 		f(g.client2)
 	}
+	for _, spectator := range g.spectators {
+		f(spectator)
+	}
 }
 
-func (g *serverGame) addClient(client *serverClient) (bool, string) {
-	if g.allowed1 != nil && !bytes.Equal(client.name, g.allowed1) && !bytes.Equal(client.name, g.allowed2) {
-		return false, "Match has already started."
+// spectating returns whether the provided client is spectating the match.
+func (g *serverGame) spectating(client *serverClient) bool {
+	for _, spectator := range g.spectators {
+		if spectator == client {
+			return true
+		}
+	}
+	return false
+}
+
+// addSpectator adds the provided client to the match as a spectator.
+func (g *serverGame) addSpectator(client *serverClient) {
+	g.spectators = append(g.spectators, client)
+	client.playerNumber = 0
+	client.lobby.Store(false)
+	client.flipped = false
+
+	ev := &bgammon.EventJoined{
+		GameID:       g.id,
+		PlayerNumber: 0,
+	}
+	ev.Player = string(client.name)
+	client.sendEvent(ev)
+	g.sendBoard(client)
+	g.sendChatHistory(client)
+}
+
+// addChat adds a chat message to the chat history of the match. The oldest
+// message is discarded when the history is full.
+func (g *serverGame) addChat(ev *bgammon.EventSay) {
+	if chatHistorySize <= 0 {
+		return
+	}
+	if len(g.chat) >= chatHistorySize {
+		g.chat[0] = nil // Allow memory to be deallocated.
+		g.chat = g.chat[len(g.chat)-chatHistorySize+1:]
+	}
+	g.chat = append(g.chat, ev)
+}
+
+// sendChatHistory sends the recent chat messages of the match to the provided
+// client. Messages from players muted by the client are not sent.
+func (g *serverGame) sendChatHistory(client *serverClient) {
+	for _, ev := range g.chat {
+		if !client.mutes([]byte(ev.Player)) {
+			client.sendEvent(ev)
+		}
+	}
+}
+
+// addClient seats the provided client as a player in the match. It returns
+// the reason the client may not join the match, or nil when the client joined.
+func (g *serverGame) addClient(client *serverClient) *bgammon.EventFailedJoin {
+	if g.client1 == client || g.client2 == client {
+		return &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorAlreadyInMatch,
+			Reason: "You are already in this match.",
+		}
+	} else if g.allowed1 != nil && !bytes.Equal(client.name, g.allowed1) && !bytes.Equal(client.name, g.allowed2) {
+		return &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorMatchStarted,
+			Reason: "Match has already started.",
+		}
+	} else if g.client1 != nil && g.client2 != nil {
+		return &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorMatchFull,
+			Reason: "Match is full.",
+		}
 	}
 
 	var playerNumber int
@@ -143,6 +421,22 @@ func (g *serverGame) addClient(client *serverClient) (bool, string) {
 			return
 		}
 
+		if g.puzzle != "" && g.allowed1 == nil && g.client1 != nil && g.client2 != nil {
+			player := playerNumber
+			if !g.puzzleJoiner {
+				player = 3 - playerNumber
+			}
+			g.startPuzzle(player)
+		}
+
+		if playerNumber == 1 {
+			g.disconnected1 = nil
+		} else {
+			g.disconnected2 = nil
+		}
+		client.lobby.Store(false)
+		client.flipped = false
+
 		ev := &bgammon.EventJoined{
 			GameID:       g.id,
 			PlayerNumber: playerNumber,
@@ -151,6 +445,7 @@ func (g *serverGame) addClient(client *serverClient) (bool, string) {
 
 		client.sendEvent(ev)
 		g.sendBoard(client)
+		g.sendChatHistory(client)
 
 		opponent := g.opponent(client)
 		if opponent != nil {
@@ -163,50 +458,125 @@ func (g *serverGame) addClient(client *serverClient) (bool, string) {
 		} else {
 			g.rejoin2 = true
 		}
+
+		g.updateClocks()
 	}()
+	// Seats of players who lost their connection are reserved for them.
+	open1 := g.client1 == nil && !g.reserved(1, client)
+	open2 := g.client2 == nil && !g.reserved(2, client)
+	if open1 && g.disconnected1 != nil {
+		open2 = false
+	} else if open2 && g.disconnected2 != nil {
+		open1 = false
+	}
+
 	switch {
-	case g.client1 != nil && g.client2 != nil:
+	case !open1 && !open2:
 		// Do not assign player number.
-	case g.client1 != nil:
+	case !open1:
 		g.client2 = client
 		g.Player2.Name = string(client.name)
+		g.Player2.Rating = client.rating
 		client.playerNumber = 2
 		playerNumber = 2
-	case g.client2 != nil:
+	case !open2:
 		g.client1 = client
 		g.Player1.Name = string(client.name)
+		g.Player1.Rating = client.rating
 		client.playerNumber = 1
 		playerNumber = 1
 	default:
 		if randInt(2) == 0 {
 			g.client1 = client
 			g.Player1.Name = string(client.name)
+			g.Player1.Rating = client.rating
 			client.playerNumber = 1
 			playerNumber = 1
 		} else {
 			g.client2 = client
 			g.Player2.Name = string(client.name)
+			g.Player2.Rating = client.rating
 			client.playerNumber = 2
 			playerNumber = 2
 		}
 	}
 
-	ok := playerNumber != 0
-	var reason string
-	if !ok {
-		reason = "Match is full."
+	if playerNumber == 0 {
+		return &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorMatchFull,
+			Reason: "Match is full.",
+		}
 	}
-	return ok, reason
+	return nil
+}
+
+// validPuzzle returns an error when the provided GNU Backgammon Position ID
+// may not be used to create a puzzle.
+func validPuzzle(positionID string) error {
+	_, err := bgammon.ParsePositionID(positionID, 1)
+	return err
 }
 
-func (g *serverGame) removeClient(client *serverClient) {
+// startPuzzle sets up the position of the puzzle once both players have
+// joined. The provided player is on roll, and must move using the dice of the
+// puzzle. The players are not required to roll for the first turn.
+func (g *serverGame) startPuzzle(player int) {
+	board, err := bgammon.ParsePositionID(g.puzzle, player)
+	if err != nil {
+		errorf("failed to set up puzzle %s of match %d: %s", g.puzzle, g.id, err)
+		return
+	}
+	g.SetBoard(board)
+	g.Turn = player
+	g.Roll1, g.Roll2 = g.puzzleRoll[0], g.puzzleRoll[1]
+	g.Started = time.Now()
+	g.allowed1, g.allowed2 = g.client1.name, g.client2.name
+}
+
+// setState sets the player whose turn it is and the dice they rolled, skipping
+// the roll for the first turn when the game has not started. Pending moves and
+// double offers are cleared. The dice are not rolled when zero.
+func (g *serverGame) setState(turn int, roll1 int, roll2 int) {
+	g.SetBoard(g.Board) // Clear pending moves.
+	g.Turn = turn
+	g.Roll1, g.Roll2 = roll1, roll2
+	g.DoubleOffered = false
+	g.Beavered = false
+	if g.Started.IsZero() {
+		g.Started = time.Now()
+	}
+	if g.allowed1 == nil {
+		g.allowed1, g.allowed2 = g.client1.name, g.client2.name
+	}
+	g.updateClocks()
+}
+
+// removeClient removes the provided player or spectator from the match. The
+// players and spectators who remain are sent the reason the client left. The
+// event is only sent once, as the client is no longer in the match afterward.
+func (g *serverGame) removeClient(client *serverClient, reason string) {
+	for i, spectator := range g.spectators {
+		if spectator == client {
+			g.spectators = append(g.spectators[:i], g.spectators[i+1:]...)
+
+			ev := &bgammon.EventLeft{
+				Reason: reason,
+			}
+			ev.Player = string(client.name)
+			client.sendEvent(ev)
+			return
+		}
+	}
+
 	var playerNumber int
 	defer func() {
 		if playerNumber == 0 {
 			return
 		}
 
-		ev := &bgammon.EventLeft{}
+		ev := &bgammon.EventLeft{
+			Reason: reason,
+		}
 		ev.Player = string(client.name)
 
 		client.sendEvent(ev)
@@ -214,20 +584,38 @@ func (g *serverGame) removeClient(client *serverClient) {
 			g.sendBoard(client)
 		}
 
-		var opponent *serverClient
-		if playerNumber == 1 && g.client2 != nil {
-			opponent = g.client2
-		} else if playerNumber == 2 && g.client1 != nil {
-			opponent = g.client1
-		}
-		if opponent != nil {
-			opponent.sendEvent(ev)
-			if !opponent.json {
-				g.sendBoard(opponent)
+		g.eachClient(func(client *serverClient) {
+			client.sendEvent(ev)
+			if !client.json {
+				g.sendBoard(client)
 			}
-		}
+		})
 
 		client.playerNumber = 0
+
+		g.updateClocks()
+
+		// Keep the match so that the player may rejoin it. Matches against
+		// bots are not kept, as bots leave the server along with their
+		// opponent.
+		if _, bot := client.Client.(*botClient); bot {
+			g.left = time.Time{}
+		} else if g.allowed1 != nil && g.Winner == 0 {
+			g.left = time.Now()
+
+			if g.playerCount() != 0 {
+				g.eachClient(func(c *serverClient) {
+					c.sendNotice(fmt.Sprintf("Match paused: %s left the match. They may rejoin it within %d minutes.", client.name, int(pauseGracePeriod.Minutes())))
+				})
+			}
+		}
+
+		// Remove spectators when no players remain in the match.
+		if g.client1 == nil && g.client2 == nil && !g.reconnecting(1) && !g.reconnecting(2) {
+			for len(g.spectators) > 0 {
+				g.removeClient(g.spectators[0], bgammon.LeftReasonLeave)
+			}
+		}
 	}()
 	switch {
 	case g.client1 == client:
@@ -243,6 +631,12 @@ func (g *serverGame) removeClient(client *serverClient) {
 	}
 }
 
+// passwordMatches returns whether the provided password may be used to join
+// or watch the match. Passwords are not case sensitive.
+func (g *serverGame) passwordMatches(password []byte) bool {
+	return len(g.password) == 0 || bytes.EqualFold(g.password, password)
+}
+
 func (g *serverGame) opponent(client *serverClient) *serverClient {
 	if g.client1 == client {
 		return g.client2
@@ -253,5 +647,751 @@ func (g *serverGame) opponent(client *serverClient) *serverClient {
 }
 
 func (g *serverGame) terminated() bool {
-	return g.client1 == nil && g.client2 == nil
+	return g.cancelled || g.client1 == nil && g.client2 == nil && !g.reconnecting(1) && !g.reconnecting(2) && !g.paused()
+}
+
+// paused returns whether a player left the match while it was in progress
+// and the grace period to rejoin it has not yet lapsed.
+func (g *serverGame) paused() bool {
+	return !g.left.IsZero() && g.Winner == 0 && time.Since(g.left) < pauseGracePeriod
+}
+
+// disconnected returns the provided player when they have lost their
+// connection and their seat is reserved, otherwise nil.
+func (g *serverGame) disconnected(player int) *disconnectedClient {
+	if player == 1 {
+		return g.disconnected1
+	}
+	return g.disconnected2
+}
+
+// reconnecting returns whether the provided player lost their connection and
+// the grace period to reconnect has not yet lapsed.
+func (g *serverGame) reconnecting(player int) bool {
+	d := g.disconnected(player)
+	return d != nil && time.Since(d.time) < reconnectGracePeriod
+}
+
+// reconnectExpired returns the player who did not reconnect within the grace
+// period, or 0 when no grace period has lapsed.
+func (g *serverGame) reconnectExpired() int {
+	for player := 1; player <= 2; player++ {
+		if g.disconnected(player) != nil && !g.reconnecting(player) {
+			return player
+		}
+	}
+	return 0
+}
+
+// reserved returns whether the seat of the provided player is reserved for
+// a different client. Registered players must reconnect using the same
+// account. Guests must reconnect using the same username.
+func (g *serverGame) reserved(player int, client *serverClient) bool {
+	d := g.disconnected(player)
+	if d == nil {
+		return false
+	}
+	return !bytes.Equal(bytes.ToLower(client.name), bytes.ToLower(d.client.name)) || (d.client.account > 0 && client.account != d.client.account)
+}
+
+// mayReconnect returns whether the provided client is a player who lost their
+// connection to the match and may reconnect to it.
+func (g *serverGame) mayReconnect(client *serverClient) bool {
+	for player := 1; player <= 2; player++ {
+		if g.reconnecting(player) && !g.reserved(player, client) {
+			return true
+		}
+	}
+	return false
+}
+
+// disconnectClient reserves the seat of the provided player, who lost their
+// connection during the match. The player may reconnect within the grace
+// period, otherwise they forfeit the match.
+func (g *serverGame) disconnectClient(client *serverClient, reason string) {
+	d := &disconnectedClient{
+		client: client,
+		time:   time.Now(),
+	}
+	switch {
+	case g.client1 == client:
+		g.client1 = nil
+		g.disconnected1 = d
+	case g.client2 == client:
+		g.client2 = nil
+		g.disconnected2 = d
+	default:
+		return
+	}
+	client.playerNumber = 0
+
+	g.updateClocks()
+
+	ev := &bgammon.EventLeft{
+		Reason: reason,
+	}
+	ev.Player = string(client.name)
+	g.eachClient(func(c *serverClient) {
+		c.sendEvent(ev)
+		c.sendNotice(fmt.Sprintf("%s lost their connection. They have %d minutes to reconnect before forfeiting the match.", client.name, int(reconnectGracePeriod.Minutes())))
+	})
+}
+
+// forfeitMatch ends the match on behalf of the provided player, who did not
+// reconnect within the grace period.
+func (g *serverGame) forfeitMatch(player int) {
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+
+	ev := g.endMatch(opponent)
+	ev.Forfeit = true
+
+	if player == 1 {
+		g.disconnected1 = nil
+		g.Player1.Name = ""
+	} else {
+		g.disconnected2 = nil
+		g.Player2.Name = ""
+	}
+
+	g.eachClient(func(client *serverClient) {
+		g.sendBoard(client)
+		client.sendEvent(ev)
+	})
+}
+
+// endMatch ends the match early, before either player has reached the number
+// of points required to win the match, and returns the win event.
+func (g *serverGame) endMatch(winner int) *bgammon.EventWin {
+	g.Winner = winner
+	g.WinType = bgammon.WinSingle
+	g.Ended = time.Now()
+
+	ev := &bgammon.EventWin{
+		WinType: bgammon.WinSingle,
+		Match:   true,
+		Score1:  g.Player1.Points,
+		Score2:  g.Player2.Points,
+	}
+	ev.Player = g.Player1.Name
+	if winner == 2 {
+		ev.Player = g.Player2.Name
+	}
+	ev.Rating = g.updateRatings()
+	g.recordMatch()
+	return ev
+}
+
+// resign concedes the current game, or the entire match, on behalf of the
+// provided client. A pending double offer is withdrawn, so the opponent is
+// awarded the current value of the doubling cube.
+func (g *serverGame) resign(client *serverClient, match bool) {
+	opponent := 1
+	if client.playerNumber == 1 {
+		opponent = 2
+	}
+	g.DoubleOffered = false
+
+	var winEvent *bgammon.EventWin
+	if match {
+		winEvent = g.endMatch(opponent)
+	} else {
+		winEvent = g.awardPoints(opponent, bgammon.WinSingle)
+	}
+	winEvent.Resigned = true
+	g.eachClient(func(client *serverClient) {
+		g.sendBoard(client)
+		client.sendEvent(winEvent)
+	})
+}
+
+// registeredPlayers returns whether all players in the match are logged in to
+// registered accounts.
+func (g *serverGame) registeredPlayers() bool {
+	var players int
+	for player := 1; player <= 2; player++ {
+		client := g.playerClient(player)
+		if client == nil {
+			continue
+		} else if client.account <= 0 {
+			return false
+		}
+		players++
+	}
+	return players > 0
+}
+
+// playerClient returns the client of the provided player, including players
+// who are reconnecting, or nil.
+func (g *serverGame) playerClient(player int) *serverClient {
+	client := g.client1
+	if player == 2 {
+		client = g.client2
+	}
+	if client == nil {
+		if d := g.disconnected(player); d != nil {
+			client = d.client
+		}
+	}
+	return client
+}
+
+// offerDouble offers a double to the opponent of the provided client.
+func (g *serverGame) offerDouble(client *serverClient) {
+	g.DoubleOffered = true
+	g.logAction(&bgammon.TranscriptAction{
+		Player: client.playerNumber,
+		Type:   bgammon.ActionDouble,
+		Value:  g.DoubleValue * 2,
+	})
+
+	ev := &bgammon.EventDoubleOffered{
+		Points: g.DoubleValue * 2,
+	}
+	ev.Player = string(client.name)
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		if client.json {
+			g.sendBoard(client)
+		}
+	})
+}
+
+// acceptDouble accepts the pending double offer on behalf of the provided
+// client, who takes possession of the doubling cube.
+func (g *serverGame) acceptDouble(client *serverClient) {
+	g.DoubleOffered = false
+	g.DoubleValue = g.DoubleValue * 2
+	g.DoublePlayer = client.playerNumber
+	g.logAction(&bgammon.TranscriptAction{
+		Player: client.playerNumber,
+		Type:   bgammon.ActionTake,
+	})
+
+	ev := &bgammon.EventDoubleAccepted{
+		Points: g.DoubleValue,
+	}
+	ev.Player = string(client.name)
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		g.sendBoard(client)
+	})
+}
+
+// beaver accepts the pending double offer on behalf of the provided client,
+// who immediately redoubles and keeps the doubling cube. The opponent may not
+// decline the redouble.
+func (g *serverGame) beaver(client *serverClient) {
+	g.DoubleOffered = false
+	g.DoubleValue = g.DoubleValue * 4
+	g.DoublePlayer = client.playerNumber
+	g.Beavered = true
+	g.logAction(&bgammon.TranscriptAction{
+		Player: client.playerNumber,
+		Type:   bgammon.ActionBeaver,
+		Value:  g.DoubleValue,
+	})
+
+	ev := &bgammon.EventBeaver{
+		Points: g.DoubleValue,
+	}
+	ev.Player = string(client.name)
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		g.sendBoard(client)
+	})
+}
+
+// raccoon redoubles on behalf of the provided client after their double offer
+// was beavered. The client takes possession of the doubling cube.
+func (g *serverGame) raccoon(client *serverClient) {
+	g.DoubleValue = g.DoubleValue * 2
+	g.DoublePlayer = client.playerNumber
+	g.Beavered = false
+	g.logAction(&bgammon.TranscriptAction{
+		Player: client.playerNumber,
+		Type:   bgammon.ActionRaccoon,
+		Value:  g.DoubleValue,
+	})
+
+	ev := &bgammon.EventRaccoon{
+		Points: g.DoubleValue,
+	}
+	ev.Player = string(client.name)
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		g.sendBoard(client)
+	})
+}
+
+// rejectDouble declines the pending double offer on behalf of the provided
+// client. The current value of the doubling cube is awarded to the opponent.
+func (g *serverGame) rejectDouble(client *serverClient) {
+	ev := &bgammon.EventDoubleRejected{
+		Points: g.DoubleValue,
+	}
+	ev.Player = string(client.name)
+	g.logAction(&bgammon.TranscriptAction{
+		Player: client.playerNumber,
+		Type:   bgammon.ActionDrop,
+	})
+
+	opponent := 1
+	if client.playerNumber == 1 {
+		opponent = 2
+	}
+	winEvent := g.awardPoints(opponent, bgammon.WinSingle)
+	g.eachClient(func(client *serverClient) {
+		client.sendEvent(ev)
+		g.sendBoard(client)
+		client.sendEvent(winEvent)
+	})
+}
+
+// awardPoints awards points to the winner of the current game based on the
+// type of win and the value of the doubling cube. When the player has reached
+// the number of points required to win the match, the match is ended.
+// Otherwise, the next game is started.
+func (g *serverGame) awardPoints(player int, winType int) *bgammon.EventWin {
+	if g.NoGammons {
+		winType = bgammon.WinSingle
+	}
+	multiplier := winType
+	if g.Jacoby && g.Points == 1 && g.DoubleValue == 1 {
+		// The cube was never turned, so gammons and backgammons count as a
+		// single game. The type of win is still reported to the players.
+		multiplier = bgammon.WinSingle
+	}
+	points := multiplier * g.DoubleValue
+
+	game := g.transcriptGame()
+	game.Winner, game.Points = player, points
+
+	winPlayer := &g.Player1
+	if player == 2 {
+		winPlayer = &g.Player2
+	}
+	winPlayer.Points = winPlayer.Points + points
+
+	ev := &bgammon.EventWin{
+		Points:  points,
+		WinType: winType,
+		Match:   winPlayer.Points >= g.Points,
+		Score1:  g.Player1.Points,
+		Score2:  g.Player2.Points,
+	}
+	ev.Player = winPlayer.Name
+
+	if ev.Match {
+		g.Winner = player
+		g.WinType = winType
+		g.Ended = time.Now()
+		ev.Rating = g.updateRatings()
+		g.recordMatch()
+	} else {
+		g.Reset()
+		g.resetClocks()
+
+		// The game after a player first reaches match point is the Crawford
+		// game. The doubling cube may not be used during the Crawford game.
+		if !g.crawfordPlayed && (g.Player1.Points == g.Points-1 || g.Player2.Points == g.Points-1) {
+			g.Crawford = true
+			g.crawfordPlayed = true
+		}
+	}
+	return ev
+}
+
+// rated returns whether the ratings of the players are updated when the match
+// ends. Matches are rated when both players are logged in to registered
+// accounts, unless the match is a puzzle or a position was set up during it.
+func (g *serverGame) rated() bool {
+	client1, client2 := g.playerClient(1), g.playerClient(2)
+	return client1 != nil && client2 != nil && client1.account > 0 && client2.account > 0 && g.puzzle == "" && !g.setUp
+}
+
+// updateRatings updates the ratings of the players after the match has ended
+// and returns the rating change of the winner. Ratings are only updated when
+// the match is rated. Matches are only rated once completed. A player who
+// loses their connection during the match may reconnect to it, and only
+// forfeits the match when they do not reconnect within the grace period.
+func (g *serverGame) updateRatings() int {
+	if !g.rated() {
+		return 0
+	}
+	client1, client2 := g.playerClient(1), g.playerClient(2)
+
+	winner, loser := client1, client2
+	if g.Winner == 2 {
+		winner, loser = loser, winner
+	}
+	delta, err := updateRatings(winner.account, loser.account)
+	if err != nil {
+		errorf("failed to update ratings of %s and %s: %s", winner.name, loser.name, err)
+		return 0
+	}
+	winner.rating += delta
+	loser.rating -= delta
+	g.Player1.Rating, g.Player2.Rating = client1.rating, client2.rating
+	return delta
+}
+
+// recordMatch records the result of the match after it has ended. Matches
+// between guests are not recorded.
+func (g *serverGame) recordMatch() {
+	metrics.gamesCompleted.Add(1)
+
+	winner := g.allowed1
+	if g.Winner == 2 {
+		winner = g.allowed2
+	}
+	infof("Match %d won by %s (%d-%d)", g.id, winner, g.Player1.Points, g.Player2.Points)
+
+	var account1, account2 int
+	if client := g.playerClient(1); client != nil {
+		account1 = client.account
+	}
+	if client := g.playerClient(2); client != nil {
+		account2 = client.account
+	}
+	if db == nil || (account1 <= 0 && account2 <= 0) || g.puzzle != "" {
+		return
+	}
+
+	err := recordMatch(g.Game, account1, account2, g.dice.seed)
+	if err != nil {
+		errorf("failed to record match %d: %s", g.id, err)
+	}
+}
+
+// runningClock returns the player whose clock is currently running, or 0 when
+// no clock is running. The clock of the player who must respond to a double
+// offer runs while the offer is pending. Clocks do not run while a player is
+// absent from the match.
+func (g *serverGame) runningClock() int {
+	if g.TimeControl == 0 || g.Turn == 0 || g.Winner != 0 || g.client1 == nil || g.client2 == nil {
+		return 0
+	}
+	if g.DoubleOffered {
+		if g.Turn == 1 {
+			return 2
+		}
+		return 1
+	}
+	return g.Turn
+}
+
+// updateClocks subtracts the time elapsed since the clocks were last updated
+// from the clock which was running. It must be called after each change to
+// the game state which may stop or start a clock.
+func (g *serverGame) updateClocks() {
+	now := time.Now()
+	if g.clockPlayer != 0 {
+		player := &g.Player1
+		if g.clockPlayer == 2 {
+			player = &g.Player2
+		}
+		player.Clock -= int(now.Sub(g.clockUpdated).Milliseconds())
+		if player.Clock < 0 {
+			player.Clock = 0
+		}
+	}
+	running := g.runningClock()
+	if running != g.clockPlayer {
+		g.clockWarned = 0
+	}
+	g.clockPlayer = running
+	g.clockUpdated = now
+}
+
+// resetClocks sets the clocks of both players to the time control.
+func (g *serverGame) resetClocks() {
+	g.Player1.Clock = g.TimeControl * 1000
+	g.Player2.Clock = g.TimeControl * 1000
+	g.clockPlayer = 0
+	g.updateClocks()
+}
+
+// clockRemaining returns the number of milliseconds remaining on the clock
+// which is running. It must only be called while a clock is running.
+func (g *serverGame) clockRemaining() int {
+	remaining := g.Player1.Clock
+	if g.clockPlayer == 2 {
+		remaining = g.Player2.Clock
+	}
+	return remaining - int(time.Since(g.clockUpdated).Milliseconds())
+}
+
+// timedOut returns the player whose clock has run out, or 0 when no clock has
+// run out.
+func (g *serverGame) timedOut() int {
+	if g.clockPlayer == 0 || g.clockRemaining() > 0 {
+		return 0
+	}
+	return g.clockPlayer
+}
+
+// clockWarning returns the lowest clock warning threshold, in seconds, which
+// the running clock has crossed and its player has not yet been warned of, or
+// 0 when no warning is due. Thresholds which are not shorter than the time
+// control are ignored, as they would be crossed at the start of each game.
+func (g *serverGame) clockWarning() int {
+	if g.clockPlayer == 0 {
+		return 0
+	}
+	remaining := g.clockRemaining()
+	if remaining <= 0 {
+		return 0
+	}
+	var warning int
+	for _, seconds := range clockWarnings {
+		if seconds >= g.TimeControl || remaining > seconds*1000 || (g.clockWarned != 0 && seconds >= g.clockWarned) {
+			continue
+		} else if warning == 0 || seconds < warning {
+			warning = seconds
+		}
+	}
+	return warning
+}
+
+// parseClockWarnings parses a comma separated list of clock warning
+// thresholds in seconds.
+func parseClockWarnings(warnings string) ([]int, error) {
+	var thresholds []int
+	for _, warning := range strings.Split(warnings, ",") {
+		warning = strings.TrimSpace(warning)
+		if warning == "" {
+			continue
+		}
+		seconds, err := strconv.Atoi(warning)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid number of seconds: %s", warning)
+		}
+		thresholds = append(thresholds, seconds)
+	}
+	return thresholds, nil
+}
+
+// nextTurn ends the turn of the current player, adding the time increment to
+// their clock.
+func (g *serverGame) nextTurn() {
+	if g.TimeControl > 0 {
+		g.updateClocks()
+		if g.Turn == 1 {
+			g.Player1.Clock += g.TimeIncrement * 1000
+		} else {
+			g.Player2.Clock += g.TimeIncrement * 1000
+		}
+	}
+	g.logTurn()
+	g.NextTurn()
+}
+
+// transcriptGame returns the record of the current game. A record of the game
+// is started when necessary.
+func (g *serverGame) transcriptGame() *bgammon.TranscriptGame {
+	if g.transcript == nil {
+		g.transcript = &bgammon.Transcript{
+			Player1: string(g.allowed1),
+			Player2: string(g.allowed2),
+			Points:  g.Points,
+		}
+	}
+	games := g.transcript.Games
+	if len(games) == 0 || games[len(games)-1].Winner != 0 {
+		g.transcript.Games = append(games, &bgammon.TranscriptGame{
+			Score1: g.Player1.Points,
+			Score2: g.Player2.Points,
+		})
+	}
+	return g.transcript.Games[len(g.transcript.Games)-1]
+}
+
+// logAction adds an action to the record of the current game.
+func (g *serverGame) logAction(action *bgammon.TranscriptAction) {
+	game := g.transcriptGame()
+	game.Actions = append(game.Actions, action)
+}
+
+// logTurn adds the roll of the current player and the checkers they moved to
+// the record of the current game.
+func (g *serverGame) logTurn() {
+	if g.Turn == 0 || g.Roll1 == 0 || g.Roll2 == 0 {
+		return
+	}
+	g.logAction(&bgammon.TranscriptAction{
+		Player: g.Turn,
+		Type:   bgammon.ActionRoll,
+		Roll1:  g.Roll1,
+		Roll2:  g.Roll2,
+		Moves:  bgammon.TranscriptMoves(g.Moves, g.Turn),
+	})
+}
+
+// passTurn ends the current turn when the player has dice rolls remaining
+// which may not be used. Clients are sent a moved event without any moves,
+// followed by the board. Returns whether the turn was ended.
+func (g *serverGame) passTurn(player []byte) bool {
+	if g.Winner != 0 || g.Turn == 0 || g.Roll1 == 0 || g.Roll2 == 0 || g.DoubleOffered {
+		return false
+	} else if len(g.DiceRolls()) == 0 || len(g.LegalMoves(false)) != 0 {
+		return false
+	}
+
+	g.nextTurn()
+	g.eachClient(func(client *serverClient) {
+		ev := &bgammon.EventMoved{}
+		ev.Player = string(player)
+		client.sendEvent(ev)
+		g.sendBoard(client)
+	})
+	return true
+}
+
+// turnStart returns a copy of the game as it was before the pending moves of
+// the current turn were made.
+func (g *serverGame) turnStart() (*bgammon.Game, error) {
+	game := g.Game.Copy()
+	for len(game.Moves) > 0 {
+		lastMove := game.Moves[len(game.Moves)-1]
+		ok, _ := game.AddMoves([][]int{{lastMove[1], lastMove[0]}}, false)
+		if !ok {
+			return nil, fmt.Errorf("failed to undo move %d/%d", lastMove[0], lastMove[1])
+		}
+	}
+	return game, nil
+}
+
+// forcedPlay returns whether every legal play of the current turn results in
+// the same position. Moving checkers in a different order is not considered
+// a different play.
+func (g *serverGame) forcedPlay() bool {
+	game, err := g.turnStart()
+	if err != nil {
+		return false
+	}
+
+	var result string
+	forced := true
+	seen := make(map[string]bool)
+	var search func(game *bgammon.Game, depth int)
+	search = func(game *bgammon.Game, depth int) {
+		legalMoves := game.LegalMoves(false)
+		if len(legalMoves) == 0 {
+			board := fmt.Sprint(game.Board)
+			if result == "" {
+				result = board
+			} else if board != result {
+				forced = false
+			}
+			return
+		}
+		for _, move := range legalMoves {
+			if !forced {
+				return
+			}
+			gc := game.Copy()
+			gc.AddLocalMove(move)
+
+			// Skip positions which were already reached in a different order.
+			key := fmt.Sprint(depth, gc.Board)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			search(gc, depth+1)
+		}
+	}
+	search(game, 0)
+	return forced
+}
+
+// confirmTurn ends the turn on behalf of the provided player when they have
+// enabled automatic confirmation, all of the dice rolled have been used and
+// no other play was possible. Players who may have played differently must
+// confirm their turn themselves, so that they may still reset their moves.
+func (g *serverGame) confirmTurn(client *serverClient) bool {
+	if !client.settings.AutoOk || g.Winner != 0 || g.Turn == 0 || g.Turn != client.playerNumber || g.Roll1 == 0 || g.Roll2 == 0 || g.DoubleOffered {
+		return false
+	} else if len(g.Moves) == 0 || len(g.LegalMoves(false)) != 0 || !g.forcedPlay() {
+		return false
+	}
+
+	g.nextTurn()
+	g.eachClient(func(client *serverClient) {
+		g.sendBoard(client)
+	})
+	return true
+}
+
+// idleActor returns the player whose inactivity timer should be running, or 0
+// when no timer should be running. Players must act within the idle timeout
+// during their turn, and when responding to a double offer. Matches with time
+// control are not affected, as each player's clock limits how long they may
+// take to act.
+func (g *serverGame) idleActor() int {
+	if idleTimeout == 0 || g.TimeControl != 0 || g.Turn == 0 || g.Winner != 0 || g.client1 == nil || g.client2 == nil {
+		return 0
+	}
+	if g.DoubleOffered {
+		if g.Turn == 1 {
+			return 2
+		}
+		return 1
+	}
+	return g.Turn
+}
+
+// updateIdle restarts the inactivity timer when the player who must act
+// changes. It must be called after each change to the game state which may
+// change which player must act.
+func (g *serverGame) updateIdle() {
+	player := g.idleActor()
+	if player == g.idlePlayer {
+		return
+	}
+	g.idlePlayer = player
+	g.idleSince = time.Now()
+	g.idleWarned = false
+}
+
+// idleRemaining returns the player whose inactivity timer is running and how
+// long they have left to act, or 0 when no inactivity timer is running.
+func (g *serverGame) idleRemaining() (int, time.Duration) {
+	if g.idlePlayer == 0 {
+		return 0, 0
+	}
+	return g.idlePlayer, idleTimeout - time.Since(g.idleSince)
+}
+
+// idleWarning returns how long before the inactivity timer expires that the
+// players are warned.
+func (g *serverGame) idleWarning() time.Duration {
+	if idleWarning > idleTimeout/2 {
+		return idleTimeout / 2
+	}
+	return idleWarning
+}
+
+// forfeitTime forfeits the current game on behalf of the provided player,
+// whose clock has run out, or when idle is true, whose inactivity timer has
+// expired.
+func (g *serverGame) forfeitTime(player int, idle bool) {
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+	winEvent := g.awardPoints(opponent, bgammon.WinSingle)
+	if idle {
+		winEvent.Idle = true
+	} else {
+		winEvent.Timeout = true
+	}
+	g.eachClient(func(client *serverClient) {
+		g.sendBoard(client)
+		client.sendEvent(winEvent)
+	})
 }
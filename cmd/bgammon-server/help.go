@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// helpText returns the help text of the provided topic, which is the keyword
+// or alias of a command. All available commands are listed when the topic is
+// empty. False is returned when no help is available for the topic.
+func (s *server) helpText(c *serverClient, topic string) (string, bool) {
+	var lines []string
+	if topic == "" {
+		lines = append(lines, "Commands:")
+		for _, h := range registeredCommands {
+			if !h.available(s, c) {
+				continue
+			}
+			line := fmt.Sprintf("%s - %s", h.syntax(), h.summary)
+			if len(h.aliases) > 0 {
+				line += fmt.Sprintf(" Aliases: %s", strings.Join(h.aliases, ", "))
+			}
+			lines = append(lines, line)
+		}
+		lines = append(lines, message(c.lang, messageHelp))
+		return strings.Join(lines, "\n"), true
+	}
+
+	h := lookupCommand(topic)
+	if h == nil || !h.available(s, c) {
+		return "", false
+	}
+	lines = append(lines, h.syntax(), h.summary)
+	if h.details != "" {
+		lines = append(lines, h.details)
+	}
+	if len(h.aliases) > 0 {
+		lines = append(lines, fmt.Sprintf("Aliases: %s", strings.Join(h.aliases, ", ")))
+	}
+	return strings.Join(lines, "\n"), true
+}
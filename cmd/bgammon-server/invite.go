@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// inviteTimeout is how long an invitation to play a match may be accepted.
+const inviteTimeout = 2 * time.Minute
+
+// invite is an invitation from one player to another to play a match. Invites
+// are only accessed while handling commands.
+type invite struct {
+	id      int
+	from    *serverClient
+	to      *serverClient
+	points  int
+	expires time.Time
+}
+
+func (i *invite) expired(now time.Time) bool {
+	return !now.Before(i.expires)
+}
+
+// valid returns whether the invite may still be accepted. Invites are no
+// longer valid after they expire or either player disconnects.
+func (i *invite) valid(now time.Time) bool {
+	return !i.expired(now) && !i.from.terminating && !i.from.Terminated() && !i.to.terminating && !i.to.Terminated()
+}
+
+// pruneInvites removes invites which are no longer valid.
+func (s *server) pruneInvites() {
+	now := time.Now()
+	j := 0
+	for _, inv := range s.invites {
+		if inv.valid(now) {
+			s.invites[j] = inv
+			j++
+		}
+	}
+	for k := j; k < len(s.invites); k++ {
+		s.invites[k] = nil // Allow memory to be deallocated.
+	}
+	s.invites = s.invites[:j]
+}
+
+// addInvite sends an invite. Any invite previously sent by the player to the
+// same recipient is replaced.
+func (s *server) addInvite(from *serverClient, to *serverClient, points int) *invite {
+	s.pruneInvites()
+	s.removeInvite(func(inv *invite) bool {
+		return inv.from == from && inv.to == to
+	})
+
+	s.inviteID++
+	inv := &invite{
+		id:      s.inviteID,
+		from:    from,
+		to:      to,
+		points:  points,
+		expires: time.Now().Add(inviteTimeout),
+	}
+	s.invites = append(s.invites, inv)
+
+	ev := &bgammon.EventInvite{
+		ID:      inv.id,
+		Points:  points,
+		Expires: int(inviteTimeout.Seconds()),
+	}
+	ev.Player = string(from.name)
+	to.sendEvent(ev)
+	return inv
+}
+
+// takeInvite removes and returns the valid invite with the provided ID which
+// was sent to the provided client, or nil when no such invite exists.
+func (s *server) takeInvite(to *serverClient, id int) *invite {
+	s.pruneInvites()
+	return s.removeInvite(func(inv *invite) bool {
+		return inv.id == id && inv.to == to
+	})
+}
+
+// removeInvite removes and returns the first invite matching the provided
+// function, or nil when no invites match.
+func (s *server) removeInvite(f func(inv *invite) bool) *invite {
+	for i, inv := range s.invites {
+		if f(inv) {
+			s.invites = append(s.invites[:i], s.invites[i+1:]...)
+			return inv
+		}
+	}
+	return nil
+}
+
+// startInvitedMatch creates a match between the players of an accepted
+// invite. Players are seated randomly.
+func (s *server) startInvitedMatch(inv *invite) *serverGame {
+	g := newServerGame(<-s.newGameIDs)
+	g.name = defaultMatchName(inv.from.name)
+	g.Points = inv.points
+	g.creator = inv.from.name
+	g.resetClocks()
+
+	// Seats are assigned while the games are locked, so that the match is not
+	// joined by another player before the invited player is seated.
+	s.gamesLock.Lock()
+	s.games = append(s.games, g)
+	for _, c := range []*serverClient{inv.from, inv.to} {
+		if failed := g.addClient(c); failed != nil {
+			s.gamesLock.Unlock()
+			log.Panicf("failed to add client to invited match %+v %+v: %s", g, c, failed.Reason)
+		}
+	}
+	s.gamesLock.Unlock()
+	return g
+}
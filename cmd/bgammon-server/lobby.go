@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// lobbyInterval is how often the list of matches is checked for changes.
+// Changes made in the meantime are sent to subscribed clients together.
+const lobbyInterval = time.Second
+
+// listing returns the match as listed to the provided client. Matches which
+// are reserved for other players are listed as full.
+func (g *serverGame) listing(c *serverClient) bgammon.GameListing {
+	var name []byte
+	if c != nil {
+		name = c.name
+	}
+	playerCount := g.playerCount()
+	if len(g.allowed1) != 0 && !bytes.Equal(g.allowed1, name) && !bytes.Equal(g.allowed2, name) {
+		playerCount = 2
+	}
+	spectators := len(g.spectators)
+	if g.hideSpectators {
+		spectators = 0
+	}
+	return bgammon.GameListing{
+		ID:         g.id,
+		Points:     g.Points,
+		Password:   len(g.password) != 0,
+		Players:    playerCount,
+		Spectators: spectators,
+		Rated:      g.registeredPlayers() && g.puzzle == "",
+		Puzzle:     g.puzzle != "",
+		Name:       string(g.name),
+	}
+}
+
+// sortListings sorts listed matches so that matches which may be joined are
+// listed first.
+func sortListings(games []bgammon.GameListing) {
+	sort.SliceStable(games, func(i, j int) bool {
+		return games[i].Players < 2 && games[j].Players == 2
+	})
+}
+
+// lobbyListings returns the matches listed to the provided client, which may
+// be nil. Each match is locked while it is listed.
+func (s *server) lobbyListings(c *serverClient) []bgammon.GameListing {
+	s.gamesLock.RLock()
+	games := make([]*serverGame, len(s.games))
+	copy(games, s.games)
+	s.gamesLock.RUnlock()
+
+	var listings []bgammon.GameListing
+	for _, g := range games {
+		g.lock.Lock()
+		if !g.terminated() {
+			listings = append(listings, g.listing(c))
+		}
+		g.lock.Unlock()
+	}
+	sortListings(listings)
+	return listings
+}
+
+// sendLobbyUpdate sends the list of matches to the provided client.
+func (s *server) sendLobbyUpdate(c *serverClient) {
+	games := s.lobbyListings(c)
+	ev := &bgammon.EventLobbyUpdate{
+		Total: len(games),
+		Games: games,
+	}
+	if len(ev.Games) > listPageSize {
+		ev.Games = ev.Games[:listPageSize]
+	}
+	c.sendEvent(ev)
+}
+
+// handleLobbyUpdates sends the list of matches to subscribed clients which are
+// not in a match whenever a match is created, joined, left or terminated.
+func (s *server) handleLobbyUpdates() {
+	var last []bgammon.GameListing
+	t := time.NewTicker(lobbyInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		listings := s.lobbyListings(nil)
+		if reflect.DeepEqual(listings, last) {
+			continue
+		}
+		last = listings
+
+		var subscribed []*serverClient
+		s.clientsLock.Lock()
+		for _, c := range s.clients {
+			if c.lobby.Load() {
+				subscribed = append(subscribed, c)
+			}
+		}
+		s.clientsLock.Unlock()
+
+		for _, c := range subscribed {
+			if s.gameByClient(c) == nil {
+				s.sendLobbyUpdate(c)
+			}
+		}
+	}
+}
+
+func (s *server) handleLobby(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	sendUsage := func() {
+		cmd.client.sendNotice("To receive updates of the list of matches while you are not in a match, send 'lobby on'. To stop receiving updates, send 'lobby off'.")
+	}
+	if len(params) != 1 {
+		sendUsage()
+		return
+	}
+	switch strings.ToLower(string(params[0])) {
+	case "on":
+		if clientGame != nil {
+			cmd.client.sendNotice("Lobby updates are only sent while you are not in a match.")
+			return
+		}
+		cmd.client.lobby.Store(true)
+		s.sendLobbyUpdate(cmd.client)
+	case "off":
+		cmd.client.lobby.Store(false)
+		cmd.client.sendNotice("Lobby updates disabled.")
+	default:
+		sendUsage()
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// defaultLanguage is the language of messages sent to players who have not
+// chosen a language, and of messages which have not been translated.
+const defaultLanguage = "en"
+
+// languages are the languages messages may be translated to.
+var languages = []string{"en", "de"}
+
+// languageFormat matches the language option which may be provided when
+// logging in, such as lang=de.
+var languageFormat = regexp.MustCompile(`^(?i)lang=[a-z]{2}$`)
+
+// Codes of messages which are not the reason a command failed. Failure
+// reasons are translated using their error code, such as
+// bgammon.ErrorNotInMatch.
+const (
+	messageHelp = "help"
+)
+
+// messages is the catalog of messages sent to players, keyed by code and then
+// by language. Every message has an English translation.
+var messages = map[string]map[string]string{
+	messageHelp: {
+		"en": "For more information about a command, send 'help <command>'. The protocol is specified at https://code.rocket9labs.com/tslocum/bgammon/src/branch/main/PROTOCOL.md",
+		"de": "Weitere Informationen zu einem Befehl erhältst du mit 'help <Befehl>'. Das Protokoll ist unter https://code.rocket9labs.com/tslocum/bgammon/src/branch/main/PROTOCOL.md beschrieben.",
+	},
+	bgammon.ErrorShuttingDown: {
+		"en": "The server is shutting down.",
+		"de": "Der Server wird heruntergefahren.",
+	},
+	bgammon.ErrorServerFull: {
+		"en": "The server may not host any more matches. Please try again later.",
+		"de": "Der Server kann keine weiteren Matches ausrichten. Bitte versuche es später erneut.",
+	},
+	bgammon.ErrorNotInMatch: {
+		"en": "You are not currently in a match.",
+		"de": "Du bist derzeit in keinem Match.",
+	},
+	bgammon.ErrorInMatch: {
+		"en": "Please leave the match you are in first.",
+		"de": "Bitte verlasse zuerst das Match, in dem du bist.",
+	},
+	bgammon.ErrorAlreadyInMatch: {
+		"en": "You are already in this match.",
+		"de": "Du bist bereits in diesem Match.",
+	},
+	bgammon.ErrorMatchNotFound: {
+		"en": "Match not found.",
+		"de": "Match nicht gefunden.",
+	},
+	bgammon.ErrorMatchFull: {
+		"en": "Match is full.",
+		"de": "Das Match ist voll.",
+	},
+	bgammon.ErrorMatchStarted: {
+		"en": "Match has already started.",
+		"de": "Das Match hat bereits begonnen.",
+	},
+	bgammon.ErrorInvalidPassword: {
+		"en": "Invalid password.",
+		"de": "Ungültiges Passwort.",
+	},
+	bgammon.ErrorSpectating: {
+		"en": "You are spectating this match.",
+		"de": "Du schaust diesem Match zu.",
+	},
+	bgammon.ErrorNotYourTurn: {
+		"en": "It is not your turn.",
+		"de": "Du bist nicht am Zug.",
+	},
+	bgammon.ErrorOpponentAway: {
+		"en": "Please wait for your opponent to rejoin the match.",
+		"de": "Bitte warte, bis dein Gegner dem Match wieder beitritt.",
+	},
+	bgammon.ErrorNotRolled: {
+		"en": "You must roll first.",
+		"de": "Du musst zuerst würfeln.",
+	},
+	bgammon.ErrorDoubleOffered: {
+		"en": "The double must be accepted or declined first.",
+		"de": "Das Doppeln muss zuerst angenommen oder abgelehnt werden.",
+	},
+}
+
+// parseLanguage returns the provided language when messages may be
+// translated to it, otherwise the default language.
+func parseLanguage(lang string) string {
+	lang = strings.ToLower(lang)
+	for _, l := range languages {
+		if l == lang {
+			return lang
+		}
+	}
+	return defaultLanguage
+}
+
+// message returns the message with the provided code in the provided
+// language. The English message is returned when the message has not been
+// translated.
+func message(lang string, code string) string {
+	translations := messages[code]
+	if m, ok := translations[lang]; ok {
+		return m
+	}
+	return translations[defaultLanguage]
+}
+
+// localizeReason returns the reason a command failed in the language of the
+// client. Reasons are only translated when the client has chosen a language
+// other than English and a translation of the error code exists, as English
+// reasons may include details which are not part of the translation.
+func (c *serverClient) localizeReason(code string, reason string) string {
+	if c.lang == "" || c.lang == defaultLanguage {
+		return reason
+	} else if m, ok := messages[code][c.lang]; ok {
+		return m
+	}
+	return reason
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota // Connections and commands sent and received.
+	levelInfo                  // Logins, matches and moderator actions.
+	levelWarn                  // Unexpected but recoverable conditions.
+	levelError                 // Failures which prevent an action from completing.
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// minLogLevel is the lowest severity of messages which are logged.
+var minLogLevel = levelInfo
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel returns the log level with the provided name.
+func parseLogLevel(name string) (logLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s: must be one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// logf logs a message when its level is at least minLogLevel. Messages are
+// prefixed with their level.
+func logf(level logLevel, format string, v ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	log.Printf(strings.ToUpper(level.String())+" "+format, v...)
+}
+
+func debugf(format string, v ...interface{}) {
+	logf(levelDebug, format, v...)
+}
+
+func infof(format string, v ...interface{}) {
+	logf(levelInfo, format, v...)
+}
+
+func warnf(format string, v ...interface{}) {
+	logf(levelWarn, format, v...)
+}
+
+func errorf(format string, v ...interface{}) {
+	logf(levelError, format, v...)
+}
@@ -6,19 +6,54 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 	var (
 		tcpAddress     string
+		tcpTLSCert     string
+		tcpTLSKey      string
 		wsAddress      string
+		dbPath         string
 		debug          int
+		logLevelName   string
+		metricsAddress string
+		proxies        string
+		origins        string
+		warnings       string
 		rollStatistics bool
+		debugCommands  bool
 	)
 	flag.StringVar(&tcpAddress, "tcp", "localhost:1337", "TCP listen address")
+	flag.StringVar(&tcpTLSCert, "tcp-tls-cert", "", "TLS certificate file (TCP connections are encrypted when specified)")
+	flag.StringVar(&tcpTLSKey, "tcp-tls-key", "", "TLS key file")
 	flag.StringVar(&wsAddress, "ws", "localhost:1338", "WebSocket listen address")
-	flag.IntVar(&debug, "debug", 0, "print debug information and serve pprof on specified port")
-	flag.BoolVar(&rollStatistics, "statistics", false, "print dice roll statistics and exit")
+	flag.BoolVar(&webSocketCompression, "ws-compression", true, "negotiate permessage-deflate compression with WebSocket clients")
+	flag.DurationVar(&webSocketPingInterval, "ws-ping-interval", webSocketPingInterval, "how often WebSocket ping frames are sent to keep connections open through proxies (0 to disable)")
+	flag.StringVar(&proxies, "ws-trusted-proxies", "", "comma separated list of addresses and networks of reverse proxies trusted to provide the address of WebSocket clients in the X-Forwarded-For header")
+	flag.StringVar(&origins, "ws-origins", "", "comma separated list of origins of web pages allowed to connect using WebSocket, such as https://bgammon.org, or * to allow all origins (only pages served from the host connected to are allowed when not specified)")
+	flag.StringVar(&dbPath, "db", "", "SQLite database path (accounts are disabled when not specified)")
+	flag.DurationVar(&clientTimeout, "timeout", clientTimeout, "how long a client may be inactive before it is disconnected")
+	flag.DurationVar(&pingInterval, "ping-interval", pingInterval, "how long a client may be inactive before it is sent a ping")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "how long a player may take to act during a match without time control before they forfeit the game (0 to disable)")
+	flag.StringVar(&warnings, "clock-warnings", "30,10", "comma separated list of the numbers of seconds remaining on a player's clock at which the players are warned their time is running out (empty to disable)")
+	flag.DurationVar(&resumeTTL, "resume-ttl", resumeTTL, "how long matches between registered players which are interrupted by the server shutting down may be resumed (0 to disable)")
+	flag.DurationVar(&diceAuditInterval, "dice-audit", diceAuditInterval, "how often the distribution of all dice rolled since the server started is logged (0 to disable)")
+	flag.IntVar(&commandWorkers, "workers", commandWorkers, "number of goroutines handling commands sent in matches concurrently (commands sent in the same match are handled in order)")
+	flag.IntVar(&maxClients, "max-clients", 0, "maximum number of clients connected at once, not including bots (0 for unlimited)")
+	flag.IntVar(&maxGames, "max-games", 0, "maximum number of matches hosted at once (0 for unlimited)")
+	flag.IntVar(&maxCommandLength, "max-command-length", maxCommandLength, "maximum length of a command sent by a client, in bytes")
+	flag.IntVar(&chatHistorySize, "chat-history", chatHistorySize, "number of recent chat messages in each match sent to players and spectators when they join (0 to disable)")
+	flag.IntVar(&ratingK, "rating-k", 32, "maximum rating change after a match (K-factor)")
+	flag.IntVar(&debug, "debug", 0, "log debug messages and serve pprof on specified port")
+	flag.StringVar(&logLevelName, "log-level", levelInfo.String(), "minimum level of messages to log: debug, info, warn or error")
+	flag.StringVar(&metricsAddress, "metrics", "", "serve Prometheus metrics at /metrics on specified address (disabled when not specified)")
+	flag.BoolVar(&debugCommands, "debug-commands", false, "allow commands used for testing, such as creating matches with a specified dice seed")
+	flag.BoolVar(&rollStatistics, "statistics", false, "print dice roll statistics of standard and balanced dice and exit")
 	flag.Parse()
 
 	if rollStatistics {
@@ -26,8 +61,57 @@ func main() {
 		return
 	}
 
+	level, err := parseLogLevel(logLevelName)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	minLogLevel = level
+	if debug > 0 {
+		minLogLevel = levelDebug
+	}
+
 	if tcpAddress == "" && wsAddress == "" {
 		log.Fatal("Error: A TCP and/or WebSocket listen address must be specified.")
+	} else if (tcpTLSCert == "") != (tcpTLSKey == "") {
+		log.Fatal("Error: Both a TLS certificate and key must be specified.")
+	} else if pingInterval < time.Second {
+		log.Fatal("Error: The ping interval must be at least one second.")
+	} else if pingInterval >= clientTimeout {
+		log.Fatal("Error: The ping interval must be shorter than the client timeout.")
+	} else if idleTimeout < 0 {
+		log.Fatal("Error: The idle timeout must not be negative.")
+	} else if diceAuditInterval < 0 {
+		log.Fatal("Error: The dice audit interval must not be negative.")
+	} else if resumeTTL < 0 {
+		log.Fatal("Error: The resume TTL must not be negative.")
+	} else if maxClients < 0 || maxGames < 0 {
+		log.Fatal("Error: The maximum number of clients and matches must not be negative.")
+	} else if maxCommandLength < 256 {
+		log.Fatal("Error: The maximum command length must be at least 256 bytes.")
+	}
+
+	if proxies != "" {
+		trustedProxies, err = parseTrustedProxies(proxies)
+		if err != nil {
+			log.Fatalf("Error: Failed to parse trusted proxies: %s", err)
+		}
+	}
+
+	webSocketOrigins, err = parseWebSocketOrigins(origins)
+	if err != nil {
+		log.Fatalf("Error: Failed to parse WebSocket origins: %s", err)
+	}
+
+	clockWarnings, err = parseClockWarnings(warnings)
+	if err != nil {
+		log.Fatalf("Error: Failed to parse clock warnings: %s", err)
+	}
+
+	if dbPath != "" {
+		err := connectDB(dbPath)
+		if err != nil {
+			log.Fatalf("failed to connect to database: %s", err)
+		}
 	}
 
 	if debug > 0 {
@@ -36,24 +120,70 @@ func main() {
 		}()
 	}
 
-	s := newServer()
+	s := newServer(debugCommands)
 	if tcpAddress != "" {
-		s.listen("tcp", tcpAddress)
+		if tcpTLSCert != "" {
+			s.listenTLS(tcpAddress, tcpTLSCert, tcpTLSKey)
+		} else {
+			s.listen("tcp", tcpAddress)
+		}
 	}
 	if wsAddress != "" {
 		s.listen("ws", wsAddress)
 	}
-	select {}
+	if metricsAddress != "" {
+		s.listenMetrics(metricsAddress)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	infof("Shutting down... Send the signal again to exit immediately.")
+	go func() {
+		<-signals
+		log.Fatal("Exiting immediately.")
+	}()
+
+	s.shutdown()
+	if db != nil {
+		db.Close()
+	}
 }
 
+// printRollStatistics prints statistics of dice rolled using standard and
+// balanced dice.
 func printRollStatistics() {
+	for _, balanced := range []bool{false, true} {
+		printDiceStatistics(balanced)
+	}
+}
+
+// printDiceStatistics prints the distribution of dice rolled over one million
+// rolls, followed by the distribution of dice rolled within each of a number
+// of simulated games. Distributions are compared with a uniform distribution
+// using Pearson's chi-squared test.
+func printDiceStatistics(balanced bool) {
+	const (
+		total     = 1000000
+		gameRolls = 50 // Approximate number of rolls in a game.
+	)
+
+	mode := "standard"
+	if balanced {
+		mode = "balanced"
+	}
+
 	var oneSame, doubles int
 	var lastroll1, lastroll2 int
+	var faces, gameFaces [6]int
+	var gameDoubles, maxGameDoubles, games, nonUniform int
+	var gameChiSquared float64
 
-	total := 1000000
+	dice := newDiceSource(randomSeed())
+	dice.balanced = balanced
 	for i := 0; i < total; i++ {
-		roll1 := randInt(6) + 1
-		roll2 := randInt(6) + 1
+		roll1, roll2 := dice.rollPair()
 
 		if roll1 == lastroll1 || roll1 == lastroll2 || roll2 == lastroll1 || roll2 == lastroll2 {
 			oneSame++
@@ -61,10 +191,31 @@ func printRollStatistics() {
 
 		if roll1 == roll2 {
 			doubles++
+			gameDoubles++
 		}
 
+		faces[roll1-1]++
+		faces[roll2-1]++
+		gameFaces[roll1-1]++
+		gameFaces[roll2-1]++
+
 		lastroll1, lastroll2 = roll1, roll2
+
+		if (i+1)%gameRolls == 0 {
+			x := chiSquared(gameFaces, gameRolls*2)
+			if x > chiSquaredCritical {
+				nonUniform++
+			}
+			gameChiSquared += x
+			if gameDoubles > maxGameDoubles {
+				maxGameDoubles = gameDoubles
+			}
+			games++
+			gameFaces, gameDoubles = [6]int{}, 0
+		}
 	}
 
-	log.Printf("total: %d, one same: %d (%.0f%%), doubles: %d (%.0f%%)", total, oneSame, float64(oneSame)/float64(total)*100, doubles, float64(doubles)/float64(total)*100)
+	log.Printf("%s dice: total: %d, one same: %d (%.0f%%), doubles: %d (%.0f%%)", mode, total, oneSame, float64(oneSame)/float64(total)*100, doubles, float64(doubles)/float64(total)*100)
+	log.Printf("%s dice: faces: %v, chi-squared: %.2f", mode, faces, chiSquared(faces, total*2))
+	log.Printf("%s dice: games of %d rolls: %d, average chi-squared: %.2f, not uniform: %d (%.1f%%), average doubles: %.1f, most doubles: %d", mode, gameRolls, games, gameChiSquared/float64(games), nonUniform, float64(nonUniform)/float64(games)*100, float64(doubles)/float64(games), maxGameDoubles)
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// metricCommands are the commands which are counted separately. Other
+// commands, including aliases, are counted together as "other" so that
+// clients may not create an unlimited number of time series.
+var metricCommands = map[string]bool{
+	bgammon.CommandLogin:        true,
+	bgammon.CommandLoginJSON:    true,
+	bgammon.CommandRegister:     true,
+	bgammon.CommandRegisterJSON: true,
+	bgammon.CommandHelp:         true,
+	bgammon.CommandJSON:         true,
+	bgammon.CommandSay:          true,
+	bgammon.CommandChat:         true,
+	bgammon.CommandWhisper:      true,
+	bgammon.CommandMute:         true,
+	bgammon.CommandUnmute:       true,
+	bgammon.CommandMuted:        true,
+	bgammon.CommandFriend:       true,
+	bgammon.CommandKick:         true,
+	bgammon.CommandBan:          true,
+	bgammon.CommandUnban:        true,
+	bgammon.CommandList:         true,
+	bgammon.CommandLobby:        true,
+	bgammon.CommandCreate:       true,
+	bgammon.CommandJoin:         true,
+	bgammon.CommandWatch:        true,
+	bgammon.CommandLeave:        true,
+	bgammon.CommandCancel:       true,
+	bgammon.CommandDouble:       true,
+	bgammon.CommandAccept:       true,
+	bgammon.CommandReject:       true,
+	bgammon.CommandBeaver:       true,
+	bgammon.CommandRaccoon:      true,
+	bgammon.CommandInvite:       true,
+	bgammon.CommandDecline:      true,
+	bgammon.CommandResume:       true,
+	bgammon.CommandResign:       true,
+	bgammon.CommandRoll:         true,
+	bgammon.CommandMove:         true,
+	bgammon.CommandReset:        true,
+	bgammon.CommandUndo:         true,
+	bgammon.CommandOk:           true,
+	bgammon.CommandRematch:      true,
+	bgammon.CommandBoard:        true,
+	bgammon.CommandFlip:         true,
+	bgammon.CommandVerify:       true,
+	bgammon.CommandPipCount:     true,
+	bgammon.CommandLeaderboard:  true,
+	bgammon.CommandHistory:      true,
+	bgammon.CommandStats:        true,
+	bgammon.CommandProfile:      true,
+	bgammon.CommandWho:          true,
+	bgammon.CommandPong:         true,
+	bgammon.CommandTimeout:      true,
+	bgammon.CommandSetBoard:     true,
+	bgammon.CommandPosition:     true,
+	bgammon.CommandHint:         true,
+	bgammon.CommandLegalMoves:   true,
+	bgammon.CommandSettings:     true,
+	bgammon.CommandAutoRoll:     true,
+	bgammon.CommandAutoOk:       true,
+	bgammon.CommandVersion:      true,
+	bgammon.CommandStatus:       true,
+	bgammon.CommandTranscript:   true,
+	bgammon.CommandDisconnect:   true,
+}
+
+// serverMetrics are counters which are exposed to operators in the Prometheus
+// text format. The counters may be updated from any goroutine.
+type serverMetrics struct {
+	logins         atomic.Int64
+	gamesCreated   atomic.Int64
+	gamesCompleted atomic.Int64
+
+	commands     map[string]int64 // Number of commands processed by keyword.
+	commandsLock sync.Mutex
+}
+
+var metrics = &serverMetrics{
+	commands: make(map[string]int64),
+}
+
+// command counts a command processed by the server.
+func (m *serverMetrics) command(keyword string) {
+	if !metricCommands[keyword] {
+		keyword = "other"
+	}
+
+	m.commandsLock.Lock()
+	m.commands[keyword]++
+	m.commandsLock.Unlock()
+}
+
+// write writes the metrics of the provided server in the Prometheus text
+// format.
+func (m *serverMetrics) write(w io.Writer, s *server) {
+	s.clientsLock.Lock()
+	clients := len(s.clients)
+	s.clientsLock.Unlock()
+
+	s.gamesLock.RLock()
+	games := len(s.games)
+	s.gamesLock.RUnlock()
+
+	writeMetric := func(name string, kind string, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	writeMetric("bgammon_clients", "gauge", "Number of connected clients.", int64(clients))
+	writeMetric("bgammon_games", "gauge", "Number of matches, including matches waiting for players.", int64(games))
+	writeMetric("bgammon_games_active", "gauge", "Number of matches in progress.", int64(s.activeGames()))
+	writeMetric("bgammon_logins_total", "counter", "Number of successful logins.", m.logins.Load())
+	writeMetric("bgammon_games_created_total", "counter", "Number of matches created, including rematches.", m.gamesCreated.Load())
+	writeMetric("bgammon_games_completed_total", "counter", "Number of matches completed.", m.gamesCompleted.Load())
+
+	faces, _ := audit.distribution()
+	fmt.Fprint(w, "# HELP bgammon_dice_rolled_total Number of dice rolled by face value.\n# TYPE bgammon_dice_rolled_total counter\n")
+	for i, count := range faces {
+		fmt.Fprintf(w, "bgammon_dice_rolled_total{face=\"%d\"} %d\n", i+1, count)
+	}
+	writeMetric("bgammon_dice_rolls_total", "counter", "Number of rolls of two dice.", audit.rolls.Load())
+	writeMetric("bgammon_dice_doubles_total", "counter", "Number of rolls of two dice which were doubles.", audit.doubles.Load())
+
+	m.commandsLock.Lock()
+	keywords := make([]string, 0, len(m.commands))
+	for keyword := range m.commands {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	fmt.Fprint(w, "# HELP bgammon_commands_total Number of commands processed.\n# TYPE bgammon_commands_total counter\n")
+	for _, keyword := range keywords {
+		fmt.Fprintf(w, "bgammon_commands_total{command=%q} %d\n", keyword, m.commands[keyword])
+	}
+	m.commandsLock.Unlock()
+}
+
+// listenMetrics serves metrics at /metrics on the provided address. Metrics
+// continue to be served while the server is shutting down.
+func (s *server) listenMetrics(address string) {
+	infof("Serving metrics on %s...", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %s", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.write(w, s)
+	})
+	go func() {
+		log.Fatalf("failed to serve metrics on %s: %s", address, http.Serve(listener, mux))
+	}()
+}
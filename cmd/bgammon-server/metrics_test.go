@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+func TestMetricsActiveGames(t *testing.T) {
+	s := newTestServer(t)
+	activeGames := func() string {
+		buf := &bytes.Buffer{}
+		metrics.write(buf, s)
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(line, "bgammon_games_active ") {
+				return strings.TrimPrefix(line, "bgammon_games_active ")
+			}
+		}
+		t.Fatal("active games were not written")
+		return ""
+	}
+
+	c1, c2, _ := startMatch(t, s, "3")
+	if active := activeGames(); active != "1" {
+		t.Errorf("%s active games, expected 1", active)
+	}
+
+	// Metrics are written while the match is played.
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			buf := &bytes.Buffer{}
+			metrics.write(buf, s)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	setState(t, c1, 1, "31")
+	c1.send("move 8/5 6/5")
+	expectEvent[*bgammon.EventMoved](t, c2)
+	c2.send("resign match")
+	expectEvent[*bgammon.EventWin](t, c1)
+	close(done)
+	<-stopped
+
+	if active := activeGames(); active != "0" {
+		t.Errorf("%s active games after the match ended, expected 0", active)
+	}
+}
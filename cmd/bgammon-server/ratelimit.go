@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+)
+
+// Clients may send commandBurst commands at once, after which they may send
+// commandRate commands per second. Clients which continue to send commands
+// faster than allowed are disconnected after commandMaxDropped commands have
+// been dropped. Each command which is not dropped reduces the number of
+// dropped commands by one.
+const (
+	commandRate       = 10
+	commandBurst      = 40
+	commandMaxDropped = 100
+)
+
+// rateLimiter limits the rate at which commands are accepted using a token
+// bucket.
+type rateLimiter struct {
+	tokens  float64
+	updated time.Time
+	dropped int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		tokens:  commandBurst,
+		updated: time.Now(),
+	}
+}
+
+// allow returns whether a command received at the provided time is accepted.
+func (r *rateLimiter) allow(now time.Time) bool {
+	r.tokens += now.Sub(r.updated).Seconds() * commandRate
+	if r.tokens > commandBurst {
+		r.tokens = commandBurst
+	}
+	r.updated = now
+
+	if r.tokens < 1 {
+		r.dropped++
+		return false
+	}
+	r.tokens--
+	if r.dropped > 0 {
+		r.dropped--
+	}
+	return true
+}
+
+// exceeded returns whether the limit has been exceeded persistently.
+func (r *rateLimiter) exceeded() bool {
+	return r.dropped >= commandMaxDropped
+}
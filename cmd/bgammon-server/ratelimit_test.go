@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := newRateLimiter()
+	now := r.updated
+	for i := 0; i < commandBurst; i++ {
+		if !r.allow(now) {
+			t.Fatalf("command %d of the burst was dropped", i+1)
+		}
+	}
+	if r.allow(now) {
+		t.Fatal("command exceeding the burst was allowed")
+	}
+
+	// Commands are allowed again at the sustained rate.
+	now = now.Add(time.Second)
+	for i := 0; i < commandRate; i++ {
+		if !r.allow(now) {
+			t.Fatalf("command %d after waiting was dropped", i+1)
+		}
+	}
+	if r.allow(now) {
+		t.Fatal("command exceeding the rate was allowed")
+	}
+
+	// The burst is not exceeded after a long wait.
+	now = now.Add(time.Hour)
+	for i := 0; i < commandBurst; i++ {
+		r.allow(now)
+	}
+	if r.allow(now) {
+		t.Fatal("command exceeding the burst was allowed after waiting")
+	}
+}
+
+func TestRateLimiterExceeded(t *testing.T) {
+	r := newRateLimiter()
+	now := r.updated
+	for i := 0; i < commandBurst; i++ {
+		r.allow(now)
+	}
+	for i := 0; i < commandMaxDropped-1; i++ {
+		r.allow(now)
+	}
+	if r.exceeded() {
+		t.Fatalf("limit exceeded after %d dropped commands", r.dropped)
+	}
+
+	// Each accepted command reduces the number of dropped commands.
+	now = now.Add(time.Second / commandRate)
+	if !r.allow(now) {
+		t.Fatal("command after waiting was dropped")
+	}
+	r.allow(now)
+	if r.exceeded() {
+		t.Fatalf("limit exceeded after %d dropped commands", r.dropped)
+	}
+	r.allow(now)
+	if !r.exceeded() {
+		t.Fatalf("limit not exceeded after %d dropped commands", r.dropped)
+	}
+}
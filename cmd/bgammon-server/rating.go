@@ -0,0 +1,17 @@
+package main
+
+import (
+	"math"
+)
+
+const defaultRating = 1500
+
+// ratingK is the maximum rating change after a match (K-factor).
+var ratingK = 32
+
+// ratingChange returns the rating change of the winner of a match using the
+// Elo rating system.
+func ratingChange(winnerRating int, loserRating int) int {
+	expected := 1 / (1 + math.Pow(10, float64(loserRating-winnerRating)/400))
+	return int(math.Round(float64(ratingK) * (1 - expected)))
+}
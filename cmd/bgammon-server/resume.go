@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// resumeTTL is how long a match which was interrupted by the server shutting
+// down may be resumed. Interrupted matches are not saved when zero.
+var resumeTTL = 24 * time.Hour
+
+// resumableMatch is a match between registered players which was interrupted
+// by the server shutting down. Its state is stored in the database.
+type resumableMatch struct {
+	id       int
+	account1 int
+	account2 int
+	player1  string
+	player2  string
+	saved    int64 // Unix timestamp.
+}
+
+// opponent returns the account and username of the opponent of the provided
+// account.
+func (m *resumableMatch) opponent(account int) (int, string) {
+	if account == m.account1 {
+		return m.account2, m.player2
+	}
+	return m.account1, m.player1
+}
+
+// savedMatch is the state of an interrupted match, which is stored as JSON.
+type savedMatch struct {
+	Name           string
+	Password       string
+	Jacoby         bool
+	AutoDouble     int
+	CrawfordPlayed bool
+	HideSpectators bool
+	Length         int
+	Puzzle         string
+	SetUp          bool
+	Dice           diceState
+	Transcript     *bgammon.Transcript
+
+	// Game is the state of the game at the start of the current turn. The
+	// pending moves of the current turn are replayed when the match is
+	// resumed, as the board states used to undo them are not stored.
+	Game *bgammon.Game
+}
+
+// save returns the state of the match, from which the match may be restored
+// after the server restarts.
+func (g *serverGame) save() ([]byte, error) {
+	game, err := g.turnStart()
+	if err != nil {
+		return nil, err
+	}
+	game.Moves = g.Moves
+
+	return json.Marshal(&savedMatch{
+		Name:           string(g.name),
+		Password:       string(g.password),
+		Jacoby:         g.Jacoby,
+		AutoDouble:     g.AutoDouble,
+		CrawfordPlayed: g.crawfordPlayed,
+		HideSpectators: g.hideSpectators,
+		Length:         g.length,
+		Puzzle:         g.puzzle,
+		SetUp:          g.setUp,
+		Dice:           g.dice.state(),
+		Transcript:     g.transcript,
+		Game:           game,
+	})
+}
+
+// restoreServerGame returns a match restored from the state returned by save.
+// No clients are seated in the restored match.
+func restoreServerGame(id int, state []byte) (*serverGame, error) {
+	saved := &savedMatch{}
+	err := json.Unmarshal(state, saved)
+	if err != nil {
+		return nil, err
+	} else if saved.Game == nil {
+		return nil, fmt.Errorf("no game state")
+	}
+
+	g := newServerGame(id)
+	g.name = []byte(saved.Name)
+	if saved.Password != "" {
+		g.password = []byte(saved.Password)
+	}
+	g.AutoDouble = saved.AutoDouble
+	g.crawfordPlayed = saved.CrawfordPlayed
+	g.hideSpectators = saved.HideSpectators
+	g.length = saved.Length
+	g.puzzle = saved.Puzzle
+	g.setUp = saved.SetUp
+	g.dice = restoreDiceSource(saved.Dice)
+	g.transcript = saved.Transcript
+	g.Game = saved.Game
+	g.Jacoby = saved.Jacoby
+
+	moves := g.Moves
+	g.SetBoard(g.Board)
+	if len(moves) != 0 {
+		if ok, _ := g.AddMoves(moves, false); !ok {
+			return nil, fmt.Errorf("failed to replay moves %v", moves)
+		}
+	}
+	return g, nil
+}
+
+// saveInterruptedMatches stores the matches between registered players which
+// are in progress, so that they may be resumed after the server restarts.
+func (s *server) saveInterruptedMatches() {
+	if db == nil || resumeTTL == 0 {
+		return
+	}
+
+	s.gamesLock.RLock()
+	games := make([]*serverGame, len(s.games))
+	copy(games, s.games)
+	s.gamesLock.RUnlock()
+
+	var saved int
+	for _, g := range games {
+		g.lock.Lock()
+		client1, client2 := g.playerClient(1), g.playerClient(2)
+		if g.terminated() || g.Winner != 0 || client1 == nil || client2 == nil || client1.account <= 0 || client2.account <= 0 {
+			g.lock.Unlock()
+			continue
+		}
+		state, err := g.save()
+		if err == nil {
+			err = storeResumableMatch(&resumableMatch{
+				account1: client1.account,
+				account2: client2.account,
+				player1:  string(client1.name),
+				player2:  string(client2.name),
+				saved:    time.Now().Unix(),
+			}, state)
+		}
+		g.lock.Unlock()
+
+		if err != nil {
+			errorf("failed to save interrupted match %d: %s", g.id, err)
+			continue
+		}
+		saved++
+	}
+	infof("Saved %d interrupted matches", saved)
+}
+
+// loadResumableMatches deletes interrupted matches which have expired, and
+// logs the number of interrupted matches which may be resumed.
+func (s *server) loadResumableMatches() {
+	count, err := purgeResumableMatches()
+	if err != nil {
+		errorf("failed to load interrupted matches: %s", err)
+		return
+	}
+	if count != 0 {
+		infof("Loaded %d interrupted matches which may be resumed", count)
+	}
+}
+
+// offerResume notifies the provided client, who has logged in, of their
+// interrupted matches. Opponents who are online are notified as well.
+func (s *server) offerResume(c *serverClient) {
+	matches, err := resumableMatches(c.account)
+	if err != nil {
+		errorf("failed to load interrupted matches of account %d: %s", c.account, err)
+		return
+	}
+	for _, m := range matches {
+		account, name := m.opponent(c.account)
+		s.clientsLock.Lock()
+		opponent := s.clientByUsername([]byte(name))
+		s.clientsLock.Unlock()
+		if opponent == nil || opponent.account != account {
+			c.sendNotice(fmt.Sprintf("Your match against %s was interrupted when the server restarted. It may be resumed while %s is online.", name, name))
+			continue
+		}
+		const notice = "Your match against %s was interrupted when the server restarted. To resume it, send 'resume %s'."
+		c.sendNotice(fmt.Sprintf(notice, name, name))
+		opponent.sendNotice(fmt.Sprintf(notice, c.name, c.name))
+	}
+}
+
+// resumeMatch restores an interrupted match and seats its players in the
+// same seats they had before the match was interrupted.
+func (s *server) resumeMatch(m *resumableMatch, client1 *serverClient, client2 *serverClient) (*serverGame, error) {
+	state, err := takeResumableMatch(m.id)
+	if err != nil {
+		return nil, err
+	}
+	g, err := restoreServerGame(<-s.newGameIDs, state)
+	if err != nil {
+		return nil, err
+	}
+
+	// Seats are reserved for the players as if they were reconnecting.
+	now := time.Now()
+	g.disconnected1 = &disconnectedClient{client: client1, time: now}
+	g.disconnected2 = &disconnectedClient{client: client2, time: now}
+
+	s.gamesLock.Lock()
+	s.games = append(s.games, g)
+	for _, c := range []*serverClient{client1, client2} {
+		if failed := g.addClient(c); failed != nil {
+			s.gamesLock.Unlock()
+			log.Panicf("failed to add client to resumed match %+v %+v: %s", g, c, failed.Reason)
+		}
+	}
+	s.gamesLock.Unlock()
+
+	// Only allow the same players to rejoin the match.
+	g.allowed1, g.allowed2 = client1.name, client2.name
+	return g, nil
+}
+
+func (s *server) handleResume(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) != 1 {
+		cmd.client.sendNotice("To resume a match which was interrupted when the server restarted, send 'resume <username>'.")
+		return
+	}
+
+	if s.shuttingDown.Load() {
+		cmd.client.sendNotice("The server is shutting down.")
+		return
+	} else if clientGame != nil {
+		cmd.client.sendNotice("Please leave the match you are in before resuming another match.")
+		return
+	} else if cmd.client.account <= 0 {
+		cmd.client.sendNotice("Only registered players may resume matches.")
+		return
+	}
+
+	matches, err := resumableMatches(cmd.client.account)
+	if err != nil {
+		errorf("failed to load interrupted matches of account %d: %s", cmd.client.account, err)
+		cmd.client.sendNotice("Failed to load interrupted matches. Please try again later.")
+		return
+	}
+	var m *resumableMatch
+	for _, match := range matches {
+		if _, name := match.opponent(cmd.client.account); strings.EqualFold(name, string(params[0])) {
+			m = match
+			break
+		}
+	}
+	if m == nil {
+		cmd.client.sendNotice(fmt.Sprintf("You have no interrupted match against %s. Interrupted matches may be resumed for %d hours.", params[0], int(resumeTTL.Hours())))
+		return
+	}
+
+	account, name := m.opponent(cmd.client.account)
+	s.clientsLock.Lock()
+	opponent := s.clientByUsername([]byte(name))
+	s.clientsLock.Unlock()
+
+	switch {
+	case opponent == nil || opponent.account != account:
+		cmd.client.sendNotice(fmt.Sprintf("Match not resumed: %s is not online.", name))
+	case s.gameByClient(opponent) != nil:
+		cmd.client.sendNotice(fmt.Sprintf("Match not resumed: %s is in a match.", opponent.name))
+	case s.resumeRequests[m.id] != opponent:
+		s.resumeRequests[m.id] = cmd.client
+		opponent.sendNotice(fmt.Sprintf("%s would like to resume your interrupted match. To resume it, send 'resume %s'.", cmd.client.name, cmd.client.name))
+		cmd.client.sendNotice(fmt.Sprintf("Asked %s to resume the match.", opponent.name))
+	default:
+		delete(s.resumeRequests, m.id)
+
+		client1, client2 := cmd.client, opponent
+		if cmd.client.account != m.account1 {
+			client1, client2 = opponent, cmd.client
+		}
+		g, err := s.resumeMatch(m, client1, client2)
+		if err != nil {
+			errorf("failed to resume interrupted match %d: %s", m.id, err)
+			cmd.client.sendNotice("Failed to resume the match.")
+			opponent.sendNotice("Failed to resume the match.")
+			return
+		}
+		infof("Clients %s and %s resumed interrupted match %d as match %d", client1.name, client2.name, m.id, g.id)
+		for _, c := range []*serverClient{client1, client2} {
+			c.sendNotice(fmt.Sprintf("Resumed match: %s", g.name))
+		}
+	}
+}
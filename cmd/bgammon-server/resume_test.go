@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+func TestSaveRestoreMatch(t *testing.T) {
+	g := newServerGame(1)
+	g.name = []byte("Friendly match")
+	g.password = []byte("secret")
+	g.crawfordPlayed = true
+	g.hideSpectators = true
+	g.length = 5
+	g.dice = newDiceSource(42)
+	g.dice.roll()
+	g.Player1.Name, g.Player2.Name = "alice", "bob"
+	g.Player1.Points, g.Player2.Points = 3, 4
+	g.Points = 5
+	g.DoubleValue, g.DoublePlayer = 2, 2
+	g.Turn = 1
+	g.Roll1, g.Roll2 = 3, 1
+	if ok, _ := g.AddMoves([][]int{{8, 5}}, false); !ok {
+		t.Fatal("failed to add move")
+	}
+
+	state, err := g.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreServerGame(2, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.id != 2 || string(restored.name) != string(g.name) || string(restored.password) != string(g.password) || !restored.crawfordPlayed || !restored.hideSpectators || restored.length != g.length {
+		t.Errorf("restored match %d named %q with password %q, Crawford played %t, hidden spectators %t and length %d", restored.id, restored.name, restored.password, restored.crawfordPlayed, restored.hideSpectators, restored.length)
+	}
+	if !reflect.DeepEqual(restored.Board, g.Board) || !reflect.DeepEqual(restored.Moves, g.Moves) {
+		t.Errorf("restored board %v with moves %v, expected board %v with moves %v", restored.Board, restored.Moves, g.Board, g.Moves)
+	}
+	if restored.Player1 != g.Player1 || restored.Player2 != g.Player2 || restored.Points != g.Points {
+		t.Errorf("restored players %+v and %+v in a %d point match, expected %+v and %+v in a %d point match", restored.Player1, restored.Player2, restored.Points, g.Player1, g.Player2, g.Points)
+	}
+	if restored.Turn != g.Turn || restored.Roll1 != g.Roll1 || restored.Roll2 != g.Roll2 || restored.DoubleValue != g.DoubleValue || restored.DoublePlayer != g.DoublePlayer {
+		t.Errorf("restored turn %d, roll %d-%d and cube %d owned by player %d", restored.Turn, restored.Roll1, restored.Roll2, restored.DoubleValue, restored.DoublePlayer)
+	}
+
+	// The pending moves may still be undone.
+	if ok, _ := restored.AddMoves([][]int{{5, 8}}, false); !ok || !reflect.DeepEqual(restored.Board, bgammon.NewBoard()) {
+		t.Errorf("undo added: %t, board %v, expected the starting position", ok, restored.Board)
+	}
+
+	// The same dice are rolled after the match is resumed.
+	for i := 0; i < 10; i++ {
+		if roll, other := g.dice.roll(), restored.dice.roll(); roll != other {
+			t.Fatalf("roll %d: rolled %d after restoring, expected %d", i, other, roll)
+		}
+	}
+
+	if _, err := restoreServerGame(3, []byte("{}")); err == nil {
+		t.Error("restored a match without a game state")
+	}
+}
+
+func TestResumeMatch(t *testing.T) {
+	newTestDatabase(t)
+	s := newTestServer(t)
+	c1, c2, g := playMatch(t, s, registerClient(t, s, "alice"), registerClient(t, s, "bob"), "3")
+	setState(t, c1, 1, "31")
+	c1.send("move 8/5")
+	expectEvent[*bgammon.EventMoved](t, c2)
+
+	g.lock.Lock()
+	board, moves, player1 := append([]int(nil), g.Board...), append([][]int(nil), g.Moves...), g.Player1.Name
+	g.lock.Unlock()
+
+	// Matches are saved when the server shuts down.
+	s.saveInterruptedMatches()
+	for _, c := range []*memoryClient{c1, c2} {
+		disconnect(t, s, c)
+	}
+
+	login := func(s *server, username string) *memoryClient {
+		t.Helper()
+		c := s.connectMemoryClient()
+		t.Cleanup(func() {
+			c.send(bgammon.CommandDisconnect)
+		})
+		c.send("loginjson test " + username + " secret")
+		expectEvent[*bgammon.EventWelcome](t, c)
+		return c
+	}
+
+	s = newTestServer(t)
+	s.loadResumableMatches()
+	alice := login(s, "alice")
+	expectNotice(t, alice, "Your match against bob was interrupted when the server restarted. It may be resumed while bob is online.")
+	bob := login(s, "bob")
+	expectNotice(t, bob, "Your match against alice was interrupted when the server restarted. To resume it, send 'resume alice'.")
+	expectNotice(t, alice, "Your match against bob was interrupted when the server restarted. To resume it, send 'resume bob'.")
+
+	alice.send("resume bob")
+	expectNotice(t, alice, "Asked bob to resume the match.")
+	expectNotice(t, bob, "alice would like to resume your interrupted match. To resume it, send 'resume alice'.")
+	bob.send("resume alice")
+	for _, c := range []*memoryClient{alice, bob} {
+		expectNotice(t, c, "Resumed match: alice's match")
+	}
+
+	resumed := s.gameByClient(alice.client)
+	if resumed == nil || resumed != s.gameByClient(bob.client) {
+		t.Fatal("players are not in the resumed match")
+	}
+	resumed.lock.Lock()
+	defer resumed.lock.Unlock()
+	if !reflect.DeepEqual(resumed.Board, board) || !reflect.DeepEqual(resumed.Moves, moves) || resumed.Player1.Name != player1 || resumed.Turn != 1 || resumed.Roll1 != 3 || resumed.Roll2 != 1 {
+		t.Errorf("resumed board %v with moves %v, player 1 %s, turn %d and roll %d-%d, expected board %v with moves %v, player 1 %s, turn 1 and roll 3-1", resumed.Board, resumed.Moves, resumed.Player1.Name, resumed.Turn, resumed.Roll1, resumed.Roll2, board, moves, player1)
+	}
+
+	// The match may only be resumed once.
+	matches, err := resumableMatches(alice.client.account)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Errorf("%d interrupted matches remain after resuming, expected none", len(matches))
+	}
+}
+
+func TestPurgeResumableMatches(t *testing.T) {
+	newTestDatabase(t)
+	now := time.Now()
+	for _, saved := range []time.Time{now.Add(-resumeTTL - time.Minute), now.Add(-resumeTTL / 2), now} {
+		err := storeResumableMatch(&resumableMatch{
+			account1: 1,
+			account2: 2,
+			player1:  "alice",
+			player2:  "bob",
+			saved:    saved.Unix(),
+		}, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count, err := purgeResumableMatches()
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Errorf("%d matches remain after purging, expected 2", count)
+	}
+	matches, err := resumableMatches(2)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 2 {
+		t.Errorf("%d matches may be resumed, expected 2", len(matches))
+	}
+}
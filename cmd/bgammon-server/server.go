@@ -3,32 +3,107 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net"
 	"net/http"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"code.rocket9labs.com/tslocum/bgammon"
 )
 
-const clientTimeout = 40 * time.Second
+// clientTimeout is how long a client may be inactive before it is
+// disconnected.
+var clientTimeout = 40 * time.Second
 
-var allowDebugCommands bool
+// pingInterval is how long a client may be inactive before it is sent a ping.
+var pingInterval = 20 * time.Second
+
+// idleTimeout is how long a player may take to act during a match without
+// time control before they forfeit the game. Players are not forfeited when
+// zero.
+var idleTimeout = 10 * time.Minute
+
+// idleWarning is how long before a player forfeits the game due to
+// inactivity that both players are warned.
+const idleWarning = time.Minute
+
+// clockWarnings are the numbers of seconds remaining on a player's clock at
+// which the players and spectators of a match are warned the clock is about to
+// run out.
+var clockWarnings = []int{30, 10}
+
+// loginTimeout is how long a client may remain connected without logging in.
+const loginTimeout = 30 * time.Second
+
+// listPageSize is the maximum number of matches listed at once.
+const listPageSize = 100
+
+// chatInterval is how long a client must wait between sending global chat
+// messages.
+const chatInterval = 2 * time.Second
+
+// shutdownGracePeriod is how long matches in progress may continue after the
+// server begins shutting down.
+const shutdownGracePeriod = 2 * time.Minute
+
+// commandWorkers is the number of goroutines which handle commands sent by
+// players and spectators in matches. Commands sent in different matches may be
+// handled concurrently, while commands sent in the same match are handled in
+// the order they were received.
+var commandWorkers = runtime.NumCPU()
+
+// maxCommandLength is the maximum length of a command sent by a client, in
+// bytes. Clients which send a longer command are disconnected before the
+// command is handled.
+var maxCommandLength = 4096
+
+var errCommandTooLong = errors.New("command too long")
+
+// maxClients is the maximum number of clients which may be connected at once,
+// not including bots. The number of clients is not limited when zero.
+var maxClients int
+
+// maxGames is the maximum number of matches which may be hosted at once. The
+// number of matches is not limited when zero.
+var maxGames int
+
+// serverVersion is the version of the server. It may be set when building the
+// server using -ldflags "-X main.serverVersion=VERSION".
+var serverVersion = "dev"
+
+// serverFeatures are the optional features supported by the server.
+var serverFeatures = []string{"cube", "clock", "bots", "spectating", "settings", "autoroll", "autook", "requestid"}
 
 var (
 	onlyNumbers = regexp.MustCompile(`^[0-9]+$`)
 	guestName   = regexp.MustCompile(`^guest[0-9]+$`)
+	botName     = regexp.MustCompile(`^bot[0-9]+$`)
+
+	timeControlFormat = regexp.MustCompile(`^[0-9]+(\+[0-9]+)?$`)
+	seedFormat        = regexp.MustCompile(`^(?i)seed=-?[0-9]+$`)
+	autoDoubleFormat  = regexp.MustCompile(`^(?i)autodouble(=[0-9]+)?$`)
+	puzzleFormat      = regexp.MustCompile(`^(?i)puzzle=[A-Za-z0-9+/]{14}:[1-6][1-6]$`)
 )
 
 type serverCommand struct {
-	client  *serverClient
-	command []byte
+	client      *serverClient
+	command     []byte
+	id          int          // Request ID provided by the client, or zero.
+	credentials *credentials // Result of checking the password provided with a login or register command, or nil.
 }
 
 type server struct {
@@ -38,24 +113,72 @@ type server struct {
 	newGameIDs   chan int
 	newClientIDs chan int
 	commands     chan serverCommand
+	tasks        chan func()           // Functions run while handling commands. See runTask.
+	workers      []chan *queuedCommand // Commands sent in matches, sharded by match ID.
+	pending      sync.WaitGroup        // Commands passed to workers which have not been handled.
 	welcome      []byte
+	started      time.Time
+
+	bans []*ban
+
+	invites  []*invite // Pending invitations. Only accessed while handling commands.
+	inviteID int       // ID of the last invitation sent.
+
+	resumeRequests map[int]*serverClient // Players who asked to resume an interrupted match, by match ID. Only accessed while handling commands.
+
+	shuttingDown atomic.Bool
+
+	done     chan struct{}  // Closed when the server is stopped.
+	routines sync.WaitGroup // Goroutines started by newServer.
+
+	debugCommands bool // Whether commands used for testing are allowed. Not changed after the server is created.
 
 	gamesLock   sync.RWMutex
 	clientsLock sync.Mutex
+	bansLock    sync.Mutex
 }
 
-func newServer() *server {
+// newServer returns a new server. Commands used for testing are only allowed
+// when debugCommands is true.
+func newServer(debugCommands bool) *server {
 	const bufferSize = 10
 	s := &server{
-		newGameIDs:   make(chan int),
-		newClientIDs: make(chan int),
-		commands:     make(chan serverCommand, bufferSize),
-		welcome:      []byte("hello Welcome to bgammon.org! Please log in by sending the 'login' command. You may specify a username, otherwise you will be assigned a random username. If you specify a username, you may also specify a password. Have fun!"),
-	}
-	go s.handleNewGameIDs()
-	go s.handleNewClientIDs()
-	go s.handleCommands()
-	go s.handleTerminatedGames()
+		debugCommands:  debugCommands,
+		newGameIDs:     make(chan int),
+		newClientIDs:   make(chan int),
+		commands:       make(chan serverCommand, bufferSize),
+		tasks:          make(chan func()),
+		resumeRequests: make(map[int]*serverClient),
+		done:           make(chan struct{}),
+		started:        time.Now(),
+		welcome:        []byte("hello Welcome to bgammon.org! Please log in by sending the 'login' command. You may specify a username, otherwise you will be assigned a random username. If you specify a username, you may also specify a password. Have fun!"),
+	}
+	if commandWorkers < 1 {
+		commandWorkers = 1
+	}
+	s.workers = make([]chan *queuedCommand, commandWorkers)
+	for i := range s.workers {
+		s.workers[i] = make(chan *queuedCommand, bufferSize)
+	}
+	routines := []func(){s.handleNewGameIDs, s.handleNewClientIDs, s.handleCommands, s.handleTerminatedGames, s.handleClocks, s.handleLobbyUpdates, s.handleDiceAudit}
+	for _, commands := range s.workers {
+		commands := commands
+		routines = append(routines, func() {
+			s.handleWorker(commands)
+		})
+	}
+	s.routines.Add(len(routines))
+	for _, routine := range routines {
+		go func(routine func()) {
+			defer s.routines.Done()
+			routine()
+		}(routine)
+	}
+
+	if db != nil {
+		s.loadBans()
+		s.loadResumableMatches()
+	}
 	return s
 }
 
@@ -72,29 +195,41 @@ func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	now := time.Now().Unix()
 
 	c := &serverClient{
-		id:         <-s.newClientIDs,
-		account:    -1,
-		connected:  now,
-		lastActive: now,
-		commands:   commands,
-		Client:     wsClient,
+		id:        <-s.newClientIDs,
+		account:   -1,
+		address:   webSocketAddress(r),
+		transport: "ws",
+		connected: now,
+		commands:  commands,
+		Client:    wsClient,
 	}
+	c.lastActive.Store(now)
 	s.handleClient(c)
 }
 
 func (s *server) listenWebSocket(address string) {
-	log.Printf("Listening for WebSocket connections on %s...", address)
-	err := http.ListenAndServe(address, http.HandlerFunc(s.handleWebSocket))
-	log.Fatalf("failed to listen on %s: %s", address, err)
+	infof("Listening for WebSocket connections on %s...", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %s", address, err)
+	}
+	go func() {
+		err := http.Serve(listener, http.HandlerFunc(s.handleWebSocket))
+		if s.shuttingDown.Load() {
+			return
+		}
+		log.Fatalf("failed to listen on %s: %s", address, err)
+	}()
+	s.listeners = append(s.listeners, listener)
 }
 
 func (s *server) listen(network string, address string) {
 	if strings.ToLower(network) == "ws" {
-		go s.listenWebSocket(address)
+		s.listenWebSocket(address)
 		return
 	}
 
-	log.Printf("Listening for %s connections on %s...", strings.ToUpper(network), address)
+	infof("Listening for %s connections on %s...", strings.ToUpper(network), address)
 	listener, err := net.Listen(network, address)
 	if err != nil {
 		log.Fatalf("failed to listen on %s: %s", address, err)
@@ -103,18 +238,122 @@ func (s *server) listen(network string, address string) {
 	s.listeners = append(s.listeners, listener)
 }
 
+// listenTLS listens for TCP connections encrypted using the provided TLS
+// certificate and key. The certificate and key are reloaded when the server
+// receives SIGHUP.
+func (s *server) listenTLS(address string, certFile string, keyFile string) {
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("failed to load TLS certificate %s and key %s: %s", certFile, keyFile, err)
+	}
+
+	infof("Listening for TCP connections (TLS) on %s...", address)
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("failed to listen on %s: %s", address, err)
+	}
+	listener = tls.NewListener(listener, &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	})
+	go s.handleListener(listener)
+	s.listeners = append(s.listeners, listener)
+}
+
 func (s *server) handleListener(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown.Load() {
+				return
+			}
 			log.Fatalf("failed to accept connection: %s", err)
 		}
 		go s.handleConnection(conn)
 	}
 }
 
+// Usernames must be between minUsernameLength and maxUsernameLength
+// characters long.
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+// invalidUsername returns the reason the provided username may not be used,
+// or an empty string when the username is valid. Assigned guest usernames
+// are not validated.
+func invalidUsername(username []byte) string {
+	if !utf8.Valid(username) {
+		return "must be valid UTF-8"
+	}
+	length := utf8.RuneCount(username)
+	if length < minUsernameLength {
+		return fmt.Sprintf("must be at least %d characters long", minUsernameLength)
+	} else if length > maxUsernameLength {
+		return fmt.Sprintf("must be at most %d characters long", maxUsernameLength)
+	}
+	for _, r := range string(username) {
+		if unicode.IsControl(r) {
+			return "must not contain control characters"
+		} else if unicode.IsSpace(r) {
+			return "must not contain spaces"
+		}
+	}
+	if onlyNumbers.Match(username) {
+		return "must contain at least one non-numeric character"
+	} else if bytes.Contains(bytes.ToLower(username), []byte("guest")) {
+		return "must not contain the word guest"
+	} else if bytes.EqualFold(username, []byte(anonymousSpectator)) {
+		return "is reserved"
+	}
+	return ""
+}
+
+// maxMatchNameLength is the maximum number of characters in a match name.
+const maxMatchNameLength = 40
+
+// sanitizeMatchName returns the provided match name without control
+// characters, invalid UTF-8 or leading and trailing spaces, truncated to
+// maxMatchNameLength characters. An empty name is returned when nothing
+// remains, in which case the default name should be used instead.
+func sanitizeMatchName(name []byte) []byte {
+	var buf bytes.Buffer
+	var length int
+	for _, r := range string(bytes.TrimSpace(name)) {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			continue
+		} else if length == maxMatchNameLength {
+			break
+		}
+		buf.WriteRune(r)
+		length++
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+// defaultMatchName returns the name of a match created by the provided player
+// when no name is specified.
+func defaultMatchName(username []byte) []byte {
+	abbr := "'s"
+	lastLetter := username[len(username)-1]
+	if lastLetter == 's' || lastLetter == 'S' {
+		abbr = "'"
+	}
+	return []byte(fmt.Sprintf("%s%s match", username, abbr))
+}
+
+// parsePassword returns the match password provided in the specified
+// parameters. Spaces are sent as underscores. Leading and trailing spaces are
+// removed.
+func parsePassword(params [][]byte) []byte {
+	password := bytes.ReplaceAll(bytes.Join(params, []byte(" ")), []byte("_"), []byte(" "))
+	return bytes.TrimSpace(password)
+}
+
 func (s *server) nameAllowed(username []byte) bool {
-	return !guestName.Match(username)
+	lower := bytes.ToLower(username)
+	return !guestName.Match(lower) && !botName.Match(lower)
 }
 
 func (s *server) clientByUsername(username []byte) *serverClient {
@@ -127,17 +366,35 @@ func (s *server) clientByUsername(username []byte) *serverClient {
 	return nil
 }
 
-func (s *server) addClient(c *serverClient) {
+// addClient adds a connected client. False is returned when the maximum
+// number of clients are already connected. Bots are always added.
+func (s *server) addClient(c *serverClient) bool {
 	s.clientsLock.Lock()
 	defer s.clientsLock.Unlock()
 
+	if maxClients > 0 && c.transport != "bot" && len(s.clients) >= maxClients {
+		return false
+	}
 	s.clients = append(s.clients, c)
+	return true
 }
 
 func (s *server) removeClient(c *serverClient) {
 	g := s.gameByClient(c)
 	if g != nil {
-		g.removeClient(c)
+		reason := bgammon.LeftReasonDisconnect
+		if c.timedOut {
+			reason = bgammon.LeftReasonTimeout
+		}
+		g.lock.Lock()
+		s.gamesLock.Lock()
+		if c.playerNumber != 0 && g.Winner == 0 {
+			g.disconnectClient(c, reason)
+		} else {
+			g.removeClient(c, reason)
+		}
+		s.gamesLock.Unlock()
+		g.lock.Unlock()
 	}
 	c.Terminate("")
 
@@ -156,7 +413,14 @@ func (s *server) removeClient(c *serverClient) {
 
 func (s *server) handleTerminatedGames() {
 	t := time.NewTicker(time.Minute)
-	for range t.C {
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
 		s.gamesLock.Lock()
 
 		i := 0
@@ -175,10 +439,198 @@ func (s *server) handleTerminatedGames() {
 	}
 }
 
+// shutdown stops accepting new connections and notifies all clients that the
+// server is shutting down. Matches in progress may continue until they are
+// finished, for up to shutdownGracePeriod. All clients are then disconnected.
+func (s *server) shutdown() {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+
+	ev := &bgammon.EventServerMessage{
+		Message: fmt.Sprintf("The server is shutting down. Matches in progress may continue for up to %d minutes. New matches may not be started.", int(shutdownGracePeriod.Minutes())),
+	}
+	if db != nil && resumeTTL > 0 {
+		ev.Message += " Matches between registered players which have not ended by then may be resumed after the server restarts."
+	}
+	s.runTask(func() {
+		s.clientsLock.Lock()
+		for _, c := range s.clients {
+			c.sendEvent(ev)
+		}
+		s.clientsLock.Unlock()
+	})
+
+	deadline := time.Now().Add(shutdownGracePeriod)
+	t := time.NewTicker(time.Second)
+	for s.activeGames() > 0 && time.Now().Before(deadline) {
+		<-t.C
+	}
+	t.Stop()
+
+	s.saveInterruptedMatches()
+	infof("%s", audit.summary())
+
+	s.runTask(func() {
+		s.clientsLock.Lock()
+		for _, c := range s.clients {
+			c.Terminate("The server is shutting down.")
+		}
+		s.clientsLock.Unlock()
+	})
+
+	// Allow time for clients to receive the reason they were disconnected.
+	time.Sleep(2 * time.Second)
+}
+
+// stop closes the connections of all clients and waits for them to be
+// removed, then stops the goroutines started by newServer. The server may not
+// be used afterward.
+func (s *server) stop() {
+	// Clients are removed as if they lost their connection.
+	s.clientsLock.Lock()
+	for _, c := range s.clients {
+		c.Client.Terminate("The server is shutting down.")
+	}
+	s.clientsLock.Unlock()
+	for {
+		s.clientsLock.Lock()
+		remaining := len(s.clients)
+		s.clientsLock.Unlock()
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.pending.Wait()
+	close(s.done)
+	s.routines.Wait()
+}
+
+// gamesFull returns whether the maximum number of matches are already hosted.
+// Matches which have ended and are waiting to be removed are not counted.
+func (s *server) gamesFull() bool {
+	if maxGames <= 0 {
+		return false
+	}
+
+	s.gamesLock.RLock()
+	defer s.gamesLock.RUnlock()
+
+	var games int
+	for _, g := range s.games {
+		if !g.terminated() {
+			games++
+		}
+	}
+	return games >= maxGames
+}
+
+// activeGames returns the number of matches in progress. It may be called
+// while commands are handled.
+func (s *server) activeGames() int {
+	// Matches are locked individually after the list of matches is
+	// unlocked, as the list is locked while handling commands.
+	s.gamesLock.RLock()
+	games := make([]*serverGame, len(s.games))
+	copy(games, s.games)
+	s.gamesLock.RUnlock()
+
+	var active int
+	for _, g := range games {
+		g.lock.Lock()
+		if !g.terminated() && g.Winner == 0 && g.Player1.Name != "" && g.Player2.Name != "" {
+			active++
+		}
+		g.lock.Unlock()
+	}
+	return active
+}
+
+// handleClocks checks for players who have run out of time, and for players
+// whose opponent did not reconnect within the grace period. Games are only
+// modified while handling commands, so a timeout command is sent on behalf of
+// each affected player.
+func (s *server) handleClocks() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		var timedOut []*serverClient
+
+		// Matches are locked individually after the list of matches is
+		// unlocked, as the list is locked while handling commands.
+		s.gamesLock.RLock()
+		games := make([]*serverGame, len(s.games))
+		copy(games, s.games)
+		s.gamesLock.RUnlock()
+
+		for _, g := range games {
+			g.lock.Lock()
+			switch g.timedOut() {
+			case 1:
+				timedOut = append(timedOut, g.client1)
+			case 2:
+				timedOut = append(timedOut, g.client2)
+			}
+			if g.clockWarning() != 0 {
+				timedOut = append(timedOut, g.playerClient(g.clockPlayer))
+			}
+			switch g.reconnectExpired() {
+			case 1:
+				timedOut = append(timedOut, g.client2)
+			case 2:
+				timedOut = append(timedOut, g.client1)
+			}
+			if player, remaining := g.idleRemaining(); player != 0 && (remaining <= 0 || (!g.idleWarned && remaining <= g.idleWarning())) {
+				timedOut = append(timedOut, g.playerClient(player))
+			}
+			g.lock.Unlock()
+		}
+
+		for _, client := range timedOut {
+			if client == nil {
+				continue
+			}
+			s.queueCommand(serverCommand{
+				client:  client,
+				command: []byte(bgammon.CommandTimeout),
+			})
+		}
+	}
+}
+
 func (s *server) handleClient(c *serverClient) {
-	s.addClient(c)
+	if !s.addClient(c) {
+		infof("Client %s refused: the server is full (%s)", c.label(), c.transport)
+		c.Terminate("The server is full. Please try again later.")
+
+		// Commands sent before the connection is closed are discarded.
+		go func() {
+			for range c.commands {
+			}
+		}()
+		c.HandleReadWrite()
+		close(c.commands)
+		return
+	}
+
+	debugf("Client %s connected (%s)", c.label(), c.transport)
 
-	log.Printf("Client %s connected", c.label())
+	if c.address != "" && s.banned(nil, c.address) {
+		infof("Client %s is banned (%s)", c.label(), c.address)
+		c.Terminate("You are banned from this server.")
+	}
 
 	go s.handlePingClient(c)
 	go s.handleClientCommands(c)
@@ -188,7 +640,7 @@ func (s *server) handleClient(c *serverClient) {
 	// Remove client.
 	s.removeClient(c)
 
-	log.Printf("Client %s disconnected", c.label())
+	debugf("Client %s disconnected", c.label())
 }
 
 func (s *server) handleConnection(conn net.Conn) {
@@ -199,64 +651,173 @@ func (s *server) handleConnection(conn net.Conn) {
 	now := time.Now().Unix()
 
 	c := &serverClient{
-		id:         <-s.newClientIDs,
-		account:    -1,
-		connected:  now,
-		lastActive: now,
-		commands:   commands,
-		Client:     newSocketClient(conn, commands, events),
+		id:        <-s.newClientIDs,
+		account:   -1,
+		address:   remoteHost(conn.RemoteAddr().String()),
+		transport: "tcp",
+		connected: now,
+		commands:  commands,
+		Client:    newSocketClient(conn, commands, events),
 	}
+	c.lastActive.Store(now)
 	s.sendHello(c)
 	s.handleClient(c)
 }
 
+// addBot adds a computer controlled player to the provided game.
+func (s *server) addBot(g *serverGame) {
+	const bufferSize = 8
+	commands := make(chan []byte, bufferSize)
+
+	now := time.Now().Unix()
+
+	id := <-s.newClientIDs
+	name := []byte(fmt.Sprintf("Bot%d", id))
+	c := &serverClient{
+		id:        id,
+		json:      true,
+		name:      name,
+		account:   0,
+		transport: "bot",
+		connected: now,
+		commands:  commands,
+		Client:    newBotClient(string(name), commands),
+	}
+	c.lastActive.Store(now)
+	g.lock.Lock()
+	s.gamesLock.Lock()
+	failed := g.addClient(c)
+	s.gamesLock.Unlock()
+	g.lock.Unlock()
+	if failed != nil {
+		log.Panicf("failed to add bot to game %+v: %s", g, failed.Reason)
+	}
+	go s.handleClient(c)
+}
+
+// handlePingClient periodically checks whether the client should be pinged or
+// disconnected until it is disconnected. Clients are checked while handling
+// commands, as the client is modified while handling its commands.
 func (s *server) handlePingClient(c *serverClient) {
-	// TODO only ping when there is no recent activity
-	t := time.NewTicker(30 * time.Second)
+	checkInterval := 5 * time.Second
+	if pingInterval < checkInterval {
+		checkInterval = pingInterval
+	}
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
 	for {
-		<-t.C
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
 
 		if c.Terminated() {
-			t.Stop()
 			return
 		}
+		s.runTask(func() {
+			pingClient(c, time.Now())
+		})
+	}
+}
 
-		if len(c.name) == 0 {
+// pingClient pings the provided client when it has not been active recently,
+// and disconnects it when it did not log in or respond in time. False is
+// returned when the client is no longer connected.
+func pingClient(c *serverClient, now time.Time) bool {
+	if c.Terminated() {
+		return false
+	}
+
+	if len(c.name) == 0 {
+		if now.Unix()-c.connected >= int64(loginTimeout.Seconds()) {
 			c.Terminate("User did not send login command within 30 seconds.")
-			t.Stop()
-			return
+			return false
 		}
+		return true
+	}
 
-		c.lastPing = time.Now().Unix()
-		c.sendEvent(&bgammon.EventPing{
-			Message: fmt.Sprintf("%d", c.lastPing),
-		})
+	inactive := now.Unix() - c.lastActive.Load()
+	if inactive >= int64(clientTimeout.Seconds()) {
+		c.timedOut = true
+		c.Terminate("Client did not respond to ping.")
+		return false
+	} else if inactive < int64(pingInterval.Seconds()) || now.Unix()-c.lastPing < int64(pingInterval.Seconds()) {
+		// Only ping clients without recent activity.
+		return true
 	}
+
+	c.lastPing = now.Unix()
+	c.pinged = now
+	c.sendEvent(&bgammon.EventPing{
+		Message: fmt.Sprintf("%d", c.lastPing),
+	})
+	return true
 }
 
+// handleClientCommands forwards commands received from a client to the shared
+// command channel. Commands are rate limited so that a single client may not
+// prevent the commands of other clients from being handled.
 func (s *server) handleClientCommands(c *serverClient) {
+	limiter := newRateLimiter()
 	var command []byte
 	for command = range c.commands {
-		s.commands <- serverCommand{
-			client:  c,
-			command: command,
+		if !limiter.allow(time.Now()) {
+			if limiter.exceeded() {
+				c.Terminate("Too many commands sent.")
+			} else if limiter.dropped == 1 {
+				c.sendNotice("You are sending commands too quickly. Some commands were not processed.")
+			}
+			continue
 		}
+
+		id, command := parseRequestID(command)
+		s.queueCommand(serverCommand{
+			client:      c,
+			command:     command,
+			id:          id,
+			credentials: checkCredentials(command),
+		})
+	}
+}
+
+// parseRequestID parses the optional request ID which may precede a command.
+// The ID is a positive number, and is included in the events sent in reply
+// to the command.
+func parseRequestID(command []byte) (int, []byte) {
+	command = bytes.TrimSpace(command)
+	firstSpace := bytes.IndexByte(command, ' ')
+	if firstSpace == -1 || !onlyNumbers.Match(command[:firstSpace]) {
+		return 0, command
+	}
+	id, err := strconv.Atoi(string(command[:firstSpace]))
+	if err != nil || id < 1 {
+		return 0, command
 	}
+	return id, command[firstSpace+1:]
 }
 
 func (s *server) handleNewGameIDs() {
 	gameID := 1
 	for {
-		s.newGameIDs <- gameID
-		gameID++
+		select {
+		case <-s.done:
+			return
+		case s.newGameIDs <- gameID:
+			gameID++
+		}
 	}
 }
 
 func (s *server) handleNewClientIDs() {
 	clientID := 1
 	for {
-		s.newClientIDs <- clientID
-		clientID++
+		select {
+		case <-s.done:
+			return
+		case s.newClientIDs <- clientID:
+			clientID++
+		}
 	}
 }
 
@@ -271,6 +832,21 @@ func (s *server) randomUsername() []byte {
 	}
 }
 
+// sendVersion sends the server version, protocol version and supported
+// features to the provided client. Clients may provide their name and version,
+// which is recorded.
+func (s *server) sendVersion(c *serverClient, params [][]byte) {
+	if len(params) > 0 {
+		c.application = string(params[0])
+		debugf("Client %s is using %s", c.label(), c.application)
+	}
+	c.sendEvent(&bgammon.EventVersion{
+		Server:   "bgammon-server/" + serverVersion,
+		Protocol: bgammon.ProtocolVersion,
+		Features: serverFeatures,
+	})
+}
+
 func (s *server) sendHello(c *serverClient) {
 	if c.json {
 		return
@@ -283,825 +859,2542 @@ func (s *server) gameByClient(c *serverClient) *serverGame {
 	defer s.gamesLock.RUnlock()
 
 	for _, g := range s.games {
-		if g.client1 == c || g.client2 == c {
+		if g.client1 == c || g.client2 == c || g.spectating(c) {
 			return g
 		}
 	}
 	return nil
 }
 
-func (s *server) handleCommands() {
-	var cmd serverCommand
-COMMANDS:
-	for cmd = range s.commands {
-		if cmd.client == nil {
-			log.Panicf("nil client with command %s", cmd.command)
-		} else if cmd.client.terminating || cmd.client.Terminated() {
-			continue
+// gameByID returns the match with the provided ID, which may have ended.
+func (s *server) gameByID(id int) *serverGame {
+	s.gamesLock.RLock()
+	defer s.gamesLock.RUnlock()
+
+	for _, g := range s.games {
+		if g.id == id {
+			return g
 		}
+	}
+	return nil
+}
 
-		cmd.command = bytes.TrimSpace(cmd.command)
+// autoRoll rolls on behalf of the player whose turn it is when they have
+// enabled automatic rolling. Players are not rolled for when they may offer a
+// double, or while rolling to determine who goes first. The roll command is
+// sent on behalf of the player, as games are only modified while handling
+// commands.
+func (s *server) autoRoll(g *serverGame) {
+	if g.Winner != 0 || g.Turn == 0 || g.Roll1 != 0 || g.DoubleOffered {
+		return
+	}
+	client := g.client1
+	if g.Turn == 2 {
+		client = g.client2
+	}
+	if client == nil || !client.settings.AutoRoll {
+		return
+	}
+	gs := &bgammon.GameState{
+		Game:         g.Game,
+		PlayerNumber: g.Turn,
+	}
+	if gs.MayDouble() || gs.MayRaccoon() {
+		return
+	}
+	go s.queueCommand(serverCommand{
+		client:  client,
+		command: []byte(bgammon.CommandRoll),
+	})
+}
 
-		firstSpace := bytes.IndexByte(cmd.command, ' ')
-		var keyword string
-		var startParameters int
-		if firstSpace == -1 {
-			keyword = string(cmd.command)
-			startParameters = len(cmd.command)
-		} else {
-			keyword = string(cmd.command[:firstSpace])
-			startParameters = firstSpace + 1
-		}
-		if keyword == "" {
-			continue
+func (s *server) handleCommands() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case cmd := <-s.commands:
+			s.handleCommand(cmd)
+		case f := <-s.tasks:
+			s.pending.Wait()
+			f()
 		}
-		keyword = strings.ToLower(keyword)
-		params := bytes.Fields(cmd.command[startParameters:])
+	}
+}
 
-		// Require users to send login command first.
-		if cmd.client.account == -1 {
-			if keyword == bgammon.CommandLogin || keyword == bgammon.CommandLoginJSON || keyword == "l" || keyword == "lj" {
-				if keyword == bgammon.CommandLoginJSON || keyword == "lj" {
-					cmd.client.json = true
-				}
+// runTask runs the provided function while handling commands, when no other
+// command is being handled, and returns after it has run. Clients may be
+// modified by the function. The function is not run after the server is
+// stopped.
+func (s *server) runTask(f func()) {
+	ran := make(chan struct{})
+	select {
+	case <-s.done:
+		return
+	case s.tasks <- func() {
+		defer close(ran)
+		f()
+	}:
+	}
+	select {
+	case <-s.done:
+	case <-ran:
+	}
+}
 
-				s.clientsLock.Lock()
-
-				var username []byte
-				var password []byte
-				readUsername := func() bool {
-					if cmd.client.json {
-						if len(params) > 1 {
-							username = params[1]
-						}
-					} else {
-						if len(params) > 0 {
-							username = params[0]
-						}
-					}
-					var randomUsername bool
-					if len(bytes.TrimSpace(username)) == 0 {
-						username = s.randomUsername()
-						randomUsername = true
-					}
-					if onlyNumbers.Match(username) {
-						cmd.client.Terminate("Invalid username: must contain at least one non-numeric character.")
-						return false
-					} else if s.clientByUsername(username) != nil || (!randomUsername && !s.nameAllowed(username)) {
-						cmd.client.Terminate("That username is already in use.")
-						return false
-					}
-					return true
-				}
-				if !readUsername() {
-					s.clientsLock.Unlock()
-					continue
-				}
-				if len(params) > 2 {
-					password = bytes.ReplaceAll(bytes.Join(params[2:], []byte(" ")), []byte("_"), []byte(" "))
-				}
+// queueCommand passes a command to be handled. Commands queued after the
+// server is stopped are discarded.
+func (s *server) queueCommand(cmd serverCommand) {
+	select {
+	case <-s.done:
+	case s.commands <- cmd:
+	}
+}
 
-				s.clientsLock.Unlock()
+// handleCommand handles a command sent by a client. Commands which only affect
+// the match the client is in are passed to the worker of the match. All other
+// commands are handled after the commands passed to workers, so that they are
+// never handled concurrently with any other command.
+func (s *server) handleCommand(cmd serverCommand) {
+	defer s.recoverCommand(cmd)
 
-				if len(password) > 0 {
-					cmd.client.account = 1
-				} else {
-					cmd.client.account = 0
-				}
-				cmd.client.name = username
+	if cmd.client == nil {
+		log.Panicf("nil client with command %s", cmd.command)
+	} else if cmd.client.terminating || cmd.client.Terminated() {
+		return
+	}
 
-				cmd.client.sendEvent(&bgammon.EventWelcome{
-					PlayerName: string(cmd.client.name),
-					Clients:    len(s.clients),
-					Games:      len(s.games),
-				})
+	cmd.client.lastActive.Store(time.Now().Unix())
 
-				log.Printf("Client %d logged in as %s", cmd.client.id, cmd.client.name)
-
-				// Rejoin match in progress.
-				s.gamesLock.RLock()
-				for _, g := range s.games {
-					if g.terminated() || g.Winner != 0 {
-						continue
-					}
-
-					var rejoin bool
-					if bytes.Equal(cmd.client.name, g.allowed1) {
-						rejoin = g.rejoin1
-					} else if bytes.Equal(cmd.client.name, g.allowed2) {
-						rejoin = g.rejoin2
-					}
-					if rejoin {
-						ok, _ := g.addClient(cmd.client)
-						if ok {
-							cmd.client.sendNotice(fmt.Sprintf("Rejoined match: %s", g.name))
-						}
-					}
-				}
-				s.gamesLock.RUnlock()
-				continue
-			}
+	cmd.command = bytes.TrimSpace(cmd.command)
 
+	firstSpace := bytes.IndexByte(cmd.command, ' ')
+	var keyword string
+	var startParameters int
+	if firstSpace == -1 {
+		keyword = string(cmd.command)
+		startParameters = len(cmd.command)
+	} else {
+		keyword = string(cmd.command[:firstSpace])
+		startParameters = firstSpace + 1
+	}
+	if keyword == "" {
+		return
+	}
+	keyword = strings.ToLower(keyword)
+	params := bytes.Fields(cmd.command[startParameters:])
+
+	metrics.command(keyword)
+
+	// Require users to send login command first.
+	var c *registeredCommand
+	if cmd.client.account == -1 {
+		if loginKeyword(keyword) {
+			c = loginCommand
+		} else if c = lookupCommand(keyword); c == nil || !c.beforeLogin {
+			cmd.client.requestID.Store(int64(cmd.id))
 			cmd.client.Terminate("You must login before using other commands.")
-			continue
+			cmd.client.requestID.Store(0)
+			return
 		}
+	} else if c = lookupCommand(keyword); c == nil {
+		debugf("Received unknown command from client %s: %s", cmd.client.label(), cmd.command)
+		return
+	}
 
-		clientGame := s.gameByClient(cmd.client)
-
-		switch keyword {
-		case bgammon.CommandHelp, "h":
-			// TODO get extended help by specifying a command after help
-			cmd.client.sendEvent(&bgammon.EventHelp{
-				Topic:   "",
-				Message: "Test help text",
-			})
-		case bgammon.CommandJSON:
-			sendUsage := func() {
-				cmd.client.sendNotice("To enable JSON formatted messages, send 'json on'. To disable JSON formatted messages, send 'json off'.")
-			}
-			if len(params) != 1 {
-				sendUsage()
-				continue
-			}
-			paramLower := strings.ToLower(string(params[0]))
-			switch paramLower {
-			case "on":
-				cmd.client.json = true
-				cmd.client.sendNotice("JSON formatted messages enabled.")
-			case "off":
-				cmd.client.json = false
-				cmd.client.sendNotice("JSON formatted messages disabled.")
-			default:
-				sendUsage()
+	if c.concurrent {
+		if g := s.gameByClient(cmd.client); g != nil {
+			s.pending.Add(1)
+			s.workers[g.id%len(s.workers)] <- &queuedCommand{
+				cmd:     cmd,
+				c:       c,
+				keyword: keyword,
+				params:  params,
 			}
-		case bgammon.CommandSay, "s":
-			if len(params) == 0 {
-				continue
-			}
-			if clientGame == nil {
-				cmd.client.sendNotice("Message not sent: You are not currently in a match.")
-				continue
-			}
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice("Message not sent: There is no one else in the match.")
-				continue
-			}
-			ev := &bgammon.EventSay{
-				Message: string(bytes.Join(params, []byte(" "))),
-			}
-			ev.Player = string(cmd.client.name)
-			opponent.sendEvent(ev)
-		case bgammon.CommandList, "ls":
-			ev := &bgammon.EventList{}
-
-			s.gamesLock.RLock()
-			var playerCount int
-			for _, g := range s.games {
-				if g.terminated() {
-					continue
-				}
-				if len(g.allowed1) != 0 && !bytes.Equal(g.allowed1, cmd.client.name) && !bytes.Equal(g.allowed2, cmd.client.name) {
-					playerCount = 2
-				} else {
-					playerCount = g.playerCount()
-				}
-				ev.Games = append(ev.Games, bgammon.GameListing{
-					ID:       g.id,
-					Points:   g.Points,
-					Password: len(g.password) != 0,
-					Players:  playerCount,
-					Name:     string(g.name),
-				})
-			}
-			s.gamesLock.RUnlock()
+			return
+		}
+	}
 
-			cmd.client.sendEvent(ev)
-		case bgammon.CommandCreate, "c":
-			if clientGame != nil {
-				cmd.client.sendNotice("Failed to create match: Please leave the match you are in before creating another.")
-				continue
+	s.pending.Wait()
+	c.run(s, cmd, keyword, params)
+}
+
+// queuedCommand is a command which was passed to a worker.
+type queuedCommand struct {
+	cmd     serverCommand
+	c       *registeredCommand
+	keyword string
+	params  [][]byte
+}
+
+// handleWorker handles the commands passed to a worker, in the order they were
+// received.
+func (s *server) handleWorker(commands chan *queuedCommand) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case q := <-commands:
+			s.handleQueuedCommand(q)
+		}
+	}
+}
+
+func (s *server) handleQueuedCommand(q *queuedCommand) {
+	defer s.pending.Done()
+	defer s.recoverCommand(q.cmd)
+
+	if q.cmd.client.terminating || q.cmd.client.Terminated() {
+		return
+	}
+	q.c.run(s, q.cmd, q.keyword, q.params)
+}
+
+// recoverCommand recovers from a panic while handling a command. The panic is
+// logged with the command and the client which sent it, and the client is
+// informed that its command failed.
+func (s *server) recoverCommand(cmd serverCommand) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	label := "<nil>"
+	if cmd.client != nil {
+		label = cmd.client.label()
+	}
+	errorf("Recovered from panic while handling command from client %s: %s: %v\n%s", label, cmd.command, r, debug.Stack())
+
+	if cmd.client != nil {
+		cmd.client.sendNotice("An unexpected error occurred while handling your command.")
+	}
+}
+
+// loginKeyword returns whether the provided keyword is that of the login or
+// register command.
+func loginKeyword(keyword string) bool {
+	switch keyword {
+	case bgammon.CommandLogin, bgammon.CommandLoginJSON, "l", "lj", bgammon.CommandRegister, bgammon.CommandRegisterJSON, "rj":
+		return true
+	}
+	return false
+}
+
+// loginRequest is a login or register command.
+type loginRequest struct {
+	json        bool   // Whether JSON formatted events were requested.
+	register    bool   // Whether an account is being registered.
+	application string // Name of the client, which is only provided when requesting JSON formatted events.
+	lang        []byte // Language code, or nil.
+	email       []byte // Email address of the account being registered, or nil when none was provided.
+	username    []byte // Username, or nil to be assigned a random username.
+	password    []byte // Password, or nil to log in as a guest.
+}
+
+// parseLogin parses the parameters of a login or register command.
+func parseLogin(keyword string, params [][]byte) *loginRequest {
+	l := &loginRequest{
+		json:     keyword == bgammon.CommandLoginJSON || keyword == "lj" || keyword == bgammon.CommandRegisterJSON || keyword == "rj",
+		register: keyword == bgammon.CommandRegister || keyword == bgammon.CommandRegisterJSON || keyword == "rj",
+	}
+
+	// Read client name.
+	if l.json && len(params) > 0 {
+		l.application = string(params[0])
+		params = params[1:]
+	}
+
+	// Read optional language.
+	if len(params) > 0 && languageFormat.Match(params[0]) {
+		l.lang = params[0][5:]
+		params = params[1:]
+	}
+
+	if l.register {
+		if len(params) < 3 {
+			return l
+		}
+		l.email = params[0]
+		params = params[1:]
+	}
+
+	if len(params) > 0 {
+		l.username = params[0]
+	}
+	if len(params) > 1 {
+		l.password = bytes.ReplaceAll(bytes.Join(params[1:], []byte(" ")), []byte("_"), []byte(" "))
+	}
+	return l
+}
+
+// credentials are the result of checking the password provided with a login
+// or register command.
+type credentials struct {
+	account *account // Account logged in to.
+	hash    string   // Hash of the password of the account being registered.
+	err     error
+}
+
+// checkCredentials checks the password provided with a login command, or
+// hashes the password provided with a register command. Nil is returned for
+// other commands. Passwords are checked before the command is handled, as
+// checking a password is slow and commands are handled one at a time.
+func checkCredentials(command []byte) *credentials {
+	fields := bytes.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	keyword := strings.ToLower(string(fields[0]))
+	if !loginKeyword(keyword) {
+		return nil
+	}
+	l := parseLogin(keyword, fields[1:])
+	if len(l.password) == 0 {
+		return nil
+	} else if db == nil {
+		return &credentials{err: errAccountsDisabled}
+	}
+
+	if l.register {
+		hash, err := hashPassword(l.password)
+		return &credentials{hash: hash, err: err}
+	}
+	a, err := loginAccount(l.username, l.password)
+	return &credentials{account: a, err: err}
+}
+
+// handleLogin handles the login and register commands, which are the only
+// commands accepted before logging in other than the version command.
+func (s *server) handleLogin(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	l := parseLogin(keyword, params)
+	if l.json {
+		cmd.client.json = true
+		if l.application != "" {
+			cmd.client.application = l.application
+		}
+	}
+	if l.lang != nil {
+		cmd.client.lang = parseLanguage(string(l.lang))
+	}
+
+	if l.register && l.email == nil {
+		cmd.client.Terminate("Failed to register: an email address, username and password must be provided.")
+		return
+	}
+
+	// Passwords are checked before the command is handled.
+	creds := cmd.credentials
+	if len(l.password) > 0 && creds == nil {
+		creds = &credentials{err: errInvalidLogin}
+	}
+
+	s.clientsLock.Lock()
+
+	username := l.username
+	readUsername := func() bool {
+		var randomUsername bool
+		if len(bytes.TrimSpace(username)) == 0 {
+			username = s.randomUsername()
+			randomUsername = true
+		}
+		if !randomUsername {
+			if reason := invalidUsername(username); reason != "" {
+				cmd.client.Terminate(fmt.Sprintf("Invalid username: %s.", reason))
+				return false
+			}
+		}
+		if s.clientByUsername(username) != nil || (!randomUsername && !s.nameAllowed(username)) {
+			cmd.client.Terminate("That username is already in use.")
+			return false
+		} else if s.banned(username, "") {
+			cmd.client.Terminate("You are banned from this server.")
+			return false
+		}
+		return true
+	}
+	if !readUsername() {
+		s.clientsLock.Unlock()
+		return
+	}
+
+	s.clientsLock.Unlock()
+
+	if l.register {
+		if creds.err != nil {
+			cmd.client.Terminate(fmt.Sprintf("Failed to register: %s.", creds.err))
+			return
+		}
+		a := &account{
+			email:    string(l.email),
+			username: string(username),
+			password: creds.hash,
+		}
+		err := registerAccount(a)
+		if err != nil {
+			cmd.client.Terminate(fmt.Sprintf("Failed to register: %s.", err))
+			return
+		}
+		cmd.client.account = a.id
+		cmd.client.name = []byte(a.username)
+		cmd.client.rating = a.rating
+	} else if len(l.password) > 0 {
+		if creds.err != nil {
+			cmd.client.Terminate(fmt.Sprintf("Failed to log in: %s.", creds.err))
+			return
+		}
+		a := creds.account
+		cmd.client.account = a.id
+		cmd.client.name = []byte(a.username)
+		cmd.client.rating = a.rating
+		cmd.client.admin = a.admin
+		cmd.client.settings = a.settings
+		if a.settings.JSON {
+			cmd.client.json = true
+		}
+
+		muted, err := mutedPlayers(a.id)
+		if err != nil {
+			errorf("failed to load muted players of %s: %s", a.username, err)
+		}
+		cmd.client.muted = make(map[string]bool)
+		for _, username := range muted {
+			cmd.client.muted[strings.ToLower(username)] = true
+		}
+
+		friends, err := friends(a.id)
+		if err != nil {
+			errorf("failed to load friends of %s: %s", a.username, err)
+		}
+		cmd.client.friends = make(map[string]string)
+		for _, username := range friends {
+			cmd.client.friends[strings.ToLower(username)] = username
+		}
+	} else {
+		// Guests may not use the username of a registered account, as
+		// players are allowed to rejoin their matches by username.
+		registered, err := accountExists(username)
+		if err != nil {
+			cmd.client.Terminate(fmt.Sprintf("Failed to log in: %s.", err))
+			return
+		} else if registered {
+			cmd.client.Terminate("That username belongs to a registered account. Please log in using its password.")
+			return
+		}
+		cmd.client.account = 0
+		cmd.client.name = username
+	}
+
+	s.clientsLock.Lock()
+	totalClients := len(s.clients)
+	s.clientsLock.Unlock()
+	s.gamesLock.RLock()
+	totalGames := len(s.games)
+	s.gamesLock.RUnlock()
+	cmd.client.sendEvent(&bgammon.EventWelcome{
+		PlayerName: string(cmd.client.name),
+		Rating:     cmd.client.rating,
+		Clients:    totalClients,
+		Games:      totalGames,
+	})
+	cmd.client.sendEvent(&bgammon.EventSession{
+		ClientID:   cmd.client.id,
+		Registered: cmd.client.account > 0,
+		Time:       time.Now().Unix(),
+		Protocol:   bgammon.ProtocolVersion,
+	})
+
+	metrics.logins.Add(1)
+	if cmd.client.application != "" {
+		infof("Client %d logged in as %s using %s", cmd.client.id, cmd.client.name, cmd.client.application)
+	} else {
+		infof("Client %d logged in as %s", cmd.client.id, cmd.client.name)
+	}
+
+	// Rejoin match in progress.
+	s.gamesLock.RLock()
+	games := make([]*serverGame, len(s.games))
+	copy(games, s.games)
+	s.gamesLock.RUnlock()
+
+	for _, g := range games {
+		g.lock.Lock()
+		s.gamesLock.Lock()
+		var rejoined bool
+		if !g.terminated() && g.Winner == 0 {
+			var rejoin bool
+			if bytes.Equal(cmd.client.name, g.allowed1) {
+				rejoin = g.rejoin1
+			} else if bytes.Equal(cmd.client.name, g.allowed2) {
+				rejoin = g.rejoin2
+			}
+			if rejoin || g.mayReconnect(cmd.client) {
+				rejoined = g.addClient(cmd.client) == nil
 			}
+		}
+		s.gamesLock.Unlock()
+		g.lock.Unlock()
+
+		if rejoined {
+			cmd.client.sendNotice(fmt.Sprintf("Rejoined match: %s", g.name))
+		}
+	}
+
+	// Offer to resume matches which were interrupted by the server restarting.
+	if cmd.client.account > 0 && db != nil && s.gameByClient(cmd.client) == nil {
+		s.offerResume(cmd.client)
+	}
+
+	s.notifyFriends(cmd.client)
+}
+
+func (s *server) handleHelp(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	var topic string
+	if len(params) > 0 {
+		topic = strings.ToLower(string(params[0]))
+	}
+	text, ok := s.helpText(cmd.client, topic)
+	if !ok {
+		cmd.client.sendNotice(fmt.Sprintf("No help is available for %s. Send 'help' to list all commands.", params[0]))
+		return
+	}
+	cmd.client.sendEvent(&bgammon.EventHelp{
+		Topic:   topic,
+		Message: text,
+	})
+}
+
+func (s *server) handleVersion(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	s.sendVersion(cmd.client, params)
+}
+
+func (s *server) handleStatus(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	s.clientsLock.Lock()
+	clients := len(s.clients)
+	s.clientsLock.Unlock()
+
+	s.gamesLock.RLock()
+	games := len(s.games)
+	s.gamesLock.RUnlock()
+
+	ev := &bgammon.EventStatus{
+		Uptime:  int64(time.Since(s.started).Seconds()),
+		Clients: clients,
+		Games:   games,
+	}
+	if cmd.client.admin {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		ev.GoroutineCount = runtime.NumGoroutine()
+		ev.MemoryMB = int(m.Sys / 1024 / 1024)
+	}
+	cmd.client.sendEvent(ev)
+}
+
+func (s *server) handleJSON(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	sendUsage := func() {
+		cmd.client.sendNotice("To enable JSON formatted messages, send 'json on'. To disable JSON formatted messages, send 'json off'.")
+	}
+	if len(params) != 1 {
+		sendUsage()
+		return
+	}
+	paramLower := strings.ToLower(string(params[0]))
+	switch paramLower {
+	case "on":
+		cmd.client.json = true
+		cmd.client.sendNotice("JSON formatted messages enabled.")
+	case "off":
+		cmd.client.json = false
+		cmd.client.sendNotice("JSON formatted messages disabled.")
+	default:
+		sendUsage()
+	}
+}
+
+func (s *server) handleSay(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 0 {
+		return
+	}
+	if clientGame == nil {
+		cmd.client.sendNotice("Message not sent: You are not currently in a match.")
+		return
+	}
+	if clientGame.playerCount()+len(clientGame.spectators) < 2 {
+		cmd.client.sendNotice("Message not sent: There is no one else in the match.")
+		return
+	}
+	ev := &bgammon.EventSay{
+		Message: string(bytes.Join(params, []byte(" "))),
+	}
+	ev.Player = string(cmd.client.name)
+	if clientGame.hideSpectators && clientGame.spectating(cmd.client) {
+		ev.Player = anonymousSpectator
+	}
+	clientGame.eachClient(func(client *serverClient) {
+		if client != cmd.client && !client.mutes(cmd.client.name) {
+			client.sendEvent(ev)
+		}
+	})
+	clientGame.addChat(ev)
+}
+
+func (s *server) handleChat(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 0 {
+		cmd.client.sendNotice("To send a message to all players, send 'chat <message>'. To stop receiving messages, send 'chat off'. To receive messages again, send 'chat on'.")
+		return
+	}
+	if len(params) == 1 {
+		switch strings.ToLower(string(params[0])) {
+		case "on":
+			cmd.client.chatOff = false
+			cmd.client.sendNotice("Chat messages enabled.")
+			return
+		case "off":
+			cmd.client.chatOff = true
+			cmd.client.sendNotice("Chat messages disabled.")
+			return
+		}
+	}
+	if cmd.client.chatOff {
+		cmd.client.sendNotice("Message not sent: You have disabled chat messages. To enable chat messages, send 'chat on'.")
+		return
+	}
+	now := time.Now()
+	if now.Sub(cmd.client.lastChat) < chatInterval {
+		cmd.client.sendNotice("Message not sent: You are sending messages too quickly.")
+		return
+	}
+	cmd.client.lastChat = now
+
+	ev := &bgammon.EventChat{
+		Message: string(bytes.Join(params, []byte(" "))),
+	}
+	ev.Player = string(cmd.client.name)
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if sc != cmd.client && len(sc.name) != 0 && !sc.chatOff && !sc.mutes(cmd.client.name) {
+			sc.sendEvent(ev)
+		}
+	}
+	s.clientsLock.Unlock()
+}
+
+func (s *server) handleWhisper(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 1 {
+		switch strings.ToLower(string(params[0])) {
+		case "on":
+			cmd.client.whisperOff = false
+			cmd.client.sendNotice("Private messages enabled.")
+			return
+		case "off":
+			cmd.client.whisperOff = true
+			cmd.client.sendNotice("Private messages disabled.")
+			return
+		}
+	}
+	if len(params) < 2 {
+		cmd.client.sendNotice("To send a private message, send 'whisper <username> <message>'. To stop receiving private messages, send 'whisper off'. To receive private messages again, send 'whisper on'.")
+		return
+	}
+
+	ev := &bgammon.EventWhisper{
+		Message: string(bytes.Join(params[1:], []byte(" "))),
+	}
+	ev.Player = string(cmd.client.name)
+
+	// The lock is held while the message is delivered so that the
+	// recipient is not removed in the meantime.
+	s.clientsLock.Lock()
+	target := s.clientByUsername(params[0])
+	var notice string
+	switch {
+	case target == nil || len(target.name) == 0:
+		notice = fmt.Sprintf("Message not sent: %s is not online.", params[0])
+	case target == cmd.client:
+		notice = "Message not sent: You may not send a private message to yourself."
+	case target.whisperOff:
+		notice = fmt.Sprintf("Message not sent: %s is not accepting private messages.", target.name)
+	case target.mutes(cmd.client.name):
+		// Messages from muted players are discarded silently.
+	default:
+		target.sendEvent(ev)
+	}
+	s.clientsLock.Unlock()
+
+	if notice != "" {
+		cmd.client.sendNotice(notice)
+	}
+}
+
+// handleMute handles the mute and unmute commands.
+func (s *server) handleMute(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) != 1 {
+		cmd.client.sendNotice(fmt.Sprintf("Please specify a username. For example: %s alice", keyword))
+		return
+	}
+	username := string(params[0])
+	lower := strings.ToLower(username)
+	if lower == strings.ToLower(string(cmd.client.name)) {
+		cmd.client.sendNotice("You may not mute yourself.")
+		return
+	}
+
+	var err error
+	if keyword == bgammon.CommandMute {
+		if cmd.client.muted == nil {
+			cmd.client.muted = make(map[string]bool)
+		}
+		cmd.client.muted[lower] = true
+		if cmd.client.account > 0 {
+			err = mutePlayer(cmd.client.account, username)
+		}
+		cmd.client.sendNotice(fmt.Sprintf("Muted %s. Messages from %s will not be delivered to you.", username, username))
+	} else {
+		if !cmd.client.muted[lower] {
+			cmd.client.sendNotice(fmt.Sprintf("%s is not muted.", username))
+			return
+		}
+		delete(cmd.client.muted, lower)
+		if cmd.client.account > 0 {
+			err = unmutePlayer(cmd.client.account, username)
+		}
+		cmd.client.sendNotice(fmt.Sprintf("Unmuted %s.", username))
+	}
+	if err != nil {
+		errorf("failed to update muted players of %s: %s", cmd.client.name, err)
+	}
+}
+
+func (s *server) handleAutoRoll(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) != 1 {
+		cmd.client.sendNotice("To roll automatically at the start of your turn, send 'autoroll on'. To stop rolling automatically, send 'autoroll off'.")
+		return
+	}
+	err := changeSetting(&cmd.client.settings, "autoroll", string(params[0]))
+	if err != nil {
+		cmd.client.sendNotice(fmt.Sprintf("Failed to change setting: %s.", err))
+		return
+	}
+	if cmd.client.account > 0 {
+		err = saveSettings(cmd.client.account, cmd.client.settings)
+		if err != nil {
+			errorf("failed to save settings of %s: %s", cmd.client.name, err)
+		}
+	}
+	if cmd.client.settings.AutoRoll {
+		cmd.client.sendNotice("Automatic rolling enabled.")
+		if clientGame != nil {
+			s.autoRoll(clientGame)
+		}
+	} else {
+		cmd.client.sendNotice("Automatic rolling disabled.")
+	}
+}
+
+func (s *server) handleAutoOk(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) != 1 {
+		cmd.client.sendNotice("To end your turn automatically when no other play was possible, send 'autook on'. To stop ending your turn automatically, send 'autook off'.")
+		return
+	}
+	err := changeSetting(&cmd.client.settings, "autook", string(params[0]))
+	if err != nil {
+		cmd.client.sendNotice(fmt.Sprintf("Failed to change setting: %s.", err))
+		return
+	}
+	if cmd.client.account > 0 {
+		err = saveSettings(cmd.client.account, cmd.client.settings)
+		if err != nil {
+			errorf("failed to save settings of %s: %s", cmd.client.name, err)
+		}
+	}
+	if cmd.client.settings.AutoOk {
+		cmd.client.sendNotice("Automatic confirmation of forced plays enabled.")
+		if clientGame != nil && clientGame.confirmTurn(cmd.client) {
+			s.autoRoll(clientGame)
+		}
+	} else {
+		cmd.client.sendNotice("Automatic confirmation of forced plays disabled.")
+	}
+}
+
+func (s *server) handleSettings(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 0 || (len(params) == 1 && strings.ToLower(string(params[0])) == "get") {
+		cmd.client.sendEvent(&bgammon.EventSettings{
+			Settings: cmd.client.settings,
+		})
+		return
+	} else if len(params) != 3 || strings.ToLower(string(params[0])) != "set" {
+		cmd.client.sendNotice(fmt.Sprintf("To view your settings, send 'settings get'. To change a setting, send 'settings set <name> <value>'. Available settings: %s", strings.Join(settingNames, ", ")))
+		return
+	}
+
+	err := changeSetting(&cmd.client.settings, string(params[1]), string(params[2]))
+	if err != nil {
+		cmd.client.sendNotice(fmt.Sprintf("Failed to change setting: %s.", err))
+		return
+	}
+	if strings.ToLower(string(params[1])) == "json" {
+		cmd.client.json = cmd.client.settings.JSON
+	}
+	if cmd.client.settings.AutoOk && clientGame != nil {
+		clientGame.confirmTurn(cmd.client)
+	}
+	if cmd.client.settings.AutoRoll && clientGame != nil {
+		s.autoRoll(clientGame)
+	}
+
+	// Settings of guests are only kept for the current session.
+	if cmd.client.account > 0 {
+		err = saveSettings(cmd.client.account, cmd.client.settings)
+		if err != nil {
+			errorf("failed to save settings of %s: %s", cmd.client.name, err)
+		}
+	}
+
+	cmd.client.sendEvent(&bgammon.EventSettings{
+		Settings: cmd.client.settings,
+	})
+}
+
+func (s *server) handleMuted(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(cmd.client.muted) == 0 {
+		cmd.client.sendNotice("You have not muted any players.")
+		return
+	}
+	muted := make([]string, 0, len(cmd.client.muted))
+	for username := range cmd.client.muted {
+		muted = append(muted, username)
+	}
+	sort.Strings(muted)
+	cmd.client.sendNotice(fmt.Sprintf("Muted players: %s", strings.Join(muted, ", ")))
+}
+
+// handleKick handles the kick, ban and unban commands.
+func (s *server) handleKick(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 0 || (keyword != bgammon.CommandBan && len(params) != 1) || len(params) > 2 {
+		switch keyword {
+		case bgammon.CommandKick:
+			cmd.client.sendNotice("To disconnect a player, send 'kick <username>'.")
+		case bgammon.CommandBan:
+			cmd.client.sendNotice("To ban a player, send 'ban <username> [minutes]'. Players are banned permanently when no duration is specified.")
+		default:
+			cmd.client.sendNotice("To remove all bans of a player, send 'unban <username>'.")
+		}
+		return
+	}
+	username := string(params[0])
+
+	if keyword == bgammon.CommandUnban {
+		if !s.removeBans(username) {
+			cmd.client.sendNotice(fmt.Sprintf("%s is not banned.", username))
+			return
+		}
+		infof("Moderator %s unbanned %s", cmd.client.name, username)
+		cmd.client.sendNotice(fmt.Sprintf("Unbanned %s.", username))
+		return
+	}
+
+	var minutes int
+	if len(params) == 2 {
+		var err error
+		minutes, err = strconv.Atoi(string(params[1]))
+		if err != nil || minutes < 1 {
+			cmd.client.sendNotice("Invalid ban duration: please specify a number of minutes.")
+			return
+		}
+	}
+
+	s.clientsLock.Lock()
+	target := s.clientByUsername(params[0])
+	s.clientsLock.Unlock()
+	if target == cmd.client {
+		cmd.client.sendNotice(fmt.Sprintf("You may not %s yourself.", keyword))
+		return
+	} else if keyword == bgammon.CommandKick && target == nil {
+		cmd.client.sendNotice(fmt.Sprintf("%s is not online.", username))
+		return
+	}
+
+	if keyword == bgammon.CommandKick {
+		infof("Moderator %s kicked %s", cmd.client.name, target.name)
+		target.Terminate("You have been disconnected by a moderator.")
+		cmd.client.sendNotice(fmt.Sprintf("Kicked %s.", target.name))
+		return
+	}
+
+	b := &ban{
+		username:  strings.ToLower(username),
+		moderator: string(cmd.client.name),
+	}
+	duration := "permanently"
+	if minutes > 0 {
+		b.expires = time.Now().Add(time.Duration(minutes) * time.Minute).Unix()
+		duration = fmt.Sprintf("for %d minutes", minutes)
+	}
+	if target != nil {
+		b.address = target.address
+	}
+	s.addBan(b)
+
+	infof("Moderator %s banned %s (%s) %s", cmd.client.name, username, b.address, duration)
+	if target != nil {
+		target.Terminate("You have been banned by a moderator.")
+	}
+	cmd.client.sendNotice(fmt.Sprintf("Banned %s %s.", username, duration))
+}
+
+func (s *server) handleList(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	sendUsage := func() {
+		cmd.client.sendNotice(fmt.Sprintf("To list matches, send 'list [open] [offset] [limit]'. When open is specified, only matches which may be joined are listed. Up to %d matches are listed at once.", listPageSize))
+	}
+
+	var open bool
+	if len(params) > 0 && strings.ToLower(string(params[0])) == "open" {
+		open = true
+		params = params[1:]
+	}
+	offset, limit := 0, listPageSize
+	if len(params) > 2 {
+		sendUsage()
+		return
+	}
+	if len(params) > 0 {
+		var err error
+		offset, err = strconv.Atoi(string(params[0]))
+		if err != nil || offset < 0 {
+			sendUsage()
+			return
+		}
+	}
+	if len(params) > 1 {
+		var err error
+		limit, err = strconv.Atoi(string(params[1]))
+		if err != nil || limit < 1 || limit > listPageSize {
+			sendUsage()
+			return
+		}
+	}
+
+	var games []bgammon.GameListing
+	s.gamesLock.RLock()
+	for _, g := range s.games {
+		if g.terminated() {
+			continue
+		}
+		listing := g.listing(cmd.client)
+		if open && listing.Players == 2 {
+			continue
+		}
+		games = append(games, listing)
+	}
+	s.gamesLock.RUnlock()
+	sortListings(games)
+
+	ev := &bgammon.EventList{
+		Offset: offset,
+		Total:  len(games),
+	}
+	if offset < len(games) {
+		end := offset + limit
+		if end > len(games) {
+			end = len(games)
+		}
+		ev.Games = games[offset:end]
+	}
+	cmd.client.sendEvent(ev)
+}
+
+func (s *server) handleCreate(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame != nil {
+		cmd.client.sendEvent(&bgammon.EventFailedCreate{
+			Code:   bgammon.ErrorInMatch,
+			Reason: "Failed to create match: Please leave the match you are in before creating another.",
+		})
+		return
+	} else if s.shuttingDown.Load() {
+		cmd.client.sendEvent(&bgammon.EventFailedCreate{
+			Code:   bgammon.ErrorShuttingDown,
+			Reason: "Failed to create match: The server is shutting down.",
+		})
+		return
+	} else if s.gamesFull() {
+		cmd.client.sendEvent(&bgammon.EventFailedCreate{
+			Code:   bgammon.ErrorServerFull,
+			Reason: "Failed to create match: The server may not host any more matches. Please try again later.",
+		})
+		return
+	}
+
+	sendFailed := func(reason string) {
+		cmd.client.sendEvent(&bgammon.EventFailedCreate{
+			Code:   bgammon.ErrorUsage,
+			Reason: reason,
+		})
+	}
+	sendUsage := func() {
+		sendFailed("To create a public match please specify whether it is public or private, and also specify how many points are needed to win the match. When creating a private match, a password must also be provided. To play against the computer, specify bot instead of public or private.")
+	}
+	if len(params) < 2 {
+		sendUsage()
+		return
+	}
+
+	var gamePassword []byte
+	gameType := bytes.ToLower(params[0])
+	var gamePoints []byte
+	var extra [][]byte
+	var bot bool
+	switch {
+	case bytes.Equal(gameType, []byte("public")), bytes.Equal(gameType, []byte("bot")):
+		bot = bytes.Equal(gameType, []byte("bot"))
+		gamePoints = params[1]
+		extra = params[2:]
+	case bytes.Equal(gameType, []byte("private")):
+		if len(params) < 3 {
+			sendUsage()
+			return
+		}
+		gamePassword = parsePassword(params[1:2])
+		if len(gamePassword) == 0 {
+			sendUsage()
+			return
+		}
+		gamePoints = params[2]
+		extra = params[3:]
+	default:
+		sendUsage()
+		return
+	}
+
+	points, err := strconv.Atoi(string(gamePoints))
+	if err != nil || points < 1 || points > 99 {
+		sendUsage()
+		return
+	}
+
+	// Parse options, which may be specified in any order. The parameters
+	// following the last option are the name of the match.
+	var (
+		timeControl, timeIncrement int
+		jacoby                     bool
+		noGammons                  bool
+		beavers                    bool
+		autoDouble                 int
+		balanced                   bool
+		hideSpectators             bool
+		puzzle                     string
+		puzzleRoll                 [2]int
+		seed                       int64
+		setSeed                    bool
+	)
+options:
+	for len(extra) > 0 {
+		option := extra[0]
+		lower := bytes.ToLower(option)
+		switch {
+		case timeControlFormat.Match(option):
+			// Time control in the form SECONDS or SECONDS+INCREMENT.
+			split := bytes.SplitN(option, []byte("+"), 2)
+			timeControl, err = strconv.Atoi(string(split[0]))
+			if err == nil && len(split) == 2 {
+				timeIncrement, err = strconv.Atoi(string(split[1]))
+			}
+			if err != nil || timeControl < 1 || timeControl > 86400 || timeIncrement > 3600 {
+				sendFailed("To create a match with time control, specify the number of seconds on each player's clock, optionally followed by a plus sign and the number of seconds added after each turn. For example: 300+5")
+				return
+			}
+		case bytes.Equal(lower, []byte("jacoby")):
+			// Matches are not affected by the Jacoby rule.
+			if points != 1 {
+				sendFailed("The Jacoby rule may only be enabled for single games. Matches to more than one point are not affected by the Jacoby rule.")
+				return
+			}
+			jacoby = true
+		case bytes.Equal(lower, []byte("nogammon")):
+			// Gammons and backgammons are scored as single games.
+			noGammons = true
+		case bytes.Equal(lower, []byte("beaver")):
+			// Beavers and raccoons are only allowed in single games.
+			if points != 1 {
+				sendFailed("Beavers may only be enabled for single games. Matches to more than one point do not allow beavers.")
+				return
+			}
+			beavers = true
+		case autoDoubleFormat.Match(option):
+			// Automatic doubles only apply to single games. A limit of the
+			// value of the doubling cube may be specified.
+			if points != 1 {
+				sendFailed("Automatic doubles may only be enabled for single games. Matches to more than one point are not affected by automatic doubles.")
+				return
+			}
+			autoDouble = maxAutoDouble
+			if split := bytes.SplitN(option, []byte("="), 2); len(split) == 2 {
+				autoDouble, err = strconv.Atoi(string(split[1]))
+				if err != nil || autoDouble < 2 || autoDouble > maxAutoDouble || autoDouble&(autoDouble-1) != 0 {
+					sendFailed(fmt.Sprintf("To limit automatic doubles, specify the highest value of the doubling cube as a power of two between 2 and %d. For example: autodouble=4", maxAutoDouble))
+					return
+				}
+			}
+		case bytes.Equal(lower, []byte("balanced")):
+			balanced = true
+		case bytes.Equal(lower, []byte("hidespectators")):
+			hideSpectators = true
+		case puzzleFormat.Match(option):
+			// Puzzle position and dice.
+			split := strings.SplitN(string(option[7:]), ":", 2)
+			err := validPuzzle(split[0])
+			if err != nil {
+				cmd.client.sendEvent(&bgammon.EventFailedCreate{
+					Code:   bgammon.ErrorInvalidPosition,
+					Reason: fmt.Sprintf("Failed to create puzzle: %s.", err),
+				})
+				return
+			}
+			puzzle = split[0]
+			puzzleRoll = [2]int{int(split[1][0] - '0'), int(split[1][1] - '0')}
+		case bytes.HasPrefix(lower, []byte("puzzle=")):
+			sendFailed("To create a puzzle, specify a GNU Backgammon Position ID followed by a colon and the dice rolled. For example: puzzle=4HPwATDgc/ABMA:31")
+			return
+		case seedFormat.Match(option):
+			// Dice seed, which is only allowed for testing.
+			if !s.debugCommands {
+				sendFailed("Matches with a specified dice seed may only be created when debug commands are enabled.")
+				return
+			}
+			seed, err = strconv.ParseInt(string(option[5:]), 10, 64)
+			if err != nil {
+				sendFailed("To create a match with a specified dice seed, specify seed=NUMBER.")
+				return
+			}
+			setSeed = true
+		default:
+			break options
+		}
+		extra = extra[1:]
+	}
+	gameName := sanitizeMatchName(bytes.Join(extra, []byte(" ")))
+
+	// Set default game name.
+	if len(gameName) == 0 {
+		gameName = defaultMatchName(cmd.client.name)
+	}
+
+	g := newServerGame(<-s.newGameIDs)
+	g.name = gameName
+	g.Points = points
+	g.password = gamePassword
+	g.TimeControl = timeControl
+	g.TimeIncrement = timeIncrement
+	g.resetClocks()
+	g.Jacoby = jacoby
+	g.Beavers = beavers
+	g.NoGammons = noGammons
+	g.AutoDouble = autoDouble
+	g.hideSpectators = hideSpectators
+	g.creator = cmd.client.name
+	g.puzzle = puzzle
+	g.puzzleRoll = puzzleRoll
+	g.puzzleJoiner = !bot
+	if setSeed {
+		g.dice = newDiceSource(seed)
+	}
+	g.dice.balanced = balanced
+	if failed := g.addClient(cmd.client); failed != nil {
+		log.Panicf("failed to add client to newly created game %+v %+v: %s", g, cmd.client, failed.Reason)
+	}
+
+	s.gamesLock.Lock()
+	s.games = append(s.games, g)
+	s.gamesLock.Unlock()
+
+	infof("Client %s created match %d", cmd.client.name, g.id)
+
+	cmd.client.sendNotice(fmt.Sprintf("Created match: %s", g.name))
+
+	if bot {
+		s.addBot(g)
+	} else if len(g.password) == 0 {
+		cmd.client.sendNotice("Note: Please be patient as you wait for another player to join the match. A chime will sound when another player joins. While you wait, join the bgammon.org community via Discord, Matrix or IRC at bgammon.org/community")
+	}
+}
+
+func (s *server) handleJoin(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if s.shuttingDown.Load() {
+		cmd.client.sendEvent(&bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorShuttingDown,
+			Reason: "The server is shutting down.",
+		})
+		return
+	}
+
+	sendUsage := func() {
+		cmd.client.sendNotice("To join a match please specify its ID or the name of a player in the match. To join a private match, a password must also be specified.")
+	}
+
+	if len(params) == 0 {
+		sendUsage()
+		return
+	}
+
+	var joinGameID int
+	if onlyNumbers.Match(params[0]) {
+		gameID, err := strconv.Atoi(string(params[0]))
+		if err == nil && gameID > 0 {
+			joinGameID = gameID
+		}
+
+		if joinGameID == 0 {
+			sendUsage()
+			return
+		}
+	} else {
+		s.clientsLock.Lock()
+		if sc := s.clientByUsername(params[0]); sc != nil {
+			if g := s.gameByClient(sc); g != nil {
+				joinGameID = g.id
+			}
+		}
+		s.clientsLock.Unlock()
+
+		if joinGameID == 0 {
+			cmd.client.sendEvent(&bgammon.EventFailedJoin{
+				Code:   bgammon.ErrorMatchNotFound,
+				Reason: "Match not found.",
+			})
+			return
+		}
+	}
+
+	if clientGame != nil {
+		failed := &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorInMatch,
+			Reason: "Please leave the match you are in before joining another.",
+		}
+		if clientGame.id == joinGameID {
+			failed.Code, failed.Reason = bgammon.ErrorAlreadyInMatch, "You are already in this match."
+		}
+		cmd.client.sendEvent(failed)
+		return
+	}
+
+	// Seats are assigned while the match is locked, so only one of
+	// multiple players joining a match at once may take its last seat.
+	g := s.gameByID(joinGameID)
+	if g == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorMatchNotFound,
+			Reason: "Match not found.",
+		})
+		return
+	}
+	g.lock.Lock()
+	s.gamesLock.Lock()
+	var failed *bgammon.EventFailedJoin
+	switch {
+	case g.terminated():
+		failed = &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorMatchNotFound,
+			Reason: "Match not found.",
+		}
+	case !g.passwordMatches(parsePassword(params[1:])):
+		failed = &bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorInvalidPassword,
+			Reason: "Invalid password.",
+		}
+	default:
+		failed = g.addClient(cmd.client)
+	}
+	s.gamesLock.Unlock()
+	g.lock.Unlock()
+
+	if failed != nil {
+		cmd.client.sendEvent(failed)
+	} else {
+		cmd.client.sendNotice(fmt.Sprintf("Joined match: %s", g.name))
+	}
+}
+
+func (s *server) handleWatch(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame != nil {
+		cmd.client.sendEvent(&bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorInMatch,
+			Reason: "Please leave the match you are in before watching another.",
+		})
+		return
+	}
+
+	sendUsage := func() {
+		cmd.client.sendNotice("To watch a match please specify its ID or the name of a player in the match. To watch a private match, a password must also be specified.")
+	}
+
+	if len(params) == 0 {
+		sendUsage()
+		return
+	}
+
+	var gameID int
+	var player *serverClient
+	if onlyNumbers.Match(params[0]) {
+		var err error
+		gameID, err = strconv.Atoi(string(params[0]))
+		if err != nil || gameID < 1 {
+			sendUsage()
+			return
+		}
+	} else {
+		s.clientsLock.Lock()
+		player = s.clientByUsername(params[0])
+		s.clientsLock.Unlock()
+		if player == nil {
+			cmd.client.sendEvent(&bgammon.EventFailedJoin{
+				Code:   bgammon.ErrorMatchNotFound,
+				Reason: fmt.Sprintf("%s is not online.", params[0]),
+			})
+			return
+		}
+	}
+
+	var g *serverGame
+	if player != nil {
+		g = s.gameByClient(player)
+	} else {
+		g = s.gameByID(gameID)
+	}
+
+	// The match of a player is checked again once the match is locked, as
+	// the player may leave their match after it was looked up.
+	found := g != nil
+	var watching bool
+	if found {
+		g.lock.Lock()
+		s.gamesLock.Lock()
+		found = !g.terminated() && (player == nil || g.client1 == player || g.client2 == player || g.spectating(player))
+		if found && g.passwordMatches(parsePassword(params[1:])) {
+			g.addSpectator(cmd.client)
+			watching = true
+		}
+		s.gamesLock.Unlock()
+		g.lock.Unlock()
+	}
+
+	if watching {
+		cmd.client.sendNotice(fmt.Sprintf("Watching match: %s", g.name))
+		return
+	} else if found {
+		cmd.client.sendEvent(&bgammon.EventFailedJoin{
+			Code:   bgammon.ErrorInvalidPassword,
+			Reason: "Invalid password.",
+		})
+		return
+	}
+
+	reason := "Match not found."
+	if player != nil {
+		reason = fmt.Sprintf("%s is not in a match.", player.name)
+	}
+	cmd.client.sendEvent(&bgammon.EventFailedJoin{
+		Code:   bgammon.ErrorMatchNotFound,
+		Reason: reason,
+	})
+}
+
+func (s *server) handleLeave(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedLeave{
+			Code:   bgammon.ErrorNotInMatch,
+			Reason: "You are not currently in a match.",
+		})
+		return
+	}
+
+	if cmd.client.playerNumber == 1 {
+		clientGame.rejoin1 = false
+	} else if cmd.client.playerNumber == 2 {
+		clientGame.rejoin2 = false
+	}
+
+	s.gamesLock.Lock()
+	clientGame.removeClient(cmd.client, bgammon.LeftReasonLeave)
+	s.gamesLock.Unlock()
+}
+
+func (s *server) handleCancel(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if cmd.client.playerNumber == 0 || !bytes.Equal(clientGame.creator, cmd.client.name) {
+		cmd.client.sendNotice("You may only cancel matches you created.")
+		return
+	} else if clientGame.allowed1 != nil || clientGame.playerCount() != 1 || clientGame.reconnecting(1) || clientGame.reconnecting(2) {
+		cmd.client.sendNotice("You may not cancel a match after another player has joined. To leave the match, send 'leave'.")
+		return
+	}
+
+	// Cancelled matches are no longer listed, and are removed along
+	// with other terminated matches.
+	s.gamesLock.Lock()
+	clientGame.cancelled = true
+	clientGame.removeClient(cmd.client, bgammon.LeftReasonLeave)
+	for len(clientGame.spectators) > 0 {
+		clientGame.removeClient(clientGame.spectators[0], bgammon.LeftReasonLeave)
+	}
+	s.gamesLock.Unlock()
+
+	infof("Client %s cancelled match %d", cmd.client.name, clientGame.id)
+	cmd.client.sendNotice(fmt.Sprintf("Cancelled match: %s", clientGame.name))
+}
+
+func (s *server) handleInvite(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) == 0 || len(params) > 2 {
+		cmd.client.sendNotice("To invite a player to play a match, send 'invite <username> [points]'.")
+		return
+	}
+
+	points := 1
+	if len(params) == 2 {
+		var err error
+		points, err = strconv.Atoi(string(params[1]))
+		if err != nil || points < 1 || points > 99 {
+			cmd.client.sendNotice("Invalid number of points: please specify a number between 1 and 99.")
+			return
+		}
+	}
+
+	if s.shuttingDown.Load() {
+		cmd.client.sendNotice("The server is shutting down.")
+		return
+	} else if clientGame != nil {
+		cmd.client.sendNotice("Please leave the match you are in before inviting another player.")
+		return
+	}
+
+	s.clientsLock.Lock()
+	target := s.clientByUsername(params[0])
+	s.clientsLock.Unlock()
+
+	var notice string
+	switch {
+	case target == nil || len(target.name) == 0:
+		notice = fmt.Sprintf("Invitation not sent: %s is not online.", params[0])
+	case target == cmd.client:
+		notice = "Invitation not sent: You may not invite yourself."
+	case target.transport == "bot":
+		notice = "Invitation not sent: To play against a computer controlled player, create a match with the bot option."
+	case s.gameByClient(target) != nil:
+		notice = fmt.Sprintf("Invitation not sent: %s is in a match.", target.name)
+	case target.mutes(cmd.client.name):
+		// Invitations from muted players are discarded silently.
+		notice = fmt.Sprintf("Invited %s to play a %d point match.", target.name, points)
+	default:
+		inv := s.addInvite(cmd.client, target, points)
+		infof("Client %s invited %s (invitation %d)", cmd.client.name, target.name, inv.id)
+		notice = fmt.Sprintf("Invited %s to play a %d point match.", target.name, points)
+	}
+	cmd.client.sendNotice(notice)
+}
+
+func (s *server) handleDecline(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	var id int
+	var err error
+	if len(params) == 1 {
+		id, err = strconv.Atoi(string(params[0]))
+	}
+	if len(params) != 1 || err != nil {
+		cmd.client.sendNotice("To decline an invitation, send 'decline <id>'.")
+		return
+	}
+
+	inv := s.takeInvite(cmd.client, id)
+	if inv == nil {
+		cmd.client.sendNotice("Invitation not found. It may have expired or been withdrawn.")
+		return
+	}
+
+	inv.from.sendNotice(fmt.Sprintf("%s declined your invitation.", cmd.client.name))
+	cmd.client.sendNotice(fmt.Sprintf("Declined invitation from %s.", inv.from.name))
+}
+
+func (s *server) handleDouble(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.client.sendNotice("It is not your turn.")
+		return
+	}
+
+	if clientGame.Crawford {
+		cmd.client.sendNotice("You may not double during the Crawford game. The doubling cube may not be used during the game after a player first reaches match point.")
+		return
+	}
 
-			sendUsage := func() {
-				cmd.client.sendNotice("To create a public match please specify whether it is public or private, and also specify how many points are needed to win the match. When creating a private match, a password must also be provided.")
-			}
-			if len(params) < 2 {
-				sendUsage()
-				continue
+	switch clientGame.phase() {
+	case phaseDoubled:
+		cmd.client.sendNotice("You have already offered a double.")
+		return
+	case phaseMoving:
+		cmd.client.sendNotice("You may not double after rolling. Players may only double before rolling on their turn.")
+		return
+	}
+
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+		Available:    clientGame.LegalMoves(false),
+	}
+	if !gameState.MayDouble() {
+		cmd.client.sendNotice("You may not double at this time.")
+		return
+	}
+
+	if clientGame.DoublePlayer != 0 && clientGame.DoublePlayer != cmd.client.playerNumber {
+		cmd.client.sendNotice("You do not currently hold the doubling cube.")
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice("You may not double until your opponent rejoins the match.")
+		return
+	}
+
+	clientGame.offerDouble(cmd.client)
+}
+
+func (s *server) handleAccept(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	// Invitations are accepted by specifying their ID.
+	if len(params) > 0 {
+		id, err := strconv.Atoi(string(params[0]))
+		if err != nil || len(params) != 1 {
+			cmd.client.sendNotice("To accept an invitation, send 'accept <id>'.")
+			return
+		}
+
+		// The invitation is kept while the player is in a match, so
+		// that it may be accepted after leaving the match.
+		if clientGame != nil {
+			cmd.client.sendNotice("Please leave the match you are in before accepting an invitation.")
+			return
+		} else if s.shuttingDown.Load() {
+			cmd.client.sendNotice("The server is shutting down.")
+			return
+		} else if s.gamesFull() {
+			cmd.client.sendNotice("The server may not host any more matches. Please try again later.")
+			return
+		}
+
+		inv := s.takeInvite(cmd.client, id)
+		if inv == nil {
+			cmd.client.sendNotice("Invitation not found. It may have expired or been withdrawn.")
+			return
+		} else if s.gameByClient(inv.from) != nil {
+			cmd.client.sendNotice(fmt.Sprintf("Invitation not accepted: %s has joined another match.", inv.from.name))
+			return
+		}
+
+		g := s.startInvitedMatch(inv)
+		infof("Client %s accepted invitation from %s to match %d", cmd.client.name, inv.from.name, g.id)
+		inv.from.sendNotice(fmt.Sprintf("%s accepted your invitation.", cmd.client.name))
+		cmd.client.sendNotice(fmt.Sprintf("Joined match: %s", g.name))
+		return
+	}
+
+	if clientGame == nil {
+		cmd.client.sendNotice("You are not currently in a match.")
+		return
+	}
+
+	if cmd.client.playerNumber == 0 {
+		cmd.client.sendNotice("You are spectating this match.")
+		return
+	}
+
+	if !clientGame.DoubleOffered || clientGame.Turn == cmd.client.playerNumber {
+		cmd.client.sendNotice("There is no double offer to accept.")
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice("You may not accept the double until your opponent rejoins the match.")
+		return
+	}
+
+	clientGame.acceptDouble(cmd.client)
+	s.autoRoll(clientGame)
+}
+
+// handleBeaver handles the beaver and raccoon commands.
+func (s *server) handleBeaver(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if !clientGame.Beavers {
+		cmd.client.sendNotice("Beavers and raccoons are not allowed in this match.")
+		return
+	}
+
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+	}
+	if keyword == bgammon.CommandBeaver && !gameState.MayBeaver() {
+		cmd.client.sendNotice("There is no double offer to beaver.")
+		return
+	} else if keyword == bgammon.CommandRaccoon && !gameState.MayRaccoon() {
+		cmd.client.sendNotice("You may only raccoon after your double offer is beavered, before rolling.")
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice(fmt.Sprintf("You may not %s until your opponent rejoins the match.", keyword))
+		return
+	}
+
+	if keyword == bgammon.CommandBeaver {
+		clientGame.beaver(cmd.client)
+	} else {
+		clientGame.raccoon(cmd.client)
+	}
+	s.autoRoll(clientGame)
+}
+
+func (s *server) handleReject(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+		Available:    clientGame.LegalMoves(false),
+	}
+	if !gameState.MayReject() {
+		cmd.client.sendNotice("There is no double offer to reject.")
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice("You may not reject the double until your opponent rejoins the match.")
+		return
+	}
+
+	clientGame.rejectDouble(cmd.client)
+}
+
+func (s *server) handleResign(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	var match bool
+	if len(params) > 0 {
+		switch strings.ToLower(string(params[0])) {
+		case "game":
+		case "match":
+			match = true
+		default:
+			cmd.client.sendNotice("To resign the current game, send 'resign game'. To resign the entire match, send 'resign match'.")
+			return
+		}
+	}
+
+	gameState := &bgammon.GameState{
+		Game:         clientGame.Game,
+		PlayerNumber: cmd.client.playerNumber,
+		Available:    clientGame.LegalMoves(false),
+	}
+	if !gameState.MayConcede() {
+		cmd.client.sendNotice("You may not resign at this time.")
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice("You may not resign until your opponent rejoins the match.")
+		return
+	}
+
+	// Resigning the game while considering a double offer declines it.
+	if !match && gameState.MayReject() {
+		clientGame.rejectDouble(cmd.client)
+		return
+	}
+	clientGame.resign(cmd.client, match)
+}
+
+func (s *server) handleRoll(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedRoll{
+			Code:   bgammon.ErrorNotInMatch,
+			Reason: "You are not currently in a match.",
+		})
+		return
+	} else if cmd.client.playerNumber == 0 {
+		cmd.client.sendEvent(&bgammon.EventFailedRoll{
+			Code:   bgammon.ErrorSpectating,
+			Reason: "You are spectating this match.",
+		})
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedRoll{
+			Code:   bgammon.ErrorOpponentAway,
+			Reason: "You may not roll until your opponent rejoins the match.",
+		})
+		return
+	}
+
+	if clientGame.phase() == phaseDoubled {
+		cmd.client.sendEvent(&bgammon.EventFailedRoll{
+			Code:   bgammon.ErrorDoubleOffered,
+			Reason: "You may not roll until the double is accepted or declined.",
+		})
+		return
+	}
+
+	if !clientGame.roll(cmd.client.playerNumber) {
+		cmd.client.sendEvent(&bgammon.EventFailedRoll{
+			Code:   bgammon.ErrorNotYourTurn,
+			Reason: "It is not your turn to roll.",
+		})
+		return
+	}
+
+	ev := &bgammon.EventRolled{
+		Roll1: clientGame.Roll1,
+		Roll2: clientGame.Roll2,
+	}
+	ev.Player = string(cmd.client.name)
+	if clientGame.Turn == 0 && clientGame.Roll1 != 0 && clientGame.Roll2 != 0 {
+		if clientGame.Roll1 > clientGame.Roll2 {
+			clientGame.Turn = 1
+		} else if clientGame.Roll2 > clientGame.Roll1 {
+			clientGame.Turn = 2
+		} else {
+			ev.Tie = true
+			clientGame.Roll1 = 0
+			clientGame.Roll2 = 0
+		}
+	}
+	if ev.Tie {
+		clientGame.openingTie(ev)
+	} else {
+		clientGame.eachClient(func(client *serverClient) {
+			client.sendEvent(ev)
+			if clientGame.Turn != 0 || !client.json {
+				clientGame.sendBoard(client)
 			}
+		})
+	}
 
-			var gamePassword []byte
-			gameType := bytes.ToLower(params[0])
-			var gameName []byte
-			var gamePoints []byte
-			switch {
-			case bytes.Equal(gameType, []byte("public")):
-				gamePoints = params[1]
-				if len(params) > 2 {
-					gameName = bytes.Join(params[2:], []byte(" "))
-				}
-			case bytes.Equal(gameType, []byte("private")):
-				if len(params) < 3 {
-					sendUsage()
-					continue
-				}
-				gamePassword = bytes.ReplaceAll(params[1], []byte("_"), []byte(" "))
-				gamePoints = params[2]
-				if len(params) > 3 {
-					gameName = bytes.Join(params[3:], []byte(" "))
-				}
-			default:
+	// End the turn when none of the dice rolled may be used.
+	if clientGame.passTurn(cmd.client.name) {
+		s.autoRoll(clientGame)
+	}
+}
+
+func (s *server) handleMove(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorNotInMatch,
+			Reason: "You are not currently in a match.",
+		})
+		return
+	} else if cmd.client.playerNumber == 0 {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorSpectating,
+			Reason: "You are spectating this match.",
+		})
+		return
+	}
+
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorNotYourTurn,
+			Reason: "It is not your turn to move.",
+		})
+		return
+	}
+
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorOpponentAway,
+			Reason: "You may not move until your opponent rejoins the match.",
+		})
+		return
+	}
+
+	switch clientGame.phase() {
+	case phasePreRoll:
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorNotRolled,
+			Reason: "You must roll before moving.",
+		})
+		return
+	case phaseDoubled:
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorDoubleOffered,
+			Reason: "You may not move until the double is accepted or declined.",
+		})
+		return
+	}
+
+	sendUsage := func() {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorUsage,
+			Reason: "Specify one or more moves in the form FROM/TO. For example: 8/4 6/4 or 13/7",
+		})
+	}
+
+	if len(params) == 0 {
+		sendUsage()
+		return
+	}
+
+	// Moves of a single checker may be combined, such as 13/7, and
+	// may include intermediate spaces, such as 13/9/7.
+	var moves [][]int
+	for i := range params {
+		split := bytes.Split(params[i], []byte("/"))
+		if len(split) < 2 {
+			sendUsage()
+			return
+		}
+		for j := 1; j < len(split); j++ {
+			from := bgammon.ParseSpace(string(split[j-1]))
+			if from == -1 {
 				sendUsage()
-				continue
+				return
 			}
-
-			points, err := strconv.Atoi(string(gamePoints))
-			if err != nil || points < 1 || points > 99 {
+			to := bgammon.ParseSpace(string(split[j]))
+			if to == -1 {
 				sendUsage()
-				continue
+				return
 			}
 
-			// Set default game name.
-			if len(bytes.TrimSpace(gameName)) == 0 {
-				abbr := "'s"
-				lastLetter := cmd.client.name[len(cmd.client.name)-1]
-				if lastLetter == 's' || lastLetter == 'S' {
-					abbr = "'"
-				}
-				gameName = []byte(fmt.Sprintf("%s%s match", cmd.client.name, abbr))
+			if !bgammon.ValidSpace(from) || !bgammon.ValidSpace(to) {
+				cmd.client.sendEvent(&bgammon.EventFailedMove{
+					From:   from,
+					To:     to,
+					Code:   bgammon.ErrorIllegalMove,
+					Reason: "Illegal move.",
+				})
+				return
 			}
 
-			g := newServerGame(<-s.newGameIDs)
-			g.name = gameName
-			g.Points = points
-			g.password = gamePassword
-			ok, reason := g.addClient(cmd.client)
-			if !ok {
-				log.Panicf("failed to add client to newly created game %+v %+v: %s", g, cmd.client, reason)
-			}
+			from, to = bgammon.FlipSpace(from, cmd.client.perspective()), bgammon.FlipSpace(to, cmd.client.perspective())
+			moves = append(moves, []int{from, to})
+		}
+	}
 
-			s.gamesLock.Lock()
-			s.games = append(s.games, g)
-			s.gamesLock.Unlock()
+	invalidMove, err := clientGame.ValidateMoves(moves)
+	if err != nil {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			From:   bgammon.FlipSpace(invalidMove[0], cmd.client.perspective()),
+			To:     bgammon.FlipSpace(invalidMove[1], cmd.client.perspective()),
+			Code:   bgammon.ErrorIllegalMove,
+			Reason: fmt.Sprintf("Illegal move: %s.", err),
+		})
+		return
+	}
 
-			cmd.client.sendNotice(fmt.Sprintf("Created match: %s", g.name))
+	gameCopy := clientGame.Copy()
+	ok, expandedMoves := clientGame.AddMoves(moves, false)
+	if !ok {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			From:   0,
+			To:     0,
+			Code:   bgammon.ErrorIllegalMove,
+			Reason: "Illegal move.",
+		})
+		return
+	}
 
-			if len(g.password) == 0 {
-				cmd.client.sendNotice("Note: Please be patient as you wait for another player to join the match. A chime will sound when another player joins. While you wait, join the bgammon.org community via Discord, Matrix or IRC at bgammon.org/community")
-			}
-		case bgammon.CommandJoin, "j":
-			if clientGame != nil {
-				cmd.client.sendEvent(&bgammon.EventFailedJoin{
-					Reason: "Please leave the match you are in before joining another.",
-				})
-				continue
-			}
+	var winEvent *bgammon.EventWin
+	if clientGame.Winner != 0 {
+		clientGame.logTurn()
+		winEvent = clientGame.awardPoints(clientGame.Winner, clientGame.WinType)
+	}
 
-			sendUsage := func() {
-				cmd.client.sendNotice("To join a match please specify its ID or the name of a player in the match. To join a private match, a password must also be specified.")
-			}
+	hits := gameCopy.HitSpaces(expandedMoves)
+	remaining := clientGame.PlayableRolls()
+	clientGame.eachClient(func(client *serverClient) {
+		ev := &bgammon.EventMoved{
+			Moves:     bgammon.FlipMoves(expandedMoves, client.perspective()),
+			Remaining: remaining,
+		}
+		for _, space := range hits {
+			ev.Hits = append(ev.Hits, bgammon.FlipSpace(space, client.perspective()))
+		}
+		ev.Player = string(cmd.client.name)
+		client.sendEvent(ev)
 
-			if len(params) == 0 {
-				sendUsage()
-				continue
-			}
+		clientGame.sendBoard(client)
 
-			var joinGameID int
-			if onlyNumbers.Match(params[0]) {
-				gameID, err := strconv.Atoi(string(params[0]))
-				if err == nil && gameID > 0 {
-					joinGameID = gameID
-				}
+		if winEvent != nil {
+			client.sendEvent(winEvent)
+		}
+	})
 
-				if joinGameID == 0 {
-					sendUsage()
-					continue
-				}
-			} else {
-				paramLower := bytes.ToLower(params[0])
-				s.clientsLock.Lock()
-				for _, sc := range s.clients {
-					if bytes.Equal(paramLower, bytes.ToLower(sc.name)) {
-						g := s.gameByClient(sc)
-						if g != nil {
-							joinGameID = g.id
-						}
-						break
-					}
-				}
-				s.clientsLock.Unlock()
+	// End the turn when the remaining dice may not be used, or when the
+	// player has enabled automatic confirmation of forced plays.
+	if clientGame.passTurn(cmd.client.name) || clientGame.confirmTurn(cmd.client) {
+		s.autoRoll(clientGame)
+	}
+}
 
-				if joinGameID == 0 {
-					cmd.client.sendEvent(&bgammon.EventFailedJoin{
-						Reason: "Match not found.",
-					})
-					continue
-				}
-			}
+func (s *server) handleReset(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.client.sendNotice("It is not your turn.")
+		return
+	}
 
-			s.gamesLock.Lock()
-			for _, g := range s.games {
-				if g.terminated() {
-					continue
-				}
-				if g.id == joinGameID {
-					providedPassword := bytes.ReplaceAll(bytes.Join(params[1:], []byte(" ")), []byte("_"), []byte(" "))
-					if len(g.password) != 0 && (len(params) < 2 || !bytes.Equal(g.password, providedPassword)) {
-						cmd.client.sendEvent(&bgammon.EventFailedJoin{
-							Reason: "Invalid password.",
-						})
-						s.gamesLock.Unlock()
-						continue COMMANDS
-					}
-					ok, reason := g.addClient(cmd.client)
-					s.gamesLock.Unlock()
-
-					if !ok {
-						cmd.client.sendEvent(&bgammon.EventFailedJoin{
-							Reason: reason,
-						})
-					} else {
-						cmd.client.sendNotice(fmt.Sprintf("Joined match: %s", g.name))
-					}
-					continue COMMANDS
-				}
-			}
-			s.gamesLock.Unlock()
+	if len(clientGame.Moves) == 0 {
+		return
+	}
 
-			cmd.client.sendEvent(&bgammon.EventFailedJoin{
-				Reason: "Match not found.",
-			})
-		case bgammon.CommandLeave, "l":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedLeave{
-					Reason: "You are not currently in a match.",
-				})
-				continue
+	l := len(clientGame.Moves)
+	undoMoves := make([][]int, l)
+	for i, move := range clientGame.Moves {
+		undoMoves[l-1-i] = []int{move[1], move[0]}
+	}
+	ok, _ := clientGame.AddMoves(undoMoves, false)
+	if !ok {
+		cmd.client.sendNotice("Failed to undo move: invalid move.")
+	} else {
+		remaining := clientGame.PlayableRolls()
+		clientGame.eachClient(func(client *serverClient) {
+			ev := &bgammon.EventMoved{
+				Moves:     bgammon.FlipMoves(undoMoves, client.perspective()),
+				Remaining: remaining,
 			}
+			ev.Player = string(cmd.client.name)
 
-			if cmd.client.playerNumber == 1 {
-				clientGame.rejoin1 = false
-			} else {
-				clientGame.rejoin2 = false
-			}
+			client.sendEvent(ev)
+			clientGame.sendBoard(client)
+		})
+	}
+}
 
-			clientGame.removeClient(cmd.client)
-		case bgammon.CommandDouble, "d":
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
+func (s *server) handleUndo(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.client.sendNotice("It is not your turn.")
+		return
+	}
+
+	if len(clientGame.Moves) == 0 {
+		cmd.client.sendNotice("There are no moves to undo.")
+		return
+	}
+
+	// Only the last move is undone. The dice used by the move become
+	// available again.
+	lastMove := clientGame.Moves[len(clientGame.Moves)-1]
+	undoMoves := [][]int{{lastMove[1], lastMove[0]}}
+	ok, _ := clientGame.AddMoves(undoMoves, false)
+	if !ok {
+		cmd.client.sendNotice("Failed to undo move: invalid move.")
+	} else {
+		remaining := clientGame.PlayableRolls()
+		clientGame.eachClient(func(client *serverClient) {
+			ev := &bgammon.EventMoved{
+				Moves:     bgammon.FlipMoves(undoMoves, client.perspective()),
+				Remaining: remaining,
 			}
+			ev.Player = string(cmd.client.name)
+
+			client.sendEvent(ev)
+			clientGame.sendBoard(client)
+		})
+	}
+}
+
+func (s *server) handleOk(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	opponent := clientGame.opponent(cmd.client)
+	if opponent == nil {
+		cmd.client.sendNotice("You must wait until your opponent rejoins the match before continuing the game.")
+		return
+	}
+
+	if clientGame.DoubleOffered && clientGame.Turn != cmd.client.playerNumber {
+		opponent := clientGame.opponent(cmd.client)
+		if opponent == nil {
+			cmd.client.sendNotice("You may not accept the double until your opponent rejoins the match.")
+			return
+		}
+
+		clientGame.acceptDouble(cmd.client)
+		s.autoRoll(clientGame)
+		return
+	}
+
+	if clientGame.Turn != cmd.client.playerNumber {
+		cmd.client.sendEvent(&bgammon.EventFailedOk{
+			Code:   bgammon.ErrorNotYourTurn,
+			Reason: "It is not your turn.",
+		})
+		return
+	} else if clientGame.Roll1 == 0 || clientGame.Roll2 == 0 {
+		cmd.client.sendEvent(&bgammon.EventFailedOk{
+			Code:   bgammon.ErrorNotRolled,
+			Reason: "You must roll before ending your turn.",
+		})
+		return
+	}
+
+	legalMoves := clientGame.LegalMoves(false)
+	if len(legalMoves) != 0 {
+		available := bgammon.FlipMoves(legalMoves, cmd.client.perspective())
+		bgammon.SortMoves(available)
+		cmd.client.sendEvent(&bgammon.EventFailedOk{
+			Code:   bgammon.ErrorMovesAvailable,
+			Reason: fmt.Sprintf("The following legal moves are available: %s", bgammon.FormatMoves(available)),
+		})
+		return
+	}
+
+	clientGame.nextTurn()
+	clientGame.eachClient(func(client *serverClient) {
+		clientGame.sendBoard(client)
+	})
+	s.autoRoll(clientGame)
+}
+
+func (s *server) handleRematch(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Winner == 0 {
+		cmd.client.sendNotice("The match you are in is still in progress.")
+		return
+	} else if s.shuttingDown.Load() {
+		cmd.client.sendNotice("The server is shutting down.")
+		return
+	} else if clientGame.client1 == nil || clientGame.client2 == nil {
+		cmd.client.sendNotice("Your opponent left the match.")
+		return
+	}
+
+	// A new match is offered unless a mode is specified. When the opponent
+	// offered a rematch, their offer is accepted unless a different mode is
+	// specified, in which case a rematch in that mode is offered instead.
+	length := clientGame.length
+	if length == 0 {
+		length = clientGame.Points
+	}
+	continueMatch := clientGame.rematch != 0 && clientGame.rematch != cmd.client.playerNumber && clientGame.rematchContinue
+	if len(params) > 0 {
+		switch strings.ToLower(string(params[0])) {
+		case "new":
+			continueMatch = false
+		case "continue":
+			continueMatch = true
+		default:
+			cmd.client.sendNotice("To offer or accept a new match to the same number of points, send 'rematch new'. To offer or accept continuing the match with the current score, send 'rematch continue'.")
+			return
+		}
+	}
+	points := length
+	if continueMatch {
+		points = clientGame.Points + length
+	}
+
+	if clientGame.rematch == cmd.client.playerNumber && clientGame.rematchContinue == continueMatch {
+		cmd.client.sendNotice("You have already requested a rematch.")
+		return
+	} else if clientGame.rematch != 0 && clientGame.rematch != cmd.client.playerNumber && clientGame.rematchContinue == continueMatch {
+		s.gamesLock.Lock()
+
+		newGame := newServerGame(<-s.newGameIDs)
+		newGame.name = clientGame.name
+		newGame.password = clientGame.password
+		newGame.client1 = clientGame.client1
+		newGame.client2 = clientGame.client2
+		newGame.Player1 = clientGame.Player1
+		newGame.Player2 = clientGame.Player2
+		newGame.Points = points
+		if continueMatch {
+			newGame.length = length
+		} else {
+			newGame.Player1.Points, newGame.Player2.Points = 0, 0
+		}
+		newGame.TimeControl = clientGame.TimeControl
+		newGame.TimeIncrement = clientGame.TimeIncrement
+		newGame.Jacoby = clientGame.Jacoby
+		newGame.Beavers = clientGame.Beavers
+		newGame.NoGammons = clientGame.NoGammons
+		newGame.AutoDouble = clientGame.AutoDouble
+		if newGame.Points != 1 {
+			// Continued single games are played as matches, to which
+			// these rules do not apply.
+			newGame.Jacoby, newGame.Beavers, newGame.AutoDouble = false, false, 0
+		}
+		newGame.dice.balanced = clientGame.dice.balanced
+		newGame.hideSpectators = clientGame.hideSpectators
+		newGame.resetClocks()
+		newGame.spectators = clientGame.spectators
+		s.games = append(s.games, newGame)
+
+		clientGame.client1 = nil
+		clientGame.client2 = nil
+		clientGame.spectators = nil
+
+		s.gamesLock.Unlock()
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice("It is not your turn.")
-				continue
-			}
+		ev1 := &bgammon.EventJoined{
+			GameID:       newGame.id,
+			PlayerNumber: 1,
+		}
+		ev1.Player = newGame.Player1.Name
 
-			gameState := &bgammon.GameState{
-				Game:         clientGame.Game,
-				PlayerNumber: cmd.client.playerNumber,
-				Available:    clientGame.LegalMoves(false),
-			}
-			if !gameState.MayDouble() {
-				cmd.client.sendNotice("You may not double at this time.")
-				continue
-			}
+		ev2 := &bgammon.EventJoined{
+			GameID:       newGame.id,
+			PlayerNumber: 2,
+		}
+		ev2.Player = newGame.Player2.Name
 
-			if clientGame.DoublePlayer != 0 && clientGame.DoublePlayer != cmd.client.playerNumber {
-				cmd.client.sendNotice("You do not currently hold the doubling cube.")
-				continue
-			}
+		newGame.eachClient(func(client *serverClient) {
+			client.sendEvent(ev1)
+			client.sendEvent(ev2)
+			newGame.sendBoard(client)
+		})
+	} else {
+		clientGame.rematch = cmd.client.playerNumber
+		clientGame.rematchContinue = continueMatch
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice("You may not double until your opponent rejoins the match.")
-				continue
-			}
+		if continueMatch {
+			clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf("Your opponent would like to continue the match to %d points with the current score. Type /rematch to accept, or /rematch new to offer a new match instead.", points))
+		} else {
+			clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf("Your opponent would like to play a new match to %d points. Type /rematch to accept, or /rematch continue to offer continuing the match instead.", points))
+		}
+		cmd.client.sendNotice("Rematch offer sent.")
+		return
+	}
+}
 
-			clientGame.DoubleOffered = true
+func (s *server) handleBoard(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	clientGame.sendBoard(cmd.client)
+}
 
-			cmd.client.sendNotice(fmt.Sprintf("Double offered to opponent (%d points).", clientGame.DoubleValue*2))
-			clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf("%s offers a double (%d points).", cmd.client.name, clientGame.DoubleValue*2))
+func (s *server) handleVerify(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if len(params) != 1 {
+		cmd.client.sendNotice("To confirm your board is in sync with the server, send 'verify <checksum>'.")
+		return
+	}
+	checksum := clientGame.gameState(cmd.client).Checksum
+	if strings.EqualFold(string(params[0]), checksum) {
+		return
+	}
+	cmd.client.sendEvent(&bgammon.EventDesync{
+		Checksum: checksum,
+	})
+	clientGame.sendBoard(cmd.client)
+}
 
-			clientGame.eachClient(func(client *serverClient) {
-				if client.json {
-					clientGame.sendBoard(client)
-				}
-			})
-		case bgammon.CommandResign:
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			}
+func (s *server) handleFlip(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	cmd.client.flipped = !cmd.client.flipped
 
-			gameState := &bgammon.GameState{
-				Game:         clientGame.Game,
-				PlayerNumber: cmd.client.playerNumber,
-				Available:    clientGame.LegalMoves(false),
-			}
-			if !gameState.MayResign() {
-				cmd.client.sendNotice("You may not resign at this time.")
-				continue
-			}
+	player := cmd.client.perspective()
+	if player == 0 {
+		player = 1
+	}
+	cmd.client.sendNotice(fmt.Sprintf("The board is now shown from the perspective of player %d.", player))
+	clientGame.sendBoard(cmd.client)
+}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice("You may not resign until your opponent rejoins the match.")
-				continue
-			}
+func (s *server) handlePipCount(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	cmd.client.sendEvent(&bgammon.EventPipCount{
+		Player1: bgammon.PipCount(clientGame.Board, 1),
+		Player2: bgammon.PipCount(clientGame.Board, 2),
+	})
+}
 
-			cmd.client.sendNotice("Declined double offer")
-			clientGame.opponent(cmd.client).sendNotice(fmt.Sprintf("%s declined double offer.", cmd.client.name))
+func (s *server) handleLeaderboard(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	count := 10
+	if len(params) > 0 {
+		var err error
+		count, err = strconv.Atoi(string(params[0]))
+		if err != nil || count < 1 {
+			cmd.client.sendNotice("To view the leaderboard, optionally specify how many players to list (up to 100).")
+			return
+		} else if count > 100 {
+			count = 100
+		}
+	}
 
-			if cmd.client.playerNumber == 1 {
-				clientGame.Player2.Points = clientGame.Player2.Points + clientGame.DoubleValue
-				if clientGame.Player2.Points >= clientGame.Points {
-					clientGame.Winner = 2
-					clientGame.Ended = time.Now()
-				} else {
-					clientGame.Reset()
-				}
-			} else {
-				clientGame.Player1.Points = clientGame.Player2.Points + clientGame.DoubleValue
-				if clientGame.Player1.Points >= clientGame.Points {
-					clientGame.Winner = 1
-					clientGame.Ended = time.Now()
-				} else {
-					clientGame.Reset()
-				}
-			}
+	// Query the database without blocking other commands.
+	go func(client *serverClient, requestID int, count int) {
+		entries, err := leaderboard(count)
+		if err != nil {
+			client.sendReply(&bgammon.EventNotice{
+				Message: fmt.Sprintf("Failed to retrieve leaderboard: %s.", err),
+			}, requestID)
+			return
+		}
+		client.sendReply(&bgammon.EventLeaderboard{
+			Players: entries,
+		}, requestID)
+	}(cmd.client, cmd.id, count)
+}
 
-			var winEvent *bgammon.EventWin
-			if clientGame.Winner != 0 {
-				winEvent = &bgammon.EventWin{
-					Points: clientGame.DoubleValue,
-				}
-				if clientGame.Winner == 1 {
-					winEvent.Player = clientGame.Player1.Name
-				} else {
-					winEvent.Player = clientGame.Player2.Name
-				}
-			}
-			clientGame.eachClient(func(client *serverClient) {
-				clientGame.sendBoard(client)
-				if winEvent != nil {
-					client.sendEvent(winEvent)
-				}
-			})
-		case bgammon.CommandRoll, "r":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: "You are not currently in a match.",
-				})
-				continue
-			}
+func (s *server) handleWho(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	var filter []byte
+	if len(params) > 0 {
+		filter = bytes.ToLower(params[0])
+	}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: "You may not roll until your opponent rejoins the match.",
-				})
-				continue
-			}
+	ev := &bgammon.EventWho{}
+	now := time.Now().Unix()
+	s.clientsLock.Lock()
+	for _, sc := range s.clients {
+		if len(sc.name) == 0 || (filter != nil && !bytes.Contains(bytes.ToLower(sc.name), filter)) {
+			continue
+		}
+		info := bgammon.PlayerInfo{
+			Name:      string(sc.name),
+			InMatch:   sc.playerNumber != 0 && s.gameByClient(sc) != nil,
+			Idle:      int(now - sc.lastActive.Load()),
+			Transport: sc.transport,
+			Latency:   int(sc.latency.Milliseconds()),
+		}
+		if sc.account > 0 {
+			info.Rating = sc.rating
+		}
+		if cmd.client.admin {
+			info.Address = sc.address
+		}
+		ev.Players = append(ev.Players, info)
+	}
+	s.clientsLock.Unlock()
 
-			if !clientGame.roll(cmd.client.playerNumber) {
-				cmd.client.sendEvent(&bgammon.EventFailedRoll{
-					Reason: "It is not your turn to roll.",
-				})
-				continue
-			}
+	sort.Slice(ev.Players, func(i, j int) bool {
+		return strings.ToLower(ev.Players[i].Name) < strings.ToLower(ev.Players[j].Name)
+	})
+	cmd.client.sendEvent(ev)
+}
 
-			ev := &bgammon.EventRolled{
-				Roll1: clientGame.Roll1,
-				Roll2: clientGame.Roll2,
-			}
-			ev.Player = string(cmd.client.name)
-			if clientGame.Turn == 0 && clientGame.Roll1 != 0 && clientGame.Roll2 != 0 {
-				if clientGame.Roll1 > clientGame.Roll2 {
-					clientGame.Turn = 1
-				} else if clientGame.Roll2 > clientGame.Roll1 {
-					clientGame.Turn = 2
-				} else {
-					clientGame.Roll1 = 0
-					clientGame.Roll2 = 0
-				}
-			}
-			clientGame.eachClient(func(client *serverClient) {
-				client.sendEvent(ev)
-				if clientGame.Turn != 0 || !client.json {
-					clientGame.sendBoard(client)
-				}
-			})
-		case bgammon.CommandMove, "m", "mv":
-			if clientGame == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: "You are not currently in a match.",
-				})
-				continue
-			}
+func (s *server) handleHistory(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if cmd.client.account <= 0 {
+		cmd.client.sendNotice("You must be logged in to a registered account to view your match history.")
+		return
+	}
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: "It is not your turn to move.",
-				})
-				continue
-			}
+	var offset int
+	if len(params) > 0 {
+		var err error
+		offset, err = strconv.Atoi(string(params[0]))
+		if err != nil || offset < 0 {
+			cmd.client.sendNotice("To view your match history, optionally specify how many matches to skip.")
+			return
+		}
+	}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: "You may not move until your opponent rejoins the match.",
-				})
-				continue
-			}
+	// Query the database without blocking other commands.
+	go func(client *serverClient, requestID int, account int, offset int) {
+		matches, err := matchHistory(account, offset)
+		if err != nil {
+			client.sendReply(&bgammon.EventNotice{
+				Message: fmt.Sprintf("Failed to retrieve match history: %s.", err),
+			}, requestID)
+			return
+		}
+		client.sendReply(&bgammon.EventHistory{
+			Offset:  offset,
+			Matches: matches,
+		}, requestID)
+	}(cmd.client, cmd.id, cmd.client.account, offset)
+}
 
-			sendUsage := func() {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					Reason: "Specify one or more moves in the form FROM/TO. For example: 8/4 6/4",
-				})
-			}
+func (s *server) handleStats(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	username := string(cmd.client.name)
+	if len(params) > 0 {
+		username = string(params[0])
+	} else if cmd.client.account <= 0 {
+		cmd.client.sendNotice("You must be logged in to a registered account to view your statistics. To view the statistics of another player, specify their username.")
+		return
+	}
+	private := strings.EqualFold(username, string(cmd.client.name)) && cmd.client.account > 0
 
-			if len(params) == 0 {
-				sendUsage()
-				continue
-			}
+	// Query the database without blocking other commands.
+	go func(client *serverClient, requestID int, username string, private bool) {
+		ev, err := playerStats(username, private)
+		if err != nil {
+			client.sendReply(&bgammon.EventNotice{
+				Message: fmt.Sprintf("Failed to retrieve statistics: %s.", err),
+			}, requestID)
+			return
+		}
+		client.sendReply(ev, requestID)
+	}(cmd.client, cmd.id, username, private)
+}
 
-			var moves [][]int
-			for i := range params {
-				split := bytes.Split(params[i], []byte("/"))
-				if len(split) != 2 {
-					sendUsage()
-					continue COMMANDS
-				}
-				from := bgammon.ParseSpace(string(split[0]))
-				if from == -1 {
-					sendUsage()
-					continue COMMANDS
-				}
-				to := bgammon.ParseSpace(string(split[1]))
-				if to == -1 {
-					sendUsage()
-					continue COMMANDS
-				}
+func (s *server) handleProfile(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	username := string(cmd.client.name)
+	if len(params) > 0 {
+		username = string(params[0])
+	}
+	self := strings.EqualFold(username, string(cmd.client.name))
 
-				if !bgammon.ValidSpace(from) || !bgammon.ValidSpace(to) {
-					cmd.client.sendEvent(&bgammon.EventFailedMove{
-						From:   from,
-						To:     to,
-						Reason: "Illegal move.",
-					})
-					continue COMMANDS
-				}
+	// The status of the player is determined before querying the database.
+	ev := &bgammon.EventProfile{
+		Name: username,
+	}
+	s.clientsLock.Lock()
+	target := s.clientByUsername([]byte(username))
+	if target != nil {
+		ev.Name = string(target.name)
+		ev.Online = true
+		ev.InMatch = target.playerNumber != 0 && s.gameByClient(target) != nil
+		if target.account <= 0 {
+			ev.Private = target.settings.Private
+		}
+	}
+	s.clientsLock.Unlock()
 
-				from, to = bgammon.FlipSpace(from, cmd.client.playerNumber), bgammon.FlipSpace(to, cmd.client.playerNumber)
-				moves = append(moves, []int{from, to})
-			}
+	// Guests and unknown players only have a minimal profile.
+	if target != nil && target.account <= 0 {
+		cmd.client.sendEvent(ev)
+		return
+	}
 
-			ok, expandedMoves := clientGame.AddMoves(moves, false)
-			if !ok {
-				cmd.client.sendEvent(&bgammon.EventFailedMove{
-					From:   0,
-					To:     0,
-					Reason: "Illegal move.",
-				})
-				continue
-			}
+	// Query the database without blocking other commands.
+	go func(client *serverClient, requestID int, username string, self bool, status *bgammon.EventProfile) {
+		ev, err := playerProfile(username, self)
+		if err == errUnknownAccount || err == errAccountsDisabled {
+			client.sendReply(status, requestID)
+			return
+		} else if err != nil {
+			client.sendReply(&bgammon.EventNotice{
+				Message: fmt.Sprintf("Failed to retrieve profile: %s.", err),
+			}, requestID)
+			return
+		}
+		ev.Online, ev.InMatch = status.Online, status.InMatch
+		client.sendReply(ev, requestID)
+	}(cmd.client, cmd.id, username, self, ev)
+}
 
-			var winEvent *bgammon.EventWin
-			if clientGame.Winner != 0 {
-				opponent := 1
-				opponentHome := bgammon.SpaceHomePlayer
-				playerBar := bgammon.SpaceBarPlayer
-				if clientGame.Winner == 1 {
-					opponent = 2
-					opponentHome = bgammon.SpaceHomeOpponent
-					playerBar = bgammon.SpaceBarOpponent
-				}
+func (s *server) handleDisconnect(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame != nil {
+		s.gamesLock.Lock()
+		clientGame.removeClient(cmd.client, bgammon.LeftReasonLeave)
+		s.gamesLock.Unlock()
+	}
+	cmd.client.Terminate("Client disconnected")
+}
 
-				backgammon := bgammon.PlayerCheckers(clientGame.Board[playerBar], opponent) != 0
-				if !backgammon {
-					homeStart, homeEnd := bgammon.HomeRange(clientGame.Winner)
-					bgammon.IterateSpaces(homeStart, homeEnd, func(space, spaceCount int) {
-						if bgammon.PlayerCheckers(clientGame.Board[space], opponent) != 0 {
-							backgammon = true
-						}
-					})
-				}
+func (s *server) handlePong(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	// Activity is recorded above. Measure the round-trip time when the
+	// client answers the last ping sent to it.
+	if !cmd.client.pinged.IsZero() && len(params) > 0 && string(params[0]) == strconv.FormatInt(cmd.client.lastPing, 10) {
+		cmd.client.latency = time.Since(cmd.client.pinged)
+		cmd.client.pinged = time.Time{}
+	}
+}
 
-				winPoints := 1
-				if backgammon {
-					winPoints = 3 // Award backgammon.
-				} else if clientGame.Board[opponentHome] == 0 {
-					winPoints = 2 // Award gammon.
-				}
+func (s *server) handleTimeout(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame == nil || cmd.client.playerNumber == 0 {
+		return
+	}
 
-				winEvent = &bgammon.EventWin{
-					Points: winPoints * clientGame.DoubleValue,
-				}
-				if clientGame.Winner == 1 {
-					winEvent.Player = clientGame.Player1.Name
-					clientGame.Player1.Points = clientGame.Player1.Points + winPoints*clientGame.DoubleValue
-					if clientGame.Player1.Points < clientGame.Points {
-						clientGame.Reset()
-					} else {
-						clientGame.Ended = time.Now()
-					}
-				} else {
-					winEvent.Player = clientGame.Player2.Name
-					clientGame.Player2.Points = clientGame.Player2.Points + winPoints*clientGame.DoubleValue
-					if clientGame.Player2.Points < clientGame.Points {
-						clientGame.Reset()
-					} else {
-						clientGame.Ended = time.Now()
-					}
-				}
-			}
+	// Forfeit the game only when the client's clock has run out.
+	clientGame.updateClocks()
+	if clientGame.timedOut() == cmd.client.playerNumber {
+		clientGame.forfeitTime(cmd.client.playerNumber, false)
+		return
+	}
 
+	// Warn the players and spectators when the client's clock is about to
+	// run out. Warnings are only sent while the client's clock is running.
+	if clientGame.clockPlayer == cmd.client.playerNumber {
+		if warning := clientGame.clockWarning(); warning != 0 {
+			clientGame.clockWarned = warning
+			ev := &bgammon.EventTimeWarning{
+				Seconds: (clientGame.clockRemaining() + 999) / 1000,
+			}
+			ev.Player = string(cmd.client.name)
 			clientGame.eachClient(func(client *serverClient) {
-				ev := &bgammon.EventMoved{
-					Moves: bgammon.FlipMoves(expandedMoves, client.playerNumber),
-				}
-				ev.Player = string(cmd.client.name)
 				client.sendEvent(ev)
+			})
+		}
+	}
 
-				clientGame.sendBoard(client)
-
-				if winEvent != nil {
-					client.sendEvent(winEvent)
-				}
+	// Forfeit the game when the player has not acted in time, warning
+	// both players beforehand.
+	if player, remaining := clientGame.idleRemaining(); player == cmd.client.playerNumber {
+		if remaining <= 0 {
+			clientGame.forfeitTime(cmd.client.playerNumber, true)
+			return
+		} else if !clientGame.idleWarned && remaining <= clientGame.idleWarning() {
+			clientGame.idleWarned = true
+			seconds := int((remaining + time.Second - 1) / time.Second)
+			clientGame.eachClient(func(client *serverClient) {
+				client.sendNotice(fmt.Sprintf("%s has %d seconds to act before forfeiting the game due to inactivity.", cmd.client.name, seconds))
 			})
-		case bgammon.CommandReset:
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			}
+			return
+		}
+	}
 
-			if clientGame.Turn != cmd.client.playerNumber {
-				cmd.client.sendNotice("It is not your turn.")
-				continue
-			}
+	// End the match when the opponent did not reconnect in time.
+	expired := clientGame.reconnectExpired()
+	if expired != 0 && expired != cmd.client.playerNumber && clientGame.Winner == 0 {
+		clientGame.forfeitMatch(expired)
+	}
+}
 
-			if len(clientGame.Moves) == 0 {
-				continue
-			}
+func (s *server) handlePosition(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	player := clientGame.Turn
+	if player == 0 {
+		player = 1
+	}
+	cmd.client.sendEvent(&bgammon.EventPosition{
+		ID:      bgammon.PositionID(clientGame.Board, player),
+		MatchID: clientGame.MatchID(),
+	})
+}
 
-			l := len(clientGame.Moves)
-			undoMoves := make([][]int, l)
-			for i, move := range clientGame.Moves {
-				undoMoves[l-1-i] = []int{move[1], move[0]}
-			}
-			ok, _ := clientGame.AddMoves(undoMoves, false)
-			if !ok {
-				cmd.client.sendNotice("Failed to undo move: invalid move.")
-			} else {
-				clientGame.eachClient(func(client *serverClient) {
-					ev := &bgammon.EventMoved{
-						Moves: bgammon.FlipMoves(undoMoves, client.playerNumber),
-					}
-					ev.Player = string(cmd.client.name)
-
-					client.sendEvent(ev)
-					clientGame.sendBoard(client)
-				})
-			}
-		case bgammon.CommandOk, "k":
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			}
+func (s *server) handleTranscript(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.transcript == nil {
+		cmd.client.sendNotice("The match has not started.")
+		return
+	}
 
-			opponent := clientGame.opponent(cmd.client)
-			if opponent == nil {
-				cmd.client.sendNotice("You must wait until your opponent rejoins the match before continuing the game.")
-				continue
-			}
+	cmd.client.sendEvent(&bgammon.EventTranscript{
+		Transcript: string(clientGame.transcript.Bytes()),
+	})
+}
 
-			if clientGame.DoubleOffered && clientGame.Turn != cmd.client.playerNumber {
-				opponent := clientGame.opponent(cmd.client)
-				if opponent == nil {
-					cmd.client.sendNotice("You may not accept the double until your opponent rejoins the match.")
-					continue
-				}
+func (s *server) handleHint(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Winner != 0 || clientGame.Turn != cmd.client.playerNumber || clientGame.Roll1 == 0 || clientGame.DoubleOffered {
+		cmd.client.sendNotice("You may only request a hint after rolling on your turn.")
+		return
+	}
 
-				clientGame.DoubleOffered = false
-				clientGame.DoubleValue = clientGame.DoubleValue * 2
-				clientGame.DoublePlayer = cmd.client.playerNumber
+	moves := botMoves(clientGame.Game.Copy())
+	if len(moves) == 0 {
+		cmd.client.sendNotice("There are no legal moves available.")
+		return
+	}
+	cmd.client.sendEvent(&bgammon.EventHint{
+		Moves: bgammon.FlipMoves(moves, cmd.client.perspective()),
+	})
+}
 
-				cmd.client.sendNotice("Accepted double.")
-				opponent.sendNotice(fmt.Sprintf("%s accepted double.", cmd.client.name))
+func (s *server) handleLegalMoves(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.Winner != 0 || clientGame.Turn != cmd.client.playerNumber || clientGame.Roll1 == 0 || clientGame.DoubleOffered {
+		cmd.client.sendNotice("You may only request legal moves after rolling on your turn.")
+		return
+	}
 
-				clientGame.eachClient(func(client *serverClient) {
-					clientGame.sendBoard(client)
-				})
-				continue
-			}
+	// Only the moves of a single checker are listed. Enumerating every
+	// combination of moves is not feasible when doubles are rolled.
+	moves := bgammon.FlipMoves(clientGame.LegalMoves(false), cmd.client.perspective())
+	bgammon.SortMoves(moves)
+	cmd.client.sendEvent(&bgammon.EventLegalMoves{
+		Moves: moves,
+	})
+}
 
-			legalMoves := clientGame.LegalMoves(false)
-			if len(legalMoves) != 0 {
-				available := bgammon.FlipMoves(legalMoves, cmd.client.playerNumber)
-				bgammon.SortMoves(available)
-				cmd.client.sendEvent(&bgammon.EventFailedOk{
-					Reason: fmt.Sprintf("The following legal moves are available: %s", bgammon.FormatMoves(available)),
-				})
-				continue
-			}
+func (s *server) handleSetBoard(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame == nil {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorNotInMatch,
+			Reason: "You are not currently in a match.",
+		})
+		return
+	} else if cmd.client.playerNumber == 0 {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorSpectating,
+			Reason: "You are spectating this match.",
+		})
+		return
+	}
 
-			clientGame.NextTurn()
-			clientGame.eachClient(func(client *serverClient) {
-				clientGame.sendBoard(client)
-			})
-		case bgammon.CommandRematch, "rm":
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			} else if clientGame.Winner == 0 {
-				cmd.client.sendNotice("The match you are in is still in progress.")
-				continue
-			} else if clientGame.rematch == cmd.client.playerNumber {
-				cmd.client.sendNotice("You have already requested a rematch.")
-				continue
-			} else if clientGame.client1 == nil || clientGame.client2 == nil {
-				cmd.client.sendNotice("Your opponent left the match.")
-				continue
-			} else if clientGame.rematch != 0 && clientGame.rematch != cmd.client.playerNumber {
-				s.gamesLock.Lock()
-
-				newGame := newServerGame(<-s.newGameIDs)
-				newGame.name = clientGame.name
-				newGame.password = clientGame.password
-				newGame.client1 = clientGame.client1
-				newGame.client2 = clientGame.client2
-				newGame.Player1 = clientGame.Player1
-				newGame.Player2 = clientGame.Player2
-				s.games = append(s.games, newGame)
-
-				clientGame.client1 = nil
-				clientGame.client2 = nil
-
-				s.gamesLock.Unlock()
-
-				ev1 := &bgammon.EventJoined{
-					GameID:       newGame.id,
-					PlayerNumber: 1,
-				}
-				ev1.Player = newGame.Player1.Name
+	if len(params) != 1 {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorUsage,
+			Reason: "Specify a GNU Backgammon Position ID. For example: setboard 4HPwATDgc/ABMA",
+		})
+		return
+	}
 
-				ev2 := &bgammon.EventJoined{
-					GameID:       newGame.id,
-					PlayerNumber: 2,
-				}
-				ev2.Player = newGame.Player2.Name
+	player := clientGame.Turn
+	if player == 0 {
+		player = 1
+	}
+	positionID := string(params[0])
+	board, err := bgammon.ParsePositionID(positionID, player)
+	if err != nil {
+		cmd.client.sendEvent(&bgammon.EventFailedMove{
+			Code:   bgammon.ErrorInvalidPosition,
+			Reason: fmt.Sprintf("Failed to set up position: %s.", err),
+		})
+		return
+	}
 
-				newGame.eachClient(func(client *serverClient) {
-					client.sendEvent(ev1)
-					client.sendEvent(ev2)
-					newGame.sendBoard(client)
-				})
-			} else {
-				clientGame.rematch = cmd.client.playerNumber
+	// Positions are only set up when both players agree, after which the
+	// match is no longer rated. Only registered players may propose a
+	// position, which their opponent agrees to by sending the same ID.
+	opponent := 3 - cmd.client.playerNumber
+	if !s.debugCommands && (clientGame.setUpPlayer != opponent || clientGame.setUpID != positionID) {
+		client := clientGame.opponent(cmd.client)
+		if cmd.client.account <= 0 {
+			cmd.client.sendEvent(&bgammon.EventFailedMove{
+				Code:   bgammon.ErrorNotRegistered,
+				Reason: "Only registered players may propose setting up a position.",
+			})
+			return
+		} else if client == nil {
+			cmd.client.sendEvent(&bgammon.EventFailedMove{
+				Code:   bgammon.ErrorOpponentAway,
+				Reason: "Your opponent must join the match before a position may be set up.",
+			})
+			return
+		}
+		clientGame.setUpPlayer, clientGame.setUpID = cmd.client.playerNumber, positionID
+		if clientGame.rated() {
+			client.sendNotice(fmt.Sprintf("%s wants to set up position %s. The match will no longer be rated. To agree, send 'setboard %s'.", cmd.client.name, positionID, positionID))
+			cmd.client.sendNotice(fmt.Sprintf("Your opponent must also send 'setboard %s' to set up the position. Once a position is set up, the match is no longer rated.", positionID))
+		} else {
+			client.sendNotice(fmt.Sprintf("%s wants to set up position %s. To agree, send 'setboard %s'.", cmd.client.name, positionID, positionID))
+			cmd.client.sendNotice(fmt.Sprintf("Your opponent must also send 'setboard %s' to set up the position.", positionID))
+		}
+		return
+	}
 
-				clientGame.opponent(cmd.client).sendNotice("Your opponent would like to play again. Type /rematch to accept.")
-				cmd.client.sendNotice("Rematch offer sent.")
-				continue
-			}
-		case bgammon.CommandBoard, "b":
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			}
+	clientGame.SetBoard(board)
+	clientGame.setUp = true
+	clientGame.setUpPlayer, clientGame.setUpID = 0, ""
+	clientGame.eachClient(func(client *serverClient) {
+		client.sendNotice(fmt.Sprintf("%s set up position %s.", cmd.client.name, positionID))
+		clientGame.sendBoard(client)
+	})
+}
 
-			clientGame.sendBoard(cmd.client)
-		case bgammon.CommandDisconnect:
-			if clientGame != nil {
-				clientGame.removeClient(cmd.client)
-			}
-			cmd.client.Terminate("Client disconnected")
-		case bgammon.CommandPong:
-			// Do nothing.
-		case "endgame":
-			if !allowDebugCommands {
-				cmd.client.sendNotice("You are not allowed to use that command.")
-				continue
-			}
+func (s *server) handleSetState(cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+	if clientGame.client1 == nil || clientGame.client2 == nil {
+		cmd.client.sendNotice("You may not set the state of the match until both players have joined.")
+		return
+	} else if clientGame.Winner != 0 {
+		cmd.client.sendNotice("The match has ended.")
+		return
+	}
 
-			if clientGame == nil {
-				cmd.client.sendNotice("You are not currently in a match.")
-				continue
-			}
+	sendUsage := func() {
+		cmd.client.sendNotice("To set the player whose turn it is and the dice they rolled, send 'setstate <1/2> [dice]'. For example: setstate 1 31")
+	}
+	if len(params) == 0 || len(params) > 2 {
+		sendUsage()
+		return
+	}
 
-			clientGame.Turn = 1
-			clientGame.Roll1 = 1
-			clientGame.Roll2 = 2
-			clientGame.Board = []int{0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, -2, 0, 0, -1}
+	turn, err := strconv.Atoi(string(params[0]))
+	if err != nil || (turn != 1 && turn != 2) {
+		sendUsage()
+		return
+	}
 
-			clientGame.eachClient(func(client *serverClient) {
-				clientGame.sendBoard(client)
-			})
-		default:
-			log.Printf("Received unknown command from client %s: %s", cmd.client.label(), cmd.command)
+	var roll1, roll2 int
+	if len(params) == 2 {
+		dice := params[1]
+		if len(dice) != 2 || dice[0] < '1' || dice[0] > '6' || dice[1] < '1' || dice[1] > '6' {
+			sendUsage()
+			return
 		}
+		roll1, roll2 = int(dice[0]-'0'), int(dice[1]-'0')
 	}
+
+	clientGame.setState(turn, roll1, roll2)
+	clientGame.eachClient(func(client *serverClient) {
+		client.sendNotice(fmt.Sprintf("%s set the state of the match.", cmd.client.name))
+		clientGame.sendBoard(client)
+	})
 }
 
 func randInt(max int) int {
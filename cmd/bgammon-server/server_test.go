@@ -0,0 +1,2014 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	c := s.connectMemoryClient()
+	defer c.send(bgammon.CommandDisconnect)
+
+	c.send("loginjson test alice")
+	ev := expectEvent[*bgammon.EventWelcome](t, c)
+	if ev.PlayerName != "alice" {
+		t.Errorf("logged in as %s, expected alice", ev.PlayerName)
+	}
+}
+
+func TestCreateJoin(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2 := loginClient(t, s, "alice"), loginClient(t, s, "bob")
+
+	c1.send("create public 1")
+	created := expectEvent[*bgammon.EventJoined](t, c1)
+	if created.PlayerNumber != 1 && created.PlayerNumber != 2 {
+		t.Fatalf("creator joined as player %d", created.PlayerNumber)
+	}
+
+	c2.send("join " + strconv.Itoa(created.GameID))
+	joined := expectEvent[*bgammon.EventJoined](t, c2)
+	if joined.GameID != created.GameID || joined.PlayerNumber != 3-created.PlayerNumber {
+		t.Errorf("joined match %d as player %d, expected match %d as player %d", joined.GameID, joined.PlayerNumber, created.GameID, 3-created.PlayerNumber)
+	}
+
+	ev := expectEventFunc(t, c1, func(ev *bgammon.EventJoined) bool {
+		return ev.Player == "bob"
+	})
+	if ev.PlayerNumber != joined.PlayerNumber {
+		t.Errorf("opponent joined as player %d, expected player %d", ev.PlayerNumber, joined.PlayerNumber)
+	}
+}
+
+func TestRoll(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+	setState(t, c1, 1, "")
+
+	c2.send("roll")
+	failed := expectEvent[*bgammon.EventFailedRoll](t, c2)
+	if failed.Code != bgammon.ErrorNotYourTurn {
+		t.Errorf("rolling out of turn failed with code %s, expected %s", failed.Code, bgammon.ErrorNotYourTurn)
+	}
+
+	c1.send("roll")
+	for _, c := range []*memoryClient{c1, c2} {
+		ev := expectEvent[*bgammon.EventRolled](t, c)
+		if ev.Player != c1.name() || ev.Roll1 < 1 || ev.Roll1 > 6 || ev.Roll2 < 1 || ev.Roll2 > 6 {
+			t.Errorf("%s rolled %d-%d", ev.Player, ev.Roll1, ev.Roll2)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+	setState(t, c1, 1, "31")
+
+	c2.send("move 19/22")
+	failed := expectEvent[*bgammon.EventFailedMove](t, c2)
+	if failed.Code != bgammon.ErrorNotYourTurn {
+		t.Errorf("moving out of turn failed with code %s, expected %s", failed.Code, bgammon.ErrorNotYourTurn)
+	}
+
+	c1.send("move 8/5 6/5")
+	ev := expectEvent[*bgammon.EventMoved](t, c1)
+	if expected := [][]int{{8, 5}, {6, 5}}; !reflect.DeepEqual(ev.Moves, expected) {
+		t.Errorf("moved %v, expected %v", ev.Moves, expected)
+	} else if len(ev.Remaining) != 0 {
+		t.Errorf("dice %v remain after moving, expected none", ev.Remaining)
+	}
+
+	board := expectEvent[*bgammon.EventBoard](t, c1)
+	if board.Board[5] != 2 || board.Board[6] != 4 || board.Board[8] != 2 {
+		t.Errorf("unexpected board after moving: %v", board.Board)
+	}
+}
+
+func TestWin(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+
+	setBoard(t, c1, gammonBoard())
+	setState(t, c1, 1, "21")
+
+	c1.send("move 1/off")
+	for _, c := range []*memoryClient{c1, c2} {
+		ev := expectEvent[*bgammon.EventWin](t, c)
+		if ev.Player != c1.name() || !ev.Match {
+			t.Errorf("%s won, match over: %t, expected %s to win the match", ev.Player, ev.Match, c1.name())
+		} else if ev.WinType != bgammon.WinGammon {
+			t.Errorf("won by %d, expected a gammon", ev.WinType)
+		} else if ev.Score1 < 1 || ev.Score2 != 0 {
+			t.Errorf("final score %d-%d, expected player 1 to win", ev.Score1, ev.Score2)
+		}
+	}
+}
+
+// TestConcurrentJoinLeave joins, watches and leaves a match from multiple
+// clients at once, some of which lose their connection, while the clocks of
+// the match are checked and the match is listed in the lobby. Run with -race.
+func TestConcurrentJoinLeave(t *testing.T) {
+	s := newTestServer(t)
+	creator := loginClient(t, s, "alice")
+	creator.send("create public 1")
+	created := expectEvent[*bgammon.EventJoined](t, creator)
+	g := s.gameByClient(creator.client)
+	id := strconv.Itoa(created.GameID)
+
+	// Clocks are checked every second.
+	deadline := time.Now().Add(1500 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; time.Now().Before(deadline); j++ {
+				c := s.connectMemoryClient()
+				c.send(fmt.Sprintf("loginjson test player%dx%d", i, j))
+				if i%2 == 0 {
+					c.send("join " + id)
+				} else {
+					c.send("watch " + id)
+				}
+
+				// Joining fails when another player took the last seat.
+				ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+					switch ev.(type) {
+					case *bgammon.EventJoined, *bgammon.EventFailedJoin:
+						return true
+					}
+					return false
+				})
+				if !ok {
+					t.Errorf("client %d did not join the match", i)
+					return
+				}
+				if _, joined := ev.(*bgammon.EventJoined); joined && j%2 == 0 {
+					c.send("leave")
+					if _, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+						_, ok := ev.(*bgammon.EventLeft)
+						return ok
+					}); !ok {
+						t.Errorf("client %d did not leave the match", i)
+						return
+					}
+				}
+
+				// Lose the connection.
+				c.Terminate("")
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			s.lobbyListings(nil)
+			s.gameByClient(creator.client)
+		}
+	}()
+	wg.Wait()
+
+	// The server still handles commands.
+	loginClient(t, s, "bob")
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.client1 != creator.client && g.client2 != creator.client {
+		t.Error("creator is no longer in the match")
+	}
+}
+
+// TestRequestIDQuery checks that the results of database queries, which are
+// sent after the command was handled, include the request ID of the command.
+func TestRequestIDQuery(t *testing.T) {
+	s := newTestServer(t)
+	c := loginClient(t, s, "alice")
+
+	c.send("7 leaderboard")
+	notice := expectEventFunc(t, c, func(ev *bgammon.EventNotice) bool {
+		return strings.HasPrefix(ev.Message, "Failed to retrieve leaderboard")
+	})
+	if notice.RequestID != 7 {
+		t.Errorf("leaderboard sent with request ID %d, expected 7", notice.RequestID)
+	}
+
+	c.send("8 profile bob")
+	profile := expectEvent[*bgammon.EventProfile](t, c)
+	if profile.RequestID != 8 {
+		t.Errorf("profile sent with request ID %d, expected 8", profile.RequestID)
+	}
+}
+
+func TestLoginRegistered(t *testing.T) {
+	newTestDatabase(t)
+	s := newTestServer(t)
+
+	c := s.connectMemoryClient()
+	c.send("registerjson test alice@example.com alice secret")
+	expectEventFunc(t, c, func(ev *bgammon.EventSession) bool {
+		return ev.Registered
+	})
+	disconnect(t, s, c)
+
+	for _, test := range []struct {
+		command string
+		notice  string
+	}{
+		{"loginjson test alice", "Connection terminated: That username belongs to a registered account. Please log in using its password."},
+		{"loginjson test ALICE", "Connection terminated: That username belongs to a registered account. Please log in using its password."},
+		{"loginjson test alice wrong", "Connection terminated: Failed to log in: invalid username or password."},
+		{"registerjson test bob@example.com alice secret", "Connection terminated: Failed to register: that username is already in use."},
+	} {
+		c := s.connectMemoryClient()
+		c.send(test.command)
+		expectNotice(t, c, test.notice)
+	}
+
+	c = s.connectMemoryClient()
+	defer c.send(bgammon.CommandDisconnect)
+	c.send("loginjson test alice secret")
+	welcome := expectEvent[*bgammon.EventWelcome](t, c)
+	session := expectEvent[*bgammon.EventSession](t, c)
+	if welcome.PlayerName != "alice" || !session.Registered {
+		t.Errorf("logged in as %s, registered: %t, expected to log in to alice's account", welcome.PlayerName, session.Registered)
+	}
+}
+
+// TestLoginOrder checks that commands sent after logging in to an account are
+// handled after the password is checked.
+func TestLoginOrder(t *testing.T) {
+	newTestDatabase(t)
+	s := newTestServer(t)
+
+	c := s.connectMemoryClient()
+	c.send("registerjson test alice@example.com alice secret")
+	expectEvent[*bgammon.EventWelcome](t, c)
+	disconnect(t, s, c)
+
+	c = s.connectMemoryClient()
+	defer c.send(bgammon.CommandDisconnect)
+	c.send("loginjson test alice secret")
+	c.send("create public 1")
+	expectEvent[*bgammon.EventWelcome](t, c)
+	expectEvent[*bgammon.EventJoined](t, c)
+}
+
+func TestSetBoardUnrated(t *testing.T) {
+	newTestDatabase(t)
+	s := startTestServer(t, false)
+	guest := loginClient(t, s, "carol")
+	c1 := registerClient(t, s, "alice")
+
+	board := bgammon.NewBoard()
+	board[6], board[5] = 4, 1
+	id := bgammon.PositionID(board, 1)
+
+	// Positions may not be set up before the opponent joins.
+	c1.send("create public 1")
+	created := expectEvent[*bgammon.EventJoined](t, c1)
+	c1.send("setboard " + id)
+	if failed := expectEvent[*bgammon.EventFailedMove](t, c1); failed.Code != bgammon.ErrorOpponentAway {
+		t.Errorf("setting up a position without an opponent failed with code %s, expected %s", failed.Code, bgammon.ErrorOpponentAway)
+	}
+
+	// Guests may not propose a position, but may agree to one.
+	c2 := guest
+	c2.send("join " + strconv.Itoa(created.GameID))
+	expectEvent[*bgammon.EventBoard](t, c2)
+	c2.send("setboard " + id)
+	if failed := expectEvent[*bgammon.EventFailedMove](t, c2); failed.Code != bgammon.ErrorNotRegistered {
+		t.Errorf("guest setting up a position failed with code %s, expected %s", failed.Code, bgammon.ErrorNotRegistered)
+	}
+
+	c1.send("setboard " + id)
+	expectNotice(t, c2, c1.name()+" wants to set up position "+id+". To agree, send 'setboard "+id+"'.")
+	c2.send("setboard " + id)
+	for _, c := range []*memoryClient{c1, c2} {
+		expectNotice(t, c, c2.name()+" set up position "+id+".")
+	}
+	g := s.gameByClient(c1.client)
+	g.lock.Lock()
+	if !reflect.DeepEqual(g.Board, board) {
+		t.Errorf("set up board %v, expected position %s", g.Board, id)
+	}
+	g.lock.Unlock()
+
+	// Player 2 has already borne off all of their checkers.
+	finished := bgammon.NewBoard()
+	for space := range finished {
+		if finished[space] < 0 {
+			finished[space] = 0
+		}
+	}
+	finished[bgammon.SpaceHomeOpponent] = -15
+	c1.send("setboard " + bgammon.PositionID(finished, 1))
+	failed := expectEvent[*bgammon.EventFailedMove](t, c1)
+	if failed.Code != bgammon.ErrorInvalidPosition {
+		t.Errorf("setting up a finished game failed with code %s, expected %s", failed.Code, bgammon.ErrorInvalidPosition)
+	}
+}
+
+func TestSetBoardRated(t *testing.T) {
+	newTestDatabase(t)
+	s := startTestServer(t, false)
+	c1, c2, g := playMatch(t, s, registerClient(t, s, "alice"), registerClient(t, s, "bob"), "1")
+
+	board := bgammon.NewBoard()
+	board[6], board[5] = 4, 1
+	id := bgammon.PositionID(board, 1)
+
+	// Both players must agree to set up the position. Proposing the same
+	// position again does not set it up.
+	proposed := c1.name() + " wants to set up position " + id + ". The match will no longer be rated. To agree, send 'setboard " + id + "'."
+	c1.send("setboard " + id)
+	expectNotice(t, c2, proposed)
+	c1.send("setboard " + id)
+	expectNotice(t, c2, proposed)
+	c2.send("setboard " + bgammon.PositionID(bgammon.NewBoard(), 1))
+	expectNotice(t, c1, c2.name()+" wants to set up position 4HPwATDgc/ABMA. The match will no longer be rated. To agree, send 'setboard 4HPwATDgc/ABMA'.")
+
+	g.lock.Lock()
+	rated, set := g.rated(), g.Board[5] != 0
+	g.lock.Unlock()
+	if !rated || set {
+		t.Fatalf("position was set up without both players agreeing")
+	}
+
+	c1.send("setboard " + id)
+	expectNotice(t, c2, proposed)
+	c2.send("setboard " + id)
+	for _, c := range []*memoryClient{c1, c2} {
+		expectNotice(t, c, c2.name()+" set up position "+id+".")
+		// Boards are sent from the perspective of each player.
+		ev := expectEvent[*bgammon.EventBoard](t, c)
+		if c == c1 && (ev.Board[5] != 1 || ev.Board[6] != 4) {
+			t.Errorf("%s was sent board %v, expected position %s", c.name(), ev.Board, id)
+		}
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.rated() {
+		t.Error("match is still rated after setting up a position")
+	}
+}
+
+// gammonBoard returns a board on which player 1 bears off their last checker
+// by moving 1/off. Player 2 has not borne off any checkers.
+func gammonBoard() []int {
+	board := make([]int, bgammon.BoardSpaces)
+	board[bgammon.SpaceHomePlayer] = 14
+	board[1] = 1
+	board[19] = -15
+	return board
+}
+
+func TestJacoby(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		double  bool
+		points  int
+		winType int
+	}{
+		{"cube not turned", false, 1, bgammon.WinGammon},
+		{"doubled", true, 4, bgammon.WinGammon},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, c2, _ := startMatch(t, s, "1 jacoby")
+			setBoard(t, c1, gammonBoard())
+			setState(t, c1, 1, "")
+
+			if test.double {
+				c1.send("double")
+				expectEvent[*bgammon.EventDoubleOffered](t, c2)
+				c2.send("ok")
+				expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+			}
+
+			c1.send("roll")
+			expectEvent[*bgammon.EventRolled](t, c1)
+			setState(t, c1, 1, "21")
+			c1.send("move 1/off")
+			ev := expectEvent[*bgammon.EventWin](t, c1)
+			if ev.Points != test.points || ev.WinType != test.winType {
+				t.Errorf("won %d points by %d, expected %d points by %d", ev.Points, ev.WinType, test.points, test.winType)
+			}
+		})
+	}
+}
+
+func TestJoinInProgress(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, g := startMatch(t, s, "3")
+
+	g.lock.Lock()
+	g.Player1.Points, g.Player2.Points = 1, 2
+	g.lock.Unlock()
+
+	setState(t, c1, 1, "")
+	c1.send("double")
+	expectEvent[*bgammon.EventDoubleOffered](t, c2)
+	c2.send("ok")
+	expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+	setState(t, c1, 1, "52")
+	c1.send("move 13/11")
+	expectEvent[*bgammon.EventMoved](t, c1)
+
+	// The board must be sent immediately after joining, so that the match
+	// may be shown without waiting for the next action.
+	expectState := func(t *testing.T, c *memoryClient, playerNumber int) {
+		t.Helper()
+		joined := expectEvent[*bgammon.EventJoined](t, c)
+		if joined.GameID != g.id || joined.PlayerNumber != playerNumber {
+			t.Fatalf("joined match %d as player %d, expected match %d as player %d", joined.GameID, joined.PlayerNumber, g.id, playerNumber)
+		}
+		message, ok := c.receive(testTimeout)
+		if !ok {
+			t.Fatal("board was not sent after joining")
+		}
+		ev, err := bgammon.DecodeEvent(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		board, ok := ev.(*bgammon.EventBoard)
+		if !ok {
+			t.Fatalf("received %T after joining, expected the board", ev)
+		}
+		if board.PlayerNumber != playerNumber || board.Turn != 1 || board.Roll1 != 5 || board.Roll2 != 2 {
+			t.Errorf("player %d, turn %d and dice %d-%d, expected player %d, turn 1 and dice 5-2", board.PlayerNumber, board.Turn, board.Roll1, board.Roll2, playerNumber)
+		}
+		if board.DoubleValue != 2 || board.DoublePlayer != 2 {
+			t.Errorf("cube at %d owned by player %d, expected 2 owned by player 2", board.DoubleValue, board.DoublePlayer)
+		}
+		if board.Player1.Points != 1 || board.Player2.Points != 2 {
+			t.Errorf("score %d-%d, expected 1-2", board.Player1.Points, board.Player2.Points)
+		}
+		if len(board.Moves) != 1 {
+			t.Errorf("moves %v, expected the move made this turn", board.Moves)
+		}
+	}
+
+	t.Run("spectator", func(t *testing.T) {
+		c := loginClient(t, s, "carol")
+		c.send("watch " + strconv.Itoa(g.id))
+		expectState(t, c, 0)
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		name := c2.name()
+		disconnect(t, s, c2)
+		c := loginClient(t, s, name)
+		expectState(t, c, 2)
+	})
+}
+
+func TestCombinedMoves(t *testing.T) {
+	for _, test := range []struct {
+		combined string
+		expected string
+	}{
+		{"off", "24/18 18/13"},
+		{"on", "24/13"},
+	} {
+		t.Run(test.combined, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, _, _ := startMatch(t, s, "1")
+			setState(t, c1, 1, "65")
+
+			c1.send("settings set combined " + test.combined)
+			expectEventFunc(t, c1, func(ev *bgammon.EventSettings) bool {
+				return ev.Combined == (test.combined == "on")
+			})
+			c1.send("settings set json off")
+
+			c1.send("move 24/13")
+			expected := "moved " + c1.name() + " " + test.expected
+			for {
+				message, ok := c1.receive(testTimeout)
+				if !ok {
+					t.Fatalf("did not receive %q", expected)
+				}
+				line := string(message)
+				if strings.HasPrefix(line, "moved ") {
+					if line != expected {
+						t.Errorf("received %q, expected %q", line, expected)
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBoardLegalMoves(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, g := startMatch(t, s, "1")
+
+	// The legal moves sent to each player must match the moves found for
+	// the current state of the game, even as the state changes.
+	expectLegalMoves := func(moves int, remaining []int) {
+		t.Helper()
+		var boards []*bgammon.EventBoard
+		for _, c := range []*memoryClient{c1, c2} {
+			boards = append(boards, expectEventFunc(t, c, func(ev *bgammon.EventBoard) bool {
+				return ev.Roll1 == 5 && ev.Roll2 == 2 && len(ev.Moves) == moves
+			}))
+		}
+
+		g.lock.Lock()
+		legalMoves := g.LegalMoves(false)
+		g.lock.Unlock()
+		if len(legalMoves) == 0 {
+			t.Fatal("no legal moves")
+		}
+
+		for i, board := range boards {
+			player := i + 1
+			expected := bgammon.FlipMoves(legalMoves, player)
+			bgammon.SortMoves(expected)
+			if !reflect.DeepEqual(board.Available, expected) {
+				t.Errorf("player %d: legal moves %v, expected %v", player, board.Available, expected)
+			}
+			if !reflect.DeepEqual(board.Remaining, remaining) {
+				t.Errorf("player %d: remaining rolls %v, expected %v", player, board.Remaining, remaining)
+			}
+		}
+	}
+
+	c1.send("setstate 1 52")
+	expectLegalMoves(0, []int{5, 2})
+
+	// The board is sent again without changing the state of the game.
+	c2.send("board")
+	c1.send("board")
+	expectLegalMoves(0, []int{5, 2})
+
+	c1.send("move 13/11")
+	expectLegalMoves(1, []int{5})
+
+	c1.send("reset")
+	expectLegalMoves(0, []int{5, 2})
+}
+
+func TestTurnOrder(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+
+	// Doubling after rolling.
+	setState(t, c1, 1, "52")
+	c1.send("double")
+	expectNotice(t, c1, "You may not double after rolling. Players may only double before rolling on their turn.")
+
+	// Moving before rolling.
+	setState(t, c1, 1, "")
+	c1.send("move 13/11")
+	failedMove := expectEvent[*bgammon.EventFailedMove](t, c1)
+	if failedMove.Code != bgammon.ErrorNotRolled {
+		t.Errorf("moving before rolling failed with code %s, expected %s", failedMove.Code, bgammon.ErrorNotRolled)
+	}
+
+	// Doubling, rolling and moving while a double is pending.
+	c1.send("double")
+	expectEvent[*bgammon.EventDoubleOffered](t, c2)
+	c1.send("double")
+	expectNotice(t, c1, "You have already offered a double.")
+	for _, c := range []*memoryClient{c1, c2} {
+		c.send("roll")
+		failedRoll := expectEvent[*bgammon.EventFailedRoll](t, c)
+		if failedRoll.Code != bgammon.ErrorDoubleOffered {
+			t.Errorf("%s: rolling while a double is pending failed with code %s, expected %s", c.name(), failedRoll.Code, bgammon.ErrorDoubleOffered)
+		}
+	}
+	c1.send("move 13/11")
+	failedMove = expectEvent[*bgammon.EventFailedMove](t, c1)
+	if failedMove.Code != bgammon.ErrorDoubleOffered {
+		t.Errorf("moving while a double is pending failed with code %s, expected %s", failedMove.Code, bgammon.ErrorDoubleOffered)
+	}
+
+	// Rolling after the double is accepted.
+	c2.send("ok")
+	expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+	c1.send("roll")
+	rolled := expectEvent[*bgammon.EventRolled](t, c1)
+	if rolled.Player != c1.name() {
+		t.Errorf("%s rolled, expected %s", rolled.Player, c1.name())
+	}
+}
+
+func TestMatchOver(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+
+	single := gammonBoard()
+	single[bgammon.SpaceHomeOpponent], single[19] = -1, -14
+
+	for _, test := range []struct {
+		name   string
+		board  []int
+		points int
+		score1 int
+		match  bool
+	}{
+		{"single game", single, 1, 1, false},
+		{"gammon reaching the match length", gammonBoard(), 2, 3, true},
+	} {
+		setBoard(t, c1, test.board)
+		setState(t, c1, 1, "21")
+		c1.send("move 1/off")
+		for _, c := range []*memoryClient{c1, c2} {
+			ev := expectEvent[*bgammon.EventWin](t, c)
+			if ev.Player != c1.name() || ev.Points != test.points {
+				t.Errorf("%s: %s: %s won %d points, expected %s to win %d points", test.name, c.name(), ev.Player, ev.Points, c1.name(), test.points)
+			}
+			if ev.Score1 != test.score1 || ev.Score2 != 0 {
+				t.Errorf("%s: %s: score %d-%d, expected %d-0", test.name, c.name(), ev.Score1, ev.Score2, test.score1)
+			}
+			if ev.Match != test.match {
+				t.Errorf("%s: %s: match over: %t, expected %t", test.name, c.name(), ev.Match, test.match)
+			}
+		}
+	}
+}
+
+func TestInvalidUsername(t *testing.T) {
+	for _, test := range []struct {
+		username string
+		reason   string
+	}{
+		{"alice", ""},
+		{"bob", ""},
+		{"Player_2", ""},
+		{"δέλτα", ""},
+		{"abcdefghijklmnopqrst", ""},
+		{"al", "must be at least 3 characters long"},
+		{"δέ", "must be at least 3 characters long"},
+		{"abcdefghijklmnopqrstu", "must be at most 20 characters long"},
+		{"al\x07ice", "must not contain control characters"},
+		{"al ice", "must not contain spaces"},
+		{"al\u00a0ice", "must not contain spaces"},
+		{"12345", "must contain at least one non-numeric character"},
+		{"Guest123", "must not contain the word guest"},
+		{"myguestname", "must not contain the word guest"},
+		{"al\xffice", "must be valid UTF-8"},
+	} {
+		if reason := invalidUsername([]byte(test.username)); reason != test.reason {
+			t.Errorf("%q: reason %q, expected %q", test.username, reason, test.reason)
+		}
+	}
+}
+
+func TestLoginInvalidUsername(t *testing.T) {
+	s := newTestServer(t)
+	c := s.connectMemoryClient()
+	defer c.send(bgammon.CommandDisconnect)
+
+	c.send("loginjson test guest42")
+	expectNotice(t, c, "Connection terminated: Invalid username: must not contain the word guest.")
+
+	// Assigned guest usernames are not validated.
+	guest := s.connectMemoryClient()
+	defer guest.send(bgammon.CommandDisconnect)
+	guest.send("loginjson")
+	welcome := expectEvent[*bgammon.EventWelcome](t, guest)
+	if !strings.HasPrefix(welcome.PlayerName, "Guest") {
+		t.Errorf("logged in as %s, expected a guest username", welcome.PlayerName)
+	}
+}
+
+func TestHideSpectators(t *testing.T) {
+	for _, test := range []struct {
+		options    string
+		spectators int
+		name       string
+	}{
+		{"1", 1, "carol"},
+		{"1 hidespectators", 0, anonymousSpectator},
+	} {
+		t.Run(test.options, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, c2, g := startMatch(t, s, test.options)
+
+			spectator := loginClient(t, s, "carol")
+			spectator.send("watch " + strconv.Itoa(g.id))
+			expectEvent[*bgammon.EventJoined](t, spectator)
+
+			for _, c := range []*memoryClient{c1, spectator, loginClient(t, s, "dave")} {
+				c.send("list")
+				list := expectEvent[*bgammon.EventList](t, c)
+				if len(list.Games) != 1 || list.Games[0].Spectators != test.spectators {
+					t.Errorf("%s: listed %+v, expected a match with %d spectators", c.name(), list.Games, test.spectators)
+				}
+			}
+
+			spectator.send("say hello")
+			for _, c := range []*memoryClient{c1, c2} {
+				say := expectEvent[*bgammon.EventSay](t, c)
+				if say.Player != test.name || say.Message != "hello" {
+					t.Errorf("%s: %s said %q, expected %s to say hello", c.name(), say.Player, say.Message, test.name)
+				}
+			}
+		})
+	}
+}
+
+func TestCrawford(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+
+	// The board of the next game is sent before the game is won.
+	expectCrawford := func(score1 int, score2 int, crawford bool) {
+		t.Helper()
+		for _, c := range []*memoryClient{c1, c2} {
+			board := expectEventFunc(t, c, func(ev *bgammon.EventBoard) bool {
+				return ev.Turn == 0 && ev.Player1.Points == score1 && ev.Player2.Points == score2
+			})
+			if board.Crawford != crawford {
+				t.Errorf("%s: Crawford game: %t, expected %t", c.name(), board.Crawford, crawford)
+			}
+		}
+	}
+
+	// Player 1 reaches match point, so the next game is the Crawford game.
+	setBoard(t, c1, gammonBoard())
+	setState(t, c1, 1, "21")
+	c1.send("move 1/off")
+	expectCrawford(2, 0, true)
+	expectEvent[*bgammon.EventWin](t, c2)
+
+	setState(t, c1, 2, "")
+	c2.send("double")
+	expectNotice(t, c2, "You may not double during the Crawford game. The doubling cube may not be used during the game after a player first reaches match point.")
+
+	// Player 2 wins the Crawford game, after which the cube may be used.
+	board := make([]int, bgammon.BoardSpaces)
+	board[bgammon.SpaceHomePlayer], board[6] = 1, 14
+	board[bgammon.SpaceHomeOpponent], board[24] = -14, -1
+	setState(t, c1, 1, "")
+	setBoard(t, c1, board)
+	setState(t, c1, 2, "21")
+	c2.send("move 1/off")
+	expectCrawford(2, 1, false)
+	win := expectEvent[*bgammon.EventWin](t, c1)
+	if win.Player != c2.name() || win.Score1 != 2 || win.Score2 != 1 || win.Match {
+		t.Fatalf("%s won and the score is %d-%d, expected %s to win and the score to be 2-1", win.Player, win.Score1, win.Score2, c2.name())
+	}
+
+	setState(t, c1, 2, "")
+	c2.send("double")
+	expectEvent[*bgammon.EventDoubleOffered](t, c1)
+}
+
+func TestPosition(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+
+	for _, c := range []*memoryClient{c1, c2} {
+		c.send("position")
+		ev := expectEvent[*bgammon.EventPosition](t, c)
+		if ev.ID != "4HPwATDgc/ABMA" {
+			t.Errorf("%s: Position ID %s, expected the starting position", c.name(), ev.ID)
+		}
+		// 3 point match at 0-0 with the doubling cube centered.
+		if ev.MatchID != "MAFgAAAAAAAA" {
+			t.Errorf("%s: Match ID %s, expected MAFgAAAAAAAA", c.name(), ev.MatchID)
+		}
+	}
+
+	board := gammonBoard()
+	setBoard(t, c1, board)
+	c2.send("position")
+	ev := expectEvent[*bgammon.EventPosition](t, c2)
+	if ev.ID != bgammon.PositionID(board, 1) {
+		t.Errorf("Position ID %s, expected %s", ev.ID, bgammon.PositionID(board, 1))
+	}
+}
+
+func TestPingClient(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	newClient := func(name string) (*serverClient, *memoryClient) {
+		mc := newMemoryClient(make(chan []byte))
+		c := &serverClient{
+			name:      []byte(name),
+			json:      true,
+			connected: start.Unix(),
+			Client:    mc,
+		}
+		c.lastActive.Store(start.Unix())
+		mc.client = c
+		return c, mc
+	}
+	expectNoEvent := func(mc *memoryClient) {
+		t.Helper()
+		if message, ok := mc.receive(0); ok {
+			t.Errorf("received %s, expected no event", message)
+		}
+	}
+
+	t.Run("login timeout", func(t *testing.T) {
+		c, mc := newClient("")
+		if !pingClient(c, start.Add(loginTimeout-time.Second)) {
+			t.Fatal("disconnected before the login timeout")
+		}
+		expectNoEvent(mc)
+		if pingClient(c, start.Add(loginTimeout)) {
+			t.Fatal("not disconnected after the login timeout")
+		}
+		expectNotice(t, mc, "Connection terminated: User did not send login command within 30 seconds.")
+	})
+
+	t.Run("active", func(t *testing.T) {
+		c, mc := newClient("alice")
+		now := start.Add(pingInterval - time.Second)
+		c.lastActive.Store(now.Unix())
+		if !pingClient(c, now.Add(pingInterval-time.Second)) {
+			t.Fatal("active client was disconnected")
+		}
+		expectNoEvent(mc)
+	})
+
+	t.Run("inactive", func(t *testing.T) {
+		c, mc := newClient("alice")
+		now := start.Add(pingInterval)
+		if !pingClient(c, now) {
+			t.Fatal("inactive client was disconnected before the timeout")
+		}
+		ping := expectEvent[*bgammon.EventPing](t, mc)
+		if ping.Message != strconv.FormatInt(now.Unix(), 10) {
+			t.Errorf("ping message %s, expected %d", ping.Message, now.Unix())
+		}
+
+		// Clients are only pinged once each interval.
+		if !pingClient(c, now.Add(pingInterval-time.Second)) {
+			t.Fatal("inactive client was disconnected before the timeout")
+		}
+		expectNoEvent(mc)
+
+		if pingClient(c, start.Add(clientTimeout)) {
+			t.Fatal("client which did not respond was not disconnected")
+		} else if !c.timedOut {
+			t.Error("client which did not respond did not time out")
+		}
+		expectNotice(t, mc, "Connection terminated: Client did not respond to ping.")
+	})
+}
+
+func TestResign(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		dice     string // Dice rolled before resigning, if any.
+		double   bool   // Whether player 1 doubled and player 2 accepted before resigning.
+		command  string
+		points   int // Points awarded for the game. No points are awarded when a match ends early.
+		match    bool
+		rejected bool // Whether resigning declined a pending double.
+	}{
+		{"game before rolling", "", false, "resign", 1, false, false},
+		{"game after rolling", "52", false, "resign game", 1, false, false},
+		{"game after accepting a double", "52", true, "resign game", 2, false, false},
+		{"match", "52", false, "resign match", 0, true, false},
+		{"pending double", "", false, "resign", 1, false, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, c2, g := startMatch(t, s, "5")
+			spectator := loginClient(t, s, "carol")
+			spectator.send("watch " + strconv.Itoa(g.id))
+			expectEvent[*bgammon.EventJoined](t, spectator)
+
+			// Player 2 resigns, except when declining a double offered by
+			// player 1, in which case player 1 is awarded the points.
+			setState(t, c1, 1, "")
+			if test.double {
+				c1.send("double")
+				expectEvent[*bgammon.EventDoubleOffered](t, c2)
+				c2.send("ok")
+				expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+			}
+			if test.dice != "" {
+				setState(t, c1, 2, test.dice)
+			}
+			resigning, winner := c2, c1
+			if test.rejected {
+				c1.send("double")
+				expectEvent[*bgammon.EventDoubleOffered](t, c2)
+			}
+			resigning.send(test.command)
+
+			if test.rejected {
+				expectEvent[*bgammon.EventDoubleRejected](t, c1)
+			}
+			for _, c := range []*memoryClient{c1, c2, spectator} {
+				ev := expectEvent[*bgammon.EventWin](t, c)
+				if ev.Player != winner.name() || ev.Points != test.points || ev.Match != test.match {
+					t.Errorf("%s: %s won %d points and the match is over: %t, expected %s to win %d points and the match to be over: %t", c.name(), ev.Player, ev.Points, ev.Match, winner.name(), test.points, test.match)
+				}
+				if ev.Resigned == test.rejected {
+					t.Errorf("%s: resigned: %t, expected %t", c.name(), ev.Resigned, !test.rejected)
+				}
+			}
+		})
+	}
+}
+
+func TestCommandBurst(t *testing.T) {
+	s := newTestServer(t)
+	c := loginClient(t, s, "alice")
+
+	for i := 0; i < commandBurst*2; i++ {
+		c.send(bgammon.CommandPong)
+	}
+	expectNotice(t, c, "You are sending commands too quickly. Some commands were not processed.")
+}
+
+func TestPassTurn(t *testing.T) {
+	// expectPass waits for the turn of player 1 to be ended automatically.
+	expectPass := func(t *testing.T, c1 *memoryClient, c2 *memoryClient) {
+		t.Helper()
+		for _, c := range []*memoryClient{c1, c2} {
+			moved := expectEventFunc(t, c, func(ev *bgammon.EventMoved) bool {
+				return len(ev.Moves) == 0
+			})
+			if moved.Player != c1.name() {
+				t.Errorf("%s: turn of %s ended, expected %s", c.name(), moved.Player, c1.name())
+			}
+			board := expectEvent[*bgammon.EventBoard](t, c)
+			if board.Turn != 2 || board.Roll1 != 0 || board.Roll2 != 0 {
+				t.Errorf("%s: turn %d and dice %d-%d, expected turn 2 without dice", c.name(), board.Turn, board.Roll1, board.Roll2)
+			}
+		}
+	}
+
+	t.Run("dance", func(t *testing.T) {
+		s := newTestServer(t)
+		c1, c2, _ := startMatch(t, s, "1")
+
+		// Player 1 may not enter from the bar, as player 2 holds every
+		// point of their home board.
+		board := make([]int, bgammon.BoardSpaces)
+		board[bgammon.SpaceBarPlayer], board[6] = 1, 14
+		for space := 19; space <= 24; space++ {
+			board[space] = -2
+		}
+		board[18] = -3
+		setBoard(t, c1, board)
+		setState(t, c1, 1, "")
+
+		c1.send("roll")
+		expectEvent[*bgammon.EventRolled](t, c1)
+		expectPass(t, c1, c2)
+	})
+
+	t.Run("remaining die", func(t *testing.T) {
+		s := newTestServer(t)
+		c1, c2, _ := startMatch(t, s, "1")
+
+		// After playing 13/7, the 5 may not be played as the 2 point is
+		// blocked.
+		board := make([]int, bgammon.BoardSpaces)
+		board[13], board[1] = 1, 14
+		board[2], board[24] = -2, -13
+		setBoard(t, c1, board)
+		setState(t, c1, 1, "65")
+
+		c1.send("move 13/7")
+		expectEventFunc(t, c1, func(ev *bgammon.EventMoved) bool {
+			return len(ev.Moves) == 1
+		})
+		expectPass(t, c1, c2)
+	})
+}
+
+func TestAutoRoll(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+
+	// expectNoRoll fails the test when the dice are rolled shortly after.
+	expectNoRoll := func(c *memoryClient) {
+		t.Helper()
+		ev, ok := c.receiveEvent(100*time.Millisecond, func(ev interface{}) bool {
+			_, ok := ev.(*bgammon.EventRolled)
+			return ok
+		})
+		if ok {
+			t.Fatalf("%s rolled automatically", ev.(*bgammon.EventRolled).Player)
+		}
+	}
+
+	// Players are not rolled for while rolling for the first turn.
+	c2.send("autoroll on")
+	expectNotice(t, c2, "Automatic rolling enabled.")
+	expectNoRoll(c2)
+
+	// Players are not rolled for on their opponent's turn.
+	setState(t, c1, 1, "")
+	expectNoRoll(c2)
+	c1.send("roll")
+	rolled := expectEvent[*bgammon.EventRolled](t, c2)
+	if rolled.Player != c1.name() {
+		t.Fatalf("%s rolled, expected %s", rolled.Player, c1.name())
+	}
+
+	// Players are rolled for at the start of their turn.
+	setState(t, c1, 1, "21")
+	c1.send("move 13/11 6/5")
+	expectEvent[*bgammon.EventMoved](t, c1)
+	c1.send("ok")
+	for _, c := range []*memoryClient{c1, c2} {
+		rolled := expectEvent[*bgammon.EventRolled](t, c)
+		if rolled.Player != c2.name() {
+			t.Errorf("%s: %s rolled, expected %s", c.name(), rolled.Player, c2.name())
+		}
+	}
+}
+
+// mirrorBoard returns the provided board with the checkers of each player
+// swapped, so that a position set up for player 1 may be played by player 2.
+func mirrorBoard(board []int) []int {
+	mirrored := make([]int, bgammon.BoardSpaces)
+	for space := 1; space <= 24; space++ {
+		mirrored[space] = -board[25-space]
+	}
+	mirrored[bgammon.SpaceHomePlayer], mirrored[bgammon.SpaceHomeOpponent] = -board[bgammon.SpaceHomeOpponent], -board[bgammon.SpaceHomePlayer]
+	mirrored[bgammon.SpaceBarPlayer], mirrored[bgammon.SpaceBarOpponent] = -board[bgammon.SpaceBarOpponent], -board[bgammon.SpaceBarPlayer]
+	return mirrored
+}
+
+func TestEnterAndBearOff(t *testing.T) {
+	// Boards are from the perspective of the player moving.
+	enter := make([]int, bgammon.BoardSpaces)
+	enter[bgammon.SpaceBarPlayer], enter[6], enter[12] = 1, 14, -15
+
+	bearOff := make([]int, bgammon.BoardSpaces)
+	bearOff[6], bearOff[4], bearOff[3], bearOff[12] = 1, 1, 13, -15
+
+	overage := make([]int, bgammon.BoardSpaces)
+	overage[4], overage[3], overage[12] = 1, 14, -15
+
+	for _, test := range []struct {
+		name    string
+		board   []int
+		dice    string
+		illegal string // Move which is rejected before the moves are made, if any.
+		moves   []string
+		space   int // Space which must hold a checker of the player afterward.
+		off     int // Number of checkers borne off afterward.
+	}{
+		{"enter", enter, "52", "13/8", []string{"bar/20", "6/4"}, 20, 0},
+		{"bear off exact", bearOff, "64", "", []string{"6/off", "4/off"}, 3, 2},
+		{"bear off overage", overage, "65", "3/off", []string{"4/off", "3/off"}, 3, 2},
+	} {
+		for player := 1; player <= 2; player++ {
+			t.Run(fmt.Sprintf("%s player %d", test.name, player), func(t *testing.T) {
+				s := newTestServer(t)
+				c1, c2, _ := startMatch(t, s, "1")
+				c := c1
+				board := test.board
+				if player == 2 {
+					c = c2
+					board = mirrorBoard(board)
+				}
+				setBoard(t, c1, board)
+				setState(t, c1, player, test.dice)
+
+				if test.illegal != "" {
+					c.send("move " + test.illegal)
+					expectEvent[*bgammon.EventFailedMove](t, c)
+				}
+				for _, move := range test.moves {
+					c.send("move " + move)
+					expectEventFunc(t, c, func(ev *bgammon.EventMoved) bool {
+						return ev.Player == c.name()
+					})
+				}
+				c.send("board")
+				ev := expectEventFunc(t, c, func(ev *bgammon.EventBoard) bool {
+					return len(ev.Moves) == len(test.moves)
+				})
+				if bgammon.PlayerCheckers(ev.Board[test.space], player) == 0 || ev.PlayerBar != 0 || ev.PlayerOff != test.off {
+					t.Errorf("board %v with %d checkers on the bar and %d borne off, expected a checker on %d, none on the bar and %d borne off", ev.Board, ev.PlayerBar, ev.PlayerOff, test.space, test.off)
+				}
+			})
+		}
+	}
+}
+
+func TestJoinFull(t *testing.T) {
+	s := newTestServer(t)
+	creator := loginClient(t, s, "alice")
+	creator.send("create public 1")
+	created := expectEvent[*bgammon.EventJoined](t, creator)
+	id := strconv.Itoa(created.GameID)
+
+	// Joining the match you are in fails.
+	creator.send("join " + id)
+	if ev := expectEvent[*bgammon.EventFailedJoin](t, creator); ev.Code != bgammon.ErrorAlreadyInMatch {
+		t.Errorf("joining the same match failed with %s, expected %s", ev.Code, bgammon.ErrorAlreadyInMatch)
+	}
+
+	const joiners = 8
+	clients := make([]*memoryClient, joiners)
+	for i := range clients {
+		clients[i] = loginClient(t, s, fmt.Sprintf("player%d", i))
+	}
+
+	// Only one of the players joining at once takes the last seat.
+	var wg sync.WaitGroup
+	var joined atomic.Int32
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *memoryClient) {
+			defer wg.Done()
+			c.send("join " + id)
+			ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+				switch ev := ev.(type) {
+				case *bgammon.EventJoined:
+					return ev.Player == c.name()
+				case *bgammon.EventFailedJoin:
+					return true
+				}
+				return false
+			})
+			if !ok {
+				t.Errorf("client %s did not join the match or fail to join", c.name())
+				return
+			}
+			switch ev := ev.(type) {
+			case *bgammon.EventJoined:
+				joined.Add(1)
+			case *bgammon.EventFailedJoin:
+				if ev.Code != bgammon.ErrorMatchFull || ev.Reason != "Match is full." {
+					t.Errorf("client %s failed to join with %s: %s, expected %s", c.name(), ev.Code, ev.Reason, bgammon.ErrorMatchFull)
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	if n := joined.Load(); n != 1 {
+		t.Fatalf("%d players joined the match, expected 1", n)
+	}
+
+	// Joining the match you are in still fails after it is full.
+	creator.send("join " + id)
+	if ev := expectEvent[*bgammon.EventFailedJoin](t, creator); ev.Code != bgammon.ErrorAlreadyInMatch {
+		t.Errorf("joining the same match failed with %s, expected %s", ev.Code, bgammon.ErrorAlreadyInMatch)
+	}
+}
+
+func TestJoinPrivate(t *testing.T) {
+	for _, test := range []struct {
+		join   string // Arguments of the join command. The match ID replaces %d.
+		joined bool
+	}{
+		{"%d Open_Sesame", true},
+		{"%d open_sesame", true},
+		{"%d OPEN SESAME", true},
+		{"%d   Open_Sesame   ", true},
+		{"%d Open_Sesame_", true},
+		{"alice Open_Sesame", true},
+		{"ALICE open_sesame", true},
+		{"%d", false},
+		{"%d Open", false},
+		{"%d OpenSesame", false},
+		{"alice", false},
+		{"alice Sesame", false},
+	} {
+		s := newTestServer(t)
+		creator := loginClient(t, s, "alice")
+		creator.send("create private Open_Sesame 1")
+		created := expectEvent[*bgammon.EventJoined](t, creator)
+
+		join := test.join
+		if strings.Contains(join, "%d") {
+			join = fmt.Sprintf(join, created.GameID)
+		}
+		joiner := loginClient(t, s, "bob")
+		joiner.send("join " + join)
+		ev, ok := joiner.receiveEvent(testTimeout, func(ev interface{}) bool {
+			switch ev.(type) {
+			case *bgammon.EventJoined, *bgammon.EventFailedJoin:
+				return true
+			}
+			return false
+		})
+		if !ok {
+			t.Fatalf("join %q: client did not join the match or fail to join", join)
+		}
+		switch ev := ev.(type) {
+		case *bgammon.EventJoined:
+			if !test.joined {
+				t.Errorf("join %q: joined the match, expected to fail", join)
+			}
+		case *bgammon.EventFailedJoin:
+			if test.joined {
+				t.Errorf("join %q: failed to join the match: %s", join, ev.Reason)
+			} else if ev.Code != bgammon.ErrorInvalidPassword {
+				t.Errorf("join %q: failed to join the match with %s, expected %s", join, ev.Code, bgammon.ErrorInvalidPassword)
+			}
+		}
+	}
+}
+
+// tiedSeed returns a dice seed with which the players tie the provided number
+// of times while rolling for the first turn, before one of them rolls higher.
+func tiedSeed(t *testing.T, ties int) int64 {
+	t.Helper()
+	for seed := int64(1); seed < 1000000; seed++ {
+		d := newDiceSource(seed)
+		var n int
+		for d.roll() == d.roll() {
+			n++
+		}
+		if n == ties {
+			return seed
+		}
+	}
+	t.Fatalf("no seed found with %d ties", ties)
+	return 0
+}
+
+// rollOpening rolls for the first turn with both players, and returns the
+// board sent to the first player after the second player rolls.
+func rollOpening(t *testing.T, c1 *memoryClient, c2 *memoryClient) *bgammon.EventBoard {
+	t.Helper()
+	c1.send("roll")
+	expectEventFunc(t, c2, func(ev *bgammon.EventRolled) bool {
+		return ev.Player == c1.name()
+	})
+	c2.send("roll")
+	expectEventFunc(t, c1, func(ev *bgammon.EventRolled) bool {
+		return ev.Player == c2.name()
+	})
+	return expectEvent[*bgammon.EventBoard](t, c1)
+}
+
+func TestOpeningTie(t *testing.T) {
+	const ties = 2
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, fmt.Sprintf("1 seed=%d", tiedSeed(t, ties)))
+
+	for i := 0; i < ties; i++ {
+		c1.send("roll")
+		expectEventFunc(t, c2, func(ev *bgammon.EventRolled) bool {
+			return ev.Player == c1.name()
+		})
+		c2.send("roll")
+
+		// Both players are told to roll again.
+		for _, c := range []*memoryClient{c1, c2} {
+			rolled := expectEventFunc(t, c, func(ev *bgammon.EventRolled) bool {
+				return ev.Player == c2.name()
+			})
+			if !rolled.Tie || rolled.Roll1 == 0 || rolled.Roll1 != rolled.Roll2 {
+				t.Fatalf("tie %d: client %s received roll %d-%d with tie %t, expected a tie", i+1, c.name(), rolled.Roll1, rolled.Roll2, rolled.Tie)
+			}
+			board := expectEvent[*bgammon.EventBoard](t, c)
+			if board.Turn != 0 || board.Roll1 != 0 || board.Roll2 != 0 || board.DoubleValue != 1 {
+				t.Fatalf("tie %d: client %s received turn %d, roll %d-%d and cube %d, expected turn 0, no roll and cube 1", i+1, c.name(), board.Turn, board.Roll1, board.Roll2, board.DoubleValue)
+			}
+		}
+	}
+
+	board := rollOpening(t, c1, c2)
+	if board.Turn == 0 || board.Roll1 == board.Roll2 {
+		t.Errorf("turn %d and roll %d-%d after %d ties, expected a player to go first", board.Turn, board.Roll1, board.Roll2, ties)
+	}
+}
+
+func TestAutoDouble(t *testing.T) {
+	s := newTestServer(t)
+	c := loginClient(t, s, "carol")
+	for _, options := range []string{"3 autodouble", "1 autodouble=3", "1 autodouble=128"} {
+		c.send("create public " + options)
+		expectEvent[*bgammon.EventFailedCreate](t, c)
+	}
+
+	// The cube is turned after each tie until it reaches the limit.
+	const ties = 3
+	c1, c2, _ := startMatch(t, s, fmt.Sprintf("1 autodouble=4 seed=%d", tiedSeed(t, ties)))
+	for i, tie := range []struct {
+		cube   int
+		turned bool
+	}{
+		{2, true},
+		{4, true},
+		{4, false},
+	} {
+		c1.send("roll")
+		expectEventFunc(t, c2, func(ev *bgammon.EventRolled) bool {
+			return ev.Player == c1.name()
+		})
+		c2.send("roll")
+
+		for _, c := range []*memoryClient{c1, c2} {
+			expectEventFunc(t, c, func(ev *bgammon.EventRolled) bool {
+				return ev.Player == c2.name() && ev.Tie
+			})
+			var autoDouble *bgammon.EventAutoDouble
+			var board *bgammon.EventBoard
+			for board == nil {
+				ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+					switch ev.(type) {
+					case *bgammon.EventAutoDouble, *bgammon.EventBoard:
+						return true
+					}
+					return false
+				})
+				if !ok {
+					t.Fatalf("tie %d: client %s did not receive the board", i+1, c.name())
+				}
+				switch ev := ev.(type) {
+				case *bgammon.EventAutoDouble:
+					autoDouble = ev
+				case *bgammon.EventBoard:
+					board = ev
+				}
+			}
+			if (autoDouble != nil) != tie.turned {
+				t.Errorf("tie %d: client %s received automatic double %t, expected %t", i+1, c.name(), autoDouble != nil, tie.turned)
+			} else if autoDouble != nil && autoDouble.Points != tie.cube {
+				t.Errorf("tie %d: client %s received automatic double to %d, expected %d", i+1, c.name(), autoDouble.Points, tie.cube)
+			}
+			if board.DoubleValue != tie.cube {
+				t.Errorf("tie %d: client %s received cube %d, expected %d", i+1, c.name(), board.DoubleValue, tie.cube)
+			}
+		}
+	}
+
+	board := rollOpening(t, c1, c2)
+	if board.Turn == 0 || board.DoubleValue != 4 {
+		t.Errorf("turn %d and cube %d after %d ties, expected a player to go first with cube 4", board.Turn, board.DoubleValue, ties)
+	}
+}
+
+func TestPuzzle(t *testing.T) {
+	s := newTestServer(t)
+	c := loginClient(t, s, "carol")
+	for _, puzzle := range []string{
+		"puzzle=//////////////:31", // Too many checkers.
+		"puzzle=AAAAAAAAAAAAAA:31", // No checkers.
+		"puzzle=4HPwATDgc/ABMA:71",
+		"puzzle=4HPwATDgc/ABMA",
+		"puzzle=4HPwATDgc:31",
+	} {
+		c.send("create public 1 " + puzzle)
+		expectEvent[*bgammon.EventFailedCreate](t, c)
+	}
+
+	// The position is from the perspective of the player who joins the
+	// match, who is on roll.
+	board := make([]int, bgammon.BoardSpaces)
+	board[6], board[5], board[19] = 1, 1, -15
+	creator, joiner := loginClient(t, s, "alice"), loginClient(t, s, "bob")
+	c1, c2, _ := playMatch(t, s, creator, joiner, "1 puzzle="+bgammon.PositionID(board, 1)+":31")
+
+	c.send("list")
+	list := expectEvent[*bgammon.EventList](t, c)
+	if len(list.Games) != 1 || !list.Games[0].Puzzle || list.Games[0].Rated {
+		t.Errorf("listed %+v, expected an unrated puzzle", list.Games)
+	}
+
+	player := 1
+	if c2 == joiner {
+		player = 2
+	}
+	joiner.send("board")
+	ev := expectEvent[*bgammon.EventBoard](t, joiner)
+	if ev.Turn != player || ev.Roll1 != 3 || ev.Roll2 != 1 || bgammon.PlayerCheckers(ev.Board[6], player) != 1 || bgammon.PlayerCheckers(ev.Board[5], player) != 1 {
+		t.Fatalf("puzzle started with turn %d, roll %d-%d and board %v, expected player %d to move 31 with checkers on 6 and 5", ev.Turn, ev.Roll1, ev.Roll2, ev.Board, player)
+	}
+
+	// The first move is made with the dice of the puzzle.
+	creator.send("roll")
+	expectEvent[*bgammon.EventFailedRoll](t, creator)
+	joiner.send("roll")
+	expectEvent[*bgammon.EventFailedRoll](t, joiner)
+	joiner.send("move 6/off")
+	expectEvent[*bgammon.EventFailedMove](t, joiner)
+	joiner.send("move 6/3")
+	expectEventFunc(t, c1, func(ev *bgammon.EventMoved) bool {
+		return ev.Player == joiner.name()
+	})
+}
+
+func TestInvite(t *testing.T) {
+	// invite sends an invitation from the first client to the second client,
+	// and returns the invitation received.
+	invite := func(t *testing.T, from *memoryClient, to *memoryClient, points string) *bgammon.EventInvite {
+		t.Helper()
+		from.send("invite " + to.name() + " " + points)
+		expectNotice(t, from, "Invited "+to.name()+" to play a "+points+" point match.")
+		ev := expectEvent[*bgammon.EventInvite](t, to)
+		if ev.Player != from.name() || strconv.Itoa(ev.Points) != points || ev.Expires != int(inviteTimeout.Seconds()) {
+			t.Fatalf("received invitation from %s to play %d points expiring in %d seconds, expected an invitation from %s to play %s points", ev.Player, ev.Points, ev.Expires, from.name(), points)
+		}
+		return ev
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		s := newTestServer(t)
+		alice, bob := loginClient(t, s, "alice"), loginClient(t, s, "bob")
+		ev := invite(t, alice, bob, "3")
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		for _, c := range []*memoryClient{alice, bob} {
+			board := expectEventFunc(t, c, func(ev *bgammon.EventBoard) bool {
+				return ev.Player1.Name != "" && ev.Player2.Name != ""
+			})
+			if board.Points != 3 {
+				t.Errorf("client %s received a board with %d points, expected 3", c.name(), board.Points)
+			}
+		}
+		expectNotice(t, alice, "bob accepted your invitation.")
+		g := s.gameByClient(alice.client)
+		if g == nil || g != s.gameByClient(bob.client) {
+			t.Fatal("players are not in the same match")
+		}
+
+		// The invitation may only be accepted once.
+		bob.send("leave")
+		expectEvent[*bgammon.EventLeft](t, bob)
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Invitation not found. It may have expired or been withdrawn.")
+	})
+
+	t.Run("decline", func(t *testing.T) {
+		s := newTestServer(t)
+		alice, bob := loginClient(t, s, "alice"), loginClient(t, s, "bob")
+		ev := invite(t, alice, bob, "1")
+		bob.send("decline " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Declined invitation from alice.")
+		expectNotice(t, alice, "bob declined your invitation.")
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Invitation not found. It may have expired or been withdrawn.")
+		if s.gameByClient(alice.client) != nil || s.gameByClient(bob.client) != nil {
+			t.Error("declining the invitation started a match")
+		}
+	})
+
+	t.Run("expire", func(t *testing.T) {
+		s := newTestServer(t)
+		alice, bob := loginClient(t, s, "alice"), loginClient(t, s, "bob")
+		ev := invite(t, alice, bob, "1")
+
+		// Invitations are only accessed while handling commands, and the
+		// invitation was sent before it was received.
+		for _, inv := range s.invites {
+			inv.expires = time.Now()
+		}
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Invitation not found. It may have expired or been withdrawn.")
+		if s.gameByClient(bob.client) != nil {
+			t.Error("accepting an expired invitation started a match")
+		}
+	})
+
+	t.Run("in match", func(t *testing.T) {
+		s := newTestServer(t)
+		alice, bob, carol := loginClient(t, s, "alice"), loginClient(t, s, "bob"), loginClient(t, s, "carol")
+		ev := invite(t, alice, bob, "1")
+
+		// Players in a match may not be invited, and may not accept an
+		// invitation until they leave the match.
+		bob.send("create public 1")
+		expectEvent[*bgammon.EventJoined](t, bob)
+		carol.send("invite bob")
+		expectNotice(t, carol, "Invitation not sent: bob is in a match.")
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Please leave the match you are in before accepting an invitation.")
+
+		// The invitation may not be accepted after the player who sent it
+		// joins another match.
+		bob.send("leave")
+		expectEvent[*bgammon.EventLeft](t, bob)
+		alice.send("create public 1")
+		expectEvent[*bgammon.EventJoined](t, alice)
+		bob.send("accept " + strconv.Itoa(ev.ID))
+		expectNotice(t, bob, "Invitation not accepted: alice has joined another match.")
+	})
+}
+
+func TestBeaver(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+	setState(t, c1, 1, "")
+	c1.send("double")
+	expectEvent[*bgammon.EventDoubleOffered](t, c2)
+	c2.send("beaver")
+	expectNotice(t, c2, "Beavers and raccoons are not allowed in this match.")
+	c1.send("leave")
+	expectEvent[*bgammon.EventLeft](t, c1)
+	c1.send("create public 3 beaver")
+	expectEvent[*bgammon.EventFailedCreate](t, c1)
+
+	s = newTestServer(t)
+	c1, c2, _ = startMatch(t, s, "1 beaver")
+	setBoard(t, c1, gammonBoard())
+	setState(t, c1, 1, "")
+	c2.send("beaver")
+	expectNotice(t, c2, "There is no double offer to beaver.")
+	c1.send("raccoon")
+	expectNotice(t, c1, "You may only raccoon after your double offer is beavered, before rolling.")
+
+	// expectCube waits for the board to be sent to both players, and checks
+	// the value and owner of the doubling cube.
+	expectCube := func(value int, owner int) {
+		t.Helper()
+		for _, c := range []*memoryClient{c1, c2} {
+			ev := expectEvent[*bgammon.EventBoard](t, c)
+			if ev.DoubleValue != value || ev.DoublePlayer != owner || ev.DoubleOffered {
+				t.Fatalf("client %s received cube %d owned by player %d with offer %t, expected cube %d owned by player %d", c.name(), ev.DoubleValue, ev.DoublePlayer, ev.DoubleOffered, value, owner)
+			}
+		}
+	}
+
+	c1.send("double")
+	expectEvent[*bgammon.EventDoubleOffered](t, c2)
+	c2.send("beaver")
+	for _, c := range []*memoryClient{c1, c2} {
+		if ev := expectEvent[*bgammon.EventBeaver](t, c); ev.Player != c2.name() || ev.Points != 4 {
+			t.Errorf("client %s received beaver by %s to %d, expected beaver by %s to 4", c.name(), ev.Player, ev.Points, c2.name())
+		}
+	}
+	expectCube(4, 2)
+	c2.send("raccoon")
+	expectNotice(t, c2, "You may only raccoon after your double offer is beavered, before rolling.")
+
+	c1.send("raccoon")
+	for _, c := range []*memoryClient{c1, c2} {
+		if ev := expectEvent[*bgammon.EventRaccoon](t, c); ev.Player != c1.name() || ev.Points != 8 {
+			t.Errorf("client %s received raccoon by %s to %d, expected raccoon by %s to 8", c.name(), ev.Player, ev.Points, c1.name())
+		}
+	}
+	expectCube(8, 1)
+	c1.send("raccoon")
+	expectNotice(t, c1, "You may only raccoon after your double offer is beavered, before rolling.")
+
+	// The gammon is won at the value of the cube.
+	c1.send("roll")
+	expectEvent[*bgammon.EventRolled](t, c1)
+	setState(t, c1, 1, "21")
+	c1.send("move 1/off")
+	if ev := expectEvent[*bgammon.EventWin](t, c1); ev.Points != 16 || ev.WinType != bgammon.WinGammon {
+		t.Errorf("won %d points by %d, expected 16 points by %d", ev.Points, ev.WinType, bgammon.WinGammon)
+	}
+}
+
+// Commands which panic are registered before any test runs, as the servers of
+// earlier tests may still be handling commands. Files are initialized in order
+// of their names, so the commands are registered after those of commands.go.
+func init() {
+	panicking := func(s *server, cmd serverCommand, clientGame *serverGame, keyword string, params [][]byte) {
+		panic("test panic")
+	}
+	registeredCommands = append(registeredCommands,
+		&registeredCommand{keyword: "panic", hidden: true, handle: panicking},
+		&registeredCommand{keyword: "panicmatch", hidden: true, inMatch: true, concurrent: true, handle: panicking},
+	)
+}
+
+func TestRecoverCommand(t *testing.T) {
+	const notice = "An unexpected error occurred while handling your command."
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+
+	// Commands are still handled after a panic, and the match is unlocked.
+	for _, command := range []string{"panic", "panicmatch"} {
+		c1.send(command)
+		expectNotice(t, c1, notice)
+		c1.send("say after " + command)
+		expectEventFunc(t, c2, func(ev *bgammon.EventSay) bool {
+			return ev.Player == c1.name() && ev.Message == "after "+command
+		})
+	}
+	loginClient(t, s, "carol")
+}
+
+func TestSanitizeMatchName(t *testing.T) {
+	long := strings.Repeat("a", maxMatchNameLength)
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"Friendly match", "Friendly match"},
+		{"  Friendly match  ", "Friendly match"},
+		{"Friendly\x00 match\x1b[31m", "Friendly match[31m"},
+		{"Friendly\nmatch\t", "Friendlymatch"},
+		{"Friendly \xff\xfematch", "Friendly match"},
+		{long + "b", long},
+		{strings.Repeat("é", maxMatchNameLength+1), strings.Repeat("é", maxMatchNameLength)},
+		{strings.Repeat("a", maxMatchNameLength-1) + " b", strings.Repeat("a", maxMatchNameLength-1)},
+		{"\x00\x01 \x7f", ""},
+		{"", ""},
+	} {
+		if name := sanitizeMatchName([]byte(test.name)); string(name) != test.expected {
+			t.Errorf("sanitized %q as %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
+
+func TestCreateMatchName(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"", "alice's match"},
+		{"\x01\x02", "alice's match"},
+		{"Friendly\x07 match", "Friendly match"},
+		{strings.Repeat("x", 100), strings.Repeat("x", maxMatchNameLength)},
+	} {
+		s := newTestServer(t)
+		c := loginClient(t, s, "alice")
+		c.send("create public 1 " + test.name)
+		expectEvent[*bgammon.EventJoined](t, c)
+		c.send("list")
+		list := expectEvent[*bgammon.EventList](t, c)
+		if len(list.Games) != 1 || list.Games[0].Name != test.expected {
+			t.Errorf("created match named %q, listed %+v, expected %q", test.name, list.Games, test.expected)
+		}
+	}
+}
+
+func TestCreateOptions(t *testing.T) {
+	for _, test := range []struct {
+		options        string
+		name           string
+		timeControl    int
+		jacoby         bool
+		beavers        bool
+		noGammons      bool
+		balanced       bool
+		hideSpectators bool
+	}{
+		{"beaver jacoby", "alice's match", 0, true, true, false, false, false},
+		{"jacoby beaver", "alice's match", 0, true, true, false, false, false},
+		{"hidespectators nogammon 60+2 balanced Friendly match", "Friendly match", 60, false, false, true, true, true},
+		{"BALANCED 60 Jacoby", "alice's match", 60, true, false, false, true, false},
+		// Options are not parsed after the name of the match.
+		{"My match jacoby", "My match jacoby", 0, false, false, false, false, false},
+	} {
+		s := newTestServer(t)
+		c := loginClient(t, s, "alice")
+		c.send("create public 1 " + test.options)
+		expectEvent[*bgammon.EventJoined](t, c)
+
+		g := s.gameByClient(c.client)
+		g.lock.Lock()
+		if string(g.name) != test.name || g.TimeControl != test.timeControl || g.Jacoby != test.jacoby || g.Beavers != test.beavers || g.NoGammons != test.noGammons || g.dice.balanced != test.balanced || g.hideSpectators != test.hideSpectators {
+			t.Errorf("%s: created match %q with time control %d, Jacoby %t, beavers %t, no gammons %t, balanced %t and hidden spectators %t", test.options, g.name, g.TimeControl, g.Jacoby, g.Beavers, g.NoGammons, g.dice.balanced, g.hideSpectators)
+		}
+		g.lock.Unlock()
+	}
+}
+
+func TestNoGammons(t *testing.T) {
+	// One of player 2's checkers remains in player 1's home board.
+	backgammon := gammonBoard()
+	backgammon[19], backgammon[2] = -14, -1
+
+	for _, test := range []struct {
+		name    string
+		options string
+		board   []int
+		double  bool
+		points  int
+		winType int
+	}{
+		{"gammon", "5", gammonBoard(), false, 2, bgammon.WinGammon},
+		{"backgammon", "5", backgammon, false, 3, bgammon.WinBackgammon},
+		{"no gammons", "5 nogammon", gammonBoard(), false, 1, bgammon.WinSingle},
+		{"no backgammons", "5 nogammon", backgammon, false, 1, bgammon.WinSingle},
+		{"no gammons doubled", "5 nogammon", gammonBoard(), true, 2, bgammon.WinSingle},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, c2, _ := startMatch(t, s, test.options)
+			setBoard(t, c1, test.board)
+			setState(t, c1, 1, "")
+
+			// Both players are told which rules apply.
+			for _, c := range []*memoryClient{c1, c2} {
+				c.send("board")
+				if ev := expectEvent[*bgammon.EventBoard](t, c); ev.NoGammons != strings.Contains(test.options, "nogammon") {
+					t.Errorf("client %s received no gammons %t with options %q", c.name(), ev.NoGammons, test.options)
+				}
+			}
+
+			if test.double {
+				c1.send("double")
+				expectEvent[*bgammon.EventDoubleOffered](t, c2)
+				c2.send("ok")
+				expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+			}
+			c1.send("roll")
+			expectEvent[*bgammon.EventRolled](t, c1)
+			setState(t, c1, 1, "21")
+			c1.send("move 1/off")
+			ev := expectEvent[*bgammon.EventWin](t, c1)
+			if ev.Points != test.points || ev.WinType != test.winType {
+				t.Errorf("won %d points by %d, expected %d points by %d", ev.Points, ev.WinType, test.points, test.winType)
+			}
+		})
+	}
+}
+
+func TestAutoOk(t *testing.T) {
+	// Moving 13/11/10 and 13/12/10 results in the same position.
+	forced := make([]int, bgammon.BoardSpaces)
+	forced[bgammon.SpaceHomePlayer], forced[13], forced[19] = 14, 1, -15
+
+	// Moving 13/11/10 and 13/11 8/7 result in different positions.
+	optional := make([]int, bgammon.BoardSpaces)
+	optional[bgammon.SpaceHomePlayer], optional[13], optional[8], optional[19] = 13, 1, 1, -15
+
+	for _, test := range []struct {
+		name      string
+		autoOk    bool
+		board     []int
+		confirmed bool
+	}{
+		{"forced", true, forced, true},
+		{"optional", true, optional, false},
+		{"disabled", false, forced, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			c1, c2, g := startMatch(t, s, "1")
+			if test.autoOk {
+				c1.send("autook on")
+				expectNotice(t, c1, "Automatic confirmation of forced plays enabled.")
+			}
+			setBoard(t, c1, test.board)
+			setState(t, c1, 1, "21")
+
+			for _, move := range []string{"13/11", "11/10"} {
+				c1.send("move " + move)
+				expectEventFunc(t, c2, func(ev *bgammon.EventMoved) bool {
+					return ev.Player == c1.name()
+				})
+			}
+			// The turn is confirmed while the move is handled.
+			g.lock.Lock()
+			turn := g.Turn
+			g.lock.Unlock()
+			if confirmed := turn == 2; confirmed != test.confirmed {
+				t.Fatalf("turn confirmed automatically: %t, expected %t", confirmed, test.confirmed)
+			} else if confirmed {
+				return
+			}
+
+			// Players who may have played differently may still reset
+			// their moves before confirming their turn.
+			c1.send("reset")
+			expectEventFunc(t, c1, func(ev *bgammon.EventBoard) bool {
+				return ev.Turn == 1 && len(ev.Moves) == 0
+			})
+			for _, move := range []string{"13/12", "12/10"} {
+				c1.send("move " + move)
+			}
+			c1.send("ok")
+			expectEventFunc(t, c2, func(ev *bgammon.EventBoard) bool {
+				return ev.Turn == 2
+			})
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "1")
+	setState(t, c1, 1, "31")
+	c1.send("move 8/5")
+	expectEvent[*bgammon.EventMoved](t, c2)
+
+	for _, c := range []*memoryClient{c1, c2} {
+		c.send("board")
+		checksum := expectEvent[*bgammon.EventBoard](t, c).Checksum
+
+		// Nothing is sent when the client is in sync.
+		c.send("verify " + strings.ToUpper(checksum))
+		c.send("board")
+		ev, ok := c.receiveEvent(testTimeout, func(ev interface{}) bool {
+			switch ev.(type) {
+			case *bgammon.EventDesync, *bgammon.EventBoard:
+				return true
+			}
+			return false
+		})
+		if !ok {
+			t.Fatalf("client %s did not receive the board", c.name())
+		} else if _, desync := ev.(*bgammon.EventDesync); desync {
+			t.Errorf("client %s received desync with checksum %s", c.name(), checksum)
+		}
+
+		// The board is sent again when the client is not in sync.
+		c.send("verify 00000000")
+		if ev := expectEvent[*bgammon.EventDesync](t, c); ev.Checksum != checksum {
+			t.Errorf("client %s received desync with checksum %s, expected %s", c.name(), ev.Checksum, checksum)
+		}
+		if ev := expectEvent[*bgammon.EventBoard](t, c); ev.Checksum != checksum || len(ev.Moves) != 1 {
+			t.Errorf("client %s received board with checksum %s and moves %v, expected checksum %s and one move", c.name(), ev.Checksum, ev.Moves, checksum)
+		}
+	}
+}
+
+func TestCreateFailed(t *testing.T) {
+	s := newTestServer(t)
+	c := loginClient(t, s, "alice")
+	for _, test := range []struct {
+		command string
+		code    string
+	}{
+		{"create", bgammon.ErrorUsage},
+		{"create public", bgammon.ErrorUsage},
+		{"create secret 1", bgammon.ErrorUsage},
+		{"create private 1", bgammon.ErrorUsage},
+		{"create private _ 1", bgammon.ErrorUsage},
+		{"create public 0", bgammon.ErrorUsage},
+		{"create public 100", bgammon.ErrorUsage},
+		{"create public one", bgammon.ErrorUsage},
+		{"create public 1 90000", bgammon.ErrorUsage},
+		{"create public 3 jacoby", bgammon.ErrorUsage},
+		{"create public 3 beaver", bgammon.ErrorUsage},
+		{"create public 3 autodouble", bgammon.ErrorUsage},
+		{"create public 1 autodouble=3", bgammon.ErrorUsage},
+		{"create public 1 puzzle=4HPwATDgc/ABMA", bgammon.ErrorUsage},
+		{"create public 1 puzzle=AAAAAAAAAAAAAA:31", bgammon.ErrorInvalidPosition},
+	} {
+		c.send(test.command)
+		if ev := expectEvent[*bgammon.EventFailedCreate](t, c); ev.Code != test.code || ev.Reason == "" {
+			t.Errorf("%s: failed with %s: %q, expected %s", test.command, ev.Code, ev.Reason, test.code)
+		}
+	}
+
+	c.send("create public 1")
+	expectEvent[*bgammon.EventJoined](t, c)
+	c.send("create public 1")
+	if ev := expectEvent[*bgammon.EventFailedCreate](t, c); ev.Code != bgammon.ErrorInMatch {
+		t.Errorf("creating a match while in a match failed with %s, expected %s", ev.Code, bgammon.ErrorInMatch)
+	}
+
+	// The limit is only checked while handling commands, which happen after
+	// it is changed.
+	maxGames = 1
+	t.Cleanup(func() {
+		maxGames = 0
+	})
+	other := loginClient(t, s, "bob")
+	other.send("create public 1")
+	if ev := expectEvent[*bgammon.EventFailedCreate](t, other); ev.Code != bgammon.ErrorServerFull {
+		t.Errorf("creating a match while the server is full failed with %s, expected %s", ev.Code, bgammon.ErrorServerFull)
+	}
+
+	s.shuttingDown.Store(true)
+	other.send("create public 1")
+	if ev := expectEvent[*bgammon.EventFailedCreate](t, other); ev.Code != bgammon.ErrorShuttingDown {
+		t.Errorf("creating a match while the server is shutting down failed with %s, expected %s", ev.Code, bgammon.ErrorShuttingDown)
+	}
+}
+
+func TestRematch(t *testing.T) {
+	// finishMatch returns the players of a 3 point match after player 2 won
+	// the first game and player 1 won the second game by a gammon, doubled.
+	finishMatch := func(t *testing.T, s *server) (*memoryClient, *memoryClient, *serverGame) {
+		t.Helper()
+		c1, c2, g := startMatch(t, s, "3")
+		c1.send("rematch")
+		expectNotice(t, c1, "The match you are in is still in progress.")
+
+		setState(t, c1, 1, "")
+		c1.send("resign")
+		expectEvent[*bgammon.EventWin](t, c2)
+
+		setBoard(t, c1, gammonBoard())
+		setState(t, c1, 1, "")
+		c1.send("double")
+		expectEvent[*bgammon.EventDoubleOffered](t, c2)
+		c2.send("ok")
+		expectEvent[*bgammon.EventDoubleAccepted](t, c1)
+		setState(t, c1, 1, "21")
+		c1.send("move 1/off")
+		for _, c := range []*memoryClient{c1, c2} {
+			ev := expectEvent[*bgammon.EventWin](t, c)
+			if ev.Player != c1.name() || !ev.Match || ev.Score1 != 4 || ev.Score2 != 1 {
+				t.Fatalf("%s: %s won and the score is %d-%d, match over: %t, expected %s to win the match 4-1", c.name(), ev.Player, ev.Score1, ev.Score2, ev.Match, c1.name())
+			}
+		}
+		return c1, c2, g
+	}
+
+	// expectRematch waits for both players to join the rematch and returns
+	// its board, as sent to player 1.
+	expectRematch := func(t *testing.T, s *server, c1 *memoryClient, c2 *memoryClient, g *serverGame) (*bgammon.EventBoard, *serverGame) {
+		t.Helper()
+		for _, c := range []*memoryClient{c1, c2} {
+			expectEventFunc(t, c, func(ev *bgammon.EventJoined) bool {
+				return ev.GameID != g.id && ev.Player == c.name()
+			})
+		}
+		rematch := s.gameByClient(c1.client)
+		if rematch == nil || rematch == g || rematch != s.gameByClient(c2.client) {
+			t.Fatal("players are not in the rematch")
+		}
+		return expectEvent[*bgammon.EventBoard](t, c1), rematch
+	}
+
+	t.Run("new", func(t *testing.T) {
+		s := newTestServer(t)
+		c1, c2, g := finishMatch(t, s)
+
+		c1.send("rematch")
+		expectNotice(t, c1, "Rematch offer sent.")
+		expectNotice(t, c2, "Your opponent would like to play a new match to 3 points. Type /rematch to accept, or /rematch continue to offer continuing the match instead.")
+		c1.send("rematch new")
+		expectNotice(t, c1, "You have already requested a rematch.")
+		c2.send("rematch")
+
+		board, rematch := expectRematch(t, s, c1, c2, g)
+		if board.Points != 3 || board.Player1.Points != 0 || board.Player2.Points != 0 {
+			t.Errorf("rematch to %d points at %d-%d, expected a 3 point match at 0-0", board.Points, board.Player1.Points, board.Player2.Points)
+		}
+		if board.DoubleValue != 1 || board.DoublePlayer != 0 || board.Crawford {
+			t.Errorf("rematch with cube %d owned by player %d and Crawford game: %t, expected a centered cube", board.DoubleValue, board.DoublePlayer, board.Crawford)
+		}
+		rematch.lock.Lock()
+		if rematch.length != 0 {
+			t.Errorf("new match has length %d, expected 0", rematch.length)
+		}
+		rematch.lock.Unlock()
+	})
+
+	t.Run("continue", func(t *testing.T) {
+		s := newTestServer(t)
+		c1, c2, g := finishMatch(t, s)
+
+		c1.send("rematch again")
+		expectNotice(t, c1, "To offer or accept a new match to the same number of points, send 'rematch new'. To offer or accept continuing the match with the current score, send 'rematch continue'.")
+
+		// Offering a different mode replaces the opponent's offer.
+		c1.send("rematch")
+		expectNotice(t, c2, "Your opponent would like to play a new match to 3 points. Type /rematch to accept, or /rematch continue to offer continuing the match instead.")
+		c2.send("rematch continue")
+		expectNotice(t, c2, "Rematch offer sent.")
+		expectNotice(t, c1, "Your opponent would like to continue the match to 6 points with the current score. Type /rematch to accept, or /rematch new to offer a new match instead.")
+		c1.send("rematch")
+
+		board, rematch := expectRematch(t, s, c1, c2, g)
+		if board.Points != 6 || board.Player1.Points != 4 || board.Player2.Points != 1 {
+			t.Errorf("rematch to %d points at %d-%d, expected a 6 point match at 4-1", board.Points, board.Player1.Points, board.Player2.Points)
+		}
+		if board.DoubleValue != 1 || board.DoublePlayer != 0 || board.Crawford {
+			t.Errorf("rematch with cube %d owned by player %d and Crawford game: %t, expected a centered cube", board.DoubleValue, board.DoublePlayer, board.Crawford)
+		}
+		rematch.lock.Lock()
+		if rematch.length != 3 || rematch.crawfordPlayed {
+			t.Errorf("continued match has length %d and Crawford played: %t, expected length 3", rematch.length, rematch.crawfordPlayed)
+		}
+		rematch.lock.Unlock()
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	s := newTestServer(t)
+	c1, c2, _ := startMatch(t, s, "3")
+
+	shutdown := make(chan struct{})
+	go func() {
+		s.shutdown()
+		close(shutdown)
+	}()
+	for _, c := range []*memoryClient{c1, c2} {
+		expectEvent[*bgammon.EventServerMessage](t, c)
+	}
+
+	// The match in progress may continue.
+	setState(t, c1, 1, "31")
+	c1.send("move 8/5 6/5")
+	expectEvent[*bgammon.EventMoved](t, c2)
+	select {
+	case <-shutdown:
+		t.Fatal("server shut down while a match was in progress")
+	default:
+	}
+
+	c2.send("resign match")
+	for _, c := range []*memoryClient{c1, c2} {
+		expectNotice(t, c, "Connection terminated: The server is shutting down.")
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(testTimeout):
+		t.Fatal("server did not shut down after the match ended")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"code.rocket9labs.com/tslocum/bgammon"
+)
+
+// settingNames are the names of the settings which may be changed using the
+// settings command.
+var settingNames = []string{"json", "highlight", "autoroll", "private", "autook", "combined"}
+
+// changeSetting changes the value of a setting. Settings are enabled with the
+// value "on" and disabled with the value "off".
+func changeSetting(settings *bgammon.Settings, name string, value string) error {
+	var on bool
+	switch strings.ToLower(value) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return fmt.Errorf("invalid value %s: must be on or off", value)
+	}
+
+	switch strings.ToLower(name) {
+	case "json":
+		settings.JSON = on
+	case "highlight":
+		settings.Highlight = on
+	case "autoroll":
+		settings.AutoRoll = on
+	case "private":
+		settings.Private = on
+	case "autook":
+		settings.AutoOk = on
+	case "combined":
+		settings.Combined = on
+	default:
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certificateReloader provides a TLS certificate which is reloaded from disk
+// when the server receives SIGHUP.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	sync.RWMutex
+}
+
+func newCertificateReloader(certFile string, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.handleReload()
+	return r, nil
+}
+
+func (r *certificateReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.cert = &cert
+	r.Unlock()
+	return nil
+}
+
+func (r *certificateReloader) handleReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := r.reload()
+		if err != nil {
+			// Continue using the previously loaded certificate.
+			errorf("failed to reload TLS certificate %s and key %s: %s", r.certFile, r.keyFile, err)
+			continue
+		}
+		infof("Reloaded TLS certificate %s and key %s", r.certFile, r.keyFile)
+	}
+}
+
+func (r *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
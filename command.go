@@ -1,49 +1,124 @@
 package bgammon
 
+// ProtocolVersion is the version of the protocol. It is incremented whenever
+// the structure of commands or events changes.
+const ProtocolVersion = 1
+
 // commands are always sent TO the server
 
 type Command string
 
 const (
-	CommandLogin      = "login"      // Log in with username and password, or as a guest.
-	CommandLoginJSON  = "loginjson"  // Log in with username and password, or as a guest, and enable JSON messages.
-	CommandHelp       = "help"       // Print help information.
-	CommandJSON       = "json"       // Enable or disable JSON formatted messages.
-	CommandSay        = "say"        // Send chat message.
-	CommandList       = "list"       // List available matches.
-	CommandCreate     = "create"     // Create match.
-	CommandJoin       = "join"       // Join match.
-	CommandLeave      = "leave"      // Leave match.
-	CommandDouble     = "double"     // Offer double to opponent.
-	CommandResign     = "resign"     // Decline double offer and resign game.
-	CommandRoll       = "roll"       // Roll dice.
-	CommandMove       = "move"       // Move checkers.
-	CommandReset      = "reset"      // Reset checker movement.
-	CommandOk         = "ok"         // Confirm checker movement and pass turn to next player.
-	CommandRematch    = "rematch"    // Confirm checker movement and pass turn to next player.
-	CommandBoard      = "board"      // Print current board state in human-readable form.
-	CommandPong       = "pong"       // Response to server ping.
-	CommandDisconnect = "disconnect" // Disconnect from server.
+	CommandLogin        = "login"        // Log in with username and password, or as a guest.
+	CommandLoginJSON    = "loginjson"    // Log in with username and password, or as a guest, and enable JSON messages.
+	CommandRegister     = "register"     // Register an account.
+	CommandRegisterJSON = "registerjson" // Register an account and enable JSON messages.
+	CommandHelp         = "help"         // Print help information.
+	CommandJSON         = "json"         // Enable or disable JSON formatted messages.
+	CommandSay          = "say"          // Send chat message.
+	CommandChat         = "chat"         // Send chat message to all players on the server.
+	CommandWhisper      = "whisper"      // Send private message to another player.
+	CommandMute         = "mute"         // Stop receiving messages from a player.
+	CommandUnmute       = "unmute"       // Resume receiving messages from a player.
+	CommandMuted        = "muted"        // List muted players.
+	CommandFriend       = "friend"       // Add, remove or list friends.
+	CommandKick         = "kick"         // Disconnect a player (moderators only).
+	CommandBan          = "ban"          // Ban a player (moderators only).
+	CommandUnban        = "unban"        // Remove all bans of a player (moderators only).
+	CommandList         = "list"         // List available matches.
+	CommandLobby        = "lobby"        // Subscribe to updates of the list of matches.
+	CommandCreate       = "create"       // Create match.
+	CommandJoin         = "join"         // Join match.
+	CommandWatch        = "watch"        // Watch match as a spectator.
+	CommandLeave        = "leave"        // Leave match.
+	CommandCancel       = "cancel"       // Cancel a created match before another player joins.
+	CommandDouble       = "double"       // Offer double to opponent.
+	CommandAccept       = "accept"       // Accept double offer or invitation.
+	CommandReject       = "reject"       // Decline double offer and resign game.
+	CommandBeaver       = "beaver"       // Accept double offer and immediately redouble.
+	CommandRaccoon      = "raccoon"      // Immediately redouble after a double offer is beavered.
+	CommandInvite       = "invite"       // Invite a player to play a match.
+	CommandDecline      = "decline"      // Decline invitation.
+	CommandResume       = "resume"       // Resume a match interrupted by the server restarting.
+	CommandResign       = "resign"       // Resign game or match.
+	CommandRoll         = "roll"         // Roll dice.
+	CommandMove         = "move"         // Move checkers.
+	CommandReset        = "reset"        // Reset checker movement.
+	CommandUndo         = "undo"         // Undo last checker movement.
+	CommandOk           = "ok"           // Confirm checker movement and pass turn to next player.
+	CommandRematch      = "rematch"      // Confirm checker movement and pass turn to next player.
+	CommandBoard        = "board"        // Print current board state in human-readable form.
+	CommandFlip         = "flip"         // Show the board from the perspective of the other player.
+	CommandVerify       = "verify"       // Confirm the board state is in sync with the server.
+	CommandPipCount     = "pip"          // Print pip count of each player.
+	CommandLeaderboard  = "leaderboard"  // List highest rated players.
+	CommandHistory      = "history"      // List recently completed matches.
+	CommandStats        = "stats"        // Print statistics of a player.
+	CommandProfile      = "profile"      // Print public profile of a player.
+	CommandWho          = "who"          // List online players.
+	CommandPong         = "pong"         // Response to server ping.
+	CommandTimeout      = "timeout"      // Sent on behalf of players when a time limit in their match expires.
+	CommandSetBoard     = "setboard"     // Set up a position from a GNU Backgammon Position ID.
+	CommandSetState     = "setstate"     // Set the player whose turn it is and the dice rolled. Only available when debug commands are enabled.
+	CommandPosition     = "position"     // Print GNU Backgammon Position ID and Match ID.
+	CommandHint         = "hint"         // Print suggested moves for the current roll.
+	CommandLegalMoves   = "legalmoves"   // Print legal moves for the current roll.
+	CommandSettings     = "settings"     // View or change preferences.
+	CommandAutoRoll     = "autoroll"     // Enable or disable rolling automatically at the start of each turn.
+	CommandAutoOk       = "autook"       // Enable or disable ending turns automatically when no other play was possible.
+	CommandVersion      = "version"      // Print server version, protocol version and supported features.
+	CommandStatus       = "status"       // Print server uptime and load.
+	CommandTranscript   = "transcript"   // Print the record of the games played in the current match.
+	CommandDisconnect   = "disconnect"   // Disconnect from server.
 )
 
 type EventType string
 
 const (
-	EventTypeWelcome     = "welcome"
-	EventTypeHelp        = "help"
-	EventTypePing        = "ping"
-	EventTypeNotice      = "notice"
-	EventTypeSay         = "say"
-	EventTypeList        = "list"
-	EventTypeJoined      = "joined"
-	EventTypeFailedJoin  = "failedjoin"
-	EventTypeLeft        = "left"
-	EventTypeFailedLeave = "failedleave"
-	EventTypeBoard       = "board"
-	EventTypeRolled      = "rolled"
-	EventTypeFailedRoll  = "failedroll"
-	EventTypeMoved       = "moved"
-	EventTypeFailedMove  = "failedmove"
-	EventTypeFailedOk    = "failedok"
-	EventTypeWin         = "win"
+	EventTypeWelcome        = "welcome"
+	EventTypeSession        = "session"
+	EventTypeHelp           = "help"
+	EventTypePing           = "ping"
+	EventTypeNotice         = "notice"
+	EventTypeServerMessage  = "servermessage"
+	EventTypeSay            = "say"
+	EventTypeChat           = "chat"
+	EventTypeWhisper        = "whisper"
+	EventTypeInvite         = "invite"
+	EventTypeFriendOnline   = "friendonline"
+	EventTypeList           = "list"
+	EventTypeLobbyUpdate    = "lobbyupdate"
+	EventTypeFailedCreate   = "failedcreate"
+	EventTypeJoined         = "joined"
+	EventTypeFailedJoin     = "failedjoin"
+	EventTypeLeft           = "left"
+	EventTypeFailedLeave    = "failedleave"
+	EventTypeBoard          = "board"
+	EventTypeDesync         = "desync"
+	EventTypeRolled         = "rolled"
+	EventTypeFailedRoll     = "failedroll"
+	EventTypeMoved          = "moved"
+	EventTypeFailedMove     = "failedmove"
+	EventTypeFailedOk       = "failedok"
+	EventTypeDoubleOffered  = "doubleoffered"
+	EventTypeDoubleAccepted = "doubleaccepted"
+	EventTypeDoubleRejected = "doublerejected"
+	EventTypeAutoDouble     = "autodouble"
+	EventTypeBeaver         = "beaver"
+	EventTypeRaccoon        = "raccoon"
+	EventTypeTimeWarning    = "timewarning"
+	EventTypeWin            = "win"
+	EventTypePipCount       = "pipcount"
+	EventTypeLeaderboard    = "leaderboard"
+	EventTypeHistory        = "history"
+	EventTypeStats          = "stats"
+	EventTypeProfile        = "profile"
+	EventTypeWho            = "who"
+	EventTypePosition       = "position"
+	EventTypeHint           = "hint"
+	EventTypeLegalMoves     = "legalmoves"
+	EventTypeSettings       = "settings"
+	EventTypeVersion        = "version"
+	EventTypeStatus         = "status"
+	EventTypeTranscript     = "transcript"
 )
@@ -8,21 +8,38 @@ import (
 // events are always received FROM the server
 
 type Event struct {
-	Type   string
-	Player string
+	Type      string
+	Player    string
+	RequestID int // ID of the command the event was sent in reply to, or zero.
+}
+
+// SetRequestID sets the ID of the command the event was sent in reply to.
+func (e *Event) SetRequestID(id int) {
+	e.RequestID = id
 }
 
 type EventWelcome struct {
 	Event
 	PlayerName string
+	Rating     int
 	Clients    int
 	Games      int
 }
 
+// EventSession is sent after EventWelcome and describes the session of the
+// client which logged in.
+type EventSession struct {
+	Event
+	ClientID   int   // ID of the client, which is included in server logs.
+	Registered bool  // Whether the client logged in to a registered account, rather than as a guest.
+	Time       int64 // Unix timestamp of the server time.
+	Protocol   int   // Version of the protocol. See ProtocolVersion.
+}
+
 type EventHelp struct {
 	Event
-	Topic   string
-	Message string
+	Topic   string // Command the help text describes, or empty when all commands are listed.
+	Message string // Help text. Lines are separated by newlines.
 }
 
 type EventPing struct {
@@ -35,22 +52,63 @@ type EventNotice struct {
 	Message string
 }
 
+type EventServerMessage struct {
+	Event
+	Message string
+}
+
 type EventSay struct {
 	Event
 	Message string
 }
 
+type EventChat struct {
+	Event
+	Message string
+}
+
+type EventWhisper struct {
+	Event
+	Message string
+}
+
+// EventInvite is sent to a player who is invited to play a match.
+type EventInvite struct {
+	Event
+	ID      int // ID of the invitation, which is specified when accepting or declining it.
+	Points  int
+	Expires int // Number of seconds the invitation may be accepted within.
+}
+
+// EventFriendOnline is sent when a player who was added as a friend logs in.
+type EventFriendOnline struct {
+	Event
+}
+
 type GameListing struct {
 	Event
-	ID       int
-	Password bool
-	Points   int
-	Players  int
-	Name     string
+	ID         int
+	Password   bool
+	Points     int
+	Players    int
+	Spectators int
+	Rated      bool // Whether all players are logged in to registered accounts. Matches are only rated when both players are.
+	Puzzle     bool // Whether the match begins from a position set up by its creator. Puzzles are not rated.
+	Name       string
 }
 
 type EventList struct {
 	Event
+	Offset int // Number of matches skipped.
+	Total  int // Number of matches available, including those not listed.
+	Games  []GameListing
+}
+
+// EventLobbyUpdate is sent to clients subscribed to lobby updates when the
+// list of matches changes.
+type EventLobbyUpdate struct {
+	Event
+	Total int // Number of matches available, including those not listed.
 	Games []GameListing
 }
 
@@ -60,17 +118,58 @@ type EventJoined struct {
 	PlayerNumber int
 }
 
+// Codes describing why a command failed. Codes are included in failure
+// events, such as EventFailedJoin, so that clients may handle failures without
+// parsing the reason, which is intended to be read by players.
+const (
+	ErrorUsage           = "usage"            // The command was not specified correctly.
+	ErrorShuttingDown    = "shutting_down"    // The server is shutting down.
+	ErrorServerFull      = "server_full"      // The server may not host any more matches.
+	ErrorNotInMatch      = "not_in_match"     // The player is not in a match.
+	ErrorInMatch         = "in_match"         // The player must leave the match they are in first.
+	ErrorAlreadyInMatch  = "already_in_match" // The player is already in the match.
+	ErrorMatchNotFound   = "match_not_found"  // The match does not exist.
+	ErrorMatchFull       = "match_full"       // Both seats in the match are taken.
+	ErrorMatchStarted    = "match_started"    // The match started with other players.
+	ErrorInvalidPassword = "invalid_password" // The password of the match is incorrect.
+	ErrorSpectating      = "spectating"       // The player is spectating the match.
+	ErrorNotYourTurn     = "not_your_turn"    // It is not the player's turn.
+	ErrorOpponentAway    = "opponent_away"    // The opponent must rejoin the match first.
+	ErrorNotRolled       = "not_rolled"       // The player must roll first.
+	ErrorDoubleOffered   = "double_offered"   // The pending double offer must be accepted or declined first.
+	ErrorIllegalMove     = "illegal_move"     // The move is not legal.
+	ErrorMovesAvailable  = "moves_available"  // The player must make the legal moves available to them first.
+	ErrorInvalidPosition = "invalid_position" // The position could not be set up.
+	ErrorNotRegistered   = "not_registered"   // The player must log in to a registered account first.
+)
+
+type EventFailedCreate struct {
+	Event
+	Code   string // Why creating the match failed. See ErrorUsage.
+	Reason string
+}
+
 type EventFailedJoin struct {
 	Event
+	Code   string // Why joining the match failed. See ErrorUsage.
 	Reason string
 }
 
+// Reasons a player left a match.
+const (
+	LeftReasonLeave      = "leave"      // The player left the match.
+	LeftReasonDisconnect = "disconnect" // The player lost their connection.
+	LeftReasonTimeout    = "timeout"    // The player did not respond to the server and was disconnected.
+)
+
 type EventLeft struct {
 	Event
+	Reason string // Why the player left the match. See LeftReasonLeave.
 }
 
 type EventFailedLeave struct {
 	Event
+	Code   string // Why leaving the match failed. See ErrorUsage.
 	Reason string
 }
 
@@ -79,39 +178,241 @@ type EventBoard struct {
 	GameState
 }
 
+// EventDesync is sent when the checksum provided using the verify command
+// does not match the board state. The board is sent again afterward.
+type EventDesync struct {
+	Event
+	Checksum string // Checksum of the current board state.
+}
+
 type EventRolled struct {
 	Event
 	Roll1 int
 	Roll2 int
+	Tie   bool // Whether the players rolled the same number for the first turn. Both players must roll again.
 }
 
 type EventFailedRoll struct {
 	Event
+	Code   string // Why rolling failed. See ErrorUsage.
 	Reason string
 }
 
 type EventMoved struct {
 	Event
-	Moves [][]int
+	Moves     [][]int
+	Hits      []int // Spaces where an opponent's checker was hit and sent to the bar, in the order they were hit.
+	Remaining []int // Dice rolls which may still be used this turn.
 }
 
 type EventFailedMove struct {
 	Event
 	From   int
 	To     int
+	Code   string // Why moving failed. See ErrorUsage.
 	Reason string
 }
 
 type EventFailedOk struct {
 	Event
+	Code   string // Why ending the turn failed. See ErrorUsage.
 	Reason string
 }
 
-type EventWin struct {
+type EventDoubleOffered struct {
+	Event
+	Points int
+}
+
+type EventDoubleAccepted struct {
 	Event
 	Points int
 }
 
+type EventDoubleRejected struct {
+	Event
+	Points int
+}
+
+// EventAutoDouble is sent when the doubling cube is turned automatically
+// after a tie while rolling for the first turn.
+type EventAutoDouble struct {
+	Event
+	Points int // New value of the doubling cube.
+}
+
+// EventBeaver is sent after a player accepts a double offer and immediately
+// redoubles. The player keeps the doubling cube.
+type EventBeaver struct {
+	Event
+	Points int // New value of the doubling cube.
+}
+
+// EventRaccoon is sent after a player whose double offer was beavered
+// immediately redoubles. The player keeps the doubling cube.
+type EventRaccoon struct {
+	Event
+	Points int // New value of the doubling cube.
+}
+
+// EventTimeWarning is sent to the players and spectators of a match when the
+// clock of the player whose clock is running is about to run out.
+type EventTimeWarning struct {
+	Event
+	Seconds int // Number of seconds remaining on the player's clock.
+}
+
+type EventWin struct {
+	Event
+	Points   int
+	WinType  int  // Single game, gammon or backgammon.
+	Match    bool // Whether the match is over. Otherwise, the next game of the match starts.
+	Score1   int  // Points scored by player 1 in the match, including the points awarded for this game.
+	Score2   int  // Points scored by player 2 in the match, including the points awarded for this game.
+	Rating   int  // Rating change of the winner. The rating of the loser changes by the same amount in the opposite direction.
+	Timeout  bool // Whether the loser ran out of time.
+	Forfeit  bool // Whether the loser forfeited the match by not reconnecting in time.
+	Resigned bool // Whether the loser resigned.
+	Idle     bool // Whether the loser did not act in time.
+}
+
+type EventPipCount struct {
+	Event
+	Player1 int
+	Player2 int
+}
+
+type LeaderboardEntry struct {
+	Name   string
+	Rating int
+	Wins   int
+	Losses int
+}
+
+type EventLeaderboard struct {
+	Event
+	Players []LeaderboardEntry
+}
+
+type HistoryMatch struct {
+	ID        int
+	Started   int64 // Unix timestamp.
+	Ended     int64 // Unix timestamp.
+	Player1   string
+	Player2   string
+	Points    int // Points required to win the match.
+	Score1    int
+	Score2    int
+	Winner    int
+	WinType   int
+	NoGammons bool  // Whether gammons and backgammons were scored as single games.
+	Seed      int64 // Seed of the dice rolled in the match. Matches may be replayed using the same seed.
+}
+
+type EventHistory struct {
+	Event
+	Offset  int
+	Matches []HistoryMatch
+}
+
+type EventStats struct {
+	Event
+	Name           string
+	Rating         int
+	Matches        int   // Number of completed matches, including unrated matches.
+	Wins           int   // Number of rated matches won.
+	Losses         int   // Number of rated matches lost.
+	GammonsWon     int   // Number of matches won by a gammon or backgammon in the final game.
+	GammonsLost    int   // Number of matches lost by a gammon or backgammon in the final game.
+	OpponentRating int   // Average current rating of the registered players the player has played against.
+	Dice           []int // Number of times each value from 1 to 6 was rolled. Only sent to the player themselves.
+}
+
+type EventProfile struct {
+	Event
+	Name       string
+	Registered bool  // Whether the player has a registered account. Only the name and status of guests are provided.
+	Private    bool  // Whether the player has chosen to hide their statistics from other players.
+	Joined     int64 // Unix timestamp of when the account was registered.
+	Rating     int
+	Rank       int // Position of the player on the leaderboard, or zero when the player has not completed a rated match.
+	Matches    int // Number of completed matches, including unrated matches.
+	Wins       int // Number of rated matches won.
+	Losses     int // Number of rated matches lost.
+	Online     bool
+	InMatch    bool // Whether the player is playing in a match. Spectators are not considered to be playing.
+}
+
+type PlayerInfo struct {
+	Name      string
+	InMatch   bool   // Whether the player is playing in a match. Spectators are not considered to be playing.
+	Rating    int    // Rating of the player, or zero when the player is not logged in to a registered account.
+	Idle      int    // Number of seconds since the player last sent a command.
+	Transport string // Transport the player is connected with: tcp, ws or bot.
+	Latency   int    // Round-trip time of the last ping answered by the player in milliseconds, or zero when unknown.
+	Address   string `json:",omitempty"` // Address the player is connected from. Only provided to moderators.
+}
+
+type EventWho struct {
+	Event
+	Players []PlayerInfo
+}
+
+type EventPosition struct {
+	Event
+	ID      string // GNU Backgammon Position ID.
+	MatchID string // GNU Backgammon Match ID.
+}
+
+type EventHint struct {
+	Event
+	Moves [][]int // Suggested moves, in the order they should be made.
+}
+
+type EventLegalMoves struct {
+	Event
+	Moves [][]int // Legal moves of a single checker, sorted from highest to lowest.
+}
+
+// Settings are the preferences of a player. The preferences of registered
+// players are stored on the server and applied when they log in.
+type Settings struct {
+	JSON      bool // Whether JSON formatted messages are enabled at login.
+	Highlight bool // Whether clients highlight legal moves.
+	AutoRoll  bool // Whether the server rolls automatically at the start of each turn.
+	AutoOk    bool // Whether the server ends turns automatically when no other play was possible.
+	Private   bool // Whether statistics are hidden from other players.
+	Combined  bool // Whether moves are sent in combined notation, such as 24/13 8/5(2). This setting only applies to plain text messages.
+}
+
+type EventSettings struct {
+	Event
+	Settings
+}
+
+type EventVersion struct {
+	Event
+	Server   string   // Name and version of the server software.
+	Protocol int      // Version of the protocol. See ProtocolVersion.
+	Features []string // Optional features supported by the server.
+}
+
+// EventStatus describes the uptime and load of the server. The number of
+// goroutines and memory usage are only provided to moderators.
+type EventStatus struct {
+	Event
+	Uptime         int64 // Number of seconds since the server started.
+	Clients        int   // Number of connected clients.
+	Games          int   // Number of matches, including matches waiting for players.
+	GoroutineCount int   // Number of goroutines.
+	MemoryMB       int   // Memory obtained from the operating system, in megabytes.
+}
+
+type EventTranscript struct {
+	Event
+	Transcript string // Record of the games played in the match, formatted as a match file. See ParseTranscript.
+}
+
 func DecodeEvent(message []byte) (interface{}, error) {
 	e := &Event{}
 	err := json.Unmarshal(message, e)
@@ -123,16 +424,32 @@ func DecodeEvent(message []byte) (interface{}, error) {
 	switch e.Type {
 	case EventTypeWelcome:
 		ev = &EventWelcome{}
+	case EventTypeSession:
+		ev = &EventSession{}
 	case EventTypeHelp:
 		ev = &EventHelp{}
 	case EventTypePing:
 		ev = &EventPing{}
 	case EventTypeNotice:
 		ev = &EventNotice{}
+	case EventTypeServerMessage:
+		ev = &EventServerMessage{}
 	case EventTypeSay:
 		ev = &EventSay{}
+	case EventTypeChat:
+		ev = &EventChat{}
+	case EventTypeWhisper:
+		ev = &EventWhisper{}
+	case EventTypeFriendOnline:
+		ev = &EventFriendOnline{}
+	case EventTypeInvite:
+		ev = &EventInvite{}
 	case EventTypeList:
 		ev = &EventList{}
+	case EventTypeLobbyUpdate:
+		ev = &EventLobbyUpdate{}
+	case EventTypeFailedCreate:
+		ev = &EventFailedCreate{}
 	case EventTypeJoined:
 		ev = &EventJoined{}
 	case EventTypeFailedJoin:
@@ -143,6 +460,8 @@ func DecodeEvent(message []byte) (interface{}, error) {
 		ev = &EventFailedLeave{}
 	case EventTypeBoard:
 		ev = &EventBoard{}
+	case EventTypeDesync:
+		ev = &EventDesync{}
 	case EventTypeRolled:
 		ev = &EventRolled{}
 	case EventTypeFailedRoll:
@@ -153,8 +472,48 @@ func DecodeEvent(message []byte) (interface{}, error) {
 		ev = &EventFailedMove{}
 	case EventTypeFailedOk:
 		ev = &EventFailedOk{}
+	case EventTypeDoubleOffered:
+		ev = &EventDoubleOffered{}
+	case EventTypeDoubleAccepted:
+		ev = &EventDoubleAccepted{}
+	case EventTypeDoubleRejected:
+		ev = &EventDoubleRejected{}
+	case EventTypeAutoDouble:
+		ev = &EventAutoDouble{}
+	case EventTypeBeaver:
+		ev = &EventBeaver{}
+	case EventTypeRaccoon:
+		ev = &EventRaccoon{}
+	case EventTypeTimeWarning:
+		ev = &EventTimeWarning{}
 	case EventTypeWin:
 		ev = &EventWin{}
+	case EventTypePipCount:
+		ev = &EventPipCount{}
+	case EventTypeLeaderboard:
+		ev = &EventLeaderboard{}
+	case EventTypeHistory:
+		ev = &EventHistory{}
+	case EventTypeStats:
+		ev = &EventStats{}
+	case EventTypeProfile:
+		ev = &EventProfile{}
+	case EventTypeWho:
+		ev = &EventWho{}
+	case EventTypePosition:
+		ev = &EventPosition{}
+	case EventTypeHint:
+		ev = &EventHint{}
+	case EventTypeLegalMoves:
+		ev = &EventLegalMoves{}
+	case EventTypeSettings:
+		ev = &EventSettings{}
+	case EventTypeVersion:
+		ev = &EventVersion{}
+	case EventTypeStatus:
+		ev = &EventStatus{}
+	case EventTypeTranscript:
+		ev = &EventTranscript{}
 	default:
 		return nil, fmt.Errorf("failed to decode event: unknown event type: %s", e.Type)
 	}
@@ -2,12 +2,21 @@ package bgammon
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
 	"strconv"
 	"time"
 )
 
+// Win types.
+const (
+	WinSingle     = 1 // The loser has borne off at least one checker.
+	WinGammon     = 2 // The loser has not borne off any checkers.
+	WinBackgammon = 3 // The loser has not borne off any checkers and has a checker on the bar or in the winner's home board.
+)
+
 var boardTopBlack = []byte("+13-14-15-16-17-18-+---+19-20-21-22-23-24-+")
 var boardBottomBlack = []byte("+12-11-10--9--8--7-+---+-6--5--4--3--2--1-+")
 
@@ -22,6 +31,7 @@ type Game struct {
 	Started time.Time
 	Ended   time.Time
 	Winner  int
+	WinType int
 	Roll1   int
 	Roll2   int
 	Moves   [][]int // Pending moves.
@@ -30,6 +40,29 @@ type Game struct {
 	DoubleValue   int  // Doubling cube value.
 	DoublePlayer  int  // Player that currently posesses the doubling cube.
 	DoubleOffered bool // Whether the current player is offering a double.
+	Crawford      bool // Whether the current game is the Crawford game, during which the doubling cube may not be used.
+
+	// Beavers is whether beavers and raccoons are allowed. Beavers may only
+	// be allowed in single games, in which the doubling cube is then used
+	// as in money play.
+	Beavers bool
+
+	// Jacoby is whether gammons and backgammons only count for more than a
+	// single game after the doubling cube has been turned. The Jacoby rule
+	// only applies to single games, in which the doubling cube is then used
+	// as in money play.
+	Jacoby bool
+
+	// NoGammons is whether gammons and backgammons are scored as single
+	// games.
+	NoGammons bool
+
+	// Beavered is whether the double offered by the current player was
+	// beavered. The current player may raccoon until they roll.
+	Beavered bool
+
+	TimeControl   int // Seconds on each player's clock at the start of each game. Time control is disabled when zero.
+	TimeIncrement int // Seconds added to a player's clock after each of their turns.
 
 	boardStates [][]int // One board state for each move to allow undoing a move.
 }
@@ -53,6 +86,7 @@ func (g *Game) Copy() *Game {
 		Started:       g.Started,
 		Ended:         g.Ended,
 		Winner:        g.Winner,
+		WinType:       g.WinType,
 		Roll1:         g.Roll1,
 		Roll2:         g.Roll2,
 		Moves:         make([][]int, len(g.Moves)),
@@ -60,6 +94,13 @@ func (g *Game) Copy() *Game {
 		DoubleValue:   g.DoubleValue,
 		DoublePlayer:  g.DoublePlayer,
 		DoubleOffered: g.DoubleOffered,
+		Crawford:      g.Crawford,
+		Beavers:       g.Beavers,
+		Jacoby:        g.Jacoby,
+		Beavered:      g.Beavered,
+		NoGammons:     g.NoGammons,
+		TimeControl:   g.TimeControl,
+		TimeIncrement: g.TimeIncrement,
 		boardStates:   make([][]int, len(g.boardStates)),
 	}
 	copy(newGame.Board, g.Board)
@@ -68,6 +109,22 @@ func (g *Game) Copy() *Game {
 	return newGame
 }
 
+// Checksum returns a hash of the board, the player whose turn it is, the dice
+// rolled and the state of the doubling cube. Positions reached by making the
+// same moves in a different order have the same checksum.
+func (g *Game) Checksum() string {
+	var buf []byte
+	for _, checkers := range g.Board {
+		buf = strconv.AppendInt(buf, int64(checkers), 10)
+		buf = append(buf, ',')
+	}
+	buf = fmt.Appendf(buf, "%d,%d,%d,%d,%d,%t", g.Turn, g.Roll1, g.Roll2, g.DoubleValue, g.DoublePlayer, g.DoubleOffered)
+
+	h := fnv.New32a()
+	h.Write(buf)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
 func (g *Game) NextTurn() {
 	if g.Winner != 0 {
 		return
@@ -79,19 +136,31 @@ func (g *Game) NextTurn() {
 	}
 	g.Roll1, g.Roll2 = 0, 0
 	g.Turn = nextTurn
+	g.Beavered = false
 	g.Moves = g.Moves[:0]
 	g.boardStates = g.boardStates[:0]
 }
 
+// SetBoard replaces the board and clears any pending moves.
+func (g *Game) SetBoard(board []int) {
+	g.Board = board
+	g.Moves = nil
+	g.boardStates = nil
+}
+
 func (g *Game) Reset() {
 	g.Board = NewBoard()
 	g.Turn = 0
+	g.Winner = 0
+	g.WinType = 0
 	g.Roll1 = 0
 	g.Roll2 = 0
 	g.Moves = nil
 	g.DoubleValue = 1
 	g.DoublePlayer = 0
 	g.DoubleOffered = false
+	g.Beavered = false
+	g.Crawford = false
 	g.boardStates = nil
 }
 
@@ -152,6 +221,10 @@ func (g *Game) AddLocalMove(move []int) bool {
 	return g.addMove(move)
 }
 
+// ExpandMove expands a move of a single checker which uses more than one dice
+// roll, such as 13/7, into the moves made using each dice roll, such as 13/9
+// 9/7. Intermediate spaces where an opponent's checker may be hit are tried
+// first. Returns false when there is no legal path.
 func (g *Game) ExpandMove(move []int, currentSpace int, moves [][]int, local bool) ([][]int, bool) {
 	l := g.LegalMoves(local)
 	var hitMoves [][]int
@@ -180,11 +253,9 @@ func (g *Game) ExpandMove(move []int, currentSpace int, moves [][]int, local boo
 				return newMoves, true
 			}
 
-			currentSpace = lm[1]
-
 			gc := g.Copy()
 			gc.addMove(lm)
-			m, ok := gc.ExpandMove(move, currentSpace, newMoves, local)
+			m, ok := gc.ExpandMove(move, lm[1], newMoves, local)
 			if ok {
 				return m, ok
 			}
@@ -204,23 +275,26 @@ func (g *Game) AddMoves(moves [][]int, local bool) (bool, [][]int) {
 
 	gameCopy := g.Copy()
 
+	// Moves are validated in order, as each move changes which moves are legal.
+	validateGame := g.Copy()
 	validateOffset := 0
 VALIDATEMOVES:
 	for _, move := range moves {
-		l := gameCopy.LegalMoves(local)
+		l := validateGame.LegalMoves(local)
 		for _, lm := range l {
 			if lm[0] == move[0] && lm[1] == move[1] {
 				addMoves = append(addMoves, []int{move[0], move[1]})
+				validateGame.addMove(move)
 				continue VALIDATEMOVES
 			}
 		}
 
-		if len(gameCopy.Moves) > 0 {
-			i := len(gameCopy.Moves) - 1 - validateOffset
+		if len(validateGame.Moves) > 0 {
+			i := len(validateGame.Moves) - 1 - validateOffset
 			if i < 0 {
 				return false, nil
 			}
-			gameMove := gameCopy.Moves[i]
+			gameMove := validateGame.Moves[i]
 			if move[0] == gameMove[1] && move[1] == gameMove[0] {
 				undoMoves = append(undoMoves, []int{gameMove[1], gameMove[0]})
 				validateOffset++
@@ -228,10 +302,11 @@ VALIDATEMOVES:
 			}
 		}
 
-		expandedMoves, ok := g.ExpandMove(move, move[0], nil, local)
+		expandedMoves, ok := validateGame.ExpandMove(move, move[0], nil, local)
 		if ok {
 			for _, expanded := range expandedMoves {
 				addMoves = append(addMoves, []int{expanded[0], expanded[1]})
+				validateGame.addMove(expanded)
 			}
 			continue VALIDATEMOVES
 		}
@@ -249,7 +324,7 @@ ADDMOVES:
 		l := gameCopy.LegalMoves(local)
 		for _, lm := range l {
 			if lm[0] == move[0] && lm[1] == move[1] {
-				if !gameCopy.addMove(move) {
+				if !gameCopy.bearOffAllowed(move) || !gameCopy.addMove(move) {
 					return false, nil
 				}
 
@@ -259,6 +334,7 @@ ADDMOVES:
 				continue ADDMOVES
 			}
 		}
+		return false, nil
 	}
 	for _, move := range undoMoves {
 		if len(gameCopy.Moves) > 0 {
@@ -292,6 +368,7 @@ ADDMOVES:
 		}
 		if !foundChecker {
 			g.Winner = g.Turn
+			g.WinType = g.winType()
 		}
 	}
 
@@ -302,18 +379,131 @@ ADDMOVES:
 	}
 }
 
+// bearOffAllowed returns false when the provided move bears off a checker
+// while any of the checkers of the current player are on the bar or outside of
+// their home board. Checkers may only be borne off to the home space of the
+// player who is moving.
+func (g *Game) bearOffAllowed(move []int) bool {
+	if move[1] != SpaceHomePlayer && move[1] != SpaceHomeOpponent {
+		return true
+	}
+	home := SpaceHomePlayer
+	if g.Turn == 2 {
+		home = SpaceHomeOpponent
+	}
+	return move[1] == home && CanBearOff(g.Board, g.Turn, false)
+}
+
+// HitSpaces returns the spaces where an opponent's checker is hit when the
+// provided moves are made, in the order they are hit. The moves are not
+// validated.
+func (g *Game) HitSpaces(moves [][]int) []int {
+	gc := g.Copy()
+	var hits []int
+	for _, move := range moves {
+		if OpponentCheckers(gc.Board[move[1]], gc.Turn) == 1 {
+			hits = append(hits, move[1])
+		}
+		gc.addMove(move)
+	}
+	return hits
+}
+
+// ValidateMoves validates moves on behalf of the player whose turn it is. The
+// moves are validated in order, as each move changes which moves are legal.
+// When a move is invalid, the move and the reason it is invalid are returned.
+// Moves must not be local, as checkers are moved in the direction of travel of
+// the player whose turn it is. A move which reverses the previous move is
+// valid, as it undoes the previous move.
+func (g *Game) ValidateMoves(moves [][]int) ([]int, error) {
+	gc := g.Copy()
+	for _, move := range moves {
+		err := gc.validateMove(move)
+		if err != nil {
+			return move, err
+		}
+		ok, _ := gc.AddMoves([][]int{move}, false)
+		if !ok {
+			return move, errors.New("the dice rolled do not allow that move")
+		}
+	}
+	return nil, nil
+}
+
+// validateMove returns an error when the provided move may not be made by the
+// player whose turn it is, regardless of the dice rolled.
+func (g *Game) validateMove(move []int) error {
+	if len(move) != 2 || !ValidSpace(move[0]) || !ValidSpace(move[1]) {
+		return errors.New("invalid space")
+	}
+	from, to := move[0], move[1]
+
+	if len(g.Moves) > 0 {
+		lastMove := g.Moves[len(g.Moves)-1]
+		if from == lastMove[1] && to == lastMove[0] {
+			return nil
+		}
+	}
+
+	home, bar, opponentHome, opponentBar := SpaceHomePlayer, SpaceBarPlayer, SpaceHomeOpponent, SpaceBarOpponent
+	if g.Turn == 2 {
+		home, bar, opponentHome, opponentBar = opponentHome, opponentBar, home, bar
+	}
+	switch {
+	case from == home || from == opponentHome:
+		return errors.New("checkers may not be moved after they are borne off")
+	case to == bar || to == opponentBar:
+		return errors.New("checkers may not be moved to the bar")
+	case from == opponentBar || to == opponentHome:
+		return errors.New("you may not move your opponent's checkers")
+	case PlayerCheckers(g.Board[from], g.Turn) == 0:
+		return errors.New("you do not have any checkers on that space")
+	case from != bar && PlayerCheckers(g.Board[bar], g.Turn) != 0:
+		return errors.New("checkers on the bar must be entered first")
+	case to == home && !CanBearOff(g.Board, g.Turn, false):
+		return errors.New("all of your checkers must be in your home board before bearing off")
+	case from != bar && to != home && (g.Turn == 1 && to > from || g.Turn == 2 && to < from):
+		return errors.New("checkers may not be moved backward")
+	}
+	return nil
+}
+
+// winType returns the type of win achieved by the winner of the game.
+func (g *Game) winType() int {
+	loser := 1
+	loserHome := SpaceHomePlayer
+	loserBar := SpaceBarPlayer
+	if g.Winner == 1 {
+		loser = 2
+		loserHome = SpaceHomeOpponent
+		loserBar = SpaceBarOpponent
+	}
+
+	if PlayerCheckers(g.Board[loserHome], loser) != 0 {
+		return WinSingle
+	}
+
+	backgammon := PlayerCheckers(g.Board[loserBar], loser) != 0
+	if !backgammon {
+		homeStart, homeEnd := HomeRange(g.Winner)
+		IterateSpaces(homeStart, homeEnd, func(space int, spaceCount int) {
+			if PlayerCheckers(g.Board[space], loser) != 0 {
+				backgammon = true
+			}
+		})
+	}
+	if backgammon {
+		return WinBackgammon
+	}
+	return WinGammon
+}
+
 func (g *Game) LegalMoves(local bool) [][]int {
 	if g.Winner != 0 || g.Roll1 == 0 || g.Roll2 == 0 {
 		return nil
 	}
 
-	rolls := []int{
-		g.Roll1,
-		g.Roll2,
-	}
-	if g.Roll1 == g.Roll2 { // Rolled doubles.
-		rolls = append(rolls, g.Roll1, g.Roll2)
-	}
+	rolls := g.DiceRolls()
 
 	haveDiceRoll := func(from, to int) int {
 		diff := SpaceDiff(from, to)
@@ -336,40 +526,6 @@ func (g *Game) LegalMoves(local bool) [][]int {
 		return c
 	}
 
-	useDiceRoll := func(from, to int) {
-		if to == SpaceHomePlayer || to == SpaceHomeOpponent {
-			needRoll := from
-			if to == SpaceHomeOpponent {
-				needRoll = 25 - from
-			}
-			for i, roll := range rolls {
-				if roll == needRoll {
-					rolls = append(rolls[:i], rolls[i+1:]...)
-					return
-				}
-			}
-			for i, roll := range rolls {
-				if roll > needRoll {
-					rolls = append(rolls[:i], rolls[i+1:]...)
-					return
-				}
-			}
-			log.Panicf("no dice roll to use for %d/%d", from, to)
-		}
-
-		diff := SpaceDiff(from, to)
-		for i, roll := range rolls {
-			if roll == diff {
-				rolls = append(rolls[:i], rolls[i+1:]...)
-				return
-			}
-		}
-	}
-
-	for _, move := range g.Moves {
-		useDiceRoll(move[0], move[1])
-	}
-
 	var moves [][]int
 	var movesFound = make(map[int]bool)
 
@@ -423,24 +579,13 @@ func (g *Game) LegalMoves(local bool) [][]int {
 				}
 				available := haveBearOffDiceRoll(SpaceDiff(space, homeSpace))
 				if available > 0 {
+					// A die larger than needed may only be used to bear off
+					// the checker furthest from home. For example, a 5 bears
+					// off a checker from the 4-point when the 5 and 6-points
+					// are empty, but not when a checker is on the 5-point.
 					ok := true
 					if haveDiceRoll(space, homeSpace) == 0 {
-						_, homeEnd := HomeRange(g.Turn)
-						if g.Turn == 2 {
-							for homeSpace := space - 1; homeSpace >= homeEnd; homeSpace-- {
-								if PlayerCheckers(g.Board[homeSpace], g.Turn) != 0 {
-									ok = false
-									break
-								}
-							}
-						} else {
-							for homeSpace := space + 1; homeSpace <= homeEnd; homeSpace++ {
-								if PlayerCheckers(g.Board[homeSpace], g.Turn) != 0 {
-									ok = false
-									break
-								}
-							}
-						}
+						ok = !higherCheckers(g.Board, space, g.Turn)
 					}
 					if ok {
 						moves = append(moves, []int{space, homeSpace})
@@ -508,11 +653,165 @@ func (g *Game) LegalMoves(local bool) [][]int {
 			}
 		}
 		moves = newMoves
+	} else if maxMoves == 1 && len(g.Moves) == 0 && g.Roll1 != g.Roll2 {
+		// When either die may be played, but not both, the larger die must
+		// be played.
+		larger := g.Roll1
+		if g.Roll2 > larger {
+			larger = g.Roll2
+		}
+		var largerMoves [][]int
+		for _, move := range moves {
+			if g.moveUsesRoll(move, larger) {
+				largerMoves = append(largerMoves, move)
+			}
+		}
+		if len(largerMoves) != 0 {
+			moves = largerMoves
+		}
 	}
 
 	return moves
 }
 
+// DiceRolls returns the dice rolls which have not been used by the pending
+// moves. Four rolls are available when doubles are rolled.
+func (g *Game) DiceRolls() []int {
+	if g.Roll1 == 0 || g.Roll2 == 0 {
+		return nil
+	}
+
+	rolls := []int{
+		g.Roll1,
+		g.Roll2,
+	}
+	if g.Roll1 == g.Roll2 { // Rolled doubles.
+		rolls = append(rolls, g.Roll1, g.Roll2)
+	}
+
+	useDiceRoll := func(from, to int) {
+		if to == SpaceHomePlayer || to == SpaceHomeOpponent {
+			needRoll := from
+			if to == SpaceHomeOpponent {
+				needRoll = 25 - from
+			}
+			for i, roll := range rolls {
+				if roll == needRoll {
+					rolls = append(rolls[:i], rolls[i+1:]...)
+					return
+				}
+			}
+			for i, roll := range rolls {
+				if roll > needRoll {
+					rolls = append(rolls[:i], rolls[i+1:]...)
+					return
+				}
+			}
+			log.Panicf("no dice roll to use for %d/%d", from, to)
+		}
+
+		diff := SpaceDiff(from, to)
+		for i, roll := range rolls {
+			if roll == diff {
+				rolls = append(rolls[:i], rolls[i+1:]...)
+				return
+			}
+		}
+	}
+
+	for _, move := range g.Moves {
+		useDiceRoll(move[0], move[1])
+	}
+	return rolls
+}
+
+// PlayableRolls returns the dice rolls which may still be used this turn.
+// Unlike DiceRolls, rolls which may not be used by any legal sequence of
+// moves are excluded.
+func (g *Game) PlayableRolls() []int {
+	legalMoves := g.LegalMoves(false)
+	if len(legalMoves) == 0 {
+		return nil
+	}
+	rolls := g.DiceRolls()
+
+	// Every legal move is part of a sequence using the maximum number of dice,
+	// so following any of them finds the number of rolls which may be used.
+	var count int
+	gc := g.Copy()
+	for moves := legalMoves; len(moves) != 0; moves = gc.LegalMoves(false) {
+		if !gc.addMove(moves[0]) {
+			log.Panicf("failed to add move %+v to game %+v", moves[0], gc)
+		}
+		count++
+	}
+	if count >= len(rolls) {
+		return rolls
+	} else if g.Roll1 == g.Roll2 {
+		return rolls[:count]
+	}
+
+	// Only one of the two dice may be used.
+	var playable []int
+	for _, roll := range rolls {
+		for _, move := range legalMoves {
+			if g.moveUsesRoll(move, roll) {
+				playable = append(playable, roll)
+				break
+			}
+		}
+	}
+	if len(playable) > count {
+		// Either die may be used, so the larger die must be used.
+		larger := playable[0]
+		for _, roll := range playable[1:] {
+			if roll > larger {
+				larger = roll
+			}
+		}
+		return []int{larger}
+	}
+	return playable
+}
+
+// moveUsesRoll returns whether the provided move may be made using the
+// provided roll.
+func (g *Game) moveUsesRoll(move []int, roll int) bool {
+	from, to := move[0], move[1]
+	diff := SpaceDiff(from, to)
+	if diff == roll {
+		return true
+	} else if (to != SpaceHomePlayer && to != SpaceHomeOpponent) || diff > roll {
+		return false
+	}
+	// Checkers may be borne off using a roll greater than needed when there
+	// are no checkers on higher spaces.
+	return !higherCheckers(g.Board, from, g.Turn)
+}
+
+// higherCheckers returns whether the provided player has any checkers in
+// their home board which are further from being borne off than the checker on
+// the provided space. Player 1 bears off from spaces 1-6 and player 2 from
+// spaces 24-19, so higher spaces are above the space for player 1 and below
+// it for player 2.
+func higherCheckers(board []int, space int, player int) bool {
+	_, homeEnd := HomeRange(player)
+	if player == 2 {
+		for homeSpace := space - 1; homeSpace >= homeEnd; homeSpace-- {
+			if PlayerCheckers(board[homeSpace], player) != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for homeSpace := space + 1; homeSpace <= homeEnd; homeSpace++ {
+		if PlayerCheckers(board[homeSpace], player) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (g *Game) RenderSpace(player int, space int, spaceValue int, legalMoves [][]int) []byte {
 	var playerColor = "x"
 	var opponentColor = "o"
@@ -591,8 +890,8 @@ func (g *Game) RenderSpace(player int, space int, spaceValue int, legalMoves [][
 func (g *Game) BoardState(player int, local bool) []byte {
 	var t bytes.Buffer
 
-	playerRating := "0"
-	opponentRating := "0"
+	playerRating := strconv.Itoa(g.Player1.Rating)
+	opponentRating := strconv.Itoa(g.Player2.Rating)
 
 	var white bool
 	if player == 2 {
@@ -607,8 +906,15 @@ func (g *Game) BoardState(player int, local bool) []byte {
 	if opponentName == "" {
 		opponentName = "Waiting..."
 	}
+	playerPoints := g.Player1.Points
+	opponentPoints := g.Player2.Points
+	playerClock := g.Player1.Clock
+	opponentClock := g.Player2.Clock
 	if white {
 		playerName, opponentName = opponentName, playerName
+		playerPoints, opponentPoints = opponentPoints, playerPoints
+		playerRating, opponentRating = opponentRating, playerRating
+		playerClock, opponentClock = opponentClock, playerClock
 	}
 
 	var playerColor = "x"
@@ -688,6 +994,10 @@ func (g *Game) BoardState(player int, local bool) []byte {
 				}
 				t.Write([]byte(fmt.Sprintf("  %d off", v)))
 			}
+		} else if i == 1 {
+			if g.Points > 1 {
+				t.Write([]byte(fmt.Sprintf("  %d/%d points", opponentPoints, g.Points)))
+			}
 		} else if i == 2 {
 			if g.Turn == 0 {
 				if g.Player1.Name != "" && g.Player2.Name != "" {
@@ -704,6 +1014,18 @@ func (g *Game) BoardState(player int, local bool) []byte {
 					t.Write([]byte(fmt.Sprintf("  -  -  ")))
 				}
 			}
+		} else if i == 3 {
+			if g.TimeControl > 0 {
+				t.Write([]byte("  " + FormatClock(opponentClock)))
+			}
+		} else if i == 5 {
+			if g.Crawford {
+				t.Write([]byte("  Crawford game"))
+			}
+		} else if i == 7 {
+			if g.TimeControl > 0 {
+				t.Write([]byte("  " + FormatClock(playerClock)))
+			}
 		} else if i == 8 {
 			if g.Turn == 0 {
 				if g.Player1.Name != "" && g.Player2.Name != "" {
@@ -720,6 +1042,10 @@ func (g *Game) BoardState(player int, local bool) []byte {
 					t.Write([]byte(fmt.Sprintf("  -  -  ")))
 				}
 			}
+		} else if i == 9 {
+			if g.Points > 1 {
+				t.Write([]byte(fmt.Sprintf("  %d/%d points", playerPoints, g.Points)))
+			}
 		} else if i == 10 {
 			t.Write([]byte(playerColor + " " + playerName + " (" + playerRating + ")"))
 			if g.Board[SpaceHomePlayer] != 0 {
@@ -794,6 +1120,29 @@ func IterateSpaces(from int, to int, f func(space int, spaceCount int)) {
 	}
 }
 
+// IsRace returns whether the rearmost checkers of both players have passed
+// each other, so that neither player may hit a checker of the other player
+// for the rest of the game.
+func (g *Game) IsRace() bool {
+	if g.Board[SpaceBarPlayer] != 0 || g.Board[SpaceBarOpponent] != 0 {
+		return false
+	}
+	rear1, rear2 := 0, 25 // Rearmost spaces of the checkers of each player.
+	for space := 24; space >= 1; space-- {
+		if PlayerCheckers(g.Board[space], 1) > 0 {
+			rear1 = space
+			break
+		}
+	}
+	for space := 1; space <= 24; space++ {
+		if PlayerCheckers(g.Board[space], 2) > 0 {
+			rear2 = space
+			break
+		}
+	}
+	return rear1 < rear2
+}
+
 func PlayerCheckers(checkers int, player int) int {
 	if player == 1 {
 		if checkers > 0 {
@@ -823,7 +1172,7 @@ func OpponentCheckers(checkers int, player int) int {
 }
 
 func FlipSpace(space int, player int) int {
-	if player == 1 {
+	if player != 2 {
 		return space
 	}
 	if space < 1 || space > 24 {
@@ -877,10 +1226,72 @@ func FormatMoves(moves [][]int) []byte {
 	return out.Bytes()
 }
 
+// CollapseMoves combines moves of a single checker into one move. For
+// example, 24/18 18/13 is collapsed into 24/13. Checkers are not moved onward
+// from the space they are borne off to.
+func CollapseMoves(moves [][]int) [][]int {
+	var collapsed [][]int
+MOVES:
+	for _, move := range moves {
+		if move[0] != SpaceHomePlayer && move[0] != SpaceHomeOpponent {
+			for i := len(collapsed) - 1; i >= 0; i-- {
+				if collapsed[i][1] == move[0] {
+					collapsed[i][1] = move[1]
+					continue MOVES
+				}
+			}
+		}
+		collapsed = append(collapsed, []int{move[0], move[1]})
+	}
+	return collapsed
+}
+
+// FormatCombinedMoves formats moves in standard notation. Moves of a single
+// checker are combined and moves made more than once are counted. For
+// example, 24/18 18/13 8/5 8/5 is formatted as 24/13 8/5(2).
+func FormatCombinedMoves(moves [][]int) []byte {
+	if len(moves) == 0 {
+		return []byte("none")
+	}
+
+	var combined [][]int
+	var counts []int
+COMBINE:
+	for _, move := range CollapseMoves(moves) {
+		for i := range combined {
+			if combined[i][0] == move[0] && combined[i][1] == move[1] {
+				counts[i]++
+				continue COMBINE
+			}
+		}
+		combined = append(combined, move)
+		counts = append(counts, 1)
+	}
+
+	var out bytes.Buffer
+	for i := range combined {
+		if i != 0 {
+			out.WriteByte(' ')
+		}
+		out.Write([]byte(fmt.Sprintf("%s/%s", FormatSpace(combined[i][0]), FormatSpace(combined[i][1]))))
+		if counts[i] > 1 {
+			out.Write([]byte(fmt.Sprintf("(%d)", counts[i])))
+		}
+	}
+	return out.Bytes()
+}
+
 func FormatAndFlipMoves(moves [][]int, player int) []byte {
 	return FormatMoves(FlipMoves(moves, player))
 }
 
+// FormatClock formats the provided number of milliseconds as minutes and
+// seconds.
+func FormatClock(milliseconds int) string {
+	seconds := (milliseconds + 999) / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
 func ValidSpace(space int) bool {
 	return space >= 0 && space <= 27
 }
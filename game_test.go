@@ -0,0 +1,271 @@
+package bgammon
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// bearOffGame returns a game in which the provided player has rolled 5-1 and
+// has checkers on the provided points of their home board. The player's other
+// checkers have been borne off.
+func bearOffGame(player int, points ...int) *Game {
+	g := NewGame()
+	g.Player1.Name, g.Player2.Name = "alice", "bob"
+	g.Turn = player
+	g.Roll1, g.Roll2 = 5, 1
+
+	board := make([]int, BoardSpaces)
+	if player == 1 {
+		board[19] = -15
+		for _, point := range points {
+			board[point]++
+		}
+		board[SpaceHomePlayer] = 15 - len(points)
+	} else {
+		board[6] = 15
+		for _, point := range points {
+			board[25-point]--
+		}
+		board[SpaceHomeOpponent] = -(15 - len(points))
+	}
+	g.SetBoard(board)
+	return g
+}
+
+func TestBearOffLargerDie(t *testing.T) {
+	for player := 1; player <= 2; player++ {
+		home, space := SpaceHomePlayer, func(point int) int { return point }
+		if player == 2 {
+			home, space = SpaceHomeOpponent, func(point int) int { return 25 - point }
+		}
+		for _, test := range []struct {
+			name    string
+			points  []int
+			from    int
+			allowed bool
+		}{
+			{"highest checker", []int{4, 2}, 4, true},
+			{"lower checker", []int{4, 2}, 2, false},
+			{"checker on 5 point", []int{5, 4, 2}, 4, false},
+			{"exact roll", []int{5, 4, 2}, 5, true},
+		} {
+			g := bearOffGame(player, test.points...)
+			move := []int{space(test.from), home}
+
+			var legal bool
+			for _, m := range g.LegalMoves(false) {
+				if m[0] == move[0] && m[1] == move[1] {
+					legal = true
+				}
+			}
+			if legal != test.allowed {
+				t.Errorf("player %d: %s: %d/off legal: %t, expected %t", player, test.name, test.from, legal, test.allowed)
+			}
+
+			ok, _ := g.AddMoves([][]int{move}, false)
+			if ok != test.allowed {
+				t.Errorf("player %d: %s: %d/off added: %t, expected %t", player, test.name, test.from, ok, test.allowed)
+			} else if ok && PlayerCheckers(g.Board[home], player) != 16-len(test.points) {
+				t.Errorf("player %d: %s: %d checkers borne off, expected %d", player, test.name, PlayerCheckers(g.Board[home], player), 16-len(test.points))
+			}
+		}
+	}
+}
+
+func TestBearOffOutsideHome(t *testing.T) {
+	for player := 1; player <= 2; player++ {
+		home, bar, space := SpaceHomePlayer, SpaceBarPlayer, func(point int) int { return point }
+		if player == 2 {
+			home, bar, space = SpaceHomeOpponent, SpaceBarOpponent, func(point int) int { return 25 - point }
+		}
+		for _, test := range []struct {
+			name string
+			from int // Space the checker on the 2 point is moved to.
+		}{
+			{"checker on the bar", bar},
+			{"checker in the outer board", space(7)},
+			{"checker in the opponent's home board", space(20)},
+		} {
+			g := bearOffGame(player, 4, 2)
+			board := append([]int(nil), g.Board...)
+			checker := 1
+			if player == 2 {
+				checker = -1
+			}
+			board[space(2)] -= checker
+			board[test.from] += checker
+			g.SetBoard(board)
+
+			for _, m := range g.LegalMoves(false) {
+				if m[1] == SpaceHomePlayer || m[1] == SpaceHomeOpponent {
+					t.Errorf("player %d: %s: bearing off %v is legal", player, test.name, m)
+				}
+			}
+			for _, to := range []int{SpaceHomePlayer, SpaceHomeOpponent} {
+				if ok, _ := g.AddMoves([][]int{{space(4), to}}, false); ok {
+					t.Errorf("player %d: %s: bearing off to %d was added", player, test.name, to)
+				}
+			}
+			if !reflect.DeepEqual(g.Board, board) {
+				t.Errorf("player %d: %s: board changed to %v, expected %v", player, test.name, g.Board, board)
+			}
+		}
+
+		// Checkers are only borne off to the home space of the player moving.
+		g := bearOffGame(player, 4, 2)
+		if ok, _ := g.AddMoves([][]int{{space(4), SpaceHomeOpponent - home}}, false); ok {
+			t.Errorf("player %d: bearing off to the home space of the opponent was added", player)
+		}
+	}
+}
+
+func TestFormatCombinedMoves(t *testing.T) {
+	for _, test := range []struct {
+		moves    string
+		expected string
+	}{
+		{"24/18/13", "24/13"},
+		{"8/5(2)", "8/5(2)"},
+		{"24/18/13 8/5(2)", "24/13 8/5(2)"},
+		{"13/9 6/2 9/5", "13/5 6/2"},
+		{"24/20(2) 20/16(2)", "24/16(2)"},
+		{"6/off 6/off", "6/off(2)"},
+		{"13/11 6/5", "13/11 6/5"},
+	} {
+		action, err := parseTranscriptAction(append([]string{"66:"}, strings.Fields(test.moves)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if formatted := string(FormatCombinedMoves(action.Moves)); formatted != test.expected {
+			t.Errorf("%s: formatted %v as %s, expected %s", test.moves, action.Moves, formatted, test.expected)
+		}
+	}
+
+	bar := [][]int{{SpaceBarPlayer, 20}, {20, 16}}
+	if formatted := string(FormatCombinedMoves(bar)); formatted != "bar/16" {
+		t.Errorf("formatted %v as %s, expected bar/16", bar, formatted)
+	}
+	if formatted := string(FormatMoves(bar)); formatted != "bar/20 20/16" {
+		t.Errorf("formatted %v as %s without combining moves, expected bar/20 20/16", bar, formatted)
+	}
+}
+
+func TestIsRace(t *testing.T) {
+	race := make([]int, BoardSpaces)
+	race[6], race[19] = 15, -15
+
+	passed := make([]int, BoardSpaces)
+	passed[12], passed[13] = 15, -15
+
+	contact := NewBoard()
+
+	bar := make([]int, BoardSpaces)
+	bar[6], bar[SpaceBarPlayer], bar[19] = 14, 1, -15
+
+	for _, test := range []struct {
+		name  string
+		board []int
+		race  bool
+	}{
+		{"home boards", race, true},
+		{"passed each other", passed, true},
+		{"starting position", contact, false},
+		{"checker on the bar", bar, false},
+	} {
+		g := NewGame()
+		g.SetBoard(test.board)
+		if g.IsRace() != test.race {
+			t.Errorf("%s: race: %t, expected %t", test.name, g.IsRace(), test.race)
+		}
+	}
+}
+
+func TestMaximumDice(t *testing.T) {
+	// Either die may be played, but not both, so the larger die must be
+	// played. Playing 13/7 or 13/8 leaves the checker unable to reach the
+	// 2 point, which is blocked.
+	larger := make([]int, BoardSpaces)
+	larger[13], larger[1] = 1, 14
+	larger[2], larger[24] = -2, -13
+
+	// Both dice must be played when possible. Playing 13/7 first leaves no
+	// 5 to play, as the 2 and 4 points are blocked.
+	both := make([]int, BoardSpaces)
+	both[13], both[9], both[1] = 1, 1, 13
+	both[2], both[4], both[24] = -2, -2, -11
+
+	for _, test := range []struct {
+		name      string
+		board     []int
+		legal     [][]int
+		illegal   []int
+		remaining []int
+	}{
+		{"larger die", larger, [][]int{{13, 7}}, []int{13, 8}, []int{6}},
+		{"both dice", both, [][]int{{13, 8}, {9, 3}}, []int{13, 7}, []int{6, 5}},
+	} {
+		g := NewGame()
+		g.Player1.Name, g.Player2.Name = "alice", "bob"
+		g.Turn = 1
+		g.Roll1, g.Roll2 = 6, 5
+		g.SetBoard(test.board)
+
+		legal := g.LegalMoves(false)
+		SortMoves(legal)
+		if !reflect.DeepEqual(legal, test.legal) {
+			t.Errorf("%s: legal moves %v, expected %v", test.name, legal, test.legal)
+		}
+		if remaining := g.PlayableRolls(); !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("%s: playable rolls %v, expected %v", test.name, remaining, test.remaining)
+		}
+		if ok, _ := g.AddMoves([][]int{test.illegal}, false); ok {
+			t.Errorf("%s: added move %v which forfeits a die", test.name, test.illegal)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// The checksum of a state does not change between versions, as clients
+	// may compare it with checksums they calculate themselves.
+	if checksum := NewGame().Checksum(); checksum != "c690452d" {
+		t.Errorf("starting position has checksum %s, expected c690452d", checksum)
+	}
+
+	newGame := func(moves ...[]int) *Game {
+		g := NewGame()
+		g.Player1.Name, g.Player2.Name = "alice", "bob"
+		g.Turn = 1
+		g.Roll1, g.Roll2 = 3, 1
+		if ok, _ := g.AddMoves(moves, false); !ok {
+			t.Fatalf("failed to add moves %v", moves)
+		}
+		return g
+	}
+
+	// The same position reached in a different order has the same checksum.
+	g := newGame([]int{8, 5}, []int{6, 5})
+	for _, other := range []*Game{newGame([]int{6, 5}, []int{8, 5}), g.Copy()} {
+		if g.Checksum() != other.Checksum() {
+			t.Errorf("equivalent states have checksums %s and %s", g.Checksum(), other.Checksum())
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		change func(g *Game)
+	}{
+		{"board", func(g *Game) { g.Board[24], g.Board[23] = 1, 1 }},
+		{"turn", func(g *Game) { g.Turn = 2 }},
+		{"dice", func(g *Game) { g.Roll1, g.Roll2 = 1, 3 }},
+		{"cube value", func(g *Game) { g.DoubleValue = 2 }},
+		{"cube owner", func(g *Game) { g.DoublePlayer = 1 }},
+		{"double offered", func(g *Game) { g.DoubleOffered = true }},
+	} {
+		other := g.Copy()
+		test.change(other)
+		if g.Checksum() == other.Checksum() {
+			t.Errorf("%s: different states have the same checksum %s", test.name, g.Checksum())
+		}
+	}
+}
@@ -4,10 +4,30 @@ import (
 	"log"
 )
 
+// GameState is the state of a game from the perspective of a player. It is
+// sent to JSON clients in the board event.
+//
+// The board always contains BoardSpaces entries. Spaces 1 through 24 are the
+// points, numbered so that space 1 is in the home board of the player the
+// state is sent to (player 1 when spectating), or of their opponent when the
+// client flipped the board. Space SpaceHomePlayer (0) and SpaceHomeOpponent
+// (25) hold the checkers borne off by that player and their opponent, and
+// SpaceBarPlayer (26) and SpaceBarOpponent (27) hold the checkers on the bar
+// of that player and their opponent. Positive values are player 1's checkers
+// and negative values are player 2's checkers.
+//
+// Moves, including pending moves and legal moves, use the same numbering.
 type GameState struct {
 	*Game
 	PlayerNumber int
 	Available    [][]int // Legal moves.
+	Remaining    []int   // Dice rolls which may still be used this turn.
+	PlayerBar    int     // Number of the player's checkers on the bar.
+	PlayerOff    int     // Number of the player's checkers borne off.
+	OpponentBar  int     // Number of the opponent's checkers on the bar.
+	OpponentOff  int     // Number of the opponent's checkers borne off.
+	Race         bool    // Whether the checkers of both players have passed each other. See Game.IsRace.
+	Checksum     string  // Checksum of the state as sent. See Game.Checksum.
 }
 
 func (g *GameState) OpponentPlayer() Player {
@@ -75,10 +95,10 @@ func (g *GameState) Pips(player int) int {
 
 // MayDouble returns whether the player may send the 'double' command.
 func (g *GameState) MayDouble() bool {
-	if g.Winner != 0 {
+	if g.Winner != 0 || g.Crawford {
 		return false
 	}
-	return g.Points != 1 && g.Turn != 0 && g.Turn == g.PlayerNumber && g.Roll1 == 0 && !g.DoubleOffered && (g.DoublePlayer == 0 || g.DoublePlayer == g.PlayerNumber)
+	return (g.Points != 1 || g.Beavers || g.Jacoby) && g.Turn != 0 && g.Turn == g.PlayerNumber && g.Roll1 == 0 && !g.DoubleOffered && (g.DoublePlayer == 0 || g.DoublePlayer == g.PlayerNumber)
 }
 
 // MayRoll returns whether the player may send the 'roll' command.
@@ -114,14 +134,43 @@ func (g *GameState) MayOK() bool {
 	return g.Turn != 0 && g.Turn == g.PlayerNumber && g.Roll1 != 0 && len(g.Available) == 0
 }
 
-// MayResign returns whether the player may send the 'resign' command.
-func (g *GameState) MayResign() bool {
+// MayReject returns whether the player may send the 'reject' command.
+func (g *GameState) MayReject() bool {
 	if g.Winner != 0 {
 		return false
 	}
 	return g.Turn != 0 && g.Turn != g.PlayerNumber && g.DoubleOffered
 }
 
+// MayBeaver returns whether the player may send the 'beaver' command.
+func (g *GameState) MayBeaver() bool {
+	return g.Beavers && g.MayReject()
+}
+
+// MayRaccoon returns whether the player may send the 'raccoon' command.
+func (g *GameState) MayRaccoon() bool {
+	if g.Winner != 0 || !g.Beavers || !g.Beavered {
+		return false
+	}
+	return g.Turn != 0 && g.Turn == g.PlayerNumber && g.Roll1 == 0
+}
+
+// MayResign returns whether the player may decline the pending double offer.
+//
+// Deprecated: Use MayReject. To check whether the player may resign the
+// current game or match, use MayConcede.
+func (g *GameState) MayResign() bool {
+	return g.MayReject()
+}
+
+// MayConcede returns whether the player may send the 'resign' command.
+func (g *GameState) MayConcede() bool {
+	if g.Winner != 0 || g.PlayerNumber == 0 {
+		return false
+	}
+	return g.Player1.Name != "" && g.Player2.Name != ""
+}
+
 // MayReset returns whether the player may send the 'reset' command.
 func (g *GameState) MayReset() bool {
 	if g.Winner != 0 {
@@ -0,0 +1,57 @@
+package bgammon
+
+import "testing"
+
+func TestMayDoubleSingleGame(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		beavers  bool
+		jacoby   bool
+		expected bool
+	}{
+		{"no cube", false, false, false},
+		{"beavers", true, false, true},
+		{"jacoby", false, true, true},
+	} {
+		g := NewGame()
+		g.Turn = 1
+		g.Beavers, g.Jacoby = test.beavers, test.jacoby
+		gs := &GameState{
+			Game:         g,
+			PlayerNumber: 1,
+		}
+		if gs.MayDouble() != test.expected {
+			t.Errorf("%s: may double: %t, expected %t", test.name, gs.MayDouble(), test.expected)
+		}
+	}
+}
+
+func TestMayResign(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		doubleOffered bool
+		reject        bool
+		concede       bool
+	}{
+		{"no double", false, false, true},
+		{"double offered", true, true, true},
+	} {
+		g := NewGame()
+		g.Turn = 2
+		g.Player1.Name, g.Player2.Name = "a", "b"
+		g.DoubleOffered = test.doubleOffered
+		gs := &GameState{
+			Game:         g,
+			PlayerNumber: 1,
+		}
+		if gs.MayReject() != test.reject {
+			t.Errorf("%s: may reject: %t, expected %t", test.name, gs.MayReject(), test.reject)
+		}
+		if gs.MayResign() != test.reject {
+			t.Errorf("%s: may resign: %t, expected %t", test.name, gs.MayResign(), test.reject)
+		}
+		if gs.MayConcede() != test.concede {
+			t.Errorf("%s: may concede: %t, expected %t", test.name, gs.MayConcede(), test.concede)
+		}
+	}
+}
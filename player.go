@@ -3,7 +3,9 @@ package bgammon
 type Player struct {
 	Number int // 1 black, 2 white
 	Name   string
+	Rating int
 	Points int
+	Clock  int // Milliseconds remaining on the player's clock when time control is enabled.
 }
 
 func NewPlayer(number int) Player {
@@ -0,0 +1,197 @@
+package bgammon
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// positionIDLength is the length of a GNU Backgammon Position ID.
+const positionIDLength = 14
+
+// ParsePositionID parses a GNU Backgammon Position ID and returns the board it
+// represents. The provided player is the player on roll. Checkers which are
+// not on the board or on the bar are borne off. Positions in which a player
+// has more than 15 checkers, or has already borne off all of their checkers,
+// are invalid.
+//
+// A Position ID is an 80 bit key encoded as base64. For each player, starting
+// with the player not on roll, each point from the player's ace point to their
+// 24 point, followed by the bar, is represented by one bit set for each checker
+// on the point, followed by an unset bit. Bits are stored least significant
+// bit first.
+func ParsePositionID(id string, player int) ([]int, error) {
+	if len(id) != positionIDLength {
+		return nil, errors.New("invalid position ID: must be 14 characters long")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(id)
+	if err != nil {
+		return nil, errors.New("invalid position ID: malformed base64")
+	}
+
+	var checkers [2][25]int
+	var side, point int
+	bit := 0
+	for ; bit < len(key)*8 && side < 2; bit++ {
+		if key[bit/8]&(1<<(bit%8)) != 0 {
+			checkers[side][point]++
+			continue
+		}
+		point++
+		if point == 25 {
+			side, point = side+1, 0
+		}
+	}
+	if side < 2 {
+		return nil, errors.New("invalid position ID: too many checkers")
+	}
+	for ; bit < len(key)*8; bit++ {
+		if key[bit/8]&(1<<(bit%8)) != 0 {
+			return nil, errors.New("invalid position ID: too many checkers")
+		}
+	}
+
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+
+	board := make([]int, BoardSpaces)
+	for i, p := range []int{opponent, player} {
+		var total int
+		for point := 0; point < 25; point++ {
+			total += checkers[i][point]
+		}
+		if total > 15 {
+			return nil, errors.New("invalid position ID: each player must have 15 checkers")
+		} else if total == 0 {
+			return nil, errors.New("invalid position ID: a player has already borne off all of their checkers")
+		}
+
+		delta, bar, home := 1, SpaceBarPlayer, SpaceHomePlayer
+		if p == 2 {
+			delta, bar, home = -1, SpaceBarOpponent, SpaceHomeOpponent
+		}
+		for point := 0; point < 24; point++ {
+			if checkers[i][point] == 0 {
+				continue
+			}
+			space := point + 1
+			if p == 2 {
+				space = 24 - point
+			}
+			if board[space] != 0 {
+				return nil, errors.New("invalid position ID: both players have checkers on the same point")
+			}
+			board[space] = checkers[i][point] * delta
+		}
+		board[bar] = checkers[i][24] * delta
+		board[home] = (15 - total) * delta
+	}
+	return board, nil
+}
+
+// PositionID returns the GNU Backgammon Position ID of the provided board. The
+// provided player is the player on roll.
+func PositionID(board []int, player int) string {
+	opponent := 1
+	if player == 1 {
+		opponent = 2
+	}
+
+	key := make([]byte, 10)
+	var bit int
+	for _, p := range []int{opponent, player} {
+		bar := SpaceBarPlayer
+		if p == 2 {
+			bar = SpaceBarOpponent
+		}
+		for point := 0; point < 25; point++ {
+			space := bar
+			if point < 24 {
+				space = point + 1
+				if p == 2 {
+					space = 24 - point
+				}
+			}
+			for i := 0; i < PlayerCheckers(board[space], p); i++ {
+				key[bit/8] |= 1 << (bit % 8)
+				bit++
+			}
+			bit++
+		}
+	}
+	return base64.RawStdEncoding.EncodeToString(key)
+}
+
+// MatchID returns the GNU Backgammon Match ID of the game. Player 1 is
+// represented as player 0 and player 2 is represented as player 1.
+//
+// A Match ID is a 66 bit key encoded as base64. The key contains, in order, the
+// doubling cube value (4 bits, log 2), the owner of the doubling cube (2 bits,
+// 3 when centered), the player on roll (1 bit), whether the Crawford rule is
+// in effect (1 bit), the game state (3 bits), the player who must make a
+// decision (1 bit), whether a double is offered (1 bit), the resignation
+// offered (2 bits), both dice (3 bits each), the match length (15 bits, 0 for
+// money play) and the score of each player (15 bits each). Bits are stored
+// least significant bit first. Single games are represented as money play.
+func (g *Game) MatchID() string {
+	key := make([]byte, 9)
+	var bit int
+	add := func(value int, bits int) {
+		for i := 0; i < bits; i++ {
+			if value&(1<<i) != 0 {
+				key[bit/8] |= 1 << (bit % 8)
+			}
+			bit++
+		}
+	}
+	boolValue := func(value bool) int {
+		if value {
+			return 1
+		}
+		return 0
+	}
+
+	var cube int
+	for value := g.DoubleValue; value > 1; value /= 2 {
+		cube++
+	}
+	owner := 3
+	if g.DoublePlayer != 0 {
+		owner = g.DoublePlayer - 1
+	}
+	onRoll := maxInt(g.Turn, 1) - 1
+	decision := onRoll
+	if g.DoubleOffered {
+		decision = 1 - onRoll
+	}
+	gameState := 1
+	if g.Winner != 0 {
+		gameState = 2
+	}
+	var roll1, roll2 int
+	if g.Turn != 0 {
+		roll1, roll2 = g.Roll1, g.Roll2
+	}
+
+	add(cube, 4)
+	add(owner, 2)
+	add(onRoll, 1)
+	add(boolValue(g.Crawford), 1)
+	add(gameState, 3)
+	add(decision, 1)
+	add(boolValue(g.DoubleOffered), 1)
+	add(0, 2)
+	add(roll1, 3)
+	add(roll2, 3)
+	if g.Points == 1 {
+		add(0, 15)
+		add(0, 15)
+		add(0, 15)
+	} else {
+		add(g.Points, 15)
+		add(g.Player1.Points, 15)
+		add(g.Player2.Points, 15)
+	}
+	return base64.RawStdEncoding.EncodeToString(key)
+}
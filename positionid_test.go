@@ -0,0 +1,170 @@
+package bgammon
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+// positionKey returns the Position ID of the provided checkers. For each
+// player, starting with the player not on roll, the number of checkers on
+// each point from the player's ace point to their 24 point, followed by the
+// bar, is provided. Unlike PositionID, the checkers are not validated.
+func positionKey(checkers [2][25]int) string {
+	key := make([]byte, 10)
+	var bit int
+	for _, side := range checkers {
+		for _, count := range side {
+			for i := 0; i < count; i++ {
+				key[bit/8] |= 1 << (bit % 8)
+				bit++
+			}
+			bit++
+		}
+	}
+	return base64.RawStdEncoding.EncodeToString(key)
+}
+
+func TestParsePositionIDStart(t *testing.T) {
+	// Position ID of the starting position, as shown by GNU Backgammon.
+	const start = "4HPwATDgc/ABMA"
+	var startKey [2][25]int
+	for side := range startKey {
+		startKey[side][5], startKey[side][7], startKey[side][12], startKey[side][23] = 5, 3, 5, 2
+	}
+	if key := positionKey(startKey); key != start {
+		t.Fatalf("starting position has key %s, expected %s", key, start)
+	}
+	for player := 1; player <= 2; player++ {
+		board, err := ParsePositionID(start, player)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(board, NewBoard()) {
+			t.Errorf("player %d: parsed %v, expected the starting position %v", player, board, NewBoard())
+		}
+		if id := PositionID(NewBoard(), player); id != start {
+			t.Errorf("player %d: starting position has ID %s, expected %s", player, id, start)
+		}
+	}
+}
+
+func TestPositionIDMidGame(t *testing.T) {
+	// Player 1 played an opening 31 as 8/5 6/5, and player 2 is on roll.
+	opening := make([]int, BoardSpaces)
+	opening[24], opening[13], opening[8], opening[6], opening[5] = 2, 5, 4, 4, 2
+	opening[19], opening[17], opening[12], opening[1] = -5, -3, -5, -2
+	var openingKey [2][25]int
+	openingKey[0][4], openingKey[0][5], openingKey[0][7], openingKey[0][12], openingKey[0][23] = 2, 4, 4, 5, 2
+	openingKey[1][5], openingKey[1][7], openingKey[1][12], openingKey[1][23] = 5, 3, 5, 2
+
+	// Player 1 is on roll with a checker on the bar.
+	bar := make([]int, BoardSpaces)
+	bar[SpaceBarPlayer], bar[24], bar[13], bar[8], bar[6] = 1, 1, 5, 3, 5
+	bar[19], bar[17], bar[12], bar[1] = -5, -3, -5, -2
+	var barKey [2][25]int
+	barKey[0][5], barKey[0][7], barKey[0][12], barKey[0][23] = 5, 3, 5, 2
+	barKey[1][5], barKey[1][7], barKey[1][12], barKey[1][23], barKey[1][24] = 5, 3, 5, 1, 1
+
+	// Both players are bearing off, and player 2 is on roll.
+	bearOff := make([]int, BoardSpaces)
+	bearOff[SpaceHomePlayer], bearOff[1], bearOff[4] = 10, 3, 2
+	bearOff[SpaceHomeOpponent], bearOff[20], bearOff[24] = -12, -2, -1
+	var bearOffKey [2][25]int
+	bearOffKey[0][0], bearOffKey[0][3] = 3, 2
+	bearOffKey[1][0], bearOffKey[1][4] = 1, 2
+
+	for _, test := range []struct {
+		name   string
+		board  []int
+		player int
+		key    [2][25]int
+	}{
+		{"opening", opening, 2, openingKey},
+		{"bar", bar, 1, barKey},
+		{"bear off", bearOff, 2, bearOffKey},
+	} {
+		if id := PositionID(test.board, test.player); id != positionKey(test.key) {
+			t.Errorf("%s: Position ID %s, expected %s", test.name, id, positionKey(test.key))
+		}
+	}
+}
+
+func TestPositionIDRoundTrip(t *testing.T) {
+	bearOff := make([]int, BoardSpaces)
+	bearOff[SpaceHomePlayer], bearOff[1], bearOff[4] = 10, 3, 2
+	bearOff[SpaceHomeOpponent], bearOff[24] = -14, -1
+
+	bar := NewBoard()
+	bar[6], bar[SpaceBarPlayer] = 3, 2
+	bar[19], bar[SpaceBarOpponent] = -4, -1
+
+	for _, board := range [][]int{NewBoard(), bearOff, bar} {
+		for player := 1; player <= 2; player++ {
+			id := PositionID(board, player)
+			parsed, err := ParsePositionID(id, player)
+			if err != nil {
+				t.Errorf("player %d: failed to parse %s: %s", player, id, err)
+			} else if !reflect.DeepEqual(parsed, board) {
+				t.Errorf("player %d: parsed %s as %v, expected %v", player, id, parsed, board)
+			}
+		}
+	}
+}
+
+func TestParsePositionIDInvalid(t *testing.T) {
+	var overlap [2][25]int
+	overlap[0][0] = 15  // Ace point of player 2, which is the 24 space.
+	overlap[1][23] = 15 // 24 point of player 1, who is on roll.
+
+	var borneOff [2][25]int
+	borneOff[1][5] = 15
+
+	var tooMany [2][25]int
+	tooMany[0][5] = 16
+	tooMany[1][5] = 14
+
+	for _, test := range []struct {
+		name string
+		id   string
+	}{
+		{"empty", ""},
+		{"too short", "4HPwATDgc/ABM"},
+		{"too long", "4HPwATDgc/ABMAA"},
+		{"malformed base64", "4HPwATDgc/AB-A"},
+		{"all checkers set", "//////////////"},
+		{"no checkers", "AAAAAAAAAAAAAA"},
+		{"borne off", positionKey(borneOff)},
+		{"too many checkers", positionKey(tooMany)},
+		{"both players on the same point", positionKey(overlap)},
+	} {
+		if board, err := ParsePositionID(test.id, 1); err == nil {
+			t.Errorf("%s: parsed %q as %v, expected an error", test.name, test.id, board)
+		}
+	}
+}
+
+func TestMatchID(t *testing.T) {
+	// Match IDs as shown by GNU Backgammon.
+	money := NewGame()
+	money.Turn = 2
+
+	match := NewGame()
+	match.Points = 9
+	match.Player1.Points, match.Player2.Points = 2, 4
+	match.DoubleValue, match.DoublePlayer = 2, 1
+	match.Turn = 2
+	match.Roll1, match.Roll2 = 5, 2
+
+	for _, test := range []struct {
+		name string
+		game *Game
+		id   string
+	}{
+		{"money game", money, "cAkAAAAAAAAA"},
+		{"9 point match", match, "QYkqASAAIAAA"},
+	} {
+		if id := test.game.MatchID(); id != test.id {
+			t.Errorf("%s: Match ID %s, expected %s", test.name, id, test.id)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package bgammon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transcript action types.
+const (
+	ActionRoll    = "roll"    // The player rolled and moved checkers.
+	ActionDouble  = "double"  // The player offered a double.
+	ActionTake    = "take"    // The player accepted a double.
+	ActionDrop    = "drop"    // The player declined a double.
+	ActionBeaver  = "beaver"  // The player accepted a double and immediately redoubled.
+	ActionRaccoon = "raccoon" // The player immediately redoubled after their double was beavered.
+)
+
+// Transcript is a record of the games played in a match. Transcripts are
+// formatted as match files (.mat), as used by Jellyfish and GNU Backgammon.
+type Transcript struct {
+	Player1 string
+	Player2 string
+	Points  int // Points required to win the match.
+	Games   []*TranscriptGame
+}
+
+// TranscriptGame is a record of a single game of a match.
+type TranscriptGame struct {
+	Score1  int // Points of player 1 at the start of the game.
+	Score2  int // Points of player 2 at the start of the game.
+	Actions []*TranscriptAction
+	Winner  int // Player who won the game, or zero when the game has not ended.
+	Points  int // Points awarded to the winner.
+}
+
+// TranscriptAction is a roll and the checkers moved, or an action involving
+// the doubling cube.
+type TranscriptAction struct {
+	Player int
+	Type   string // See ActionRoll.
+	Roll1  int
+	Roll2  int
+	Moves  [][]int // Moves from the perspective of the player. The bar is space 25 and checkers are borne off to space 0.
+	Value  int     // Value of the doubling cube offered.
+}
+
+// TranscriptMoves converts moves on a board oriented from the perspective of
+// player 1, as it is on the server, to moves from the perspective of the
+// provided player, as they are recorded in a transcript.
+func TranscriptMoves(moves [][]int, player int) [][]int {
+	m := FlipMoves(moves, player)
+	for _, move := range m {
+		for i, space := range move {
+			if space == SpaceBarPlayer || space == SpaceBarOpponent {
+				move[i] = 25
+			}
+		}
+	}
+	return m
+}
+
+func (a *TranscriptAction) String() string {
+	switch a.Type {
+	case ActionDouble:
+		return fmt.Sprintf("Doubles => %d", a.Value)
+	case ActionTake:
+		return "Takes"
+	case ActionDrop:
+		return "Drops"
+	case ActionBeaver:
+		return fmt.Sprintf("Beavers => %d", a.Value)
+	case ActionRaccoon:
+		return fmt.Sprintf("Raccoons => %d", a.Value)
+	}
+
+	roll := fmt.Sprintf("%d%d:", maxInt(a.Roll1, a.Roll2), minInt(a.Roll1, a.Roll2))
+	if len(a.Moves) == 0 {
+		return roll
+	}
+	moves := make([]string, len(a.Moves))
+	for i, move := range a.Moves {
+		moves[i] = fmt.Sprintf("%d/%d", move[0], move[1])
+	}
+	return roll + " " + strings.Join(moves, " ")
+}
+
+// Columns of the actions of each player in a match file.
+const (
+	transcriptColumn1 = 5
+	transcriptColumn2 = 34
+)
+
+// Bytes returns the transcript formatted as a match file.
+func (t *Transcript) Bytes() []byte {
+	var out bytes.Buffer
+	writeLine := func(line string) {
+		out.WriteString(strings.TrimRight(line, " "))
+		out.WriteByte('\n')
+	}
+
+	writeLine(fmt.Sprintf(" %d point match", t.Points))
+	for i, game := range t.Games {
+		writeLine("")
+		writeLine(fmt.Sprintf(" Game %d", i+1))
+		writeLine(fmt.Sprintf(" %-*s %s", transcriptColumn2-2, fmt.Sprintf("%s : %d", t.Player1, game.Score1), fmt.Sprintf("%s : %d", t.Player2, game.Score2)))
+
+		// Each line contains an action of player 1 followed by an action of
+		// player 2.
+		var number int
+		var cells [2]string
+		var used [2]bool
+		flush := func() {
+			if !used[0] && !used[1] {
+				return
+			}
+			number++
+			writeLine(fmt.Sprintf("%3d) %-*s %s", number, transcriptColumn2-transcriptColumn1-1, cells[0], cells[1]))
+			cells, used = [2]string{}, [2]bool{}
+		}
+		for _, action := range game.Actions {
+			column := 0
+			if action.Player == 2 {
+				column = 1
+			}
+			if used[column] || (column == 0 && used[1]) {
+				flush()
+			}
+			cells[column], used[column] = action.String(), true
+		}
+		flush()
+
+		if game.Winner == 0 {
+			continue
+		}
+		score1, score2 := game.Score1, game.Score2
+		if game.Winner == 1 {
+			score1 += game.Points
+		} else {
+			score2 += game.Points
+		}
+		wins := fmt.Sprintf("Wins %d point", game.Points)
+		if game.Points != 1 {
+			wins += "s"
+		}
+		if score1 >= t.Points || score2 >= t.Points {
+			wins += " and the match"
+		}
+		indent := transcriptColumn1
+		if game.Winner == 2 {
+			indent = transcriptColumn2
+		}
+		writeLine(strings.Repeat(" ", indent) + wins)
+	}
+	return out.Bytes()
+}
+
+var (
+	transcriptMatchFormat   = regexp.MustCompile(`^\s*(\d+) point match\s*$`)
+	transcriptGameFormat    = regexp.MustCompile(`^\s*Game \d+\s*$`)
+	transcriptPlayersFormat = regexp.MustCompile(`^\s*(\S+)\s*:\s*(\d+)\s+(\S+)\s*:\s*(\d+)\s*$`)
+	transcriptLineFormat    = regexp.MustCompile(`^\s*\d+\)`)
+	transcriptWinsFormat    = regexp.MustCompile(`^(\s*)Wins (\d+) points?`)
+	transcriptRollFormat    = regexp.MustCompile(`^([1-6])([1-6]):$`)
+	transcriptTokenFormat   = regexp.MustCompile(`\S+`)
+)
+
+// ParseTranscript parses a match file.
+func ParseTranscript(b []byte) (*Transcript, error) {
+	t := &Transcript{}
+	var game *TranscriptGame
+	for i, line := range strings.Split(strings.ReplaceAll(string(b), "\r", ""), "\n") {
+		lineError := func(message string) error {
+			return fmt.Errorf("failed to parse transcript: line %d: %s", i+1, message)
+		}
+
+		if match := transcriptMatchFormat.FindStringSubmatch(line); match != nil {
+			t.Points, _ = strconv.Atoi(match[1])
+			continue
+		} else if transcriptGameFormat.MatchString(line) {
+			game = &TranscriptGame{}
+			t.Games = append(t.Games, game)
+			continue
+		} else if strings.TrimSpace(line) == "" {
+			continue
+		} else if game == nil {
+			return nil, lineError("expected game header")
+		}
+
+		if match := transcriptPlayersFormat.FindStringSubmatch(line); match != nil {
+			t.Player1, t.Player2 = match[1], match[3]
+			game.Score1, _ = strconv.Atoi(match[2])
+			game.Score2, _ = strconv.Atoi(match[4])
+			continue
+		} else if match := transcriptWinsFormat.FindStringSubmatch(line); match != nil {
+			game.Winner = transcriptPlayer(len(match[1]))
+			game.Points, _ = strconv.Atoi(match[2])
+			continue
+		}
+
+		prefix := transcriptLineFormat.FindStringIndex(line)
+		if prefix == nil {
+			return nil, lineError("unexpected line")
+		}
+		tokens := transcriptTokenFormat.FindAllStringIndex(line, -1)[1:]
+
+		// Split the line into the actions of each player. Each action begins
+		// with a roll or a doubling cube action.
+		var start []int
+		for j, token := range tokens {
+			value := line[token[0]:token[1]]
+			if transcriptRollFormat.MatchString(value) || value == "Doubles" || value == "Takes" || value == "Drops" {
+				start = append(start, j)
+			}
+		}
+		if len(start) == 0 && len(tokens) != 0 {
+			return nil, lineError("unexpected action")
+		} else if len(start) > 2 {
+			return nil, lineError("too many actions")
+		}
+		for j, first := range start {
+			last := len(tokens)
+			if j < len(start)-1 {
+				last = start[j+1]
+			}
+			player := transcriptPlayer(tokens[first][0] - prefix[0])
+			if len(start) == 2 {
+				player = j + 1
+			}
+
+			var values []string
+			for _, token := range tokens[first:last] {
+				values = append(values, line[token[0]:token[1]])
+			}
+			action, err := parseTranscriptAction(values)
+			if err != nil {
+				return nil, lineError(err.Error())
+			}
+			action.Player = player
+			game.Actions = append(game.Actions, action)
+		}
+	}
+	if t.Points == 0 {
+		return nil, errors.New("failed to parse transcript: match length not specified")
+	}
+	return t, nil
+}
+
+// transcriptPlayer returns the player whose column begins nearest to the
+// provided column.
+func transcriptPlayer(column int) int {
+	if column < (transcriptColumn1+transcriptColumn2)/2 {
+		return 1
+	}
+	return 2
+}
+
+func parseTranscriptAction(values []string) (*TranscriptAction, error) {
+	switch values[0] {
+	case "Doubles":
+		if len(values) != 3 || values[1] != "=>" {
+			return nil, errors.New("invalid double")
+		}
+		value, err := strconv.Atoi(values[2])
+		if err != nil || value < 2 {
+			return nil, errors.New("invalid doubling cube value")
+		}
+		return &TranscriptAction{Type: ActionDouble, Value: value}, nil
+	case "Beavers", "Raccoons":
+		if len(values) != 3 || values[1] != "=>" {
+			return nil, errors.New("invalid redouble")
+		}
+		value, err := strconv.Atoi(values[2])
+		if err != nil || value < 4 {
+			return nil, errors.New("invalid doubling cube value")
+		}
+		actionType := ActionBeaver
+		if values[0] == "Raccoons" {
+			actionType = ActionRaccoon
+		}
+		return &TranscriptAction{Type: actionType, Value: value}, nil
+	case "Takes":
+		return &TranscriptAction{Type: ActionTake}, nil
+	case "Drops":
+		return &TranscriptAction{Type: ActionDrop}, nil
+	}
+
+	roll := transcriptRollFormat.FindStringSubmatch(values[0])
+	action := &TranscriptAction{Type: ActionRoll}
+	action.Roll1, _ = strconv.Atoi(roll[1])
+	action.Roll2, _ = strconv.Atoi(roll[2])
+	for _, value := range values[1:] {
+		// Moves repeated multiple times are written as 8/5(2).
+		count := 1
+		if open := strings.IndexByte(value, '('); open != -1 && strings.HasSuffix(value, ")") {
+			var err error
+			count, err = strconv.Atoi(value[open+1 : len(value)-1])
+			if err != nil || count < 1 || count > 4 {
+				return nil, fmt.Errorf("invalid move %s", value)
+			}
+			value = value[:open]
+		}
+
+		// Moves of a single checker may be written as 13/9/7.
+		var spaces []int
+		for _, s := range strings.Split(value, "/") {
+			space := parseTranscriptSpace(s)
+			if space == -1 {
+				return nil, fmt.Errorf("invalid move %s", value)
+			}
+			spaces = append(spaces, space)
+		}
+		if len(spaces) < 2 {
+			return nil, fmt.Errorf("invalid move %s", value)
+		}
+		for i := 0; i < count; i++ {
+			for j := 1; j < len(spaces); j++ {
+				action.Moves = append(action.Moves, []int{spaces[j-1], spaces[j]})
+			}
+		}
+	}
+	return action, nil
+}
+
+// parseTranscriptSpace parses a space from the perspective of the player who
+// is moving. Returns -1 when the space is invalid.
+func parseTranscriptSpace(space string) int {
+	space = strings.TrimSuffix(space, "*")
+	switch strings.ToLower(space) {
+	case "bar":
+		return 25
+	case "off":
+		return 0
+	}
+	i, err := strconv.Atoi(space)
+	if err != nil || i < 0 || i > 25 {
+		return -1
+	}
+	return i
+}